@@ -0,0 +1,338 @@
+package riak
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AdmissionOptions limits the commands a Cluster executes at once and how often it executes them.
+// See ClusterOptions.Admission.
+//
+// A command must be admitted before it is executed. It waits for a token from the rate limit of its
+// type, then for a free slot among expensive commands if it is one, then for a free slot among all
+// commands. Expensive commands are ListKeys, ListBuckets, MapReduce and streaming
+// SecondaryIndexQuery commands.
+//
+// A command waits to be admitted until its context is done, or for at most MaxWait if that is set.
+// If it can not be admitted in time, or at once when Reject is set, it fails with an
+// AdmissionRejectedError. Commands waiting to be admitted do not hold a connection
+type AdmissionOptions struct {
+	MaxConcurrent int // NB: commands executing at once, including retries, 0 for no limit
+	MaxExpensive  int // NB: expensive commands executing at once, 0 for no limit
+	// RateLimits limits the rate of each type of command, keyed by name, e.g. "FetchValue"
+	RateLimits map[string]RateLimit
+	// DefaultRateLimit, if set, limits the rate of each type of command not in RateLimits
+	DefaultRateLimit *RateLimit
+	MaxWait          time.Duration // NB: 0 waits until the command's context is done
+	Reject           bool          // NB: reject commands that can not be admitted at once, rather than waiting
+}
+
+// RateLimit is a token bucket rate limit
+type RateLimit struct {
+	Rate  float64 // NB: commands per second
+	Burst int     // NB: commands that may be executed at once after a quiet period, defaults to 1
+}
+
+// AdmissionLimit identifies the limit that rejected a command
+type AdmissionLimit byte
+
+// Admission limits
+const (
+	AdmissionConcurrency AdmissionLimit = iota // NB: AdmissionOptions.MaxConcurrent
+	AdmissionExpensive                         // NB: AdmissionOptions.MaxExpensive
+	AdmissionRate                              // NB: a RateLimit
+)
+
+func (l AdmissionLimit) String() string {
+	switch l {
+	case AdmissionConcurrency:
+		return "concurrency"
+	case AdmissionExpensive:
+		return "expensive"
+	case AdmissionRate:
+		return "rate"
+	default:
+		return fmt.Sprintf("AdmissionLimit(%d)", byte(l))
+	}
+}
+
+// AdmissionStats describes the utilization of a Cluster's admission limits. See
+// Cluster.AdmissionStats
+type AdmissionStats struct {
+	InFlight      int    // NB: commands admitted and executing
+	MaxConcurrent int    // NB: 0 for no limit
+	Expensive     int    // NB: expensive commands admitted and executing
+	MaxExpensive  int    // NB: 0 for no limit
+	Waiting       int    // NB: commands waiting to be admitted
+	Admitted      uint64 // NB: since the Cluster was created
+	Rejected      uint64 // NB: since the Cluster was created
+}
+
+// Utilization returns the fraction of MaxConcurrent in use, or 0 if there is no limit
+func (s AdmissionStats) Utilization() float64 {
+	if s.MaxConcurrent == 0 {
+		return 0
+	}
+	return float64(s.InFlight) / float64(s.MaxConcurrent)
+}
+
+type admission struct {
+	concurrent       chan struct{} // NB: nil for no limit
+	expensive        chan struct{} // NB: nil for no limit
+	rateLimits       map[string]*tokenBucket
+	defaultRateLimit *RateLimit
+	maxWait          time.Duration
+	reject           bool
+	inFlight         int32
+	inFlightExpense  int32
+	waiting          int32
+	admitted         uint64
+	rejected         uint64
+	sync.Mutex       // NB: guards rateLimits
+}
+
+func newAdmission(options *AdmissionOptions) *admission {
+	a := &admission{
+		rateLimits:       make(map[string]*tokenBucket),
+		defaultRateLimit: options.DefaultRateLimit,
+		maxWait:          options.MaxWait,
+		reject:           options.Reject,
+	}
+	if options.MaxConcurrent > 0 {
+		a.concurrent = make(chan struct{}, options.MaxConcurrent)
+	}
+	if options.MaxExpensive > 0 {
+		a.expensive = make(chan struct{}, options.MaxExpensive)
+	}
+	for name, limit := range options.RateLimits {
+		a.rateLimits[name] = newTokenBucket(limit)
+	}
+	return a
+}
+
+// admit waits until cmd may be executed, returning a function that releases its slots
+func (a *admission) admit(ctx context.Context, cmd Command) (func(), error) {
+	atomic.AddInt32(&a.waiting, 1)
+	defer atomic.AddInt32(&a.waiting, -1)
+
+	waitCtx := ctx
+	if a.maxWait > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, a.maxWait)
+		defer cancel()
+	}
+	name := commandTypeName(cmd)
+
+	tb := a.rateLimit(name)
+	if tb != nil {
+		if !tb.wait(waitCtx, a.reject) {
+			return nil, a.onRejected(ctx, name, AdmissionRate)
+		}
+	}
+	// NB: a command rejected by a slot limit gives its token back, so that it is not charged against
+	// the rate limit of its type
+	expensive := isExpensiveCommand(cmd)
+	if expensive && a.expensive != nil {
+		if !acquire(waitCtx, a.expensive, a.reject) {
+			if tb != nil {
+				tb.cancel()
+			}
+			return nil, a.onRejected(ctx, name, AdmissionExpensive)
+		}
+	}
+	if a.concurrent != nil {
+		if !acquire(waitCtx, a.concurrent, a.reject) {
+			if expensive && a.expensive != nil {
+				<-a.expensive
+			}
+			if tb != nil {
+				tb.cancel()
+			}
+			return nil, a.onRejected(ctx, name, AdmissionConcurrency)
+		}
+	}
+
+	atomic.AddUint64(&a.admitted, 1)
+	atomic.AddInt32(&a.inFlight, 1)
+	if expensive {
+		atomic.AddInt32(&a.inFlightExpense, 1)
+	}
+	return func() {
+		if a.concurrent != nil {
+			<-a.concurrent
+		}
+		if expensive {
+			if a.expensive != nil {
+				<-a.expensive
+			}
+			atomic.AddInt32(&a.inFlightExpense, -1)
+		}
+		atomic.AddInt32(&a.inFlight, -1)
+	}, nil
+}
+
+// onRejected returns the error for a command that was not admitted. NB: if the command's context
+// is done, that is reported rather than the limit
+func (a *admission) onRejected(ctx context.Context, name string, limit AdmissionLimit) error {
+	atomic.AddUint64(&a.rejected, 1)
+	if err := ctx.Err(); err != nil {
+		return newClientError(ErrClusterContextDone, err)
+	}
+	return AdmissionRejectedError{Command: name, Limit: limit}
+}
+
+func (a *admission) rateLimit(name string) *tokenBucket {
+	a.Lock()
+	defer a.Unlock()
+	tb, ok := a.rateLimits[name]
+	if !ok && a.defaultRateLimit != nil {
+		tb = newTokenBucket(*a.defaultRateLimit)
+		a.rateLimits[name] = tb
+	}
+	return tb
+}
+
+func (a *admission) stats() AdmissionStats {
+	return AdmissionStats{
+		InFlight:      int(atomic.LoadInt32(&a.inFlight)),
+		MaxConcurrent: cap(a.concurrent),
+		Expensive:     int(atomic.LoadInt32(&a.inFlightExpense)),
+		MaxExpensive:  cap(a.expensive),
+		Waiting:       int(atomic.LoadInt32(&a.waiting)),
+		Admitted:      atomic.LoadUint64(&a.admitted),
+		Rejected:      atomic.LoadUint64(&a.rejected),
+	}
+}
+
+// acquire takes a slot of sem, waiting until ctx is done unless reject is set. It returns false if
+// no slot was taken
+func acquire(ctx context.Context, sem chan struct{}, reject bool) bool {
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+	}
+	if reject {
+		return false
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// tokenBucket is a RateLimit. NB: tokens may go negative, which reserves future tokens for
+// commands that are waiting
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sync.Mutex
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		now:    time.Now,
+	}
+}
+
+// reserve takes a token, returning how long to wait before using it. If that is longer than
+// maxWait, no token is taken and false is returned
+func (tb *tokenBucket) reserve(maxWait time.Duration) (time.Duration, bool) {
+	tb.Lock()
+	defer tb.Unlock()
+	now := tb.now()
+	if !tb.last.IsZero() {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+	}
+	tb.last = now
+	var wait time.Duration
+	if tb.tokens < 1 {
+		if tb.rate <= 0 {
+			return 0, false
+		}
+		wait = time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return 0, false
+	}
+	tb.tokens--
+	return wait, true
+}
+
+// cancel returns a token taken by reserve that was not used
+func (tb *tokenBucket) cancel() {
+	tb.Lock()
+	defer tb.Unlock()
+	tb.tokens++
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+}
+
+// wait takes a token, waiting for it until ctx is done unless reject is set. It returns false if
+// no token was taken
+func (tb *tokenBucket) wait(ctx context.Context, reject bool) bool {
+	maxWait := time.Duration(0)
+	if !reject {
+		maxWait = time.Duration(math.MaxInt64)
+		if deadline, ok := ctx.Deadline(); ok {
+			maxWait = time.Until(deadline)
+		}
+	}
+	d, ok := tb.reserve(maxWait)
+	if !ok {
+		return false
+	}
+	if d == 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		tb.cancel()
+		return false
+	}
+}
+
+// isExpensiveCommand returns true if cmd makes Riak do a lot of work, see AdmissionOptions
+func isExpensiveCommand(cmd Command) bool {
+	switch c := cmd.(type) {
+	case *ListKeysCommand, *ListBucketsCommand, *MapReduceCommand:
+		return true
+	case *SecondaryIndexQueryCommand:
+		return c.protobuf.GetStream()
+	default:
+		return false
+	}
+}
+
+// AdmissionStats returns the utilization of the Cluster's admission limits, see AdmissionOptions.
+// It is zero if ClusterOptions.Admission was not set
+func (c *Cluster) AdmissionStats() AdmissionStats {
+	if c.admission == nil {
+		return AdmissionStats{}
+	}
+	return c.admission.stats()
+}
@@ -0,0 +1,228 @@
+package riak
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := newTokenBucket(RateLimit{Rate: 10, Burst: 2})
+	now := time.Unix(1000, 0)
+	tb.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if wait, ok := tb.reserve(0); !ok || wait != 0 {
+			t.Fatalf("expected burst token %d at once, got %v %v", i, wait, ok)
+		}
+	}
+	if _, ok := tb.reserve(50 * time.Millisecond); ok {
+		t.Error("expected no token within 50ms")
+	}
+	if wait, ok := tb.reserve(time.Second); !ok || wait != 100*time.Millisecond {
+		t.Errorf("expected a token after 100ms, got %v %v", wait, ok)
+	}
+	// NB: the next token is reserved behind the one above
+	if wait, ok := tb.reserve(time.Second); !ok || wait != 200*time.Millisecond {
+		t.Errorf("expected a token after 200ms, got %v %v", wait, ok)
+	}
+	tb.cancel()
+
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if _, ok := tb.reserve(0); !ok {
+			t.Fatalf("expected burst token %d after a quiet period", i)
+		}
+	}
+	if _, ok := tb.reserve(0); ok {
+		t.Error("expected tokens to be capped at the burst")
+	}
+}
+
+func TestAdmissionConcurrency(t *testing.T) {
+	a := newAdmission(&AdmissionOptions{
+		MaxConcurrent: 1,
+		MaxWait:       20 * time.Millisecond,
+	})
+	release, err := a.admit(context.Background(), &PingCommand{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := a.stats(); s.InFlight != 1 || s.MaxConcurrent != 1 || s.Utilization() != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	started := time.Now()
+	_, err = a.admit(context.Background(), &PingCommand{})
+	var admissionErr AdmissionRejectedError
+	if !errors.As(err, &admissionErr) || admissionErr.Limit != AdmissionConcurrency || admissionErr.Command != "Ping" {
+		t.Errorf("expected concurrency rejection, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed < 20*time.Millisecond {
+		t.Errorf("expected to wait MaxWait before rejecting, waited %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = a.admit(ctx, &PingCommand{}); IsAdmissionRejected(err) || !isContextError(err) {
+		t.Errorf("expected context error, got %v", err)
+	}
+
+	admitted := make(chan error)
+	go func() {
+		release, err := a.admit(context.Background(), &PingCommand{})
+		if err == nil {
+			release()
+		}
+		admitted <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	release()
+	if err = <-admitted; err != nil {
+		t.Errorf("expected waiting command to be admitted, got %v", err)
+	}
+
+	if s := a.stats(); s.InFlight != 0 || s.Waiting != 0 || s.Admitted != 2 || s.Rejected != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestAdmissionExpensive(t *testing.T) {
+	a := newAdmission(&AdmissionOptions{
+		MaxExpensive: 1,
+		Reject:       true,
+	})
+	listKeys, err := NewListKeysCommandBuilder().
+		WithBucket("b").
+		WithStreaming(true).
+		WithCallback(func([]string) error { return nil }).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.admit(context.Background(), listKeys); err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.admit(context.Background(), &ListBucketsCommand{})
+	var admissionErr AdmissionRejectedError
+	if !errors.As(err, &admissionErr) || admissionErr.Limit != AdmissionExpensive {
+		t.Errorf("expected expensive rejection, got %v", err)
+	}
+	if _, err = a.admit(context.Background(), &FetchValueCommand{}); err != nil {
+		t.Errorf("expected cheap command to be admitted, got %v", err)
+	}
+	if s := a.stats(); s.InFlight != 2 || s.Expensive != 1 || s.MaxExpensive != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestAdmissionRejectionReturnsRateToken(t *testing.T) {
+	a := newAdmission(&AdmissionOptions{
+		MaxConcurrent: 1,
+		RateLimits: map[string]RateLimit{
+			"Ping": {Rate: 1, Burst: 2},
+		},
+		Reject: true,
+	})
+	now := time.Unix(1000, 0)
+	a.rateLimits["Ping"].now = func() time.Time { return now }
+
+	release, err := a.admit(context.Background(), &PingCommand{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.admit(context.Background(), &PingCommand{})
+	var admissionErr AdmissionRejectedError
+	if !errors.As(err, &admissionErr) || admissionErr.Limit != AdmissionConcurrency {
+		t.Fatalf("expected concurrency rejection, got %v", err)
+	}
+	release()
+
+	// NB: the second token of the burst was given back by the rejected command
+	if release, err = a.admit(context.Background(), &PingCommand{}); err != nil {
+		t.Fatalf("expected command to be admitted, got %v", err)
+	}
+	release()
+}
+
+func TestClusterRejectsCommandOverConcurrencyLimit(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{
+		Admission: &AdmissionOptions{
+			MaxConcurrent: 1,
+			Reject:        true,
+		},
+	}, srv.Addr())
+	srv.SetLatency(100 * time.Millisecond)
+
+	async := &Async{
+		Command: &PingCommand{},
+		Done:    make(chan Command, 1),
+	}
+	if err := cluster.ExecuteAsync(async); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cluster.AdmissionStats().InFlight != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected first ping to be admitted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	err := cluster.Execute(&PingCommand{})
+	if !IsAdmissionRejected(err) || ClassifyError(err) != ErrorClassRejected {
+		t.Errorf("expected admission rejection, got %v", err)
+	}
+	<-async.Done
+	if async.Error != nil {
+		t.Errorf("expected first ping to succeed, got %v", async.Error)
+	}
+	if s := cluster.AdmissionStats(); s.InFlight != 0 || s.Admitted != 1 || s.Rejected != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestClusterRateLimitsCommandType(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{
+		Admission: &AdmissionOptions{
+			RateLimits: map[string]RateLimit{
+				"Ping": {Rate: 20},
+			},
+		},
+	}, srv.Addr())
+
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := cluster.Execute(&PingCommand{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(started); elapsed < 90*time.Millisecond {
+		t.Errorf("expected 3 pings at 20/s to take 100ms, took %v", elapsed)
+	}
+
+	// NB: other command types are not limited
+	cmd, err := NewFetchValueCommandBuilder().WithBucket("b").WithKey("k").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	started = time.Now()
+	if err = cluster.Execute(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed >= 40*time.Millisecond {
+		t.Errorf("expected FetchValue not to be limited, took %v", elapsed)
+	}
+
+	if err = cluster.Execute(&PingCommand{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = cluster.ExecuteContext(ctx, &PingCommand{}); !IsAdmissionRejected(err) {
+		t.Errorf("expected rejection when no token is due before the deadline, got %v", err)
+	}
+}
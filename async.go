@@ -1,6 +1,7 @@
 package riak
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -8,31 +9,72 @@ import (
 )
 
 // Async object is used to pass required arguments to execute a Command asynchronously
+//
+// If Context is non-nil, cancelling it or reaching its deadline stops any
+// further retries of the Command and interrupts a request that is in flight
 type Async struct {
 	Command    Command
 	Done       chan Command
 	Wait       *sync.WaitGroup
+	Context    context.Context
 	Error      error
-	rb         *backoff.Backoff // rb - Retry Backoff
 	enqueuedAt time.Time
 	executeAt  time.Time
 	qb         *backoff.Backoff // qb - Queue Backoff
+	startedAt  time.Time
+	attempts   int
+	hedge      bool             // NB: an execution started by Cluster.executeHedged, which is not hedged again
+	release    func()           // NB: releases the Command's admission slots, see AdmissionOptions
+	replay     bool             // NB: an execution of a journaled Command, which is not journaled again
+	untrack    func()           // NB: removes the Command from the Cluster's commands in flight, see Cluster.Shutdown
+	log        *componentLogger // NB: set by the Cluster executing the Command, see Cluster.execute
 }
 
-func (a *Async) onExecute() {
-	if a.rb == nil {
-		a.rb = &backoff.Backoff{
-			Jitter: true,
-		}
-	} else {
-		a.rb.Reset()
+// onExecute returns true the first time the Command is executed. A Command taken from the Cluster's
+// queue is executed again
+func (a *Async) onExecute() bool {
+	if a.startedAt.IsZero() {
+		a.startedAt = time.Now()
+		return true
+	}
+	return false
+}
+
+// onAttempt returns the number of the attempt about to be made, counting all executions
+func (a *Async) onAttempt() int {
+	a.attempts++
+	return a.attempts
+}
+
+// logger returns the Logger of the Cluster executing the Command, or the package logger if the
+// Command has not been executed by one
+func (a *Async) logger() *componentLogger {
+	if a.log == nil {
+		a.log = newComponentLogger(nil, "component", "Async")
 	}
+	return a.log
 }
 
-func (a *Async) onRetry() {
-	d := a.rb.Duration()
-	logDebug("[Async]", "onRetry cmd: %s sleep: %v", a.Command.Name(), d)
-	time.Sleep(d)
+func (a *Async) context() context.Context {
+	if a.Context == nil {
+		return context.Background()
+	}
+	return a.Context
+}
+
+// onRetry sleeps for d, the delay chosen by the RetryPolicy, returning early with an error
+// if the Async's context is done first
+func (a *Async) onRetry(d time.Duration) error {
+	a.logger().debug("retrying command", "command", a.Command.Name(), "delay", d)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	ctx := a.context()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return newClientError(ErrClusterContextDone, ctx.Err())
+	}
 }
 
 func (a *Async) onEnqueued() {
@@ -46,17 +88,31 @@ func (a *Async) onEnqueued() {
 	a.executeAt = a.enqueuedAt.Add(a.qb.Duration())
 }
 
+// releaseAdmission releases the Command's admission slots, if it holds any
+func (a *Async) releaseAdmission() {
+	if a.release != nil {
+		a.release()
+		a.release = nil
+	}
+}
+
 func (a *Async) done(err error) {
+	// NB: before signalling, so that the next Command can be admitted
+	a.releaseAdmission()
+	if a.untrack != nil {
+		a.untrack()
+		a.untrack = nil
+	}
 	if err != nil {
-		logDebugln("[Async]", "done error:", err)
+		a.logger().debug("command done with error", "command", a.Command.Name(), "err", err)
 		a.Error = err
 	}
 	if a.Done != nil {
-		logDebug("[Async]", "signaling a.Done channel with '%s'", a.Command.Name())
+		a.logger().debug("signaling Done channel", "command", a.Command.Name())
 		a.Done <- a.Command
 	}
 	if a.Wait != nil {
-		logDebug("[Async]", "signaling a.Wait WaitGroup for '%s'", a.Command.Name())
+		a.logger().debug("signaling Wait WaitGroup", "command", a.Command.Name())
 		a.Wait.Done()
 	}
 }
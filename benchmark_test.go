@@ -3,8 +3,14 @@
 package riak
 
 import (
+	"bytes"
+	"encoding/binary"
+	"net"
 	"strconv"
 	"testing"
+
+	"github.com/basho/riak-go-client/riaktest"
+	proto "github.com/golang/protobuf/proto"
 )
 
 func BenchmarkPuttingManyObjects(b *testing.B) {
@@ -32,3 +38,99 @@ func BenchmarkPuttingManyObjects(b *testing.B) {
 		}
 	}
 }
+
+// legacyRiakMessage frames a request as it was before requests were marshalled into pooled buffers
+func legacyRiakMessage(code byte, msg proto.Message) ([]byte, error) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(len(data)+1))
+	binary.Write(buf, binary.BigEndian, code)
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+func BenchmarkRequestFraming(b *testing.B) {
+	cmd, err := NewStoreValueCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		WithContent(&Object{Value: randomBytes}).
+		Build()
+	if err != nil {
+		b.Fatal(err)
+	}
+	rpb, err := cmd.constructPbRequest()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("legacy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := legacyRiakMessage(rpbCode_RpbPutReq, rpb); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			msg, err := appendRiakMessage(rpbCode_RpbPutReq, rpb)
+			if err != nil {
+				b.Fatal(err)
+			}
+			buffers.put(msg)
+		}
+	})
+}
+
+// BenchmarkFetchLargeValue reports the bytes a connection keeps for reading responses after
+// fetching a value larger than its initial buffer
+func BenchmarkFetchLargeValue(b *testing.B) {
+	srv, err := riaktest.NewServer(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer srv.Stop()
+	addr, err := net.ResolveTCPAddr("tcp", srv.Addr())
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, err := newConnection(&connectionOptions{remoteAddress: addr})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = conn.connect(); err != nil {
+		b.Fatal(err)
+	}
+	defer conn.close()
+	store, err := NewStoreValueCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		WithContent(&Object{Value: bytes.Repeat(randomBytes, 64*1024/len(randomBytes)+1)}).
+		Build()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = conn.execute(store); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fetch, err := NewFetchValueCommandBuilder().WithBucket("b").WithKey("k").Build()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = conn.execute(fetch); err != nil {
+			b.Fatal(err)
+		}
+	}
+	retained := cap(conn.dataBuf)
+	if conn.largeBuf != nil {
+		retained += cap(*conn.largeBuf)
+	}
+	b.ReportMetric(float64(retained), "retained-B")
+}
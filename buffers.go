@@ -0,0 +1,87 @@
+package riak
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sync"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// Buffers are pooled in size classes of powers of two, so that a connection that once read a large
+// response does not keep a large buffer, and a large buffer is only reused for a large message
+const (
+	minBufferSizeClass = 8  // NB: 256 bytes
+	maxBufferSizeClass = 24 // NB: 16MB, larger buffers are not pooled
+	frameHeaderLength  = 5  // NB: the 4 byte message length and the message code
+)
+
+// bufferPool is a set of pools of byte slices, one per size class
+type bufferPool struct {
+	classes [maxBufferSizeClass - minBufferSizeClass + 1]sync.Pool // NB: of *[]byte
+}
+
+// buffers holds the buffers requests are marshalled into and large responses are read into
+var buffers bufferPool
+
+// marshalBuffers holds proto.Buffers used to marshal requests into pooled buffers
+var marshalBuffers = sync.Pool{
+	New: func() interface{} { return proto.NewBuffer(nil) },
+}
+
+// get returns a buffer of length size, which should be returned with put once it is no longer used
+func (p *bufferPool) get(size int) *[]byte {
+	c := 0
+	if size > 1<<minBufferSizeClass {
+		c = bits.Len(uint(size-1)) - minBufferSizeClass
+	}
+	if c >= len(p.classes) {
+		b := make([]byte, size)
+		return &b
+	}
+	if v := p.classes[c].Get(); v != nil {
+		b := v.(*[]byte)
+		*b = (*b)[:size]
+		return b
+	}
+	b := make([]byte, size, 1<<(c+minBufferSizeClass))
+	return &b
+}
+
+// put returns b to the pool. NB: the class is that of its capacity rounded down, as a buffer grown
+// by append may not have a capacity that is a power of two
+func (p *bufferPool) put(b *[]byte) {
+	c := bits.Len(uint(cap(*b))) - 1 - minBufferSizeClass
+	if c < 0 || c >= len(p.classes) {
+		return
+	}
+	p.classes[c].Put(b)
+}
+
+// appendRiakMessage marshals msg, which may be nil, into a framed message in a pooled buffer. The
+// buffer should be returned to the pool with buffers.put once the message is written
+func appendRiakMessage(code byte, msg proto.Message) (*[]byte, error) {
+	size := frameHeaderLength
+	if msg != nil {
+		size += proto.Size(msg)
+	}
+	b := buffers.get(size)
+	frame := (*b)[:frameHeaderLength]
+	if msg != nil {
+		pb := marshalBuffers.Get().(*proto.Buffer)
+		pb.SetBuf(frame)
+		err := pb.Marshal(msg)
+		frame = pb.Bytes()
+		pb.SetBuf(nil)
+		marshalBuffers.Put(pb)
+		if err != nil {
+			buffers.put(b)
+			return nil, err
+		}
+	}
+	// NB: the length includes the message code
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	frame[4] = code
+	*b = frame
+	return b, nil
+}
@@ -0,0 +1,119 @@
+package riak
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/basho/riak-go-client/riaktest"
+	proto "github.com/golang/protobuf/proto"
+)
+
+func TestBufferPoolSizeClasses(t *testing.T) {
+	var p bufferPool
+	for _, tt := range []struct {
+		size, cap int
+	}{
+		{1, 256},
+		{256, 256},
+		{257, 512},
+		{5000, 8192},
+		{1 << maxBufferSizeClass, 1 << maxBufferSizeClass},
+		{1<<maxBufferSizeClass + 1, 1<<maxBufferSizeClass + 1}, // NB: too large to be pooled
+	} {
+		b := p.get(tt.size)
+		if len(*b) != tt.size || cap(*b) != tt.cap {
+			t.Errorf("get(%d): expected len %d cap %d, got len %d cap %d", tt.size, tt.size, tt.cap, len(*b), cap(*b))
+		}
+		p.put(b)
+	}
+
+	// NB: a buffer grown past its class is pooled in the class below its capacity
+	grown := make([]byte, 0, 700)
+	p.put(&grown)
+	if b := p.get(600); cap(*b) < 600 {
+		t.Errorf("expected a buffer of at least 600 bytes, got %d", cap(*b))
+	}
+}
+
+func TestAppendRiakMessage(t *testing.T) {
+	msg, err := appendRiakMessage(rpbCode_RpbPingReq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := buildRiakMessage(rpbCode_RpbPingReq, nil); !bytes.Equal(*msg, expected) {
+		t.Errorf("expected %v, got %v", expected, *msg)
+	}
+	buffers.put(msg)
+
+	cmd, err := NewStoreValueCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		WithContent(&Object{Value: bytes.Repeat([]byte("v"), 1000)}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = getRiakMessage(cmd); err != nil {
+		t.Fatal(err)
+	}
+	defer buffers.put(msg)
+	rpb, err := cmd.constructPbRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := proto.Marshal(rpb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := buildRiakMessage(rpbCode_RpbPutReq, data); !bytes.Equal(*msg, expected) {
+		t.Errorf("expected the message to be framed as by buildRiakMessage")
+	}
+}
+
+func TestConnectionReleasesLargeReadBuffer(t *testing.T) {
+	srv, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	addr, err := net.ResolveTCPAddr("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := newConnection(&connectionOptions{remoteAddress: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.close()
+
+	value := bytes.Repeat([]byte("v"), 4*defaultInitBuffer)
+	store, err := NewStoreValueCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		WithContent(&Object{Value: value}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.execute(store); err != nil {
+		t.Fatal(err)
+	}
+	fetch, err := NewFetchValueCommandBuilder().WithBucket("b").WithKey("k").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.execute(fetch); err != nil {
+		t.Fatal(err)
+	}
+	values := fetch.(*FetchValueCommand).Response.Values
+	if len(values) != 1 || !bytes.Equal(values[0].Value, value) {
+		t.Fatal("expected the large value to be fetched")
+	}
+	if conn.largeBuf != nil || cap(conn.dataBuf) != defaultInitBuffer {
+		t.Errorf("expected the large read buffer to be returned to the pool, dataBuf has cap %d", cap(conn.dataBuf))
+	}
+}
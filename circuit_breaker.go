@@ -0,0 +1,303 @@
+package riak
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCircuitBreakerFailureRate      = 0.5
+	defaultCircuitBreakerWindow           = 10 * time.Second
+	defaultCircuitBreakerMinimumRequests  = 20
+	defaultCircuitBreakerCoolDown         = 5 * time.Second
+	defaultCircuitBreakerHalfOpenRequests = 1
+	circuitBreakerWindowBuckets           = 10
+)
+
+// CircuitBreakerState is the state of a Node's circuit breaker
+type CircuitBreakerState byte
+
+// Circuit breaker states
+const (
+	// CircuitClosed means commands are executed on the Node as normal
+	CircuitClosed CircuitBreakerState = iota
+	// CircuitOpen means the Node is not used until it has cooled down and passed a health check
+	CircuitOpen
+	// CircuitHalfOpen means a limited number of trial commands are executed on the Node to decide
+	// whether to close the circuit again
+	CircuitHalfOpen
+)
+
+func (s CircuitBreakerState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitBreakerState(%d)", byte(s))
+	}
+}
+
+// CircuitBreakerOptions configures the circuit breaker of a Node. See NodeOptions.CircuitBreaker.
+//
+// A command fails, for the purposes of the breaker, if no connection could be made to Riak or the
+// connection broke while executing it. Error responses from Riak, and commands that were cancelled
+// or gave up waiting for a connection, do not count.
+//
+// While the breaker is closed, it opens when at least MinimumRequests commands have completed in
+// the last Window and FailureRate of them or more have failed. The Node then stops executing
+// commands and begins health checking with its health check command. Once CoolDown has passed and
+// a health check succeeds, the breaker is half-open: up to HalfOpenRequests commands are executed
+// on the Node. If they all succeed the breaker closes, and if any fails it opens again
+type CircuitBreakerOptions struct {
+	FailureRate      float64 // NB: between 0 and 1, defaults to 0.5
+	Window           time.Duration
+	MinimumRequests  int
+	CoolDown         time.Duration
+	HalfOpenRequests int
+	// OnStateChange, if set, is called synchronously each time the breaker changes state
+	OnStateChange func(e *CircuitBreakerEvent)
+}
+
+// CircuitBreakerEvent describes a change in the state of a Node's circuit breaker
+type CircuitBreakerEvent struct {
+	Node        *Node
+	From        CircuitBreakerState
+	To          CircuitBreakerState
+	Requests    int     // NB: commands completed in the window when the breaker opened from closed
+	FailureRate float64 // NB: failure rate over the window when the breaker opened from closed
+}
+
+// breakerOutcome classifies the result of a command for the circuit breaker
+type breakerOutcome byte
+
+const (
+	breakerIgnored breakerOutcome = iota
+	breakerSuccess
+	breakerFailure
+)
+
+func breakerOutcomeOf(err error) breakerOutcome {
+	if err == nil {
+		return breakerSuccess
+	}
+	if isContextError(err) {
+		return breakerIgnored
+	}
+	switch err.(type) {
+	case RiakError:
+		// NB: Riak responded, so the node is up
+		return breakerSuccess
+	case ClientError:
+		return breakerIgnored
+	default:
+		return breakerFailure
+	}
+}
+
+type breakerBucket struct {
+	index     int64
+	successes int
+	failures  int
+}
+
+type circuitBreaker struct {
+	node             *Node
+	failureRate      float64
+	window           time.Duration
+	minimumRequests  int
+	coolDown         time.Duration
+	halfOpenRequests int
+	onStateChange    func(e *CircuitBreakerEvent)
+	state            CircuitBreakerState
+	generation       uint64 // NB: incremented on each transition, so that late results are ignored
+	buckets          []breakerBucket
+	openedAt         time.Time
+	trials           int
+	trialSuccesses   int
+	now              func() time.Time
+	sync.Mutex
+}
+
+func newCircuitBreaker(node *Node, options *CircuitBreakerOptions) *circuitBreaker {
+	b := &circuitBreaker{
+		node:             node,
+		failureRate:      options.FailureRate,
+		window:           options.Window,
+		minimumRequests:  options.MinimumRequests,
+		coolDown:         options.CoolDown,
+		halfOpenRequests: options.HalfOpenRequests,
+		onStateChange:    options.OnStateChange,
+		buckets:          make([]breakerBucket, circuitBreakerWindowBuckets),
+		now:              time.Now,
+	}
+	if b.failureRate <= 0 || b.failureRate > 1 {
+		b.failureRate = defaultCircuitBreakerFailureRate
+	}
+	if b.window <= 0 {
+		b.window = defaultCircuitBreakerWindow
+	} else if b.window < circuitBreakerWindowBuckets {
+		// NB: so that each bucket of the window is at least a nanosecond wide
+		b.window = circuitBreakerWindowBuckets
+	}
+	if b.minimumRequests <= 0 {
+		b.minimumRequests = defaultCircuitBreakerMinimumRequests
+	}
+	if b.coolDown <= 0 {
+		b.coolDown = defaultCircuitBreakerCoolDown
+	}
+	if b.halfOpenRequests <= 0 {
+		b.halfOpenRequests = defaultCircuitBreakerHalfOpenRequests
+	}
+	return b
+}
+
+func (b *circuitBreaker) getState() CircuitBreakerState {
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
+
+// allow returns true if a command may be executed, and the generation to pass to record
+func (b *circuitBreaker) allow() (uint64, bool) {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case CircuitClosed:
+		return b.generation, true
+	case CircuitHalfOpen:
+		if b.trials < b.halfOpenRequests {
+			b.trials++
+			return b.generation, true
+		}
+	}
+	return b.generation, false
+}
+
+// record counts the outcome of a command allowed in generation, returning true if this opened the
+// breaker
+func (b *circuitBreaker) record(generation uint64, outcome breakerOutcome) bool {
+	b.Lock()
+	if generation != b.generation {
+		b.Unlock()
+		return false
+	}
+	var e *CircuitBreakerEvent
+	switch b.state {
+	case CircuitClosed:
+		if outcome == breakerIgnored {
+			break
+		}
+		bucket := b.bucket()
+		if outcome == breakerSuccess {
+			bucket.successes++
+		} else {
+			bucket.failures++
+		}
+		requests, rate := b.failures()
+		if requests >= b.minimumRequests && rate >= b.failureRate {
+			e = b.transition(CircuitOpen)
+			e.Requests = requests
+			e.FailureRate = rate
+		}
+	case CircuitHalfOpen:
+		switch outcome {
+		case breakerIgnored:
+			b.trials--
+		case breakerSuccess:
+			b.trialSuccesses++
+			if b.trialSuccesses >= b.halfOpenRequests {
+				e = b.transition(CircuitClosed)
+			}
+		case breakerFailure:
+			e = b.transition(CircuitOpen)
+		}
+	}
+	b.Unlock()
+
+	if e == nil {
+		return false
+	}
+	b.notify(e)
+	return e.To == CircuitOpen
+}
+
+// coolDownElapsed returns true if the breaker is not open or has been open for at least its
+// cool-down
+func (b *circuitBreaker) coolDownElapsed() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.state != CircuitOpen || b.now().Sub(b.openedAt) >= b.coolDown
+}
+
+// halfOpen moves an open breaker to half-open, following a successful health check
+func (b *circuitBreaker) halfOpen() {
+	b.Lock()
+	if b.state != CircuitOpen {
+		b.Unlock()
+		return
+	}
+	e := b.transition(CircuitHalfOpen)
+	b.Unlock()
+	b.notify(e)
+}
+
+// transition changes the state of the breaker, returning the event to notify. b must be locked
+func (b *circuitBreaker) transition(to CircuitBreakerState) *CircuitBreakerEvent {
+	e := &CircuitBreakerEvent{
+		Node: b.node,
+		From: b.state,
+		To:   to,
+	}
+	b.state = to
+	b.generation++
+	b.trials = 0
+	b.trialSuccesses = 0
+	for i := range b.buckets {
+		b.buckets[i] = breakerBucket{}
+	}
+	if to == CircuitOpen {
+		b.openedAt = b.now()
+	}
+	return e
+}
+
+func (b *circuitBreaker) notify(e *CircuitBreakerEvent) {
+	b.node.log.info("circuit breaker state changed", "from", e.From, "to", e.To)
+	if b.onStateChange != nil {
+		b.onStateChange(e)
+	}
+}
+
+// bucket returns the window bucket for the current time, clearing it if it is stale. b must be
+// locked
+func (b *circuitBreaker) bucket() *breakerBucket {
+	index := b.now().UnixNano() / int64(b.window/circuitBreakerWindowBuckets)
+	bucket := &b.buckets[index%circuitBreakerWindowBuckets]
+	if bucket.index != index {
+		*bucket = breakerBucket{index: index}
+	}
+	return bucket
+}
+
+// failures returns the number of commands completed in the window and the fraction that failed. b
+// must be locked
+func (b *circuitBreaker) failures() (int, float64) {
+	current := b.now().UnixNano() / int64(b.window/circuitBreakerWindowBuckets)
+	successes, failures := 0, 0
+	for _, bucket := range b.buckets {
+		if current-bucket.index < circuitBreakerWindowBuckets {
+			successes += bucket.successes
+			failures += bucket.failures
+		}
+	}
+	requests := successes + failures
+	if requests == 0 {
+		return 0, 0
+	}
+	return requests, float64(failures) / float64(requests)
+}
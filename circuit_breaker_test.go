@@ -0,0 +1,255 @@
+package riak
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/basho/riak-go-client/riaktest"
+	rpbRiak "github.com/basho/riak-go-client/rpb/riak"
+)
+
+type recordingBreakerEvents struct {
+	events []*CircuitBreakerEvent
+	sync.Mutex
+}
+
+func (r *recordingBreakerEvents) record(e *CircuitBreakerEvent) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recordingBreakerEvents) transitions() []CircuitBreakerState {
+	r.Lock()
+	defer r.Unlock()
+	var to []CircuitBreakerState
+	for _, e := range r.events {
+		to = append(to, e.To)
+	}
+	return to
+}
+
+func newTestBreaker(options *CircuitBreakerOptions) (*circuitBreaker, *time.Time) {
+	node, err := NewNode(nil)
+	if err != nil {
+		panic(err)
+	}
+	now := time.Unix(1000, 0)
+	b := newCircuitBreaker(node, options)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func TestCircuitBreakerOpensOnFailureRate(t *testing.T) {
+	events := &recordingBreakerEvents{}
+	b, _ := newTestBreaker(&CircuitBreakerOptions{
+		FailureRate:     0.5,
+		MinimumRequests: 4,
+		OnStateChange:   events.record,
+	})
+
+	generation, _ := b.allow()
+	for _, outcome := range []breakerOutcome{breakerFailure, breakerFailure, breakerIgnored, breakerSuccess} {
+		if b.record(generation, outcome) {
+			t.Fatal("expected breaker to stay closed below the minimum number of requests")
+		}
+	}
+	if !b.record(generation, breakerFailure) {
+		t.Fatal("expected breaker to open")
+	}
+	if got := b.getState(); got != CircuitOpen {
+		t.Errorf("expected open, got %v", got)
+	}
+	if _, allowed := b.allow(); allowed {
+		t.Error("expected open breaker not to allow commands")
+	}
+
+	if len(events.events) != 1 {
+		t.Fatalf("expected one event, got %d", len(events.events))
+	}
+	e := events.events[0]
+	if e.From != CircuitClosed || e.To != CircuitOpen || e.Requests != 4 || e.FailureRate != 0.75 || e.Node != b.node {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestCircuitBreakerWindowSlides(t *testing.T) {
+	b, now := newTestBreaker(&CircuitBreakerOptions{
+		Window:          time.Second,
+		MinimumRequests: 2,
+	})
+
+	generation, _ := b.allow()
+	b.record(generation, breakerFailure)
+	*now = now.Add(2 * time.Second)
+	if b.record(generation, breakerFailure) {
+		t.Error("expected failures outside the window not to count")
+	}
+	*now = now.Add(500 * time.Millisecond)
+	if !b.record(generation, breakerFailure) {
+		t.Error("expected failures inside the window to open the breaker")
+	}
+}
+
+func TestCircuitBreakerTinyWindow(t *testing.T) {
+	b, _ := newTestBreaker(&CircuitBreakerOptions{
+		Window:          time.Nanosecond,
+		MinimumRequests: 2,
+	})
+	if b.window != circuitBreakerWindowBuckets {
+		t.Errorf("expected window to be raised to %dns, got %v", circuitBreakerWindowBuckets, b.window)
+	}
+	generation, _ := b.allow()
+	b.record(generation, breakerFailure)
+	if !b.record(generation, breakerFailure) {
+		t.Error("expected failures inside the window to open the breaker")
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	events := &recordingBreakerEvents{}
+	b, now := newTestBreaker(&CircuitBreakerOptions{
+		MinimumRequests:  1,
+		CoolDown:         time.Second,
+		HalfOpenRequests: 2,
+		OnStateChange:    events.record,
+	})
+
+	closedGeneration, _ := b.allow()
+	b.record(closedGeneration, breakerFailure)
+	if b.coolDownElapsed() {
+		t.Error("expected cool-down not to have elapsed")
+	}
+	*now = now.Add(time.Second)
+	if !b.coolDownElapsed() {
+		t.Error("expected cool-down to have elapsed")
+	}
+
+	b.halfOpen()
+	g1, ok1 := b.allow()
+	g2, ok2 := b.allow()
+	if _, ok3 := b.allow(); !ok1 || !ok2 || ok3 {
+		t.Fatalf("expected exactly two trial commands, got %v %v %v", ok1, ok2, ok3)
+	}
+
+	// NB: a late result from before the breaker opened is ignored
+	b.record(closedGeneration, breakerSuccess)
+	// NB: an ignored outcome frees its trial
+	b.record(g1, breakerIgnored)
+	g3, ok := b.allow()
+	if !ok {
+		t.Fatal("expected a trial command to be allowed")
+	}
+	b.record(g2, breakerSuccess)
+	if got := b.getState(); got != CircuitHalfOpen {
+		t.Errorf("expected half-open, got %v", got)
+	}
+	b.record(g3, breakerSuccess)
+	if got := b.getState(); got != CircuitClosed {
+		t.Errorf("expected closed, got %v", got)
+	}
+
+	generation, _ := b.allow()
+	b.record(generation, breakerFailure)
+	b.halfOpen()
+	generation, _ = b.allow()
+	if !b.record(generation, breakerFailure) {
+		t.Error("expected a failed trial to open the breaker")
+	}
+
+	want := []CircuitBreakerState{CircuitOpen, CircuitHalfOpen, CircuitClosed, CircuitOpen, CircuitHalfOpen, CircuitOpen}
+	got := events.transitions()
+	if len(got) != len(want) {
+		t.Fatalf("expected transitions %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected transitions %v, got %v", want, got)
+		}
+	}
+}
+
+func TestBreakerOutcomeOf(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want breakerOutcome
+	}{
+		{nil, breakerSuccess},
+		{newRiakError(&rpbRiak.RpbErrorResp{Errmsg: []byte("not found")}), breakerSuccess},
+		{ErrConnMgrAcquireTimeout, breakerIgnored},
+		{newClientError(ErrConnMgrContextDone, context.Canceled), breakerIgnored},
+		{io.EOF, breakerFailure},
+		{errors.New("connection reset"), breakerFailure},
+	} {
+		if got := breakerOutcomeOf(tc.err); got != tc.want {
+			t.Errorf("%v: expected %v, got %v", tc.err, tc.want, got)
+		}
+	}
+}
+
+func TestNodeCircuitBreakerWithHealthCheck(t *testing.T) {
+	srv, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := srv.Addr()
+
+	events := &recordingBreakerEvents{}
+	node, err := NewNode(&NodeOptions{
+		RemoteAddress:       addr,
+		MinConnections:      1,
+		HealthCheckInterval: 10 * time.Millisecond,
+		CircuitBreaker: &CircuitBreakerOptions{
+			MinimumRequests: 2,
+			CoolDown:        50 * time.Millisecond,
+			OnStateChange:   events.record,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = node.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer node.stop()
+
+	srv.Stop()
+	for i := 0; i < 2; i++ {
+		if executed, err := node.execute(&PingCommand{}); err == nil {
+			t.Fatalf("expected ping to fail, got executed %v", executed)
+		}
+	}
+	if got := node.CircuitBreakerState(); got != CircuitOpen {
+		t.Fatalf("expected open, got %v", got)
+	}
+	if executed, _ := node.execute(&PingCommand{}); executed {
+		t.Error("expected node with an open breaker not to execute commands")
+	}
+
+	if srv, err = riaktest.NewServer(&riaktest.ServerOptions{Address: addr}); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for node.CircuitBreakerState() != CircuitHalfOpen || !node.isCurrentState(nodeRunning) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected health check to half-open the breaker")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if executed, err := node.execute(&PingCommand{}); !executed || err != nil {
+		t.Fatalf("expected trial ping to execute, got executed %v err %v", executed, err)
+	}
+	if got := node.CircuitBreakerState(); got != CircuitClosed {
+		t.Errorf("expected closed, got %v", got)
+	}
+	want := []CircuitBreakerState{CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	if got := events.transitions(); len(got) != 3 || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("expected transitions %v, got %v", want, got)
+	}
+}
@@ -1,6 +1,7 @@
 package riak
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
@@ -23,6 +24,7 @@ type NewClientOptions struct {
 	Cluster         *Cluster
 	Port            uint16   // NB: if specified, all connections will use this value if port is not provided
 	RemoteAddresses []string // NB: in the form HOST|IP[:PORT]
+	Logger          Logger   // NB: used with RemoteAddresses, a Cluster uses its ClusterOptions.Logger
 }
 
 // NewClient generates a new Client object using the provided options
@@ -34,7 +36,7 @@ func NewClient(opts *NewClientOptions) (*Client, error) {
 		return newClientUsingCluster(opts.Cluster)
 	}
 	if opts.RemoteAddresses != nil {
-		return newClientUsingAddresses(opts.Port, opts.RemoteAddresses)
+		return newClientUsingAddresses(opts.Port, opts.RemoteAddresses, opts.Logger)
 	}
 	return nil, ErrClientMissingRequiredData
 }
@@ -48,6 +50,12 @@ func (c *Client) Execute(cmd Command) error {
 	return c.cluster.Execute(cmd)
 }
 
+// ExecuteContext (synchronously) executes the provided Command against the cluster, stopping
+// when ctx is cancelled or its deadline passes
+func (c *Client) ExecuteContext(ctx context.Context, cmd Command) error {
+	return c.cluster.ExecuteContext(ctx, cmd)
+}
+
 // Execute (asynchronously) the provided Command against the cluster
 func (c *Client) ExecuteAsync(a *Async) error {
 	return c.cluster.ExecuteAsync(a)
@@ -74,7 +82,7 @@ func newClientUsingCluster(cluster *Cluster) (*Client, error) {
 	}, nil
 }
 
-func newClientUsingAddresses(port uint16, remoteAddresses []string) (*Client, error) {
+func newClientUsingAddresses(port uint16, remoteAddresses []string, logger Logger) (*Client, error) {
 	if len(remoteAddresses) == 0 {
 		remoteAddresses = make([]string, 1)
 		remoteAddresses[0] = defaultRemoteAddress
@@ -110,7 +118,8 @@ func newClientUsingAddresses(port uint16, remoteAddresses []string) (*Client, er
 		}
 	}
 	copts := &ClusterOptions{
-		Nodes: nodes,
+		Nodes:  nodes,
+		Logger: logger,
 	}
 	if cluster, err := NewCluster(copts); err != nil {
 		return nil, err
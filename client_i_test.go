@@ -38,21 +38,21 @@ func TestNewClientWithPort(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	if expected, actual := true, reflect.DeepEqual(addr, c.cluster.nodes[0].addr); expected != actual {
+	if expected, actual := true, reflect.DeepEqual(addr, c.cluster.nodes[0].cm.getAddr()); expected != actual {
 		t.Errorf("expected %v, actual %v", expected, actual)
 	}
 	addr, err = net.ResolveTCPAddr("tcp", "127.0.0.1:5678")
 	if err != nil {
 		t.Error(err)
 	}
-	if expected, actual := true, reflect.DeepEqual(addr, c.cluster.nodes[1].addr); expected != actual {
+	if expected, actual := true, reflect.DeepEqual(addr, c.cluster.nodes[1].cm.getAddr()); expected != actual {
 		t.Errorf("expected %v, actual %v", expected, actual)
 	}
 	addr, err = net.ResolveTCPAddr("tcp", "127.0.0.1:1234")
 	if err != nil {
 		t.Error(err)
 	}
-	if expected, actual := true, reflect.DeepEqual(addr, c.cluster.nodes[2].addr); expected != actual {
+	if expected, actual := true, reflect.DeepEqual(addr, c.cluster.nodes[2].cm.getAddr()); expected != actual {
 		t.Errorf("expected %v, actual %v", expected, actual)
 	}
 }
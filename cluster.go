@@ -1,8 +1,10 @@
 package riak
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,6 +12,7 @@ import (
 const (
 	clusterCreated state = iota
 	clusterRunning
+	clusterDraining
 	clusterShuttingDown
 	clusterShutdown
 	clusterError
@@ -21,9 +24,20 @@ type ClusterOptions struct {
 	Nodes                  []*Node
 	NoDefaultNode          bool
 	NodeManager            NodeManager
-	ExecutionAttempts      byte
+	ExecutionAttempts      byte        // NB: only used when RetryPolicy is nil
+	RetryPolicy            RetryPolicy // NB: defaults to an ExponentialRetryPolicy making ExecutionAttempts attempts
 	QueueMaxDepth          uint16
 	QueueExecutionInterval time.Duration
+	Logger                 Logger               // NB: also used by the Cluster's Nodes, defaults to Stderr
+	Observer               CommandObserver      // NB: optional, see CommandObserver
+	SRVDiscovery           *SRVDiscoveryOptions // NB: optional, see SRVDiscoveryOptions
+	MembershipProvider     MembershipProvider   // NB: optional, see MembershipProvider. Not used with SRVDiscovery
+	MemberNodeOptions      *NodeOptions         // NB: template for the Nodes of MembershipProvider members
+	NodeDrainTimeout       time.Duration        // NB: how long RemoveNode waits for commands in flight, defaults to 10s
+	Hedging                *HedgingOptions      // NB: optional, enables hedged reads, see HedgingOptions
+	Admission              *AdmissionOptions    // NB: optional, limits concurrency and rate, see AdmissionOptions
+	Journal                *JournalOptions      // NB: optional, journals writes during outages, see JournalOptions
+	Compression            *CompressionOptions  // NB: optional, compresses values, see CompressionOptions
 }
 
 // Cluster object contains your pool of Node objects, the NodeManager and the
@@ -32,10 +46,28 @@ type Cluster struct {
 	stopChan           chan struct{}
 	nodes              []*Node
 	nodeManager        NodeManager
-	executionAttempts  byte
+	retryPolicy        RetryPolicy
 	queueCommands      bool
 	cq                 *queue
 	commandQueueTicker *time.Ticker
+	logger             Logger
+	log                *componentLogger
+	asyncLog           *componentLogger // NB: of the Asyncs this Cluster executes
+	observer           CommandObserver
+	events             *eventHub
+	membership         MembershipProvider
+	memberNodeOptions  *NodeOptions
+	members            map[string]*Node // NB: by address, only used by Start and the watchMembers goroutine
+	membershipStop     chan struct{}
+	membershipDone     chan struct{}
+	drainTimeout       time.Duration
+	hedger             *hedger
+	admission          *admission
+	journal            *journal
+	journalStop        chan struct{}
+	journalDone        chan struct{}
+	compression        *compression
+	inFlight           int32 // NB: commands executing or queued, see Shutdown
 	sync.Mutex
 	stateData
 }
@@ -48,9 +80,18 @@ var (
 	ErrClusterEnqueueWhileShuttingDown        = newClientError("[Cluster] will not enqueue command, shutting down", nil)
 	ErrClusterShuttingDown                    = newClientError("[Cluster] will not execute command, shutting down", nil)
 	ErrClusterNodeMustBeNonNil                = newClientError("[Cluster] node argument must be non-nil", nil)
+	ErrClusterSRVNameRequired                 = newClientError("[Cluster] SRVDiscovery requires a Name", nil)
+	ErrClusterSRVDiscoveryWithMembership      = newClientError("[Cluster] SRVDiscovery and MembershipProvider can not both be set", nil)
+	ErrClusterJournalDirRequired              = newClientError("[Cluster] Journal requires a Dir", nil)
+	ErrClusterJournalClosed                   = newClientError("[Cluster] journal is closed", nil)
+	ErrClusterCommandJournaled                = newClientError("[Cluster] command journaled, it will be executed when a node is available", nil)
+	ErrClusterNodesStillRunning               = newClientError("[Cluster] nodes still running when all should be stopped", nil)
 )
 
 const ErrClusterNoNodesAvailable = "[Cluster] all retries exhausted and/or no nodes available to execute command"
+const ErrClusterContextDone = "[Cluster] context done before command completed"
+const ErrClusterJournalFailed = "[Cluster] could not journal command"
+const ErrClusterShutdownIncomplete = "[Cluster] context done before commands in flight completed"
 
 var defaultClusterOptions = &ClusterOptions{
 	Nodes:             make([]*Node, 0),
@@ -69,12 +110,38 @@ func NewCluster(options *ClusterOptions) (*Cluster, error) {
 	if options.ExecutionAttempts == 0 {
 		options.ExecutionAttempts = defaultExecutionAttempts
 	}
+	if options.RetryPolicy == nil {
+		options.RetryPolicy = NewExponentialRetryPolicy(&ExponentialRetryPolicyOptions{
+			MaxAttempts: int(options.ExecutionAttempts),
+		})
+	}
+
+	if options.Logger == nil {
+		options.Logger = packageLogger{}
+	}
+	if options.NodeDrainTimeout == 0 {
+		options.NodeDrainTimeout = defaultNodeDrainTimeout
+	}
 
 	c := &Cluster{
-		executionAttempts: options.ExecutionAttempts,
+		retryPolicy:       options.RetryPolicy,
 		nodeManager:       options.NodeManager,
+		logger:            options.Logger,
+		log:               newComponentLogger(options.Logger, "component", "Cluster"),
+		asyncLog:          newComponentLogger(options.Logger, "component", "Async"),
+		observer:          options.Observer,
+		membership:        options.MembershipProvider,
+		memberNodeOptions: options.MemberNodeOptions,
+		drainTimeout:      options.NodeDrainTimeout,
+		events:            &eventHub{},
+	}
+	if lm, ok := c.nodeManager.(loggingNodeManager); ok {
+		lm.setLogger(c.logger)
+	}
+	c.initStateData("clusterCreated", "clusterRunning", "clusterDraining", "clusterShuttingDown", "clusterShutdown", "clusterError")
+	c.onStateChange = func(from, to state) {
+		c.events.emit(&Event{Type: EventClusterStateChanged, From: c.stateName(from), To: c.stateName(to)})
 	}
-	c.initStateData("clusterCreated", "clusterRunning", "clusterShuttingDown", "clusterShutdown", "clusterError")
 
 	if options.Nodes == nil {
 		c.nodes = make([]*Node, 0)
@@ -82,7 +149,43 @@ func NewCluster(options *ClusterOptions) (*Cluster, error) {
 		c.nodes = options.Nodes
 	}
 
-	if options.NoDefaultNode == false && len(c.nodes) == 0 {
+	if options.SRVDiscovery != nil {
+		if options.MembershipProvider != nil {
+			return nil, ErrClusterSRVDiscoveryWithMembership
+		}
+		if options.SRVDiscovery.Name == "" {
+			return nil, ErrClusterSRVNameRequired
+		}
+		if options.SRVDiscovery.RefreshInterval == 0 {
+			options.SRVDiscovery.RefreshInterval = defaultSRVRefreshInterval
+		}
+		c.membership = newSRVMembershipProvider(options.SRVDiscovery)
+		c.memberNodeOptions = options.SRVDiscovery.NodeOptions
+	}
+	if c.membership != nil {
+		c.members = make(map[string]*Node)
+	}
+	if options.Hedging != nil {
+		c.hedger = newHedger(options.Hedging)
+	}
+	if options.Admission != nil {
+		c.admission = newAdmission(options.Admission)
+	}
+	if options.Compression != nil {
+		c.compression = newCompression(options.Compression)
+	}
+	if options.Journal != nil {
+		if options.Journal.Dir == "" {
+			return nil, ErrClusterJournalDirRequired
+		}
+		j, err := openJournal(options.Journal)
+		if err != nil {
+			return nil, err
+		}
+		c.journal = j
+	}
+
+	if options.NoDefaultNode == false && c.membership == nil && len(c.nodes) == 0 {
 		defaultNode, nerr := NewNode(nil)
 		if nerr != nil {
 			return nil, nerr
@@ -94,6 +197,7 @@ func NewCluster(options *ClusterOptions) (*Cluster, error) {
 		if node == nil {
 			return nil, ErrClusterNodesMustBeNonNil
 		}
+		c.initNode(node)
 	}
 
 	if options.QueueMaxDepth > 0 {
@@ -113,14 +217,14 @@ func NewCluster(options *ClusterOptions) (*Cluster, error) {
 
 // String returns a formatted string that lists status information for the Cluster
 func (c *Cluster) String() string {
-	return fmt.Sprintf("%v", c.nodes)
+	return fmt.Sprintf("%v", c.getNodes())
 }
 
 // Start opens connections with your configured nodes and adds them to
 // the active pool
 func (c *Cluster) Start() error {
 	if c.isCurrentState(clusterRunning) {
-		logWarnln("[Cluster]", "cluster already running.")
+		c.log.warn("cluster already running")
 		return nil
 	}
 
@@ -128,8 +232,32 @@ func (c *Cluster) Start() error {
 		return err
 	}
 
-	logDebug("[Cluster]", "starting")
+	c.log.debug("starting", "nodes", len(c.getNodes()))
+
+	if err := c.startNodes(); err != nil {
+		return err
+	}
+
+	c.setState(clusterRunning)
+	c.log.debug("cluster started", "state", c.stateData.String())
+
+	if c.membership != nil {
+		c.refreshMembers()
+		c.membershipStop = make(chan struct{})
+		c.membershipDone = make(chan struct{})
+		go c.watchMembers()
+	}
+
+	if c.journal != nil {
+		c.journalStop = make(chan struct{})
+		c.journalDone = make(chan struct{})
+		go c.replayJournal()
+	}
+
+	return nil
+}
 
+func (c *Cluster) startNodes() error {
 	c.Lock()
 	defer c.Unlock()
 	for _, node := range c.nodes {
@@ -137,30 +265,93 @@ func (c *Cluster) Start() error {
 			return err
 		}
 	}
-
-	c.setState(clusterRunning)
-	logDebug("[Cluster]", "cluster started")
-
 	return nil
 }
 
 // Stop closes the connections with your configured nodes and removes them from
-// the active pool
+// the active pool. Commands in flight fail and queued commands fail with ErrClusterShuttingDown,
+// see Shutdown to let them complete
 func (c *Cluster) Stop() (err error) {
 	if err = c.stateCheck(clusterRunning); err != nil {
 		return
 	}
 
-	logDebug("[Cluster]", "shutting down")
+	c.log.debug("shutting down")
+
+	if err = c.stop(); err == ErrClusterNodesStillRunning {
+		panic("[Cluster] nodes still running when all should be stopped")
+	}
+	return
+}
+
+// Shutdown gracefully stops the Cluster. New commands fail with ErrClusterShuttingDown, while the
+// commands in flight, including queued commands and retries, are given until ctx is done to
+// complete. Queued commands are executed as usual while Nodes are available. The commands still
+// queued then fail with ErrClusterShuttingDown, delivered through their Async, and the Nodes are
+// stopped, closing their connections.
+//
+// If ctx is done before the commands in flight complete, Shutdown stops the Nodes anyway and
+// returns an error wrapping ctx.Err(). Unlike Stop, it returns ErrClusterNodesStillRunning rather
+// than panicking if a Node does not stop
+func (c *Cluster) Shutdown(ctx context.Context) error {
+	if err := c.stateCheck(clusterRunning); err != nil {
+		return err
+	}
+
+	c.log.debug("draining", "inFlight", atomic.LoadInt32(&c.inFlight))
+	c.setState(clusterDraining)
 
+	derr := c.drain(ctx)
+	if derr != nil {
+		c.log.warn("shutting down with commands in flight", "inFlight", atomic.LoadInt32(&c.inFlight), "err", derr)
+	}
+	err := c.stop()
+	if derr != nil {
+		return newClientError(ErrClusterShutdownIncomplete, derr)
+	}
+	return err
+}
+
+// drain waits until no command is in flight, or ctx is done
+func (c *Cluster) drain(ctx context.Context) error {
+	t := time.NewTicker(nodeDrainPollInterval)
+	defer t.Stop()
+	for atomic.LoadInt32(&c.inFlight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+// stop fails queued commands and stops the Nodes. It returns ErrClusterNodesStillRunning if a Node
+// did not stop, otherwise the error stopping the last Node that failed to stop, if any
+func (c *Cluster) stop() (err error) {
 	c.setState(clusterShuttingDown)
 
+	if c.membershipStop != nil {
+		// NB: wait, so that no Node is added while the Nodes are stopped
+		close(c.membershipStop)
+		<-c.membershipDone
+		c.closeMembership()
+	}
+
+	if c.journalStop != nil {
+		close(c.journalStop)
+		<-c.journalDone
+		if jerr := c.journal.close(); jerr != nil {
+			c.log.err("error when closing journal", jerr)
+		}
+	}
+
 	if c.queueCommands {
 		close(c.stopChan)
 		c.commandQueueTicker.Stop()
 		qc := c.cq.count()
 		if qc > 0 {
-			logWarn("[Cluster]", "commands in queue during shutdown: %d", qc)
+			c.log.warn("commands in queue during shutdown", "queued", qc)
 			var f = func(v interface{}) (bool, bool) {
 				if v == nil {
 					return true, false
@@ -171,7 +362,7 @@ func (c *Cluster) Stop() (err error) {
 				return false, false
 			}
 			if qerr := c.cq.iterate(f); qerr != nil {
-				logErr("[Cluster]", qerr)
+				c.log.err("error when draining command queue", qerr)
 			}
 		}
 		c.cq.destroy()
@@ -182,12 +373,12 @@ func (c *Cluster) Stop() (err error) {
 	for _, node := range c.nodes {
 		err = node.stop()
 		if err != nil {
-			logErr("[Cluster]", err)
+			c.log.err("error when stopping node", err, "node", node.Addr())
 		}
 	}
 
 	allStopped := true
-	logDebug("[Cluster]", "checking to see if nodes are shut down")
+	c.log.debug("checking to see if nodes are shut down")
 	for _, node := range c.nodes {
 		nodeState := node.getState()
 		if nodeState != nodeShutdown {
@@ -198,14 +389,22 @@ func (c *Cluster) Stop() (err error) {
 
 	if allStopped {
 		c.setState(clusterShutdown)
-		logDebug("[Cluster]", "cluster shut down")
+		c.log.debug("cluster shut down", "state", c.stateData.String())
 	} else {
-		panic("[Cluster] nodes still running when all should be stopped")
+		c.setState(clusterError)
+		err = ErrClusterNodesStillRunning
 	}
 
 	return
 }
 
+// initNode shares the Cluster's Logger, CommandObserver and Event subscriptions with n
+func (c *Cluster) initNode(n *Node) {
+	n.setLogger(c.logger)
+	n.setObserver(c.observer)
+	n.setEvents(c.events)
+}
+
 // Adds a node to the cluster and starts it
 func (c *Cluster) AddNode(n *Node) error {
 	if n == nil {
@@ -218,36 +417,53 @@ func (c *Cluster) AddNode(n *Node) error {
 			return nil
 		}
 	}
+	c.initNode(n)
 	if c.isCurrentState(clusterRunning) {
 		if err := n.start(); err != nil {
 			return err
 		}
 	}
-	c.nodes = append(c.nodes, n)
+	// NB: copy-on-write, commands in flight may be iterating the current slice, see getNodes
+	c.nodes = append(c.nodes[:len(c.nodes):len(c.nodes)], n)
 	return nil
 }
 
-// Stops the node and removes from the cluster
+// RemoveNode removes the node from the cluster, so that no new commands are executed on it, then
+// drains and stops it. Draining waits up to NodeDrainTimeout for the commands in flight on the node
+// to complete
 func (c *Cluster) RemoveNode(n *Node) error {
 	if n == nil {
 		return ErrClusterNodeMustBeNonNil
 	}
+	if !c.removeNode(n) || n.isCurrentState(nodeCreated) {
+		return nil
+	}
+	n.drain(c.drainTimeout)
+	return n.stop()
+}
+
+// removeNode removes n from the cluster's nodes, returning false if it was not one of them
+func (c *Cluster) removeNode(n *Node) bool {
 	c.Lock()
 	defer c.Unlock()
-	cn := c.nodes
 	for i, node := range c.nodes {
 		if n == node {
-			l := len(cn) - 1
-			cn[i], cn[l], c.nodes = cn[l], nil, cn[:l]
-			if !node.isCurrentState(nodeCreated) {
-				if err := node.stop(); err != nil {
-					return err
-				}
-			}
-			return nil
+			// NB: copy-on-write, commands in flight may be iterating the current slice, see getNodes
+			nodes := make([]*Node, 0, len(c.nodes)-1)
+			nodes = append(nodes, c.nodes[:i]...)
+			c.nodes = append(nodes, c.nodes[i+1:]...)
+			return true
 		}
 	}
-	return nil
+	return false
+}
+
+// getNodes returns the cluster's nodes. NB: the slice is never modified, AddNode and removeNode
+// replace it, so it may be used without holding the lock
+func (c *Cluster) getNodes() []*Node {
+	c.Lock()
+	defer c.Unlock()
+	return c.nodes
 }
 
 // Execute (asynchronously) the provided Command against the active pooled Nodes using the NodeManager
@@ -267,11 +483,19 @@ func (c *Cluster) ExecuteAsync(async *Async) error {
 
 // Execute (synchronously) the provided Command against the active pooled Nodes using the NodeManager
 func (c *Cluster) Execute(command Command) error {
+	return c.ExecuteContext(context.Background(), command)
+}
+
+// ExecuteContext (synchronously) executes the provided Command against the active pooled Nodes
+// using the NodeManager. If ctx is cancelled or its deadline passes, retries are stopped, any
+// in-flight request is aborted and the returned error wraps ctx.Err()
+func (c *Cluster) ExecuteContext(ctx context.Context, command Command) error {
 	if command == nil {
 		return ErrClusterCommandRequired
 	}
 	async := &Async{
 		Command: command,
+		Context: ctx,
 	}
 	c.execute(async)
 	if async.Error != nil {
@@ -291,44 +515,119 @@ func (c *Cluster) execute(async *Async) {
 	if async == nil {
 		panic("[Cluster] nil async argument")
 	}
+	if async.log == nil {
+		async.log = c.asyncLog
+	}
+	if async.untrack == nil && !async.hedge {
+		c.track(async)
+	}
+	if cc, ok := async.Command.(compressedCommand); ok && c.compression != nil {
+		cc.setCompression(c.compression)
+	}
+	if c.admission != nil && !async.hedge {
+		release, err := c.admission.admit(async.context(), async.Command)
+		if err != nil {
+			c.log.debug("command not admitted", "command", async.Command.Name(), "err", err)
+			async.done(err)
+			return
+		}
+		async.release = release
+	}
+	if c.journals(async) && c.journal.pending() > 0 {
+		// NB: behind the journaled commands, so that writes are executed in order, unless the
+		// Cluster is not accepting commands
+		err := c.checkState(async)
+		if err == nil {
+			err = c.journalCommand(async.Command)
+		}
+		async.done(err)
+		return
+	}
+
+	if c.hedger != nil && !async.hedge {
+		if hc, ok := async.Command.(hedgeableCommand); ok && c.canHedge() {
+			if primary := hc.cloneCommand(); primary != nil {
+				c.executeHedged(async, hc, primary)
+				return
+			}
+		}
+	}
+
 	var err error
 	executed := false
 	enqueued := false
 	cmd := async.Command
+	ctx := async.context()
+	cmd.setContext(ctx)
 
-	tries := byte(1)
+	policy := c.retryPolicy
+	if p := cmd.getRetryPolicy(); p != nil {
+		policy = p
+	}
 	var lastExeNode *Node
-	if rc, ok := cmd.(retryableCommand); ok {
-		tries = c.executionAttempts
-		logDebug("[Cluster]", "cmd %s initial tries: %d", cmd.Name(), tries)
+	rc, retryable := cmd.(retryableCommand)
+	if retryable {
+		c.log.debug("command is re-tryable", "command", cmd.Name())
 		lastExeNode = rc.getLastNode()
 	} else {
-		logDebug("[Cluster]", "cmd %s NOT re-tryable", cmd.Name())
+		c.log.debug("command is NOT re-tryable", "command", cmd.Name())
 	}
 
-	async.onExecute()
-	for tries > 0 {
-		if err = c.stateCheck(clusterRunning); err != nil {
+	if async.onExecute() && c.observer != nil {
+		c.observer.CommandStarted(cmd)
+	}
+	for tries := 1; ; tries++ {
+		attempt := async.onAttempt()
+		cmd.setAttempt(attempt)
+		cmd.setRequestWritten(false)
+		if err = c.checkState(async); err != nil {
+			break
+		}
+		if cerr := ctx.Err(); cerr != nil {
+			err = newClientError(ErrClusterContextDone, cerr)
 			break
 		}
-		executed, err = c.nodeManager.ExecuteOnNode(c.nodes, cmd, lastExeNode)
+		executed, err = c.nodeManager.ExecuteOnNode(c.getNodes(), cmd, lastExeNode)
 		// NB: do *not* call cmd.onError here as it will have been called in connection
+		if err != nil && cmd.getRequestWritten() && !isIdempotent(cmd) && isOutcomeUnknown(err) {
+			c.log.debug("command will not be re-tried, outcome unknown", "command", cmd.Name(), "attempt", attempt, "err", err)
+			err = OutcomeUnknownError{InnerError: err}
+			break
+		}
+		if err != nil && isContextError(err) {
+			c.log.debug("command will not be re-tried, context done", "command", cmd.Name(), "attempt", attempt, "err", err)
+			break
+		}
+		if err != nil && isSizeLimitError(err) {
+			c.log.debug("command will not be re-tried, too large", "command", cmd.Name(), "attempt", attempt, "err", err)
+			break
+		}
+		if err != nil && IsCodecError(err) {
+			c.log.debug("command will not be re-tried, codec failed", "command", cmd.Name(), "attempt", attempt, "err", err)
+			break
+		}
 		if executed {
 			// NB: "executed" means that a node sent the data to Riak and received a response
 			if err == nil {
 				// No need to re-try
-				logDebug("[Cluster]", "successfully executed cmd '%s'", cmd.Name())
+				c.log.debug("successfully executed command", "command", cmd.Name(), "attempt", attempt)
 				break
 			} else {
 				// NB: retry since error occurred
-				logDebug("[Cluster]", "executed cmd '%s': re-try due to error '%v'", cmd.Name(), err)
+				c.log.debug("executed command, re-try due to error", "command", cmd.Name(), "attempt", attempt, "err", err)
 			}
 		} else {
 			// Command did NOT execute
 			if err == nil {
-				logDebug("[Cluster]", "did NOT execute cmd '%s', nil err", cmd.Name())
+				c.log.debug("did NOT execute command, nil err", "command", cmd.Name(), "attempt", attempt)
+				if c.journals(async) {
+					err = c.journalCommand(cmd)
+					break
+				}
 				// Command did not execute but there was no error, so enqueue it
-				if c.queueCommands {
+				if c.queueCommands && !async.replay {
+					// NB: a queued command is admitted again when it is executed
+					async.releaseAdmission()
 					if err = c.enqueueCommand(async); err == nil {
 						enqueued = true
 					}
@@ -336,34 +635,83 @@ func (c *Cluster) execute(async *Async) {
 				}
 			} else {
 				// NB: retry since error occurred
-				logDebug("[Cluster]", "did NOT execute cmd '%s': re-try due to error '%v'", cmd.Name(), err)
+				c.log.debug("did NOT execute command, re-try due to error", "command", cmd.Name(), "attempt", attempt, "err", err)
 			}
 		}
 
-		tries--
-		logDebug("[Cluster]", "cmd %s tries: %d", cmd.Name(), tries)
-
-		if tries > 0 {
-			cmd.onRetry()
-			async.onRetry()
-		} else {
+		retry, delay := false, time.Duration(0)
+		if retryable {
+			retry, delay = policy.Retry(cmd, tries, err)
+		}
+		if !retry {
+			c.log.debug("command will not be re-tried", "command", cmd.Name(), "attempt", attempt)
 			err = newClientError(ErrClusterNoNodesAvailable, err)
+			break
+		}
+
+		if c.observer != nil {
+			c.observer.CommandRetrying(&RetryEvent{
+				Command: cmd,
+				Attempt: attempt,
+				Err:     err,
+			})
+		}
+		cmd.onRetry()
+		if rerr := async.onRetry(delay); rerr != nil {
+			err = rerr
+			break
 		}
 	}
+	if c.shouldJournal(async, err) {
+		err = c.journalCommand(cmd)
+	}
 	if !enqueued {
+		if c.observer != nil {
+			c.observer.CommandCompleted(&CompletedEvent{
+				Command:    cmd,
+				Attempts:   async.attempts,
+				Duration:   time.Since(async.startedAt),
+				Err:        err,
+				ErrorClass: ClassifyError(err),
+			})
+		}
 		async.done(err)
 	}
 }
 
+// track counts the command of async as in flight until it is done, see Shutdown
+func (c *Cluster) track(async *Async) {
+	atomic.AddInt32(&c.inFlight, 1)
+	async.untrack = func() {
+		atomic.AddInt32(&c.inFlight, -1)
+	}
+}
+
+// checkState returns an error if the Cluster can not make an attempt to execute the command of
+// async. NB: while draining, only commands in flight, which have already been attempted, and their
+// hedges are executed
+func (c *Cluster) checkState(async *Async) error {
+	switch st := c.getState(); {
+	case st == clusterRunning, st == clusterDraining && (async.attempts > 1 || async.hedge):
+		return nil
+	case st == clusterDraining, st == clusterShuttingDown:
+		return ErrClusterShuttingDown
+	default:
+		return c.stateCheck(clusterRunning)
+	}
+}
+
 func (c *Cluster) enqueueCommand(async *Async) error {
 	var err error
 	if c.isStateLessThan(clusterShuttingDown) {
 		command := async.Command
-		logDebug("[Cluster]", "enqueuing command '%s'", command.Name())
+		c.log.debug("enqueuing command", "command", command.Name(), "queued", c.cq.count())
 		async.onEnqueued()
 		err = c.cq.enqueue(async)
 		if err != nil {
 			async.done(err)
+		} else if c.observer != nil {
+			c.observer.CommandEnqueued(command, c.cq.count())
 		}
 	} else {
 		err = ErrClusterEnqueueWhileShuttingDown
@@ -373,18 +721,18 @@ func (c *Cluster) enqueueCommand(async *Async) error {
 }
 
 func (c *Cluster) executeEnqueuedCommands() {
-	logDebug("[Cluster]", "(%v) command queue routine is starting", c)
+	c.log.debug("command queue routine is starting")
 	for {
 		select {
 		case <-c.stopChan:
-			logDebug("[Cluster]", "(%v) command queue routine is quitting", c)
+			c.log.debug("command queue routine is quitting")
 			return
 		case t := <-c.commandQueueTicker.C:
 			// NB: ensure we're not already shutting down
 			if c.isStateLessThan(clusterShuttingDown) {
 				var f = func(v interface{}) (bool, bool) {
 					if !c.isStateLessThan(clusterShuttingDown) {
-						logDebug("[Cluster]", "(%v) shutting down, command queue routine is quitting")
+						c.log.debug("shutting down, command queue routine is quitting", "state", c.stateData.String())
 						return true, false
 					}
 					if v == nil {
@@ -392,21 +740,25 @@ func (c *Cluster) executeEnqueuedCommands() {
 					}
 					var re_enqueue bool
 					async := v.(*Async)
-					if t.After(async.executeAt) {
+					if cerr := async.context().Err(); cerr != nil {
+						re_enqueue = false
+						c.log.debug("dropping queued command, context done", "command", async.Command.Name())
+						async.done(newClientError(ErrClusterContextDone, cerr))
+					} else if t.After(async.executeAt) {
 						re_enqueue = false
-						logDebug("[Cluster]", "(%v) executing queued command '%s' at %v", c, async.Command.Name(), t)
+						c.log.debug("executing queued command", "command", async.Command.Name(), "at", t)
 						go c.execute(async) // NB: *may* re-enqueue, so goroutine required
 					} else {
 						re_enqueue = true
-						logDebug("[Cluster]", "(%v) skipping queued command '%s'", c, async.Command.Name())
+						c.log.debug("skipping queued command", "command", async.Command.Name())
 					}
 					return false, re_enqueue
 				}
 				if qerr := c.cq.iterate(f); qerr != nil {
-					logErr("[Cluster]", qerr)
+					c.log.err("error when executing queued commands", qerr)
 				}
 			} else {
-				logDebug("[Cluster]", "(%v) shutting down, command queue routine is quitting")
+				c.log.debug("shutting down, command queue routine is quitting", "state", c.stateData.String())
 				return
 			}
 		}
@@ -1,9 +1,17 @@
 package riak
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/basho/riak-go-client/riaktest"
 )
 
 func TestCreateClusterWithDefaultOptions(t *testing.T) {
@@ -17,7 +25,7 @@ func TestCreateClusterWithDefaultOptions(t *testing.T) {
 	if expected, actual := 1, len(cluster.nodes); expected != actual {
 		t.Errorf("expected %v, got %v", expected, actual)
 	}
-	defaultNodeAddr := cluster.nodes[0].addr.String()
+	defaultNodeAddr := cluster.nodes[0].cm.getAddr().String()
 	if expected, actual := defaultRemoteAddress, defaultNodeAddr; expected != actual {
 		t.Errorf("expected %v, got %v", expected, actual)
 	}
@@ -27,7 +35,7 @@ func TestCreateClusterWithDefaultOptions(t *testing.T) {
 	if cluster.nodeManager == nil {
 		t.Error("expected cluster to have a node manager")
 	}
-	if expected, actual := defaultExecutionAttempts, cluster.executionAttempts; expected != actual {
+	if expected, actual := int(defaultExecutionAttempts), cluster.retryPolicy.(*ExponentialRetryPolicy).maxAttempts; expected != actual {
 		t.Errorf("expected %v, got %v", expected, actual)
 	}
 }
@@ -52,7 +60,7 @@ func TestCreateClusterWithoutDefaultNodeAndStart(t *testing.T) {
 	if cluster.nodeManager == nil {
 		t.Error("expected cluster to have a node manager")
 	}
-	if expected, actual := defaultExecutionAttempts, cluster.executionAttempts; expected != actual {
+	if expected, actual := int(defaultExecutionAttempts), cluster.retryPolicy.(*ExponentialRetryPolicy).maxAttempts; expected != actual {
 		t.Errorf("expected %v, got %v", expected, actual)
 	}
 	err = cluster.Start()
@@ -124,7 +132,7 @@ func TestAddAndRemoveNodeFromCluster(t *testing.T) {
 		if expected, actual := true, n.isCurrentState(nodeCreated); expected != actual {
 			t.Errorf("expected %v, got %v", expected, actual)
 		}
-		if n.addr == addrRemoved {
+		if n.cm.getAddr() == addrRemoved {
 			t.Errorf("node with addr %v should have been removed", addrRemoved)
 		}
 	}
@@ -157,7 +165,7 @@ func TestCreateClusterWithFourNodes(t *testing.T) {
 	for i, node := range cluster.nodes {
 		port := 10007 + ((i + 1) * 10)
 		expectedAddr := fmt.Sprintf("127.0.0.1:%d", port)
-		if expected, actual := expectedAddr, node.addr.String(); expected != actual {
+		if expected, actual := expectedAddr, node.cm.getAddr().String(); expected != actual {
 			t.Errorf("expected %v, got %v", expected, actual)
 		}
 	}
@@ -174,6 +182,285 @@ func ExampleNewCluster() {
 	if err != nil {
 		panic(fmt.Sprintf("Error building cluster object: %s", err.Error()))
 	}
-	fmt.Println(cluster.nodes[0].addr.String())
+	fmt.Println(cluster.nodes[0].cm.getAddr().String())
 	// Output: 127.0.0.1:8087
 }
+
+func TestExecuteContextWithDoneContext(t *testing.T) {
+	cluster, err := NewCluster(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.setState(clusterRunning)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cmd := &PingCommand{}
+	err = cluster.ExecuteContext(ctx, cmd)
+	if err == nil {
+		t.Fatal("expected non-nil error")
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error to wrap context.Canceled, got %v", err)
+	}
+	if expected, actual := false, cmd.Success(); expected != actual {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestAsyncRetryBackoffInterruptedByContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	async := &Async{
+		Command: &PingCommand{},
+		Context: ctx,
+	}
+	async.onExecute()
+	start := time.Now()
+	err := async.onRetry(tenSeconds)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected error to wrap context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= tenSeconds {
+		t.Errorf("expected backoff sleep to be interrupted, took %v", elapsed)
+	}
+}
+
+// newDroppingListener accepts connections and closes each one after reading a single request, as
+// a Riak node that crashes while handling it would. It returns the address and the number of
+// requests read so far
+func newDroppingListener(t *testing.T) (string, func() int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var requests int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				header := make([]byte, 4)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				body := make([]byte, binary.BigEndian.Uint32(header))
+				if _, err := io.ReadFull(conn, body); err != nil {
+					return
+				}
+				atomic.AddInt32(&requests, 1)
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() int32 { return atomic.LoadInt32(&requests) }
+}
+
+func TestClusterDoesNotRetryNonIdempotentCommandWithUnknownOutcome(t *testing.T) {
+	addr, requests := newDroppingListener(t)
+	node, err := NewNode(&NodeOptions{
+		RemoteAddress:  addr,
+		MinConnections: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &recordingRetryPolicy{retries: 2}
+	cluster, err := NewCluster(&ClusterOptions{
+		Nodes:       []*Node{node},
+		RetryPolicy: policy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Stop()
+
+	cmd, err := NewUpdateCounterCommandBuilder().
+		WithBucketType("counters").
+		WithBucket("b").
+		WithKey("k").
+		WithIncrement(1).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Execute(cmd)
+	if !IsOutcomeUnknown(err) {
+		t.Fatalf("expected an OutcomeUnknownError, got %v", err)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected error to wrap io.EOF, got %v", err)
+	}
+	if got := ClassifyError(err); got != ErrorClassOutcomeUnknown {
+		t.Errorf("expected error class %v, got %v", ErrorClassOutcomeUnknown, got)
+	}
+	if len(policy.attempts) != 0 {
+		t.Errorf("expected no retries, got %v", policy.attempts)
+	}
+	if got := requests(); got != 1 {
+		t.Errorf("expected one request, got %d", got)
+	}
+
+	fetch, err := NewFetchValueCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Execute(fetch)
+	if err == nil || IsOutcomeUnknown(err) {
+		t.Fatalf("expected an error other than OutcomeUnknownError, got %v", err)
+	}
+	if len(policy.attempts) != 3 {
+		t.Errorf("expected an idempotent command to be re-tried, got %v", policy.attempts)
+	}
+}
+
+func TestClusterShutdownWaitsForCommandsInFlight(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	cluster, _ := newTestCluster(t, &NodeOptions{HealthCheckInterval: 10 * time.Millisecond}, &ClusterOptions{
+		QueueExecutionInterval: 10 * time.Millisecond,
+	}, srv.Addr())
+	srv.SetLatency(100 * time.Millisecond)
+
+	async := &Async{
+		Command: &PingCommand{},
+		Done:    make(chan Command, 1),
+	}
+	if err := cluster.ExecuteAsync(async); err != nil {
+		t.Fatal(err)
+	}
+	for atomic.LoadInt32(&cluster.inFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- cluster.Shutdown(context.Background())
+	}()
+	for !cluster.isCurrentState(clusterDraining) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := cluster.Execute(&PingCommand{}); err != ErrClusterShuttingDown {
+		t.Errorf("expected new command to be refused, got %v", err)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	<-async.Done
+	if async.Error != nil || !async.Command.Success() {
+		t.Errorf("expected command in flight to complete, got %v", async.Error)
+	}
+	if !cluster.isCurrentState(clusterShutdown) {
+		t.Errorf("expected cluster to be shut down, got %v", cluster.stateData.String())
+	}
+}
+
+func TestClusterShutdownDeadline(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	cluster, _ := newTestCluster(t, &NodeOptions{HealthCheckInterval: 10 * time.Millisecond}, &ClusterOptions{
+		QueueExecutionInterval: 10 * time.Millisecond,
+	}, srv.Addr())
+	srv.SetLatency(200 * time.Millisecond)
+
+	async := &Async{
+		Command: &PingCommand{},
+		Done:    make(chan Command, 1),
+	}
+	if err := cluster.ExecuteAsync(async); err != nil {
+		t.Fatal(err)
+	}
+	for atomic.LoadInt32(&cluster.inFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := cluster.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline error, got %v", err)
+	}
+	if cluster.isCurrentState(clusterRunning) || cluster.isCurrentState(clusterDraining) {
+		t.Errorf("expected cluster to be stopped, got %v", cluster.stateData.String())
+	}
+	<-async.Done
+}
+
+func TestClusterShutdownFlushesQueue(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	addr := srv.Addr()
+	cluster, nodes := newTestCluster(t, &NodeOptions{HealthCheckInterval: 10 * time.Millisecond}, &ClusterOptions{
+		QueueMaxDepth:          4,
+		QueueExecutionInterval: 10 * time.Millisecond,
+	}, addr)
+	node := nodes[0]
+	srv.Stop()
+	// NB: a failed ping has the node health checked, so that commands are queued
+	cluster.Execute(&PingCommand{})
+	for node.isCurrentState(nodeRunning) {
+		time.Sleep(time.Millisecond)
+	}
+
+	async := &Async{
+		Command: &PingCommand{},
+		Done:    make(chan Command, 1),
+	}
+	// NB: returns once the command is queued
+	cluster.execute(async)
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- cluster.Shutdown(context.Background())
+	}()
+	srv, err := riaktest.NewServer(&riaktest.ServerOptions{Address: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	if err = <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	<-async.Done
+	if async.Error != nil {
+		t.Errorf("expected queued command to be executed, got %v", async.Error)
+	}
+}
+
+func TestClusterShutdownFailsQueuedCommands(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	cluster, nodes := newTestCluster(t, &NodeOptions{HealthCheckInterval: 10 * time.Millisecond}, &ClusterOptions{
+		QueueMaxDepth:          4,
+		QueueExecutionInterval: 10 * time.Millisecond,
+	}, srv.Addr())
+	node := nodes[0]
+	srv.Stop()
+	cluster.Execute(&PingCommand{})
+	for node.isCurrentState(nodeRunning) {
+		time.Sleep(time.Millisecond)
+	}
+
+	async := &Async{
+		Command: &PingCommand{},
+		Done:    make(chan Command, 1),
+	}
+	// NB: returns once the command is queued
+	cluster.execute(async)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := cluster.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline error, got %v", err)
+	}
+	<-async.Done
+	if async.Error != ErrClusterShuttingDown {
+		t.Errorf("expected queued command to fail with ErrClusterShuttingDown, got %v", async.Error)
+	}
+}
@@ -0,0 +1,45 @@
+/*
+Package snappy provides a Snappy riak.Codec, to compress values with riak.CompressionOptions:
+
+	import "github.com/basho/riak-go-client/codecs/snappy"
+
+	options := &riak.ClusterOptions{
+		Compression: &riak.CompressionOptions{Codec: snappy.Codec},
+	}
+
+Values are compressed in the Snappy block format, not the framed stream format. The package is
+kept out of package riak so that the client does not depend on a Snappy library
+*/
+package snappy
+
+import (
+	riak "github.com/basho/riak-go-client"
+	gsnappy "github.com/golang/snappy"
+)
+
+// Name is the ContentEncoding of values compressed by Codec
+const Name = "snappy"
+
+// Codec compresses values with Snappy
+var Codec riak.Codec = codec{}
+
+type codec struct{}
+
+func (codec) Name() string {
+	return Name
+}
+
+func (codec) Compress(value []byte) ([]byte, error) {
+	return gsnappy.Encode(nil, value), nil
+}
+
+func (codec) Decompress(value []byte, maxSize int) ([]byte, error) {
+	n, err := gsnappy.DecodedLen(value)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSize {
+		return nil, riak.ErrDecompressedValueTooLarge
+	}
+	return gsnappy.Decode(nil, value)
+}
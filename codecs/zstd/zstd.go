@@ -0,0 +1,82 @@
+/*
+Package zstd provides a Zstandard riak.Codec, to compress values with riak.CompressionOptions:
+
+	import "github.com/basho/riak-go-client/codecs/zstd"
+
+	options := &riak.ClusterOptions{
+		Compression: &riak.CompressionOptions{Codec: zstd.Codec},
+	}
+
+It is kept out of package riak so that the client does not depend on a Zstandard library
+*/
+package zstd
+
+import (
+	"errors"
+	"sync"
+
+	riak "github.com/basho/riak-go-client"
+	kzstd "github.com/klauspost/compress/zstd"
+)
+
+// Name is the ContentEncoding of values compressed by Codec
+const Name = "zstd"
+
+// Codec compresses values with Zstandard
+var Codec riak.Codec = &codec{}
+
+// codec creates its encoder when first used, and a decoder for each maximum size. Both are safe for
+// concurrent use with EncodeAll and DecodeAll
+type codec struct {
+	once     sync.Once
+	encoder  *kzstd.Encoder
+	err      error
+	decoders sync.Map // NB: *kzstd.Decoder by maximum size, see kzstd.WithDecoderMaxMemory
+}
+
+func (c *codec) init() error {
+	c.once.Do(func() {
+		c.encoder, c.err = kzstd.NewWriter(nil)
+	})
+	return c.err
+}
+
+// decoder returns a decoder failing with kzstd.ErrDecoderSizeExceeded, or ErrWindowSizeExceeded,
+// for values larger than maxSize once decompressed. NB: the maximum size is usually the same for every value
+func (c *codec) decoder(maxSize int) (*kzstd.Decoder, error) {
+	if d, ok := c.decoders.Load(maxSize); ok {
+		return d.(*kzstd.Decoder), nil
+	}
+	d, err := kzstd.NewReader(nil, kzstd.WithDecoderMaxMemory(uint64(maxSize)))
+	if err != nil {
+		return nil, err
+	}
+	if actual, loaded := c.decoders.LoadOrStore(maxSize, d); loaded {
+		d.Close()
+		return actual.(*kzstd.Decoder), nil
+	}
+	return d, nil
+}
+
+func (c *codec) Name() string {
+	return Name
+}
+
+func (c *codec) Compress(value []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.encoder.EncodeAll(value, nil), nil
+}
+
+func (c *codec) Decompress(value []byte, maxSize int) ([]byte, error) {
+	d, err := c.decoder(maxSize)
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := d.DecodeAll(value, nil)
+	if errors.Is(err, kzstd.ErrDecoderSizeExceeded) || errors.Is(err, kzstd.ErrWindowSizeExceeded) {
+		return nil, riak.ErrDecompressedValueTooLarge
+	}
+	return decompressed, err
+}
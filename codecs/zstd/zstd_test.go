@@ -0,0 +1,105 @@
+package zstd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	riak "github.com/basho/riak-go-client"
+	"github.com/basho/riak-go-client/riaktest"
+)
+
+var value = []byte(strings.Repeat("riak-go-client compression ", 100))
+
+func TestCodec(t *testing.T) {
+	compressed, err := Codec.Compress(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(value) {
+		t.Errorf("expected value to be compressed, %d bytes", len(compressed))
+	}
+	decompressed, err := Codec.Decompress(compressed, len(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, value) {
+		t.Error("decompressed value differs")
+	}
+	if _, err = Codec.Decompress([]byte("not compressed"), len(value)); err == nil {
+		t.Error("expected an error decompressing an invalid value")
+	}
+}
+
+func TestCodecMaxSize(t *testing.T) {
+	// NB: a few KB that inflate to 16 MB
+	compressed, err := Codec.Compress(make([]byte, 16*1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Codec.Decompress(compressed, 1024*1024); err != riak.ErrDecompressedValueTooLarge {
+		t.Errorf("expected ErrDecompressedValueTooLarge, got %v", err)
+	}
+	if _, err = Codec.Decompress(compressed, 16*1024*1024); err != nil {
+		t.Errorf("expected the value to be decompressed, got %v", err)
+	}
+}
+
+func newCluster(t *testing.T, addr string, compression *riak.CompressionOptions) *riak.Cluster {
+	node, err := riak.NewNode(&riak.NodeOptions{RemoteAddress: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := riak.NewCluster(&riak.ClusterOptions{
+		Nodes:       []*riak.Node{node},
+		Compression: compression,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cluster.Stop() })
+	return cluster
+}
+
+func fetch(t *testing.T, cluster *riak.Cluster) *riak.Object {
+	cmd, err := riak.NewFetchValueCommandBuilder().WithBucket("b").WithKey("k").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(cmd); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.(*riak.FetchValueCommand).Response.Values[0]
+}
+
+func TestStoreAndFetch(t *testing.T) {
+	srv, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	plain := newCluster(t, srv.Addr(), nil)
+	cluster := newCluster(t, srv.Addr(), &riak.CompressionOptions{Codec: Codec})
+
+	store, err := riak.NewStoreValueCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		WithContent(&riak.Object{Value: value}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(store); err != nil {
+		t.Fatal(err)
+	}
+
+	if o := fetch(t, plain); o.ContentEncoding != Name || len(o.Value) >= len(value) {
+		t.Errorf("expected a value compressed with %s, got ContentEncoding %q", Name, o.ContentEncoding)
+	}
+	if o := fetch(t, cluster); o.ContentEncoding != "" || !bytes.Equal(o.Value, value) {
+		t.Errorf("expected the value to be decompressed, got ContentEncoding %q", o.ContentEncoding)
+	}
+}
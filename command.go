@@ -1,7 +1,7 @@
 package riak
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"sync/atomic"
@@ -19,26 +19,55 @@ type retryableCommand interface {
 	getLastNode() *Node
 }
 
+// Interface implemented by Command types that are not always idempotent, that is executing them
+// more than once may not have the same effect as executing them once. Commands that do not
+// implement it are idempotent
+type idempotentCommand interface {
+	isIdempotent() bool
+}
+
+func isIdempotent(cmd Command) bool {
+	if ic, ok := cmd.(idempotentCommand); ok {
+		return ic.isIdempotent()
+	}
+	return true
+}
+
 // Implementation of retryableCommand
 type retryableCommandImpl struct {
-	lastNode *Node
+	lastNode atomic.Value // NB: *Node, read by a hedged execution while the command executes
 }
 
 func (cmd *retryableCommandImpl) setLastNode(lastNode *Node) {
 	if lastNode == nil {
 		panic("[retryableCommandImpl] nil last node")
 	}
-	cmd.lastNode = lastNode
+	cmd.lastNode.Store(lastNode)
 }
 
 func (cmd *retryableCommandImpl) getLastNode() *Node {
-	return cmd.lastNode
+	n, _ := cmd.lastNode.Load().(*Node)
+	return n
+}
+
+// Interface implemented by read-only Command types that can be hedged, see HedgingOptions
+type hedgeableCommand interface {
+	Command
+	// cloneCommand returns a new command with a copy of the request and no response, or nil if
+	// this command can not be hedged
+	cloneCommand() hedgeableCommand
+	// adopt takes the response and result of clone, which was returned by cloneCommand
+	adopt(clone hedgeableCommand)
 }
 
 type commandImpl struct {
 	error   error
 	success bool
 	name    string
+	ctx     context.Context
+	attempt int
+	policy  RetryPolicy
+	written bool
 }
 
 func (cmd *commandImpl) Success() bool {
@@ -58,6 +87,56 @@ func (cmd *commandImpl) onRetry() {
 	cmd.error = nil
 }
 
+// adoptResult takes the result of a clone of this command, see hedgeableCommand
+func (cmd *commandImpl) adoptResult(clone *commandImpl) {
+	cmd.success = clone.success
+	cmd.error = clone.error
+	cmd.attempt = clone.attempt
+	cmd.written = clone.written
+}
+
+func (cmd *commandImpl) setContext(ctx context.Context) {
+	cmd.ctx = ctx
+}
+
+func (cmd *commandImpl) setAttempt(attempt int) {
+	cmd.attempt = attempt
+}
+
+// getAttempt returns the number of the Cluster's current attempt to execute the command, starting
+// at 1, or 0 if it is not being executed by a Cluster
+func (cmd *commandImpl) getAttempt() int {
+	return cmd.attempt
+}
+
+func (cmd *commandImpl) setRetryPolicy(policy RetryPolicy) {
+	cmd.policy = policy
+}
+
+// getRetryPolicy returns the RetryPolicy set with WithRetryPolicy, or nil if the Cluster's is used
+func (cmd *commandImpl) getRetryPolicy() RetryPolicy {
+	return cmd.policy
+}
+
+func (cmd *commandImpl) setRequestWritten(written bool) {
+	cmd.written = written
+}
+
+// getRequestWritten returns true if any of the request of the last attempt to execute the command
+// was written to Riak
+func (cmd *commandImpl) getRequestWritten() bool {
+	return cmd.written
+}
+
+// getContext returns the context the command is executing under, or
+// context.Background() if none has been set
+func (cmd *commandImpl) getContext() context.Context {
+	if cmd.ctx == nil {
+		return context.Background()
+	}
+	return cmd.ctx
+}
+
 func (cmd *commandImpl) getName(n string) string {
 	if n == "" {
 		panic("getName: n must not be empty")
@@ -104,33 +183,32 @@ type Command interface {
 	constructPbRequest() (proto.Message, error)
 	onRetry()
 	onError(error)
+	setContext(context.Context)
+	getContext() context.Context
+	setAttempt(int)
+	getAttempt() int
+	setRetryPolicy(RetryPolicy)
+	getRetryPolicy() RetryPolicy
+	setRequestWritten(bool)
+	getRequestWritten() bool
 	onSuccess(proto.Message) error // NB: important for streaming commands to "do the right thing" here
 	getResponseCode() byte
 	getResponseProtobufMessage() proto.Message
 }
 
-func getRiakMessage(cmd Command) (msg []byte, err error) {
+// getRiakMessage returns the framed request message of cmd in a pooled buffer, which should be
+// returned to the pool with buffers.put once it is written
+func getRiakMessage(cmd Command) (*[]byte, error) {
 	requestCode := cmd.getRequestCode()
 	if requestCode == 0 {
 		panic(fmt.Sprintf("Must have non-zero value for getRequestCode(): %s", cmd.Name()))
 	}
 
-	var rpb proto.Message
-	rpb, err = cmd.constructPbRequest()
+	rpb, err := cmd.constructPbRequest()
 	if err != nil {
-		return
-	}
-
-	var bytes []byte
-	if rpb != nil {
-		bytes, err = proto.Marshal(rpb)
-		if err != nil {
-			return nil, err
-		}
+		return nil, err
 	}
-
-	msg = buildRiakMessage(requestCode, bytes)
-	return
+	return appendRiakMessage(requestCode, rpb)
 }
 
 func decodeRiakMessage(cmd Command, data []byte) (msg proto.Message, err error) {
@@ -155,12 +233,12 @@ func decodeRiakMessage(cmd Command, data []byte) (msg proto.Message, err error)
 }
 
 func buildRiakMessage(code byte, data []byte) []byte {
-	buf := new(bytes.Buffer)
+	msg := make([]byte, frameHeaderLength+len(data))
 	// write total message length, including one byte for msg code
-	binary.Write(buf, binary.BigEndian, uint32(len(data)+1))
+	binary.BigEndian.PutUint32(msg, uint32(len(data)+1))
 	// write the message code
-	binary.Write(buf, binary.BigEndian, byte(code))
+	msg[4] = code
 	// write the protobuf data
-	buf.Write(data)
-	return buf.Bytes()
+	copy(msg[frameHeaderLength:], data)
+	return msg
 }
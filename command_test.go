@@ -65,3 +65,40 @@ func TestEnqueueDequeueCommandsConcurrently(t *testing.T) {
 		t.Error("expected non-nil err")
 	}
 }
+
+func TestCommandIdempotency(t *testing.T) {
+	build := func(builder CommandBuilder) Command {
+		cmd, err := builder.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cmd
+	}
+	for _, tc := range []struct {
+		name string
+		cmd  Command
+		want bool
+	}{
+		{"fetch", build(NewFetchValueCommandBuilder().WithBucket("b").WithKey("k")), true},
+		{"store without vclock", build(NewStoreValueCommandBuilder().WithBucket("b").WithKey("k").
+			WithContent(&Object{Value: []byte("v")})), false},
+		{"store with vclock", build(NewStoreValueCommandBuilder().WithBucket("b").WithKey("k").
+			WithContent(&Object{Value: []byte("v"), VClock: []byte("vclock")})), true},
+		{"counter increment", build(NewUpdateCounterCommandBuilder().WithBucketType("counters").WithBucket("b").
+			WithKey("k").WithIncrement(1)), false},
+		{"set add", build(NewUpdateSetCommandBuilder().WithBucketType("sets").WithBucket("b").
+			WithKey("k").WithAdditions([]byte("a"))), true},
+		{"map register", build(NewUpdateMapCommandBuilder().WithBucketType("maps").WithBucket("b").
+			WithKey("k").WithMapOperation((&MapOperation{}).SetRegister("r", []byte("v")))), true},
+		{"nested map counter", build(NewUpdateMapCommandBuilder().WithBucketType("maps").WithBucket("b").
+			WithKey("k").WithMapOperation(func() *MapOperation {
+			op := &MapOperation{}
+			op.Map("m").IncrementCounter("c", 1)
+			return op
+		}())), false},
+	} {
+		if got := isIdempotent(tc.cmd); got != tc.want {
+			t.Errorf("%s: expected idempotent %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package riak
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	rpbRiakKV "github.com/basho/riak-go-client/rpb/riak_kv"
+)
+
+const (
+	defaultCompressionMinSize  = 1024
+	defaultMaxDecompressedSize = 50 * 1024 * 1024
+)
+
+// Codec compresses the values of Objects, see CompressionOptions. Name is set as the
+// ContentEncoding of the values it compresses, e.g. "gzip". A Codec is used by many goroutines at
+// once.
+//
+// Decompress must not allocate much more than maxSize bytes, and fails with
+// ErrDecompressedValueTooLarge if the value is larger than maxSize bytes once decompressed.
+//
+// GzipCodec is built in. Codecs for Zstandard and Snappy are in the codecs/zstd and codecs/snappy
+// subpackages
+type Codec interface {
+	Name() string
+	Compress(value []byte) ([]byte, error)
+	Decompress(value []byte, maxSize int) ([]byte, error)
+}
+
+// GzipCodec compresses values with gzip
+var GzipCodec Codec = gzipCodec{}
+
+// CompressionOptions compresses the values of Objects stored by a Cluster, and decompresses them
+// when they are fetched. See ClusterOptions.Compression.
+//
+// When a StoreValue command is executed, the Value of its Object is compressed with the Codec of
+// its bucket if it is at least MinSize bytes long and has no ContentEncoding, and the stored
+// ContentEncoding is set to the Name of the Codec. The Object itself is not modified. Values that
+// do not get smaller are stored uncompressed.
+//
+// When a FetchValue command, or a StoreValue command that returns the body, is executed, each value
+// whose ContentEncoding is the Name of Codec, of a Codec in Buckets or Codecs, or of GzipCodec is
+// decompressed and its ContentEncoding cleared, so that the Object can be stored again.
+// Each sibling is decompressed on its own, and other values, such as those stored before
+// compression was enabled, are returned as they are. A value larger than MaxDecompressedSize once
+// decompressed fails the command with a CodecError, rather than a few compressed bytes costing
+// gigabytes of memory
+type CompressionOptions struct {
+	Codec   Codec // NB: nil to store values uncompressed, except in Buckets
+	MinSize int   // NB: in bytes, defaults to 1024
+	// MaxDecompressedSize is the size in bytes values may be decompressed to. Defaults to 50 MiB,
+	// Riak's default maximum object size
+	MaxDecompressedSize int
+	// Buckets overrides Codec and MinSize for buckets, keyed by "bucketType/bucket", or by "bucket"
+	// for the bucket of that name of any type
+	Buckets map[string]*BucketCompression
+	// Codecs are further Codecs to decompress values with, for instance ones no longer used to
+	// store values
+	Codecs []Codec
+}
+
+// BucketCompression overrides CompressionOptions for a bucket
+type BucketCompression struct {
+	Codec   Codec // NB: nil to store values in the bucket uncompressed
+	MinSize int   // NB: defaults to CompressionOptions.MinSize
+}
+
+// compressedCommand is implemented by commands whose values are compressed or decompressed
+type compressedCommand interface {
+	setCompression(c *compression)
+}
+
+// compression compresses and decompresses values as configured by CompressionOptions
+type compression struct {
+	codec   Codec
+	minSize int
+	maxSize int // NB: of decompressed values
+	buckets map[string]*BucketCompression
+	codecs  map[string]Codec // NB: by Name, the Codecs values are decompressed with
+}
+
+func newCompression(options *CompressionOptions) *compression {
+	c := &compression{
+		codec:   options.Codec,
+		minSize: options.MinSize,
+		maxSize: options.MaxDecompressedSize,
+		buckets: options.Buckets,
+		codecs:  make(map[string]Codec),
+	}
+	if c.minSize <= 0 {
+		c.minSize = defaultCompressionMinSize
+	}
+	if c.maxSize <= 0 {
+		c.maxSize = defaultMaxDecompressedSize
+	}
+	c.codecs[GzipCodec.Name()] = GzipCodec
+	for _, codec := range options.Codecs {
+		if codec != nil {
+			c.codecs[codec.Name()] = codec
+		}
+	}
+	for _, b := range options.Buckets {
+		if b != nil && b.Codec != nil {
+			c.codecs[b.Codec.Name()] = b.Codec
+		}
+	}
+	if c.codec != nil {
+		c.codecs[c.codec.Name()] = c.codec
+	}
+	return c
+}
+
+// codecFor returns the Codec values stored in bucket are compressed with, or nil, and the minimum
+// size of the values it compresses
+func (c *compression) codecFor(bucketType, bucket string) (Codec, int) {
+	if bucketType == "" {
+		bucketType = defaultBucketType
+	}
+	b, ok := c.buckets[bucketType+"/"+bucket]
+	if !ok {
+		b, ok = c.buckets[bucket]
+	}
+	if !ok || b == nil {
+		return c.codec, c.minSize
+	}
+	if b.MinSize > 0 {
+		return b.Codec, b.MinSize
+	}
+	return b.Codec, c.minSize
+}
+
+// compress compresses the value of content, to be stored in bucket
+func (c *compression) compress(bucketType, bucket string, content *rpbRiakKV.RpbContent) error {
+	if c == nil || content == nil || len(content.ContentEncoding) > 0 {
+		return nil
+	}
+	codec, minSize := c.codecFor(bucketType, bucket)
+	if codec == nil || len(content.Value) < minSize {
+		return nil
+	}
+	compressed, err := codec.Compress(content.Value)
+	if err != nil {
+		return newClientError(errCodecCompress, CodecError{Codec: codec.Name(), InnerError: err})
+	}
+	if len(compressed) >= len(content.Value) {
+		return nil
+	}
+	content.Value = compressed
+	content.ContentEncoding = []byte(codec.Name())
+	return nil
+}
+
+// decompress decompresses the value of ro if its ContentEncoding is the Name of a known Codec
+func (c *compression) decompress(ro *Object) error {
+	if c == nil || ro.IsTombstone || ro.ContentEncoding == "" {
+		return nil
+	}
+	codec, ok := c.codecs[ro.ContentEncoding]
+	if !ok {
+		return nil
+	}
+	value, err := codec.Decompress(ro.Value, c.maxSize)
+	if err != nil {
+		return newClientError(errCodecDecompress, CodecError{Codec: codec.Name(), InnerError: err})
+	}
+	ro.Value = value
+	ro.ContentEncoding = ""
+	return nil
+}
+
+type gzipCodec struct{}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) Compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(value []byte, maxSize int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	decompressed, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > maxSize {
+		return nil, ErrDecompressedValueTooLarge
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,256 @@
+package riak
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+var compressibleValue = []byte(strings.Repeat("riak-go-client compression ", 100))
+
+// incompressibleValue returns size random bytes, which do not get smaller when compressed
+func incompressibleValue(size int) []byte {
+	value := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(value)
+	return value
+}
+
+// renamedCodec is GzipCodec under another name. NB: the codecs subpackages import this package,
+// so can not be used in its tests
+type renamedCodec struct {
+	name string
+}
+
+func (c renamedCodec) Name() string {
+	return c.name
+}
+
+func (c renamedCodec) Compress(value []byte) ([]byte, error) {
+	return GzipCodec.Compress(value)
+}
+
+func (c renamedCodec) Decompress(value []byte, maxSize int) ([]byte, error) {
+	return GzipCodec.Decompress(value, maxSize)
+}
+
+var (
+	testCodecA Codec = renamedCodec{name: "x-test-a"}
+	testCodecB Codec = renamedCodec{name: "x-test-b"}
+)
+
+func storeTestValue(t *testing.T, cluster *Cluster, object *Object) {
+	cmd, err := NewStoreValueCommandBuilder().WithContent(object).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(cmd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fetchTestValues(t *testing.T, cluster *Cluster, bucketType, bucket, key string) ([]*Object, error) {
+	cmd, err := NewFetchValueCommandBuilder().
+		WithBucketType(bucketType).
+		WithBucket(bucket).
+		WithKey(key).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(cmd); err != nil {
+		return nil, err
+	}
+	return cmd.(*FetchValueCommand).Response.Values, nil
+}
+
+func TestCodecs(t *testing.T) {
+	for _, codec := range []Codec{GzipCodec} {
+		compressed, err := codec.Compress(compressibleValue)
+		if err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+		if len(compressed) >= len(compressibleValue) {
+			t.Errorf("%s: expected value to be compressed, %d bytes", codec.Name(), len(compressed))
+		}
+		value, err := codec.Decompress(compressed, len(compressibleValue))
+		if err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+		if !bytes.Equal(value, compressibleValue) {
+			t.Errorf("%s: decompressed value differs", codec.Name())
+		}
+		if _, err = codec.Decompress(compressed, len(compressibleValue)-1); err != ErrDecompressedValueTooLarge {
+			t.Errorf("%s: expected ErrDecompressedValueTooLarge, got %v", codec.Name(), err)
+		}
+		if _, err = codec.Decompress([]byte("not compressed"), len(compressibleValue)); err == nil {
+			t.Errorf("%s: expected an error decompressing an invalid value", codec.Name())
+		}
+	}
+}
+
+func TestCompressionStoreAndFetch(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	plain, _ := newTestCluster(t, nil, nil, srv.Addr())
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{
+		Compression: &CompressionOptions{
+			Codec:   testCodecA,
+			MinSize: 64,
+			Buckets: map[string]*BucketCompression{
+				"default/other": {Codec: testCodecB},
+				"plain":         {},
+				"large":         {Codec: GzipCodec, MinSize: 4096},
+			},
+		},
+	}, srv.Addr())
+
+	for _, tc := range []struct {
+		bucket, key string
+		value       []byte
+		encoding    string
+	}{
+		{"b", "large", compressibleValue, "x-test-a"},
+		{"b", "small", []byte("small"), ""},
+		{"b", "incompressible", incompressibleValue(256), ""},
+		{"other", "k", compressibleValue, "x-test-b"},
+		{"plain", "k", compressibleValue, ""},
+		{"large", "k", compressibleValue, ""},
+	} {
+		object := &Object{Bucket: tc.bucket, Key: tc.key, Value: tc.value}
+		storeTestValue(t, cluster, object)
+		if object.ContentEncoding != "" || !bytes.Equal(object.Value, tc.value) {
+			t.Errorf("%s/%s: expected the stored Object not to be modified", tc.bucket, tc.key)
+		}
+
+		values, err := fetchTestValues(t, plain, "", tc.bucket, tc.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := values[0].ContentEncoding; got != tc.encoding {
+			t.Errorf("%s/%s: expected ContentEncoding %q, got %q", tc.bucket, tc.key, tc.encoding, got)
+		}
+
+		values, err = fetchTestValues(t, cluster, "", tc.bucket, tc.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if values[0].ContentEncoding != "" || !bytes.Equal(values[0].Value, tc.value) {
+			t.Errorf("%s/%s: expected the value to be decompressed", tc.bucket, tc.key)
+		}
+	}
+}
+
+func TestCompressionKeepsContentEncoding(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{
+		Compression: &CompressionOptions{Codec: GzipCodec, MinSize: 1},
+	}, srv.Addr())
+	object := &Object{Bucket: "b", Key: "k", Value: compressibleValue, ContentEncoding: "utf-8"}
+	storeTestValue(t, cluster, object)
+	values, err := fetchTestValues(t, cluster, "", "b", "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0].ContentEncoding != "utf-8" || !bytes.Equal(values[0].Value, compressibleValue) {
+		t.Errorf("expected the value to be stored as it is, got ContentEncoding %q", values[0].ContentEncoding)
+	}
+}
+
+func TestCompressionDecodesSiblingsIndependently(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	plain, _ := newTestCluster(t, nil, nil, srv.Addr())
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{
+		Compression: &CompressionOptions{
+			Codec:   GzipCodec,
+			MinSize: 1,
+			Codecs:  []Codec{testCodecA},
+		},
+	}, srv.Addr())
+
+	// NB: siblings stored before compression was enabled, compressed, and compressed by another codec
+	storeTestValue(t, plain, &Object{BucketType: "siblings", Bucket: "b", Key: "k", Value: compressibleValue})
+	storeTestValue(t, cluster, &Object{BucketType: "siblings", Bucket: "b", Key: "k", Value: compressibleValue})
+	compressed, err := testCodecA.Compress(compressibleValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeTestValue(t, plain, &Object{BucketType: "siblings", Bucket: "b", Key: "k", Value: compressed, ContentEncoding: "x-test-a"})
+
+	values, err := fetchTestValues(t, plain, "siblings", "b", "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encodings []string
+	for _, v := range values {
+		encodings = append(encodings, v.ContentEncoding)
+	}
+	if got := strings.Join(encodings, ","); got != ",gzip,x-test-a" {
+		t.Fatalf("expected siblings with ContentEncodings \",gzip,x-test-a\", got %q", got)
+	}
+
+	values, err = fetchTestValues(t, cluster, "siblings", "b", "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 {
+		t.Fatalf("expected 3 siblings, got %d", len(values))
+	}
+	for i, v := range values {
+		if v.ContentEncoding != "" || !bytes.Equal(v.Value, compressibleValue) {
+			t.Errorf("expected sibling %d to be decompressed, got ContentEncoding %q", i, v.ContentEncoding)
+		}
+	}
+}
+
+func TestCompressionInvalidValue(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	plain, _ := newTestCluster(t, nil, nil, srv.Addr())
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{
+		Compression: &CompressionOptions{Codec: GzipCodec},
+	}, srv.Addr())
+	storeTestValue(t, plain, &Object{Bucket: "b", Key: "k", Value: []byte("not compressed"), ContentEncoding: "gzip"})
+
+	_, err := fetchTestValues(t, cluster, "", "b", "k")
+	var codecErr CodecError
+	if !errors.As(err, &codecErr) || codecErr.Codec != "gzip" {
+		t.Fatalf("expected CodecError for gzip, got %v", err)
+	}
+
+	// NB: without compression, values are returned as they are
+	values, err := fetchTestValues(t, plain, "", "b", "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0].ContentEncoding != "gzip" {
+		t.Errorf("expected ContentEncoding gzip, got %q", values[0].ContentEncoding)
+	}
+
+	// NB: nor are values of unknown codecs
+	storeTestValue(t, plain, &Object{Bucket: "b", Key: "unknown", Value: []byte("?"), ContentEncoding: "x-unknown"})
+	values, err = fetchTestValues(t, cluster, "", "b", "unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0].ContentEncoding != "x-unknown" || string(values[0].Value) != "?" {
+		t.Errorf("expected the value to be returned as it is, got ContentEncoding %q", values[0].ContentEncoding)
+	}
+}
+
+func TestCompressionMaxDecompressedSize(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{
+		Compression: &CompressionOptions{
+			Codec:               GzipCodec,
+			MaxDecompressedSize: 1024,
+		},
+	}, srv.Addr())
+	// NB: a few KB that inflate to 1 MB
+	storeTestValue(t, cluster, &Object{Bucket: "b", Key: "k", Value: make([]byte, 1024*1024)})
+
+	_, err := fetchTestValues(t, cluster, "", "b", "k")
+	var codecErr CodecError
+	if !errors.Is(err, ErrDecompressedValueTooLarge) || !errors.As(err, &codecErr) || codecErr.Codec != "gzip" {
+		t.Fatalf("expected CodecError wrapping ErrDecompressedValueTooLarge, got %v", err)
+	}
+}
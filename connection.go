@@ -1,6 +1,7 @@
 package riak
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"errors"
@@ -19,11 +20,26 @@ var (
 	ErrCannotWrite = errors.New("Cannot write to a non-active or closed connection")
 )
 
-// AuthOptions object contains the authentication credentials and tls config
+const ErrConnectionContextDone = "[Connection] context done before response was received"
+
+// aLongTimeAgo is used as a deadline to immediately abort blocked reads and writes
+var aLongTimeAgo = time.Unix(1, 0)
+
+// AuthOptions object contains the authentication credentials and tls config. Connections are
+// upgraded to TLS with TlsConfig, then authenticated as User.
+//
+// With a password security source, set User and Password. With a certificate source, Riak
+// authenticates the user by the common name (CN) of the client certificate, so set
+// TlsConfig.Certificates and leave Password empty. User then defaults to the common name of the
+// first certificate.
+//
+// For credentials that rotate, set CredentialProvider instead of User and Password. It is consulted
+// each time a connection is opened, see CredentialProvider
 type AuthOptions struct {
-	User      string
-	Password  string
-	TlsConfig *tls.Config
+	User               string // NB: optional when TlsConfig.Certificates holds a client certificate
+	Password           string // NB: optional for certificate and trust sources
+	TlsConfig          *tls.Config
+	CredentialProvider CredentialProvider // NB: if set, User and Password are ignored
 }
 
 type connectionOptions struct {
@@ -32,6 +48,8 @@ type connectionOptions struct {
 	requestTimeout      time.Duration
 	authOptions         *AuthOptions
 	tempNetErrorRetries uint16
+	maxResponseSize     int // NB: 0 for no limit
+	logger              Logger
 }
 
 const (
@@ -47,12 +65,18 @@ type connection struct {
 	connectTimeout      time.Duration
 	requestTimeout      time.Duration
 	tempNetErrorRetries uint16
+	maxResponseSize     int
 	authOptions         *AuthOptions
 	sizeBuf             []byte
-	dataBuf             []byte
+	dataBuf             []byte  // NB: responses that fit are read into this, see readBuffer
+	largeBuf            *[]byte // NB: the pooled buffer the last response that did not fit was read into
 	active              bool
 	inFlight            bool
 	lastUsed            time.Time
+	expiresAt           time.Time // NB: zero if the connection does not expire, see NodeOptions.MaxConnectionAge
+	bytesWritten        int       // NB: by the last call to execute
+	bytesRead           int       // NB: by the last call to execute
+	log                 *componentLogger
 	stateData
 }
 
@@ -77,11 +101,13 @@ func newConnection(options *connectionOptions) (*connection, error) {
 		connectTimeout:      options.connectTimeout,
 		requestTimeout:      options.requestTimeout,
 		tempNetErrorRetries: options.tempNetErrorRetries,
+		maxResponseSize:     options.maxResponseSize,
 		authOptions:         options.authOptions,
 		sizeBuf:             make([]byte, 4),
 		dataBuf:             make([]byte, defaultInitBuffer),
 		inFlight:            false,
 		lastUsed:            time.Now(),
+		log:                 newComponentLogger(options.logger, "component", "Connection", "node", options.remoteAddress),
 	}
 	c.initStateData("connCreated", "connTlsStarting", "connActive", "connInactive")
 	c.setState(connCreated)
@@ -89,51 +115,107 @@ func newConnection(options *connectionOptions) (*connection, error) {
 }
 
 func (c *connection) connect() (err error) {
+	if err = c.dial(); err != nil {
+		return
+	}
+	err = c.startTls(false)
+	if IsAuthError(err) && c.authOptions.CredentialProvider != nil {
+		// NB: the credentials may have rotated since the CredentialProvider cached them
+		c.log.warn("authentication failed, refreshing credentials", "err", err)
+		c.close()
+		if err = c.dial(); err == nil {
+			err = c.startTls(true)
+		}
+	}
+	if err != nil {
+		c.close()
+		c.setState(connInactive)
+		return
+	}
+	c.setState(connActive)
+	return
+}
+
+func (c *connection) dial() (err error) {
 	dialer := &net.Dialer{
 		Timeout:   c.connectTimeout,
 		KeepAlive: time.Second * 30,
 	}
 	c.conn, err = dialer.Dial("tcp", c.addr.String()) // NB: SetNoDelay() is true by default for TCP connections
 	if err != nil {
-		logError("[Connection]", "error when dialing %s: '%s'", c.addr.String(), err.Error())
+		c.log.err("error when dialing", err, "connectTimeout", c.connectTimeout)
 		c.close()
 	} else {
-		logDebug("[Connection]", "connected to: %s", c.addr)
-		if err = c.startTls(); err != nil {
-			c.close()
-			c.setState(connInactive)
-			return
-		}
-		c.setState(connActive)
+		c.log.debug("connected", "local", c.conn.LocalAddr())
 	}
 	return
 }
 
-func (c *connection) startTls() error {
+// startTls upgrades the connection to TLS and authenticates, if there are AuthOptions. refresh is
+// passed on to the CredentialProvider, if any
+func (c *connection) startTls(refresh bool) error {
 	if c.authOptions == nil {
 		return nil
 	}
-	if c.authOptions.TlsConfig == nil {
-		return ErrAuthMissingConfig
+	ctx, cancel := context.WithTimeout(context.Background(), c.connectTimeout)
+	defer cancel()
+	creds, tlsConfig, err := c.authOptions.credentials(ctx, refresh)
+	if err != nil {
+		return err
 	}
 	c.setState(connTlsStarting)
 	startTlsCmd := &startTlsCommand{}
-	if err := c.execute(startTlsCmd); err != nil {
+	if err = c.execute(startTlsCmd); err != nil {
+		var riakErr RiakError
+		if errors.As(err, &riakErr) {
+			// NB: e.g. security is not enabled on the node
+			return TLSError{InnerError: err}
+		}
 		return err
 	}
 	var tlsConn *tls.Conn
-	if tlsConn = tls.Client(c.conn, c.authOptions.TlsConfig); tlsConn == nil {
+	if tlsConn = tls.Client(c.conn, tlsConfig); tlsConn == nil {
 		return ErrAuthTLSUpgradeFailed
 	}
-	if err := tlsConn.Handshake(); err != nil {
+	// NB: the handshake is part of connecting, so it must complete within the connect timeout
+	if err = c.conn.SetDeadline(time.Now().Add(c.connectTimeout)); err != nil {
+		return err
+	}
+	if err = tlsConn.Handshake(); err != nil {
+		c.log.err("error when upgrading to TLS", err)
+		return TLSError{InnerError: err}
+	}
+	if err = c.conn.SetDeadline(time.Time{}); err != nil {
 		return err
 	}
 	c.conn = tlsConn
 	authCmd := &authCommand{
-		user:     c.authOptions.User,
-		password: c.authOptions.Password,
+		user:     creds.User,
+		password: creds.Password,
 	}
-	return c.execute(authCmd)
+	if err = c.execute(authCmd); err != nil {
+		var riakErr RiakError
+		if errors.As(err, &riakErr) {
+			return AuthError{User: creds.User, InnerError: err}
+		}
+		if isTLSAlert(err) {
+			// NB: with TLS 1.3, Riak rejects the client certificate after the handshake completes
+			return TLSError{InnerError: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// isTLSAlert returns true if err is a TLS alert sent by the remote end of the connection
+func isTLSAlert(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error"
+}
+
+// isExpired returns true if the connection has reached its maximum age at now
+func (c *connection) isExpired(now time.Time) bool {
+	return !c.expiresAt.IsZero() && !now.Before(c.expiresAt)
 }
 
 func (c *connection) available() bool {
@@ -162,12 +244,30 @@ func (c *connection) execute(cmd Command) (err error) {
 	c.setInFlight(true)
 	defer c.setInFlight(false)
 	c.lastUsed = time.Now()
+	c.bytesWritten, c.bytesRead = 0, 0
+	cmd.setRequestWritten(false)
+
+	ctx := cmd.getContext()
+	if cerr := ctx.Err(); cerr != nil {
+		err = newClientError(ErrConnectionContextDone, cerr)
+		cmd.onError(err)
+		return
+	}
 
-	var message []byte
+	var message *[]byte
 	message, err = getRiakMessage(cmd)
 	if err != nil {
 		return
 	}
+	defer c.releaseLargeBuf()
+	if size := len(*message) - frameHeaderLength; c.maxResponseSize > 0 && size > c.maxResponseSize {
+		if _, ok := cmd.(*StoreValueCommand); ok {
+			buffers.put(message)
+			err = newClientError(errRequestTooLarge, RequestTooLargeError{Size: size, MaxSize: c.maxResponseSize})
+			cmd.onError(err)
+			return
+		}
+	}
 
 	// Use the *greater* of the connection's request timeout
 	// or the Command's timeout
@@ -179,15 +279,28 @@ func (c *connection) execute(cmd Command) (err error) {
 		}
 	}
 
-	if err = c.write(message, timeout); err != nil {
+	stopWatching := c.watchContext(ctx)
+	defer stopWatching()
+
+	err = c.write(*message, timeout)
+	buffers.put(message)
+	cmd.setRequestWritten(c.bytesWritten > 0)
+	if err != nil {
+		if cerr := ctx.Err(); cerr != nil {
+			err = newClientError(ErrConnectionContextDone, cerr)
+			cmd.onError(err)
+		}
 		return
 	}
 
 	var response []byte
 	var decoded proto.Message
 	for {
-		response, err = c.read(timeout) // NB: response *will* have entire pb message
+		response, err = c.read(ctx, timeout) // NB: response *will* have entire pb message
 		if err != nil {
+			if cerr := ctx.Err(); cerr != nil {
+				err = newClientError(ErrConnectionContextDone, cerr)
+			}
 			cmd.onError(err)
 			return
 		}
@@ -221,12 +334,41 @@ func (c *connection) execute(cmd Command) (err error) {
 	}
 }
 
-func (c *connection) setReadDeadline(t time.Duration) {
+// watchContext aborts any blocked read or write on the underlying net.Conn when ctx is done. The
+// returned func must be called once the command has completed, and only returns once watching
+// has stopped so that a late abort can not affect the next command run on this connection
+func (c *connection) watchContext(ctx context.Context) func() {
+	done := ctx.Done()
+	if done == nil || c.conn == nil {
+		return func() {}
+	}
+	conn := c.conn
+	stopChan := make(chan struct{})
+	stoppedChan := make(chan struct{})
+	go func() {
+		defer close(stoppedChan)
+		select {
+		case <-done:
+			c.log.debug("context done, aborting in-flight request")
+			conn.SetDeadline(aLongTimeAgo)
+		case <-stopChan:
+		}
+	}()
+	return func() {
+		close(stopChan)
+		<-stoppedChan
+	}
+}
+
+// setReadDeadline sets the read deadline of the underlying net.Conn. The context is checked
+// afterwards since setting a deadline would otherwise undo an abort done by watchContext
+func (c *connection) setReadDeadline(ctx context.Context, t time.Duration) error {
 	c.conn.SetReadDeadline(time.Now().Add(t))
+	return ctx.Err()
 }
 
 // NB: This will read one full pb message from Riak, or error in doing so
-func (c *connection) read(timeout time.Duration) ([]byte, error) {
+func (c *connection) read(ctx context.Context, timeout time.Duration) ([]byte, error) {
 	if !c.available() {
 		return nil, ErrCannotRead
 	}
@@ -234,6 +376,7 @@ func (c *connection) read(timeout time.Duration) ([]byte, error) {
 	var err error
 	var count int
 	var messageLength uint32
+	var data []byte
 	var rt time.Duration = timeout // rt = 'read timeout'
 	b := &backoff.Backoff{
 		Min:    rt,
@@ -242,18 +385,25 @@ func (c *connection) read(timeout time.Duration) ([]byte, error) {
 	try := uint16(0)
 
 	for {
-		c.setReadDeadline(rt)
+		if err = c.setReadDeadline(ctx, rt); err != nil {
+			c.setState(connInactive)
+			return nil, err
+		}
 		if count, err = io.ReadFull(c.conn, c.sizeBuf); err == nil && count == 4 {
 			messageLength = binary.BigEndian.Uint32(c.sizeBuf)
-			if messageLength > uint32(cap(c.dataBuf)) {
-				logDebug("[Connection]", "allocating larger dataBuf of size %d", messageLength)
-				c.dataBuf = make([]byte, messageLength)
-			} else {
-				c.dataBuf = c.dataBuf[0:messageLength]
+			if c.maxResponseSize > 0 && int64(messageLength) > int64(c.maxResponseSize) {
+				// NB: the response is not read, so the connection can not be used again
+				c.log.warn("response is larger than MaxResponseSize", "size", messageLength, "maxResponseSize", c.maxResponseSize)
+				c.setState(connInactive)
+				return nil, newClientError(errResponseTooLarge, ResponseTooLargeError{Size: int(messageLength), MaxSize: c.maxResponseSize})
 			}
+			data = c.readBuffer(int(messageLength))
 			// FUTURE: large object warning / error
-			c.setReadDeadline(rt)
-			count, err = io.ReadFull(c.conn, c.dataBuf)
+			if err = c.setReadDeadline(ctx, rt); err != nil {
+				c.setState(connInactive)
+				return nil, err
+			}
+			count, err = io.ReadFull(c.conn, data)
 		} else {
 			if err == nil && count != 4 {
 				err = newClientError(fmt.Sprintf("[Connection] expected to read 4 bytes, only read: %d", count), nil)
@@ -265,13 +415,14 @@ func (c *connection) read(timeout time.Duration) ([]byte, error) {
 		}
 
 		if err == nil {
-			return c.dataBuf, nil
+			c.bytesRead += len(c.sizeBuf) + count
+			return data, nil
 		}
 
-		if try < c.tempNetErrorRetries && isTemporaryNetError(err) {
+		if try < c.tempNetErrorRetries && isTemporaryNetError(err) && ctx.Err() == nil {
 			rt = b.Duration()
 			try++
-			logDebug("[Connection]", "temporary error, re-try %v, new read timeout: %v", try, rt)
+			c.log.debug("temporary error, re-trying read", "err", err, "try", try, "timeout", rt)
 		} else {
 			c.setState(connInactive)
 			return nil, err
@@ -279,12 +430,32 @@ func (c *connection) read(timeout time.Duration) ([]byte, error) {
 	}
 }
 
+// readBuffer returns a buffer of length size to read a response into. Responses that do not fit in
+// dataBuf are read into a pooled buffer, which is kept until the next response is read or the
+// command completes, so that the connection does not hold on to memory for its largest response
+func (c *connection) readBuffer(size int) []byte {
+	c.releaseLargeBuf()
+	if size <= cap(c.dataBuf) {
+		return c.dataBuf[:size]
+	}
+	c.largeBuf = buffers.get(size)
+	return *c.largeBuf
+}
+
+func (c *connection) releaseLargeBuf() {
+	if c.largeBuf != nil {
+		buffers.put(c.largeBuf)
+		c.largeBuf = nil
+	}
+}
+
 func (c *connection) write(data []byte, timeout time.Duration) error {
 	if !c.available() {
 		return ErrCannotWrite
 	}
 	c.conn.SetWriteDeadline(time.Now().Add(timeout))
 	count, err := c.conn.Write(data)
+	c.bytesWritten += count
 	if err != nil {
 		c.setState(connInactive)
 		return err
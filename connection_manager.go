@@ -1,10 +1,14 @@
 package riak
 
 import (
+	"container/list"
+	"context"
 	"fmt"
 	"math"
+	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,6 +23,7 @@ const (
 
 type connectionCounter struct {
 	value uint16
+	log   *componentLogger // NB: that of the connectionManager, see connectionManager.setLogger
 	sync.RWMutex
 }
 
@@ -52,7 +57,7 @@ func (counter *connectionCounter) increment() uint16 {
 	if counter.value < math.MaxUint16 {
 		counter.value++
 	} else {
-		logDebug("[connectionCounter]", "increment would have exceeded %v", math.MaxUint16)
+		counter.log.debug("connection count would exceed its maximum", "max", math.MaxUint16)
 	}
 	return counter.value
 }
@@ -63,7 +68,7 @@ func (counter *connectionCounter) decrement() uint16 {
 	if counter.value > 0 {
 		counter.value--
 	} else {
-		logDebug("[connectionCounter]", "decrement would result in negative count")
+		counter.log.debug("connection count would be negative")
 	}
 	return counter.value
 }
@@ -77,11 +82,18 @@ type connectionManagerOptions struct {
 	idleTimeout            time.Duration
 	connectTimeout         time.Duration
 	requestTimeout         time.Duration
+	acquireTimeout         time.Duration
+	maxConnectionAge       time.Duration // NB: 0 if connections are kept open indefinitely
+	maxResponseSize        int
 	authOptions            *AuthOptions
+	logger                 Logger
+	onEvent                func(t EventType) // NB: optional, notified when connections are opened and closed
 }
 
 type connectionManager struct {
-	addr                   *net.TCPAddr
+	addr                   *net.TCPAddr // NB: guarded by addrMutex, as it changes if the Node re-resolves it
+	addrMutex              sync.RWMutex
+	connectFailures        uint32 // NB: consecutive, accessed atomically
 	minConnections         uint16
 	maxConnections         uint16
 	tempNetErrorRetries    uint16
@@ -89,22 +101,50 @@ type connectionManager struct {
 	idleTimeout            time.Duration
 	connectTimeout         time.Duration
 	requestTimeout         time.Duration
+	acquireTimeout         time.Duration
+	maxConnectionAge       time.Duration
+	maxResponseSize        int
 	authOptions            *AuthOptions
 	stopChan               chan struct{}
 	q                      *queue
 	expireTicker           *time.Ticker
 	connectionCounter      connectionCounter
+	waiters                *list.List // NB: of chan *connection, guarded by waitMutex
+	waitMutex              sync.Mutex
+	waitCount              uint64
+	waitDuration           int64
+	acquireTimeouts        uint64
+	logger                 Logger
+	log                    *componentLogger
+	onEvent                func(t EventType)
 	sync.RWMutex
 	stateData
 }
 
+// PoolStats contains connection pool statistics for a Node. The wait fields are only updated when
+// NodeOptions.ConnectionAcquireTimeout is set
+type PoolStats struct {
+	Connections     uint16        // open connections, both idle and in use
+	Idle            uint16        // connections available in the pool
+	Waiting         int           // callers currently waiting for a connection
+	WaitCount       uint64        // total number of callers that had to wait for a connection
+	WaitDuration    time.Duration // total time callers spent waiting for a connection
+	AcquireTimeouts uint64        // total number of callers that gave up after ConnectionAcquireTimeout
+}
+
 var (
 	ErrConnectionManagerRequiresOptions         = newClientError("[connectionManager] new manager requires options", nil)
 	ErrConnectionManagerRequiresAddress         = newClientError("[connectionManager] new manager requires non-nil address", nil)
 	ErrConnectionManagerMaxMustBeGreaterThanMin = newClientError("[connectionManager] new connection manager maxConnections must be greater than minConnections", nil)
 	ErrConnMgrAllConnectionsInUse               = newClientError("[connectionManager] all connections in use / max connections reached", nil)
+	ErrConnMgrAcquireTimeout                    = newClientError("[connectionManager] timed out waiting for an available connection", nil)
+	ErrConnMgrShuttingDown                      = newClientError("[connectionManager] shut down while waiting for an available connection", nil)
 )
 
+// ErrConnMgrContextDone is the message of the error returned when the context of a command is done
+// while waiting for an available connection
+const ErrConnMgrContextDone = "[connectionManager] context done while waiting for an available connection"
+
 func newConnectionManager(options *connectionManagerOptions) (*connectionManager, error) {
 	if options == nil {
 		return nil, ErrConnectionManagerRequiresOptions
@@ -145,17 +185,89 @@ func newConnectionManager(options *connectionManagerOptions) (*connectionManager
 		idleTimeout:            options.idleTimeout,
 		connectTimeout:         options.connectTimeout,
 		requestTimeout:         options.requestTimeout,
+		acquireTimeout:         options.acquireTimeout,
+		maxConnectionAge:       options.maxConnectionAge,
+		maxResponseSize:        options.maxResponseSize,
 		authOptions:            options.authOptions,
 		stopChan:               make(chan struct{}),
 		q:                      newQueue(options.maxConnections),
+		waiters:                list.New(),
+		onEvent:                options.onEvent,
 	}
+	cm.setLogger(options.logger)
 	cm.initStateData("connMgrError", "connMgrCreated", "connMgrRunning", "connMgrShuttingDown", "connMgrShutdown")
 	cm.setState(cmCreated)
 	return cm, nil
 }
 
 func (cm *connectionManager) String() string {
-	return fmt.Sprintf("%v", cm.addr)
+	return fmt.Sprintf("%v", cm.getAddr())
+}
+
+func (cm *connectionManager) getAddr() *net.TCPAddr {
+	cm.addrMutex.RLock()
+	defer cm.addrMutex.RUnlock()
+	return cm.addr
+}
+
+// setAddr changes the address new connections are made to, returning true if it differs from the
+// current one. Idle connections to the old address are closed, and connections to it that are in
+// use are closed when returned
+func (cm *connectionManager) setAddr(addr *net.TCPAddr) bool {
+	cm.addrMutex.Lock()
+	if cm.addr.String() == addr.String() {
+		cm.addrMutex.Unlock()
+		return false
+	}
+	cm.addr = addr
+	cm.addrMutex.Unlock()
+	atomic.StoreUint32(&cm.connectFailures, 0)
+
+	if !cm.isCurrentState(cmRunning) {
+		return true
+	}
+	var stale []*connection
+	var f = func(v interface{}) (bool, bool) {
+		if v == nil {
+			return true, false
+		}
+		conn := v.(*connection)
+		if !cm.isStale(conn) {
+			return false, true
+		}
+		stale = append(stale, conn)
+		return false, false
+	}
+	if err := cm.q.iterate(f); err != nil {
+		cm.log.err("error when closing connections to previous address", err)
+	}
+	// NB: not while iterating, as remove may signal a waiter
+	for _, conn := range stale {
+		if err := cm.remove(conn); err != nil {
+			cm.log.err("error when closing connection to previous address", err)
+		}
+	}
+	return true
+}
+
+// isStale returns true if conn is connected to an address other than the current one
+func (cm *connectionManager) isStale(conn *connection) bool {
+	return conn.addr.String() != cm.getAddr().String()
+}
+
+// consecutiveConnectFailures returns the number of attempts to connect that have failed since the
+// last one that succeeded
+func (cm *connectionManager) consecutiveConnectFailures() uint32 {
+	return atomic.LoadUint32(&cm.connectFailures)
+}
+
+// setLogger replaces the Logger used by this connectionManager and the connections it creates
+func (cm *connectionManager) setLogger(l Logger) {
+	cm.logger = l
+	cm.log = newComponentLogger(l, "component", "connectionManager", "node", cm.getAddr())
+	cm.connectionCounter.Lock()
+	cm.connectionCounter.log = cm.log
+	cm.connectionCounter.Unlock()
 }
 
 func (cm *connectionManager) start() error {
@@ -166,10 +278,10 @@ func (cm *connectionManager) start() error {
 		conn, err := cm.create()
 		if err == nil {
 			if perr := cm.put(conn); perr != nil {
-				logErr("[connectionManager]", perr)
+				cm.log.err("error when adding connection to pool", perr)
 			}
 		} else {
-			logErr("[connectionManager]", err)
+			cm.log.err("error when creating connection", err, "connections", cm.count(), "minConnections", cm.minConnections)
 		}
 	}
 	cm.expireTicker = time.NewTicker(cm.idleExpirationInterval)
@@ -183,14 +295,14 @@ func (cm *connectionManager) stop() error {
 		return err
 	}
 
-	logDebug("[connectionManager]", "shutting down")
+	cm.log.debug("shutting down", "connections", cm.count())
 
 	cm.setState(cmShuttingDown)
 	close(cm.stopChan)
 	cm.expireTicker.Stop()
 
 	if cm.count() != cm.q.count() {
-		logError("[connectionManager]", "stop: current connection count '%d' does NOT equal q count '%d'", cm.count(), cm.q.count())
+		cm.log.error("stop: current connection count does NOT equal q count", "connections", cm.count(), "idle", cm.q.count())
 	}
 
 	cm.Lock()
@@ -202,8 +314,9 @@ func (cm *connectionManager) stop() error {
 		}
 		conn := v.(*connection)
 		if err := conn.close(); err != nil {
-			logErr("[connectionManager] error when closing connection in stop()", err)
+			cm.log.err("error when closing connection in stop()", err)
 		}
+		cm.notify(EventConnectionClosed)
 
 		if cm.connectionCounter.decrement() == 0 {
 			return true, false
@@ -245,89 +358,305 @@ func (cm *connectionManager) create() (*connection, error) {
 	}
 
 	cm.connectionCounter.increment()
+	cm.notify(EventConnectionOpened)
 	return conn, nil
 }
 
+func (cm *connectionManager) notify(t EventType) {
+	if cm.onEvent != nil {
+		cm.onEvent(t)
+	}
+}
+
 func (cm *connectionManager) createConnection() (*connection, error) {
 	opts := &connectionOptions{
-		remoteAddress:       cm.addr,
+		remoteAddress:       cm.getAddr(),
 		connectTimeout:      cm.connectTimeout,
 		requestTimeout:      cm.requestTimeout,
 		authOptions:         cm.authOptions,
 		tempNetErrorRetries: cm.tempNetErrorRetries,
+		maxResponseSize:     cm.maxResponseSize,
+		logger:              cm.logger,
 	}
 	conn, err := newConnection(opts)
 	if err != nil {
 		return nil, err
 	}
-	err = conn.connect()
+	if err = conn.connect(); err != nil {
+		atomic.AddUint32(&cm.connectFailures, 1)
+	} else {
+		atomic.StoreUint32(&cm.connectFailures, 0)
+	}
+	if cm.maxConnectionAge > 0 {
+		// NB: up to a quarter shorter, so that connections opened together are replaced gradually
+		jitter := time.Duration(rand.Int63n(int64(cm.maxConnectionAge)/4 + 1))
+		conn.expiresAt = time.Now().Add(cm.maxConnectionAge - jitter)
+	}
 	return conn, err
 }
 
-func (cm *connectionManager) get() (*connection, error) {
+func (cm *connectionManager) stats() PoolStats {
+	cm.waitMutex.Lock()
+	waiting := cm.waiters.Len()
+	cm.waitMutex.Unlock()
+	return PoolStats{
+		Connections:     cm.count(),
+		Idle:            cm.q.count(),
+		Waiting:         waiting,
+		WaitCount:       atomic.LoadUint64(&cm.waitCount),
+		WaitDuration:    time.Duration(atomic.LoadInt64(&cm.waitDuration)),
+		AcquireTimeouts: atomic.LoadUint64(&cm.acquireTimeouts),
+	}
+}
+
+// get returns an available connection, creating one if maxConnections has not been reached. When
+// all connections are in use, it returns ErrConnMgrAllConnectionsInUse unless acquireTimeout is set,
+// in which case the caller waits in line for a connection to be returned to the pool
+func (cm *connectionManager) get(ctx context.Context) (*connection, error) {
+	if cm.acquireTimeout > 0 && cm.hasWaiters() {
+		// NB: don't jump the queue
+		return cm.wait(ctx)
+	}
+	conn, err := cm.getAvailable()
+	if err != nil {
+		return nil, err
+	}
+	if conn != nil {
+		return conn, nil
+	}
+
+	// NB: if we get here, there were no available connections
+	conn, err = cm.create()
+	if err == ErrConnMgrAllConnectionsInUse && cm.acquireTimeout > 0 {
+		return cm.wait(ctx)
+	}
+	return conn, err
+}
+
+// getAvailable returns a connection from the pool, or nil if none is available. Must not be called
+// with waitMutex held, see takeAvailable
+func (cm *connectionManager) getAvailable() (*connection, error) {
+	conn, discarded, err := cm.takeAvailable()
+	if discarded > 0 {
+		cm.waitMutex.Lock()
+		cm.signalWaiters(discarded)
+		cm.waitMutex.Unlock()
+	}
+	return conn, err
+}
+
+// takeAvailable returns a connection from the pool, or nil if none is available, discarding those
+// that are no longer available or have expired. It returns how many were discarded, making room
+// for as many waiters to create a new connection, see signalWaiters
+func (cm *connectionManager) takeAvailable() (*connection, int, error) {
 	var conn *connection
+	discarded := 0
 	var f = func(v interface{}) (bool, bool) {
 		if v == nil {
 			// connection pool is empty
 			return true, false
 		}
 		conn = v.(*connection)
-		if conn.available() {
+		expired := conn.isExpired(time.Now())
+		if conn.available() && !expired {
 			// we found our connection, don't re-queue
 			return true, false
 		} else {
 			// Remove connection, don't re-queue, keep going
-			cm.remove(conn)
-			conn = nil // GH-47
+			cm.connectionCounter.decrement()
+			discarded++
+			conn.close() // NB: discard error
+			conn = nil   // GH-47
+			if expired {
+				cm.notify(EventConnectionExpired)
+			}
 			return false, false
 		}
 	}
-	err := cm.q.iterate(f)
-	if err != nil {
-		return nil, err
+	if err := cm.q.iterate(f); err != nil {
+		return nil, discarded, err
 	}
+	return conn, discarded, nil
+}
 
-	if conn != nil {
-		return conn, nil
+func (cm *connectionManager) hasWaiters() bool {
+	cm.waitMutex.Lock()
+	defer cm.waitMutex.Unlock()
+	return cm.waiters.Len() > 0
+}
+
+// wait queues the caller until a connection is handed over by put, room for a new connection is
+// made by remove, or acquireTimeout elapses. Waiters are served in FIFO order
+func (cm *connectionManager) wait(ctx context.Context) (*connection, error) {
+	start := time.Now()
+	atomic.AddUint64(&cm.waitCount, 1)
+	defer func() {
+		atomic.AddInt64(&cm.waitDuration, int64(time.Since(start)))
+	}()
+
+	timer := time.NewTimer(cm.acquireTimeout)
+	defer timer.Stop()
+
+	w := make(chan *connection, 1)
+	signalled := false
+	for {
+		// NB: check again while holding waitMutex, so that a connection returned since
+		// the last check is not missed
+		cm.waitMutex.Lock()
+		conn, discarded, err := cm.takeAvailable()
+		cm.signalWaiters(discarded)
+		if err != nil || conn != nil {
+			cm.waitMutex.Unlock()
+			return conn, err
+		}
+		if cm.connectionCounter.isLessThan(cm.maxConnections) {
+			cm.waitMutex.Unlock()
+			conn, err = cm.create()
+			if err != ErrConnMgrAllConnectionsInUse {
+				return conn, err
+			}
+			continue
+		}
+		var e *list.Element
+		if signalled {
+			// NB: this caller was already at the front of the line
+			e = cm.waiters.PushFront(w)
+		} else {
+			e = cm.waiters.PushBack(w)
+		}
+		cm.waitMutex.Unlock()
+
+		select {
+		case conn = <-w:
+			if conn != nil {
+				return conn, nil
+			}
+			signalled = true
+		case <-timer.C:
+			atomic.AddUint64(&cm.acquireTimeouts, 1)
+			return cm.leaveQueue(e, w, ErrConnMgrAcquireTimeout)
+		case <-ctx.Done():
+			return cm.leaveQueue(e, w, newClientError(ErrConnMgrContextDone, ctx.Err()))
+		case <-cm.stopChan:
+			return cm.leaveQueue(e, w, ErrConnMgrShuttingDown)
+		}
 	}
+}
 
-	// NB: if we get here, there were no available connections
-	return cm.create()
+// leaveQueue removes a waiter that gave up. If a connection was handed over in the meantime it
+// is returned instead of err
+func (cm *connectionManager) leaveQueue(e *list.Element, w chan *connection, err error) (*connection, error) {
+	cm.waitMutex.Lock()
+	defer cm.waitMutex.Unlock()
+	select {
+	case conn := <-w:
+		if conn != nil {
+			return conn, nil
+		}
+		// NB: pass on the notification that there is room for a new connection
+		cm.signalWaiter(nil)
+	default:
+		cm.waiters.Remove(e)
+	}
+	return nil, err
+}
+
+// signalWaiter hands conn to the first waiter, if any. A nil conn tells the waiter that it may
+// create a new connection. Must be called with waitMutex held
+func (cm *connectionManager) signalWaiter(conn *connection) bool {
+	e := cm.waiters.Front()
+	if e == nil {
+		return false
+	}
+	cm.waiters.Remove(e)
+	e.Value.(chan *connection) <- conn
+	return true
+}
+
+// signalWaiters tells up to n waiters that they may create a new connection. Must be called with
+// waitMutex held
+func (cm *connectionManager) signalWaiters(n int) {
+	for i := 0; i < n; i++ {
+		if !cm.signalWaiter(nil) {
+			return
+		}
+	}
 }
 
 func (cm *connectionManager) put(conn *connection) error {
 	if cm.isStateLessThan(cmShuttingDown) {
+		if cm.isStale(conn) {
+			return cm.remove(conn)
+		}
+		if conn.isExpired(time.Now()) {
+			return cm.discard(conn, EventConnectionExpired)
+		}
+		cm.waitMutex.Lock()
+		defer cm.waitMutex.Unlock()
+		if cm.signalWaiter(conn) {
+			return nil
+		}
 		return cm.q.enqueue(conn)
 	} else {
 		// shutting down
-		logDebug("[connectionManager]", "(%v)|Connection returned during shutdown.", cm)
+		cm.log.debug("connection returned during shutdown", "state", cm.stateData.String())
 		cm.connectionCounter.decrement()
 		conn.close() // NB: discard error
+		cm.notify(EventConnectionClosed)
 	}
 	return nil
 }
 
 func (cm *connectionManager) remove(conn *connection) error {
+	return cm.discard(conn, EventConnectionClosed)
+}
+
+// discard closes conn, which is not in the pool, making room for a new connection. t is the Event
+// it is reported as
+func (cm *connectionManager) discard(conn *connection, t EventType) error {
 	if cm.isStateLessThan(cmShuttingDown) {
 		cm.connectionCounter.decrement()
-		return conn.close()
+		err := conn.close()
+		cm.notify(t)
+		cm.waitMutex.Lock()
+		cm.signalWaiter(nil)
+		cm.waitMutex.Unlock()
+		return err
 	}
 	return nil
 }
 
+// replenish opens connections until there are minConnections, replacing those closed when they
+// reached maxConnectionAge
+func (cm *connectionManager) replenish() {
+	for cm.isCurrentState(cmRunning) && cm.connectionCounter.isLessThan(cm.minConnections) {
+		conn, err := cm.create()
+		if err != nil || conn == nil {
+			if err != nil {
+				cm.log.err("error when replacing expired connection", err, "connections", cm.count(), "minConnections", cm.minConnections)
+			}
+			return
+		}
+		if err = cm.put(conn); err != nil {
+			cm.log.err("error when adding connection to pool", err)
+			return
+		}
+	}
+}
+
 func (cm *connectionManager) manageConnections() {
-	logDebug("[connectionManager]", "connection expiration routine is starting")
+	cm.log.debug("connection expiration routine is starting")
 	for {
 		select {
 		case <-cm.stopChan:
-			logDebug("[connectionManager]", "connection expiration routine is quitting")
+			cm.log.debug("connection expiration routine is quitting")
 			return
 		case t := <-cm.expireTicker.C:
 			if !cm.isStateLessThan(cmShuttingDown) {
-				logDebug("[connectionManager]", "(%v) connection expiration routine is quitting.", cm)
+				cm.log.debug("connection expiration routine is quitting", "state", cm.stateData.String())
 			}
 
-			logDebug("[connectionManager]", "(%v) expiring connections at %v", cm, t)
+			cm.log.debug("expiring connections", "at", t, "connections", cm.count(), "idle", cm.q.count())
 
 			count := uint16(0)
 			now := time.Now()
@@ -343,30 +672,47 @@ func (cm *connectionManager) manageConnections() {
 				conn := v.(*connection)
 				cm.Lock()
 				defer cm.Unlock()
+				if conn.isExpired(now) {
+					cm.connectionCounter.decrement()
+					if err := conn.close(); err != nil {
+						cm.log.err("error when closing connection past its maximum age", err)
+					}
+					cm.notify(EventConnectionExpired)
+					count++
+					return false, false // don't break, don't re-enqueue
+				}
 				if cm.connectionCounter.isGreaterThan(cm.minConnections) {
 					// expire connection if not available or if it has passed idle timeout
 					if !conn.available() || (now.Sub(conn.lastUsed) >= cm.idleTimeout) {
 						cm.connectionCounter.decrement()
 						if err := conn.close(); err != nil {
-							logErr("[connectionManager]", err)
+							cm.log.err("error when closing expired connection", err)
 						}
+						cm.notify(EventConnectionExpired)
 						count++
 						return false, false // don't break, don't re-enqueue
 					} else {
 						return false, true // don't break, re-enqueue
 					}
 				}
+				if cm.maxConnectionAge > 0 {
+					return false, true // don't break, re-enqueue, as later connections may be past their maximum age
+				}
 				return true, true // break, re-enqueue
 			}
 
 			if err := cm.q.iterate(f); err != nil {
-				logErr("[connectionManager]", err)
+				cm.log.err("error when expiring connections", err)
 			}
 
-			logDebug("[connectionManager]", "(%v) expired %d connections.", cm, count)
+			cm.log.debug("expired connections", "expired", count, "connections", cm.count())
+
+			if cm.maxConnectionAge > 0 {
+				cm.replenish()
+			}
 
 			if !cm.isStateLessThan(cmShuttingDown) {
-				logDebug("[connectionManager]", "(%v) connection expiration routine is quitting.", cm)
+				cm.log.debug("connection expiration routine is quitting", "state", cm.stateData.String())
 			}
 		}
 	}
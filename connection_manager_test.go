@@ -1,7 +1,13 @@
 package riak
 
 import (
+	"context"
+	"net"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/basho/riak-go-client/riaktest"
 )
 
 func TestCreateConnectionManager(t *testing.T) {
@@ -10,3 +16,260 @@ func TestCreateConnectionManager(t *testing.T) {
 		t.Error("expected non-nil error when creating without options")
 	}
 }
+
+func newWaitingConnectionManager(t *testing.T, acquireTimeout time.Duration) *connectionManager {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	cm, err := newConnectionManager(&connectionManagerOptions{
+		addr:           ln.Addr().(*net.TCPAddr),
+		minConnections: 1,
+		maxConnections: 1,
+		acquireTimeout: acquireTimeout,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cm.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cm.stop()
+		ln.Close()
+	})
+	return cm
+}
+
+func TestConnectionManagerReturnsErrorWhenAllConnectionsInUse(t *testing.T) {
+	cm := newWaitingConnectionManager(t, 0)
+	conn, err := cm.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.put(conn)
+	if _, err = cm.get(context.Background()); err != ErrConnMgrAllConnectionsInUse {
+		t.Errorf("expected ErrConnMgrAllConnectionsInUse, got %v", err)
+	}
+}
+
+func TestConnectionManagerWaitersAreServedInOrder(t *testing.T) {
+	cm := newWaitingConnectionManager(t, 5*time.Second)
+	conn, err := cm.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			c, err := cm.get(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- i
+			cm.put(c)
+		}(i)
+		// NB: ensure waiters queue up in order
+		for cm.stats().Waiting != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	cm.put(conn)
+	for want := 0; want < 3; want++ {
+		if got := <-order; got != want {
+			t.Errorf("expected waiter %d to be served, got %d", want, got)
+		}
+	}
+
+	stats := cm.stats()
+	if stats.WaitCount != 3 || stats.Waiting != 0 || stats.WaitDuration <= 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if stats.Connections != 1 || stats.Idle != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestConnectionManagerAcquireTimeout(t *testing.T) {
+	cm := newWaitingConnectionManager(t, 50*time.Millisecond)
+	conn, err := cm.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.put(conn)
+
+	start := time.Now()
+	if _, err = cm.get(context.Background()); err != ErrConnMgrAcquireTimeout {
+		t.Errorf("expected ErrConnMgrAcquireTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected to wait for acquire timeout, waited %v", elapsed)
+	}
+	if stats := cm.stats(); stats.AcquireTimeouts != 1 || stats.Waiting != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestConnectionManagerWaitInterruptedByContext(t *testing.T) {
+	cm := newWaitingConnectionManager(t, 5*time.Second)
+	conn, err := cm.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.put(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = cm.get(ctx); !isContextError(err) {
+		t.Errorf("expected context error, got %v", err)
+	}
+	if stats := cm.stats(); stats.Waiting != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestConnectionManagerRemoveWakesWaiter(t *testing.T) {
+	cm := newWaitingConnectionManager(t, 5*time.Second)
+	conn, err := cm.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan error, 1)
+	go func() {
+		c, err := cm.get(context.Background())
+		if err == nil {
+			cm.put(c)
+		}
+		got <- err
+	}()
+	for cm.stats().Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// NB: removing a connection makes room for the waiter to create a new one
+	if err = cm.remove(conn); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-got:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected waiter to be woken up")
+	}
+}
+
+func TestConnectionManagerDiscardingUnavailableConnectionWakesWaiter(t *testing.T) {
+	cm := newWaitingConnectionManager(t, 5*time.Second)
+	conn, err := cm.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan error, 1)
+	go func() {
+		c, err := cm.get(context.Background())
+		if err == nil {
+			cm.put(c)
+		}
+		got <- err
+	}()
+	for cm.stats().Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// NB: a closed connection in the pool, as when it is returned just before the waiter queued up,
+	// is discarded by the next caller, making room for the waiter to create a new one
+	conn.close()
+	if err = cm.q.enqueue(conn); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := cm.getAvailable(); c != nil || err != nil {
+		t.Fatalf("expected no available connection, got %v, %v", c, err)
+	}
+	select {
+	case err = <-got:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected waiter to be woken up")
+	}
+}
+
+func TestConnectionManagerReplacesConnectionsPastMaxAge(t *testing.T) {
+	srv, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	addr, err := net.ResolveTCPAddr("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expired int32
+	cm, err := newConnectionManager(&connectionManagerOptions{
+		addr:                   addr,
+		minConnections:         1,
+		maxConnections:         2,
+		idleExpirationInterval: 5 * time.Millisecond,
+		maxConnectionAge:       40 * time.Millisecond,
+		onEvent: func(e EventType) {
+			if e == EventConnectionExpired {
+				atomic.AddInt32(&expired, 1)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cm.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cm.stop()
+
+	inUse, err := cm.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	// NB: a connection in use is closed when it is returned
+	if err = cm.put(inUse); err != nil {
+		t.Fatal(err)
+	}
+	if inUse.available() {
+		t.Error("expected connection past its maximum age to be closed when returned")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cm.q.count() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a replacement connection, have %d idle", cm.q.count())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	conn, err := cm.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.put(conn)
+	if conn == inUse || conn.isExpired(time.Now()) {
+		t.Error("expected a connection within its maximum age")
+	}
+	if n := atomic.LoadInt32(&expired); n < 1 {
+		t.Errorf("expected EventConnectionExpired, got %d", n)
+	}
+}
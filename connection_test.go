@@ -1,8 +1,13 @@
 package riak
 
 import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net"
 	"testing"
+	"time"
 )
 
 func TestCreateConnection(t *testing.T) {
@@ -87,3 +92,53 @@ func TestEnsureDefaultConnectionValues(t *testing.T) {
 		t.Error(err.Error())
 	}
 }
+
+func TestExecuteAbortsReadWhenContextCancelled(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// accept, but never respond
+		c, aerr := ln.Accept()
+		if aerr != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(ioutil.Discard, c)
+	}()
+
+	opts := &connectionOptions{
+		remoteAddress:  ln.Addr().(*net.TCPAddr),
+		requestTimeout: tenSeconds,
+	}
+	conn, err := newConnection(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	cmd := &PingCommand{}
+	cmd.setContext(ctx)
+	start := time.Now()
+	err = conn.execute(cmd)
+	if err == nil {
+		t.Fatal("expected non-nil error")
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error to wrap context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= tenSeconds {
+		t.Errorf("expected read to be aborted, took %v", elapsed)
+	}
+	if expected, actual := false, conn.available(); expected != actual {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
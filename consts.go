@@ -19,6 +19,10 @@ const (
 	defaultRequestTimeout         = fiveSeconds
 	defaultHealthCheckInterval    = 125 * time.Millisecond
 	defaultExecutionAttempts      = byte(3)
+	defaultSRVRefreshInterval     = 30 * time.Second
+	defaultMembershipPollInterval = fiveSeconds
+	defaultNodeDrainTimeout       = tenSeconds
+	nodeDrainPollInterval         = 10 * time.Millisecond
 	defaultQueueExecutionInterval = 125 * time.Millisecond
 	defaultInitBuffer             = 2048
 	defaultTempNetErrorRetries    = uint16(0)
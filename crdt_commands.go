@@ -29,6 +29,14 @@ func (cmd *UpdateCounterCommand) Name() string {
 	return cmd.getName("UpdateCounter")
 }
 
+func (cmd *UpdateCounterCommand) isIdempotent() bool {
+	return false
+}
+
+func (cmd *UpdateCounterCommand) getLocation() (location, bool) {
+	return locationOf(cmd.protobuf)
+}
+
 func (cmd *UpdateCounterCommand) constructPbRequest() (proto.Message, error) {
 	return cmd.protobuf, nil
 }
@@ -253,6 +261,27 @@ func (cmd *FetchCounterCommand) Name() string {
 	return cmd.getName("FetchCounter")
 }
 
+func (cmd *FetchCounterCommand) getLocation() (location, bool) {
+	return locationOf(cmd.protobuf)
+}
+
+func (cmd *FetchCounterCommand) cloneCommand() hedgeableCommand {
+	return &FetchCounterCommand{
+		commandImpl: commandImpl{name: cmd.name},
+		timeoutImpl: cmd.timeoutImpl,
+		protobuf:    proto.Clone(cmd.protobuf).(*rpbRiakDT.DtFetchReq),
+	}
+}
+
+func (cmd *FetchCounterCommand) adopt(c hedgeableCommand) {
+	clone := c.(*FetchCounterCommand)
+	cmd.adoptResult(&clone.commandImpl)
+	cmd.Response = clone.Response
+	if n := clone.getLastNode(); n != nil {
+		cmd.setLastNode(n)
+	}
+}
+
 func (cmd *FetchCounterCommand) constructPbRequest() (proto.Message, error) {
 	return cmd.protobuf, nil
 }
@@ -407,6 +436,10 @@ func (cmd *UpdateSetCommand) Name() string {
 	return cmd.getName("UpdateSet")
 }
 
+func (cmd *UpdateSetCommand) getLocation() (location, bool) {
+	return locationOf(cmd.protobuf)
+}
+
 func (cmd *UpdateSetCommand) constructPbRequest() (proto.Message, error) {
 	return cmd.protobuf, nil
 }
@@ -597,6 +630,27 @@ func (cmd *FetchSetCommand) Name() string {
 	return cmd.getName("FetchSet")
 }
 
+func (cmd *FetchSetCommand) getLocation() (location, bool) {
+	return locationOf(cmd.protobuf)
+}
+
+func (cmd *FetchSetCommand) cloneCommand() hedgeableCommand {
+	return &FetchSetCommand{
+		commandImpl: commandImpl{name: cmd.name},
+		timeoutImpl: cmd.timeoutImpl,
+		protobuf:    proto.Clone(cmd.protobuf).(*rpbRiakDT.DtFetchReq),
+	}
+}
+
+func (cmd *FetchSetCommand) adopt(c hedgeableCommand) {
+	clone := c.(*FetchSetCommand)
+	cmd.adoptResult(&clone.commandImpl)
+	cmd.Response = clone.Response
+	if n := clone.getLastNode(); n != nil {
+		cmd.setLastNode(n)
+	}
+}
+
 func (cmd *FetchSetCommand) constructPbRequest() (proto.Message, error) {
 	return cmd.protobuf, nil
 }
@@ -755,6 +809,15 @@ func (cmd *UpdateMapCommand) Name() string {
 	return cmd.getName("UpdateMap")
 }
 
+// NB: only counter increments are not idempotent
+func (cmd *UpdateMapCommand) isIdempotent() bool {
+	return !cmd.op.incrementsCounters()
+}
+
+func (cmd *UpdateMapCommand) getLocation() (location, bool) {
+	return locationOf(cmd.protobuf)
+}
+
 func (cmd *UpdateMapCommand) constructPbRequest() (proto.Message, error) {
 	pbMapOp := &rpbRiakDT.MapOp{}
 	populate(cmd.op, pbMapOp)
@@ -952,6 +1015,19 @@ type MapOperation struct {
 	removeMaps map[string]bool
 }
 
+// incrementsCounters returns true if this operation, or that of a nested map, increments a counter
+func (mapOp *MapOperation) incrementsCounters() bool {
+	if len(mapOp.incrementCounters) > 0 {
+		return true
+	}
+	for _, op := range mapOp.maps {
+		if op.incrementsCounters() {
+			return true
+		}
+	}
+	return false
+}
+
 // IncrementCounter increments a child counter CRDT of the map at the specified key
 func (mapOp *MapOperation) IncrementCounter(key string, increment int64) *MapOperation {
 	if mapOp.removeCounters != nil {
@@ -1307,6 +1383,27 @@ func (cmd *FetchMapCommand) Name() string {
 	return cmd.getName("FetchMap")
 }
 
+func (cmd *FetchMapCommand) getLocation() (location, bool) {
+	return locationOf(cmd.protobuf)
+}
+
+func (cmd *FetchMapCommand) cloneCommand() hedgeableCommand {
+	return &FetchMapCommand{
+		commandImpl: commandImpl{name: cmd.name},
+		timeoutImpl: cmd.timeoutImpl,
+		protobuf:    proto.Clone(cmd.protobuf).(*rpbRiakDT.DtFetchReq),
+	}
+}
+
+func (cmd *FetchMapCommand) adopt(c hedgeableCommand) {
+	clone := c.(*FetchMapCommand)
+	cmd.adoptResult(&clone.commandImpl)
+	cmd.Response = clone.Response
+	if n := clone.getLastNode(); n != nil {
+		cmd.setLastNode(n)
+	}
+}
+
 func (cmd *FetchMapCommand) constructPbRequest() (proto.Message, error) {
 	return cmd.protobuf, nil
 }
@@ -0,0 +1,99 @@
+package riak
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// ErrAuthCredentialProviderFailed is the message of the error returned when a CredentialProvider
+// fails to supply credentials
+const ErrAuthCredentialProviderFailed = "[Connection] credential provider failed to supply credentials"
+
+// Credentials are the credentials a connection authenticates with, as supplied by a
+// CredentialProvider
+type Credentials struct {
+	User     string // NB: defaults to the common name of the client certificate
+	Password string
+	// Certificate is presented to Riak as the client certificate, in place of the certificates in
+	// AuthOptions.TlsConfig. Leave nil to use those
+	Certificate *tls.Certificate
+}
+
+// CredentialProvider supplies credentials that rotate, for instance ones issued by a secrets
+// agent. It is consulted each time a Node opens a connection, so it should cache the credentials it
+// returns, and it may be called from several goroutines at once.
+//
+// When Riak rejects the credentials, Credentials is called again with refresh set, so that cached
+// credentials that have since rotated are re-read, and the connection is retried once before the
+// error is returned. Connections that are already open are unaffected by rotation; set
+// NodeOptions.MaxConnectionAge to have them replaced
+type CredentialProvider interface {
+	Credentials(ctx context.Context, refresh bool) (*Credentials, error)
+}
+
+// CredentialProviderFunc is a function that implements CredentialProvider
+type CredentialProviderFunc func(ctx context.Context, refresh bool) (*Credentials, error)
+
+// Credentials calls f
+func (f CredentialProviderFunc) Credentials(ctx context.Context, refresh bool) (*Credentials, error) {
+	return f(ctx, refresh)
+}
+
+// credentials returns the credentials and TLS config a connection authenticates with: those
+// supplied by the CredentialProvider, if any, or else those in o
+func (o *AuthOptions) credentials(ctx context.Context, refresh bool) (*Credentials, *tls.Config, error) {
+	if o.TlsConfig == nil {
+		return nil, nil, ErrAuthMissingConfig
+	}
+	creds := &Credentials{
+		User:     o.User,
+		Password: o.Password,
+	}
+	tlsConfig := o.TlsConfig
+	if o.CredentialProvider != nil {
+		provided, err := o.CredentialProvider.Credentials(ctx, refresh)
+		if err != nil {
+			return nil, nil, newClientError(ErrAuthCredentialProviderFailed, err)
+		}
+		if provided == nil {
+			return nil, nil, newClientError(ErrAuthCredentialProviderFailed, nil)
+		}
+		creds = &Credentials{
+			User:     provided.User,
+			Password: provided.Password,
+		}
+		if provided.Certificate != nil {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.Certificates = []tls.Certificate{*provided.Certificate}
+		}
+	}
+	if creds.User == "" {
+		user, err := certificateUser(tlsConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		creds.User = user
+	}
+	return creds, tlsConfig, nil
+}
+
+// certificateUser returns the common name of the client certificate in tlsConfig, which a
+// certificate security source authenticates as
+func certificateUser(tlsConfig *tls.Config) (string, error) {
+	if len(tlsConfig.Certificates) == 0 || len(tlsConfig.Certificates[0].Certificate) == 0 {
+		return "", ErrAuthMissingUser
+	}
+	cert := tlsConfig.Certificates[0]
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return "", TLSError{InnerError: err}
+		}
+	}
+	if leaf.Subject.CommonName == "" {
+		return "", ErrAuthMissingUser
+	}
+	return leaf.Subject.CommonName, nil
+}
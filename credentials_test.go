@@ -0,0 +1,136 @@
+package riak
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/basho/riak-go-client/riaktest"
+)
+
+// rotatingSecret is a password that rotates, as stored by a secrets agent
+type rotatingSecret struct {
+	password string
+	sync.Mutex
+}
+
+func (s *rotatingSecret) get() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.password
+}
+
+func (s *rotatingSecret) rotate(password string) {
+	s.Lock()
+	defer s.Unlock()
+	s.password = password
+}
+
+// cachingProvider returns a CredentialProvider that caches the password of secret until refreshed,
+// counting the calls made with refresh set
+func cachingProvider(secret *rotatingSecret, refreshes *int32) CredentialProvider {
+	var mu sync.Mutex
+	cached := secret.get()
+	return CredentialProviderFunc(func(ctx context.Context, refresh bool) (*Credentials, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if refresh {
+			atomic.AddInt32(refreshes, 1)
+			cached = secret.get()
+		}
+		return &Credentials{User: "riakpass", Password: cached}, nil
+	})
+}
+
+func newRotatingTestServer(t *testing.T, ca *testCA, secret *rotatingSecret) *riaktest.Server {
+	srv, err := riaktest.NewServer(&riaktest.ServerOptions{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{ca.serverCert(t)}},
+		Authenticate: func(user, password string, cert *x509.Certificate) error {
+			if user != "riakpass" || password != secret.get() {
+				return errors.New("Authentication failed")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Stop() })
+	return srv
+}
+
+func TestCredentialProviderRefreshesAfterRotation(t *testing.T) {
+	ca := newTestCA(t)
+	secret := &rotatingSecret{password: "first"}
+	srv := newRotatingTestServer(t, ca, secret)
+	var refreshes int32
+	authOptions := &AuthOptions{
+		TlsConfig:          &tls.Config{ServerName: "riak-test", RootCAs: ca.pool},
+		CredentialProvider: cachingProvider(secret, &refreshes),
+	}
+	if err := connectSecure(t, srv, authOptions); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&refreshes); n != 0 {
+		t.Errorf("expected cached credentials to be used, refreshed %d times", n)
+	}
+
+	secret.rotate("second")
+	if err := connectSecure(t, srv, authOptions); err != nil {
+		t.Fatalf("expected refreshed credentials to be accepted, got %v", err)
+	}
+	if n := atomic.LoadInt32(&refreshes); n != 1 {
+		t.Errorf("expected one refresh, got %d", n)
+	}
+}
+
+func TestCredentialProviderRetriesOnce(t *testing.T) {
+	ca := newTestCA(t)
+	srv := newRotatingTestServer(t, ca, &rotatingSecret{password: "current"})
+	var refreshes int32
+	err := connectSecure(t, srv, &AuthOptions{
+		TlsConfig:          &tls.Config{ServerName: "riak-test", RootCAs: ca.pool},
+		CredentialProvider: cachingProvider(&rotatingSecret{password: "stale"}, &refreshes),
+	})
+	if !IsAuthError(err) {
+		t.Errorf("expected AuthError, got %v", err)
+	}
+	if n := atomic.LoadInt32(&refreshes); n != 1 {
+		t.Errorf("expected one refresh, got %d", n)
+	}
+}
+
+func TestCredentialProviderError(t *testing.T) {
+	ca := newTestCA(t)
+	srv := newRotatingTestServer(t, ca, &rotatingSecret{password: "current"})
+	agentErr := errors.New("secrets agent unavailable")
+	err := connectSecure(t, srv, &AuthOptions{
+		TlsConfig: &tls.Config{ServerName: "riak-test", RootCAs: ca.pool},
+		CredentialProvider: CredentialProviderFunc(func(ctx context.Context, refresh bool) (*Credentials, error) {
+			return nil, agentErr
+		}),
+	})
+	var clientErr ClientError
+	if !errors.As(err, &clientErr) || clientErr.Errmsg != ErrAuthCredentialProviderFailed || !errors.Is(err, agentErr) {
+		t.Errorf("expected the CredentialProvider error to be wrapped, got %v", err)
+	}
+}
+
+func TestCredentialProviderCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	srv := newSecureTestServer(t, ca)
+	cert := ca.clientCert(t, "riakuser")
+	err := connectSecure(t, srv, &AuthOptions{
+		TlsConfig: &tls.Config{ServerName: "riak-test", RootCAs: ca.pool},
+		CredentialProvider: CredentialProviderFunc(func(ctx context.Context, refresh bool) (*Credentials, error) {
+			return &Credentials{Certificate: &cert}, nil
+		}),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
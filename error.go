@@ -1,6 +1,8 @@
 package riak
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	rpb_riak "github.com/basho/riak-go-client/rpb/riak"
@@ -40,11 +42,14 @@ func (e RiakError) Error() (s string) {
 var (
 	ErrAddressRequired      = newClientError("RemoteAddress is required in options", nil)
 	ErrAuthMissingConfig    = newClientError("[Connection] authentication is missing TLS config", nil)
+	ErrAuthMissingUser      = newClientError("[Connection] authentication requires a User or a client certificate with a common name", nil)
 	ErrAuthTLSUpgradeFailed = newClientError("[Connection] upgrading to TLS connection failed", nil)
 	ErrBucketRequired       = newClientError("Bucket is required", nil)
 	ErrKeyRequired          = newClientError("Key is required", nil)
 	ErrNilOptions           = newClientError("[Command] options must be non-nil", nil)
 	ErrOptionsRequired      = newClientError("Options are required", nil)
+	ErrRequestTooLarge      = newClientError(errRequestTooLarge, nil)  // NB: matched by RequestTooLargeError
+	ErrResponseTooLarge     = newClientError(errResponseTooLarge, nil) // NB: matched by ResponseTooLargeError
 	ErrZeroLength           = newClientError("[Command] 0 byte data response", nil)
 )
 
@@ -66,3 +71,200 @@ func (e ClientError) Error() (s string) {
 	}
 	return fmt.Sprintf("ClientError|%s|InnerError|%v", e.Errmsg, e.InnerError)
 }
+
+// Unwrap returns the inner error, if any, so that ClientError values can be
+// inspected with errors.Is and errors.As
+func (e ClientError) Unwrap() error {
+	return e.InnerError
+}
+
+// OutcomeUnknownError is returned when a command that is not idempotent, such as a counter
+// increment, fails after its request was written to Riak. Riak may or may not have applied it, so
+// the command is not re-tried
+type OutcomeUnknownError struct {
+	InnerError error
+}
+
+func (e OutcomeUnknownError) Error() string {
+	return fmt.Sprintf("OutcomeUnknownError|InnerError|%v", e.InnerError)
+}
+
+// Unwrap returns the error the command failed with
+func (e OutcomeUnknownError) Unwrap() error {
+	return e.InnerError
+}
+
+// IsOutcomeUnknown returns true if err is, or wraps, an OutcomeUnknownError
+func IsOutcomeUnknown(err error) bool {
+	var outcomeErr OutcomeUnknownError
+	return errors.As(err, &outcomeErr)
+}
+
+// AdmissionRejectedError is returned when a command is not admitted by the Cluster's admission
+// control, see AdmissionOptions. The command was not executed
+type AdmissionRejectedError struct {
+	Command string         // NB: the type of command, e.g. "FetchValue"
+	Limit   AdmissionLimit // NB: the limit that rejected it
+}
+
+func (e AdmissionRejectedError) Error() string {
+	return fmt.Sprintf("[Cluster] %s command rejected by %v limit", e.Command, e.Limit)
+}
+
+// IsAdmissionRejected returns true if err is, or wraps, an AdmissionRejectedError
+func IsAdmissionRejected(err error) bool {
+	var admissionErr AdmissionRejectedError
+	return errors.As(err, &admissionErr)
+}
+
+// TLSError is returned when a connection cannot be upgraded to TLS, for instance because Riak's
+// certificate is not trusted, Riak rejected the client certificate or security is not enabled on
+// the node. See AuthOptions
+type TLSError struct {
+	InnerError error
+}
+
+func (e TLSError) Error() string {
+	return fmt.Sprintf("TLSError|InnerError|%v", e.InnerError)
+}
+
+// Unwrap returns the error the TLS upgrade failed with
+func (e TLSError) Unwrap() error {
+	return e.InnerError
+}
+
+// IsTLSError returns true if err is, or wraps, a TLSError
+func IsTLSError(err error) bool {
+	var tlsErr TLSError
+	return errors.As(err, &tlsErr)
+}
+
+// AuthError is returned when Riak rejects the credentials in AuthOptions, after the connection was
+// upgraded to TLS
+type AuthError struct {
+	User       string // NB: the user authenticated as
+	InnerError error  // NB: the RiakError Riak responded with
+}
+
+func (e AuthError) Error() string {
+	return fmt.Sprintf("AuthError|%s|InnerError|%v", e.User, e.InnerError)
+}
+
+// Unwrap returns the error Riak responded with
+func (e AuthError) Unwrap() error {
+	return e.InnerError
+}
+
+// IsAuthError returns true if err is, or wraps, an AuthError
+func IsAuthError(err error) bool {
+	var authErr AuthError
+	return errors.As(err, &authErr)
+}
+
+const (
+	errRequestTooLarge  = "[Connection] StoreValue request is larger than MaxResponseSize"
+	errResponseTooLarge = "[Connection] response is larger than MaxResponseSize"
+)
+
+// ResponseTooLargeError is the inner error of the ClientError a command fails with when Riak
+// announces a response larger than NodeOptions.MaxResponseSize. It is not read, and the connection
+// is closed. errors.Is(err, ErrResponseTooLarge) reports whether err is, or wraps, one
+type ResponseTooLargeError struct {
+	Size    int // NB: the announced size of the response, in bytes
+	MaxSize int
+}
+
+func (e ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("ResponseTooLargeError|%d|%d", e.Size, e.MaxSize)
+}
+
+// Is returns true if target is ErrResponseTooLarge
+func (e ResponseTooLargeError) Is(target error) bool {
+	return target == ErrResponseTooLarge
+}
+
+// RequestTooLargeError is the inner error of the ClientError a StoreValueCommand fails with, without
+// being sent, when its request is larger than NodeOptions.MaxResponseSize, as the value could not be
+// fetched. errors.Is(err, ErrRequestTooLarge) reports whether err is, or wraps, one
+type RequestTooLargeError struct {
+	Size    int // NB: the size of the request, in bytes
+	MaxSize int
+}
+
+func (e RequestTooLargeError) Error() string {
+	return fmt.Sprintf("RequestTooLargeError|%d|%d", e.Size, e.MaxSize)
+}
+
+// Is returns true if target is ErrRequestTooLarge
+func (e RequestTooLargeError) Is(target error) bool {
+	return target == ErrRequestTooLarge
+}
+
+// UnknownContentTypeError is the inner error of the ClientError returned when no Serializer is
+// registered for a content type, see RegisterSerializer. errors.Is(err, ErrUnknownContentType)
+// reports whether err is, or wraps, one
+type UnknownContentTypeError struct {
+	ContentType string
+}
+
+func (e UnknownContentTypeError) Error() string {
+	return fmt.Sprintf("UnknownContentTypeError|%s", e.ContentType)
+}
+
+// Is returns true if target is ErrUnknownContentType
+func (e UnknownContentTypeError) Is(target error) bool {
+	return target == ErrUnknownContentType
+}
+
+// isSizeLimitError returns true if err is a request or response exceeding NodeOptions.MaxResponseSize
+func isSizeLimitError(err error) bool {
+	return errors.Is(err, ErrResponseTooLarge) || errors.Is(err, ErrRequestTooLarge)
+}
+
+const (
+	errCodecCompress   = "[Compression] could not compress value"
+	errCodecDecompress = "[Compression] could not decompress value"
+)
+
+// ErrDecompressedValueTooLarge is returned by a Codec when a value is larger than
+// CompressionOptions.MaxDecompressedSize once decompressed
+var ErrDecompressedValueTooLarge = newClientError("[Compression] value is larger than MaxDecompressedSize once decompressed", nil)
+
+// CodecError is the inner error of the ClientError a command fails with when a Codec could not
+// compress or decompress a value, see CompressionOptions. Such commands are not re-tried
+type CodecError struct {
+	Codec      string // NB: the Name of the Codec
+	InnerError error
+}
+
+func (e CodecError) Error() string {
+	return fmt.Sprintf("CodecError|%s|InnerError|%v", e.Codec, e.InnerError)
+}
+
+// Unwrap returns the error the Codec failed with
+func (e CodecError) Unwrap() error {
+	return e.InnerError
+}
+
+// IsCodecError returns true if err is, or wraps, a CodecError
+func IsCodecError(err error) bool {
+	var codecErr CodecError
+	return errors.As(err, &codecErr)
+}
+
+// isOutcomeUnknown returns true if, having written its request, a command that failed with err may
+// have been applied by Riak. Riak rejects a request with an error response, except when it times
+// out waiting for vnodes
+func isOutcomeUnknown(err error) bool {
+	var riakErr RiakError
+	if errors.As(err, &riakErr) {
+		return isTimeoutError(riakErr)
+	}
+	return true
+}
+
+// isContextError returns true if err was caused by a cancelled context or by
+// a context deadline passing
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,120 @@
+package riak
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventType identifies the kind of an Event
+type EventType byte
+
+// Event types
+const (
+	EventClusterStateChanged EventType = iota // NB: the Cluster was started or is stopping, see Event.From and To
+	EventNodeStateChanged                     // NB: e.g. from "nodeRunning" to "nodeHealthChecking"
+	EventConnectionOpened                     // NB: a connection was added to a Node's pool
+	EventConnectionClosed                     // NB: a connection was closed after an error or when its Node stopped
+	EventConnectionExpired                    // NB: an idle connection was closed, see NodeOptions.IdleTimeout
+	EventHealthCheckFailed                    // NB: see Event.Err
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventClusterStateChanged:
+		return "cluster_state_changed"
+	case EventNodeStateChanged:
+		return "node_state_changed"
+	case EventConnectionOpened:
+		return "connection_opened"
+	case EventConnectionClosed:
+		return "connection_closed"
+	case EventConnectionExpired:
+		return "connection_expired"
+	case EventHealthCheckFailed:
+		return "health_check_failed"
+	default:
+		return fmt.Sprintf("EventType(%d)", byte(t))
+	}
+}
+
+// Event describes a change in the state of a Cluster, one of its Nodes or one of their
+// connections. See Cluster.Subscribe
+type Event struct {
+	Type EventType
+	Time time.Time
+	Node *Node  // NB: nil for EventClusterStateChanged
+	From string // NB: the previous state, for state changes
+	To   string // NB: the new state, for state changes
+	Err  error  // NB: why the health check failed, for EventHealthCheckFailed
+}
+
+// EventListener is called with each Event it is subscribed to
+type EventListener func(e *Event)
+
+// eventHub delivers Events to the subscribed EventListeners
+type eventHub struct {
+	listeners []*EventListener // NB: copied on write, so that emit does not hold the lock
+	sync.Mutex
+}
+
+// subscribe adds l, returning a function that removes it
+func (h *eventHub) subscribe(l EventListener) func() {
+	h.Lock()
+	defer h.Unlock()
+	p := &l
+	listeners := make([]*EventListener, len(h.listeners), len(h.listeners)+1)
+	copy(listeners, h.listeners)
+	h.listeners = append(listeners, p)
+	return func() {
+		h.Lock()
+		defer h.Unlock()
+		listeners := make([]*EventListener, 0, len(h.listeners))
+		for _, other := range h.listeners {
+			if other != p {
+				listeners = append(listeners, other)
+			}
+		}
+		h.listeners = listeners
+	}
+}
+
+// emit delivers e to the listeners. NB: h may be nil, for a Node that is not in a Cluster
+func (h *eventHub) emit(e *Event) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	listeners := h.listeners
+	h.Unlock()
+	if len(listeners) == 0 {
+		return
+	}
+	e.Time = time.Now()
+	for _, l := range listeners {
+		(*l)(e)
+	}
+}
+
+// Subscribe calls l with every Event of the Cluster, its Nodes and their connections, returning a
+// function that unsubscribes it. Subscribe before Start to see the Cluster start.
+//
+// l is called on the goroutine that changed the state, which may hold locks of the Node or its
+// connection pool, so it must return quickly and must not execute commands. Events of different
+// Nodes or connections may be delivered concurrently and out of order. See SubscribeChannel to
+// handle Events on another goroutine
+func (c *Cluster) Subscribe(l EventListener) (unsubscribe func()) {
+	return c.events.subscribe(l)
+}
+
+// SubscribeChannel sends every Event of the Cluster, its Nodes and their connections to ch,
+// returning a function that unsubscribes it. NB: Events are dropped when ch is full, so give it
+// room for bursts such as a Node starting or stopping, which opens or closes all of its connections
+func (c *Cluster) SubscribeChannel(ch chan<- *Event) (unsubscribe func()) {
+	return c.Subscribe(func(e *Event) {
+		select {
+		case ch <- e:
+		default:
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package riak
+
+import (
+	"testing"
+	"time"
+
+	"github.com/basho/riak-go-client/riaktest"
+)
+
+// waitForEvent returns the first Event received from events that matches, failing the test if
+// none is received in time
+func waitForEvent(t *testing.T, events <-chan *Event, match func(e *Event) bool) *Event {
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if match(e) {
+				return e
+			}
+		case <-deadline:
+			t.Fatal("expected event")
+			return nil
+		}
+	}
+}
+
+func isStateChange(typ EventType, from, to string) func(e *Event) bool {
+	return func(e *Event) bool {
+		return e.Type == typ && e.From == from && e.To == to
+	}
+}
+
+func TestClusterEvents(t *testing.T) {
+	srv, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := srv.Addr()
+	node, err := NewNode(&NodeOptions{
+		RemoteAddress:       addr,
+		HealthCheckInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := NewCluster(&ClusterOptions{Nodes: []*Node{node}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan *Event, 100)
+	unsubscribe := cluster.SubscribeChannel(events)
+
+	if err = cluster.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Stop()
+	if e := waitForEvent(t, events, func(e *Event) bool { return e.Type == EventConnectionOpened }); e.Node != node || e.Time.IsZero() {
+		t.Errorf("unexpected event %+v", e)
+	}
+	waitForEvent(t, events, isStateChange(EventNodeStateChanged, "nodeCreated", "nodeRunning"))
+	waitForEvent(t, events, isStateChange(EventClusterStateChanged, "clusterCreated", "clusterRunning"))
+
+	srv.Stop()
+	cluster.Execute(&PingCommand{})
+	waitForEvent(t, events, func(e *Event) bool { return e.Type == EventConnectionClosed })
+	waitForEvent(t, events, isStateChange(EventNodeStateChanged, "nodeRunning", "nodeHealthChecking"))
+	if e := waitForEvent(t, events, func(e *Event) bool { return e.Type == EventHealthCheckFailed }); e.Err == nil || e.Node != node {
+		t.Errorf("expected health check error, got %+v", e)
+	}
+
+	if srv, err = riaktest.NewServer(&riaktest.ServerOptions{Address: addr}); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	waitForEvent(t, events, isStateChange(EventNodeStateChanged, "nodeHealthChecking", "nodeRunning"))
+
+	unsubscribe()
+	for len(events) > 0 {
+		<-events
+	}
+	cluster.Stop()
+	if len(events) != 0 {
+		t.Errorf("expected no events after unsubscribing, got %+v", <-events)
+	}
+}
+
+func TestConnectionManagerExpiredEvent(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	addr, err := resolveTCPAddr("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan EventType, 10)
+	cm, err := newConnectionManager(&connectionManagerOptions{
+		addr:                   addr,
+		minConnections:         1,
+		maxConnections:         2,
+		idleTimeout:            time.Millisecond,
+		idleExpirationInterval: 10 * time.Millisecond,
+		onEvent:                func(t EventType) { events <- t },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cm.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cm.stop()
+	if got := <-events; got != EventConnectionOpened {
+		t.Fatalf("expected connection opened, got %v", got)
+	}
+
+	conn, err := cm.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cm.put(conn); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-events; got != EventConnectionOpened {
+		t.Fatalf("expected connection opened, got %v", got)
+	}
+	select {
+	case got := <-events:
+		if got != EventConnectionExpired {
+			t.Errorf("expected connection expired, got %v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected idle connection to expire")
+	}
+}
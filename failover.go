@@ -0,0 +1,318 @@
+package riak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// FailoverPolicy decides whether a command may be executed on a secondary Cluster of a
+// FailoverClient
+type FailoverPolicy byte
+
+// Failover policies
+const (
+	FailoverDefault FailoverPolicy = iota // NB: the ReadPolicy or WritePolicy of the FailoverClient
+	FailoverAllowed                       // NB: execute on a secondary when the primary is unavailable
+	FailoverDenied                        // NB: execute on the primary only
+)
+
+func (p FailoverPolicy) String() string {
+	switch p {
+	case FailoverDefault:
+		return "default"
+	case FailoverAllowed:
+		return "allowed"
+	case FailoverDenied:
+		return "denied"
+	default:
+		return fmt.Sprintf("FailoverPolicy(%d)", byte(p))
+	}
+}
+
+const defaultFailbackAfter = time.Second * 30
+
+// FailoverClientOptions configures a FailoverClient. Primary is required.
+//
+// Reads are commands that do not change data, such as FetchValue, ListKeys and Ping; every other
+// command is a write. By default reads fail over and writes do not, as a write accepted by a
+// secondary may conflict with one made on the primary before it is replicated
+type FailoverClientOptions struct {
+	Primary     *Cluster
+	Secondaries []*Cluster     // NB: tried in order
+	ReadPolicy  FailoverPolicy // NB: defaults to FailoverAllowed
+	WritePolicy FailoverPolicy // NB: defaults to FailoverDenied
+	// Policies overrides ReadPolicy and WritePolicy for types of command, keyed by name, e.g.
+	// "UpdateCounter"
+	Policies map[string]FailoverPolicy
+	// FailbackAfter is how long the primary must be healthy before commands are executed on it
+	// again, after failing over. Defaults to 30 seconds
+	FailbackAfter time.Duration
+	Logger        Logger
+}
+
+// FailoverResult reports which Cluster executed a command for a FailoverClient
+type FailoverResult struct {
+	Cluster *Cluster // NB: nil if no Cluster was tried
+	Index   int      // NB: 0 for the primary, 1 for the first secondary, and so on
+}
+
+// Primary returns true if the command was executed on the primary Cluster
+func (r *FailoverResult) Primary() bool {
+	return r.Cluster != nil && r.Index == 0
+}
+
+// FailoverClient executes commands on a primary Cluster and fails over to secondary Clusters, such
+// as Riak clusters in other datacenters connected by MDC replication, when it is unavailable.
+//
+// The primary is unavailable when none of its Nodes is running, for instance because they are all
+// health checking after network errors. Commands that may fail over are then executed on the first
+// secondary with a running Node, until the primary has been available for FailbackAfter. Commands
+// that may fail over are also re-tried on the secondaries if they fail on the primary for want of
+// an available Node or with a network error. They are not re-tried if Riak responded with an error,
+// or if Riak may have applied them, see OutcomeUnknownError.
+//
+// Streaming commands, ListKeys, ListBuckets, MapReduce and SecondaryIndexQuery, never fail over, as
+// the results they delivered before failing would be delivered again
+type FailoverClient struct {
+	clusters      []*Cluster // NB: the primary, then the secondaries
+	readPolicy    FailoverPolicy
+	writePolicy   FailoverPolicy
+	policies      map[string]FailoverPolicy
+	failbackAfter time.Duration
+	unsubscribe   func()
+	log           *componentLogger
+	failedOver    bool      // NB: guarded by mu
+	healthySince  time.Time // NB: when the primary became available, zero if it is not, guarded by mu
+	mu            sync.Mutex
+}
+
+// FailoverClient errors
+var (
+	ErrFailoverClientPrimaryRequired = newClientError("[FailoverClient] Primary is required", nil)
+	ErrFailoverClientNilCluster      = newClientError("[FailoverClient] Secondaries must not be nil", nil)
+)
+
+// NewFailoverClient starts the Clusters in options and returns a FailoverClient executing commands
+// on them
+func NewFailoverClient(options *FailoverClientOptions) (*FailoverClient, error) {
+	if options == nil {
+		return nil, ErrClientOptionsRequired
+	}
+	if options.Primary == nil {
+		return nil, ErrFailoverClientPrimaryRequired
+	}
+	for _, c := range options.Secondaries {
+		if c == nil {
+			return nil, ErrFailoverClientNilCluster
+		}
+	}
+	fc := &FailoverClient{
+		clusters:      append([]*Cluster{options.Primary}, options.Secondaries...),
+		readPolicy:    options.ReadPolicy,
+		writePolicy:   options.WritePolicy,
+		policies:      options.Policies,
+		failbackAfter: options.FailbackAfter,
+		log:           newComponentLogger(options.Logger, "component", "FailoverClient"),
+	}
+	if fc.readPolicy == FailoverDefault {
+		fc.readPolicy = FailoverAllowed
+	}
+	if fc.writePolicy == FailoverDefault {
+		fc.writePolicy = FailoverDenied
+	}
+	if fc.failbackAfter == 0 {
+		fc.failbackAfter = defaultFailbackAfter
+	}
+	for i, c := range fc.clusters {
+		if err := c.Start(); err != nil {
+			for _, started := range fc.clusters[:i] {
+				started.Stop()
+			}
+			return nil, err
+		}
+	}
+	// NB: so that the time the primary becomes available is known even when no commands are
+	// executed. Not on the listener's goroutine, which may hold the Cluster's lock
+	fc.unsubscribe = options.Primary.Subscribe(func(e *Event) {
+		if e.Type == EventNodeStateChanged || e.Type == EventClusterStateChanged {
+			go fc.update()
+		}
+	})
+	fc.update()
+	return fc, nil
+}
+
+// Primary returns the primary Cluster
+func (fc *FailoverClient) Primary() *Cluster {
+	return fc.clusters[0]
+}
+
+// Active returns the Cluster commands that may fail over are executed on: the primary, or the first
+// available secondary after failing over
+func (fc *FailoverClient) Active() *Cluster {
+	if !fc.update() {
+		return fc.clusters[0]
+	}
+	for _, c := range fc.clusters[1:] {
+		if isClusterAvailable(c) {
+			return c
+		}
+	}
+	return fc.clusters[0]
+}
+
+// Execute (synchronously) the provided Command, reporting which Cluster executed it
+func (fc *FailoverClient) Execute(cmd Command) (*FailoverResult, error) {
+	return fc.ExecuteContext(context.Background(), cmd)
+}
+
+// ExecuteContext (synchronously) executes the provided Command, stopping when ctx is cancelled or
+// its deadline passes, and reports which Cluster executed it. The FailoverResult is never nil; when
+// the command failed it reports the last Cluster that was tried
+func (fc *FailoverClient) ExecuteContext(ctx context.Context, cmd Command) (*FailoverResult, error) {
+	result := &FailoverResult{}
+	candidates := fc.candidates(cmd)
+	var err error
+	for i, index := range candidates {
+		if i > 0 {
+			// NB: clear the error of the Cluster tried before
+			cmd.onRetry()
+		}
+		result.Cluster, result.Index = fc.clusters[index], index
+		err = result.Cluster.ExecuteContext(ctx, cmd)
+		if !isFailoverError(err) || ctx.Err() != nil {
+			return result, err
+		}
+		if i < len(candidates)-1 {
+			fc.log.warn("command failed, trying next cluster", "command", cmd.Name(), "cluster", index, "err", err)
+		}
+	}
+	return result, err
+}
+
+// Stop stops the FailoverClient and its Clusters
+func (fc *FailoverClient) Stop() error {
+	fc.unsubscribe()
+	var err error
+	for _, c := range fc.clusters {
+		if serr := c.Stop(); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// policy returns the FailoverPolicy of cmd
+func (fc *FailoverClient) policy(cmd Command) FailoverPolicy {
+	if p := fc.policies[commandTypeName(cmd)]; p != FailoverDefault {
+		return p
+	}
+	if isReadCommand(cmd) {
+		return fc.readPolicy
+	}
+	return fc.writePolicy
+}
+
+// candidates returns the indexes of the Clusters to try executing cmd on, in order
+func (fc *FailoverClient) candidates(cmd Command) []int {
+	if _, streaming := cmd.(streamingCommand); streaming || fc.policy(cmd) != FailoverAllowed {
+		return []int{0}
+	}
+	failedOver := fc.update()
+	candidates := make([]int, 0, len(fc.clusters))
+	if !failedOver {
+		candidates = append(candidates, 0)
+	}
+	for i := 1; i < len(fc.clusters); i++ {
+		if isClusterAvailable(fc.clusters[i]) {
+			candidates = append(candidates, i)
+		}
+	}
+	if failedOver {
+		// NB: the primary may be available again, and is used if no secondary is
+		candidates = append(candidates, 0)
+	}
+	return candidates
+}
+
+// update records whether the primary is available, failing over when it is not and failing back
+// once it has been available for failbackAfter. It returns true if failed over
+func (fc *FailoverClient) update() bool {
+	available := isClusterAvailable(fc.clusters[0])
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	now := time.Now()
+	switch {
+	case !available:
+		fc.healthySince = time.Time{}
+		if !fc.failedOver {
+			fc.failedOver = true
+			fc.log.warn("primary cluster is unavailable, failing over")
+		}
+	case fc.healthySince.IsZero():
+		fc.healthySince = now
+	case fc.failedOver && now.Sub(fc.healthySince) >= fc.failbackAfter:
+		fc.failedOver = false
+		fc.log.info("primary cluster is available, failing back", "availableFor", now.Sub(fc.healthySince))
+	}
+	return fc.failedOver
+}
+
+// isClusterAvailable returns true if c is running and at least one of its Nodes is running
+func isClusterAvailable(c *Cluster) bool {
+	if !c.isCurrentState(clusterRunning) {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	for _, n := range c.nodes {
+		if n.isCurrentState(nodeRunning) {
+			return true
+		}
+	}
+	return false
+}
+
+// isFailoverError returns true if a command that failed with err may be executed on another Cluster:
+// no Node was available to execute it, or it failed with a network error before Riak could apply it.
+// Other errors, such as ErrRequestTooLarge, a CodecError or ErrClusterShuttingDown, would fail on
+// every Cluster, or are not caused by the Cluster being unavailable
+func isFailoverError(err error) bool {
+	if err == nil || isContextError(err) || IsOutcomeUnknown(err) || isSizeLimitError(err) || IsCodecError(err) {
+		return false
+	}
+	var riakErr RiakError
+	if errors.As(err, &riakErr) {
+		return false
+	}
+	var clientErr ClientError
+	if errors.As(err, &clientErr) {
+		switch clientErr.Errmsg {
+		case ErrClusterNoNodesAvailable:
+			return true
+		case ErrClusterJournalFailed:
+			return false
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isReadCommand returns true if cmd does not change data, see FailoverClientOptions
+func isReadCommand(cmd Command) bool {
+	switch cmd.(type) {
+	case *FetchValueCommand, *FetchCounterCommand, *FetchSetCommand, *FetchMapCommand,
+		*FetchPreflistCommand, *FetchBucketPropsCommand, *FetchBucketTypePropsCommand,
+		*FetchIndexCommand, *FetchSchemaCommand, *ListBucketsCommand, *ListKeysCommand,
+		*SecondaryIndexQueryCommand, *MapReduceCommand, *SearchCommand, *PingCommand,
+		*GetServerInfoCommand:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,252 @@
+package riak
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/basho/riak-go-client/riaktest"
+)
+
+// stopFailoverPrimary stops the server of the primary and waits for the FailoverClient to fail over
+func stopFailoverPrimary(t *testing.T, fc *FailoverClient, srv *riaktest.Server) {
+	srv.Stop()
+	// NB: a failed ping has the node health checked
+	fc.Primary().Execute(&PingCommand{})
+	deadline := time.Now().Add(5 * time.Second)
+	for fc.Active() == fc.Primary() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected to fail over")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFailoverClientPolicies(t *testing.T) {
+	srvs := newTestServers(t, 2)
+	nodeOptions := &NodeOptions{HealthCheckInterval: 10 * time.Millisecond}
+	options := &ClusterOptions{ExecutionAttempts: 1}
+	primary, _ := newTestCluster(t, nodeOptions, options, srvs[0].Addr())
+	secondary, _ := newTestCluster(t, nodeOptions, options, srvs[1].Addr())
+	fc, err := NewFailoverClient(&FailoverClientOptions{
+		Primary:     primary,
+		Secondaries: []*Cluster{secondary},
+		Policies: map[string]FailoverPolicy{
+			"UpdateCounter": FailoverAllowed,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fc.Stop()
+
+	result, err := fc.Execute(&PingCommand{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Primary() || result.Cluster != fc.Primary() {
+		t.Errorf("expected the primary to execute the ping, got %+v", result)
+	}
+
+	stopFailoverPrimary(t, fc, srvs[0])
+	fetch, err := NewFetchValueCommandBuilder().WithBucket("b").WithKey("k").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err = fc.Execute(fetch); err != nil {
+		t.Fatal(err)
+	}
+	if result.Primary() || result.Index != 1 {
+		t.Errorf("expected the read to fail over, got %+v", result)
+	}
+
+	store, err := NewStoreValueCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		WithContent(&Object{Value: []byte("v")}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err = fc.Execute(store); err == nil || !result.Primary() {
+		t.Errorf("expected the write to fail on the primary, got %+v %v", result, err)
+	}
+
+	increment, err := NewUpdateCounterCommandBuilder().
+		WithBucketType("counters").
+		WithBucket("b").
+		WithKey("k").
+		WithIncrement(1).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err = fc.Execute(increment); err != nil || result.Index != 1 {
+		t.Errorf("expected the write allowed to fail over to execute on the secondary, got %+v %v", result, err)
+	}
+}
+
+func TestFailoverClientFailsBack(t *testing.T) {
+	srvs := newTestServers(t, 2)
+	addr := srvs[0].Addr()
+	nodeOptions := &NodeOptions{HealthCheckInterval: 10 * time.Millisecond}
+	options := &ClusterOptions{ExecutionAttempts: 1}
+	primary, _ := newTestCluster(t, nodeOptions, options, addr)
+	secondary, _ := newTestCluster(t, nodeOptions, options, srvs[1].Addr())
+	fc, err := NewFailoverClient(&FailoverClientOptions{
+		Primary:       primary,
+		Secondaries:   []*Cluster{secondary},
+		FailbackAfter: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fc.Stop()
+	stopFailoverPrimary(t, fc, srvs[0])
+
+	srv, err := riaktest.NewServer(&riaktest.ServerOptions{Address: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for !isClusterAvailable(fc.Primary()) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the primary to recover")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	recovered := time.Now()
+
+	result, err := fc.Execute(&PingCommand{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Primary() && time.Since(recovered) < 90*time.Millisecond {
+		t.Errorf("expected not to fail back until the primary was available for FailbackAfter")
+	}
+	for fc.Active() != fc.Primary() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected to fail back")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if result, err = fc.Execute(&PingCommand{}); err != nil || !result.Primary() {
+		t.Errorf("expected the primary to execute the ping after failing back, got %+v %v", result, err)
+	}
+}
+
+func TestFailoverClientClearsPrimaryError(t *testing.T) {
+	srvs := newTestServers(t, 2)
+	nodeOptions := &NodeOptions{MinConnections: 1}
+	options := &ClusterOptions{ExecutionAttempts: 1}
+	primary, _ := newTestCluster(t, nodeOptions, options, srvs[0].Addr())
+	secondary, _ := newTestCluster(t, nodeOptions, options, srvs[1].Addr())
+	fc, err := NewFailoverClient(&FailoverClientOptions{
+		Primary:     primary,
+		Secondaries: []*Cluster{secondary},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fc.Stop()
+
+	// NB: the primary is still available, and fails with a network error on its pooled connection
+	srvs[0].Stop()
+	fetch, err := NewFetchValueCommandBuilder().WithBucket("b").WithKey("k").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := fc.Execute(fetch)
+	if err != nil || result.Index != 1 || !fetch.Success() || fetch.Error() != nil {
+		t.Errorf("expected the fetch to succeed on the secondary, got %+v %v %v", result, err, fetch.Error())
+	}
+}
+
+func TestFailoverClientDoesNotFailOverStreamingCommands(t *testing.T) {
+	srvs := newTestServers(t, 2)
+	primary, _ := newTestCluster(t, nil, nil, srvs[0].Addr())
+	secondary, _ := newTestCluster(t, nil, nil, srvs[1].Addr())
+	fc, err := NewFailoverClient(&FailoverClientOptions{
+		Primary:     primary,
+		Secondaries: []*Cluster{secondary},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fc.Stop()
+
+	listKeys, err := NewListKeysCommandBuilder().
+		WithBucket("b").
+		WithStreaming(true).
+		WithCallback(func([]string) error { return nil }).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fc.candidates(listKeys); len(got) != 1 || got[0] != 0 {
+		t.Errorf("expected a streaming command to be executed on the primary only, got %v", got)
+	}
+}
+
+func TestFailoverClientDoesNotFailOverTooLargeRequest(t *testing.T) {
+	srvs := newTestServers(t, 2)
+	primary, _ := newTestCluster(t, &NodeOptions{MaxResponseSize: 1024}, nil, srvs[0].Addr())
+	secondary, _ := newTestCluster(t, nil, nil, srvs[1].Addr())
+	fc, err := NewFailoverClient(&FailoverClientOptions{
+		Primary:     primary,
+		Secondaries: []*Cluster{secondary},
+		WritePolicy: FailoverAllowed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fc.Stop()
+
+	store, err := NewStoreValueCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		WithContent(&Object{Value: make([]byte, 2048)}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := fc.Execute(store)
+	if !errors.Is(err, ErrRequestTooLarge) || !result.Primary() {
+		t.Errorf("expected ErrRequestTooLarge from the primary, got %+v %v", result, err)
+	}
+}
+
+func TestIsFailoverError(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		failover bool
+	}{
+		{newClientError(ErrClusterNoNodesAvailable, nil), true},
+		{newClientError(ErrClusterNoNodesAvailable, io.EOF), true},
+		{testNetError{}, true},
+		{io.ErrUnexpectedEOF, true},
+		{nil, false},
+		{newClientError(ErrClusterNoNodesAvailable, RiakError{Errmsg: "overload"}), false},
+		{RiakError{Errmsg: "not found"}, false},
+		{ErrRequestTooLarge, false},
+		{ErrResponseTooLarge, false},
+		{newClientError(errCodecDecompress, CodecError{Codec: "gzip", InnerError: io.ErrUnexpectedEOF}), false},
+		{ErrClusterShuttingDown, false},
+		{newClientError(ErrClusterJournalFailed, io.EOF), false},
+		{ErrClusterCommandJournaled, false},
+		{context.DeadlineExceeded, false},
+	} {
+		if got := isFailoverError(tc.err); got != tc.failover {
+			t.Errorf("%v: expected %v, got %v", tc.err, tc.failover, got)
+		}
+	}
+}
+
+func TestFailoverClientRequiresPrimary(t *testing.T) {
+	if _, err := NewFailoverClient(&FailoverClientOptions{}); err != ErrFailoverClientPrimaryRequired {
+		t.Errorf("expected ErrFailoverClientPrimaryRequired, got %v", err)
+	}
+}
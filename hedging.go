@@ -0,0 +1,210 @@
+package riak
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHedgingPercentile = 0.95
+	defaultHedgingMinDelay   = 5 * time.Millisecond
+	defaultHedgingMaxDelay   = time.Second
+	defaultHedgingMinSamples = 100
+	hedgingLatencySamples    = 1000
+	hedgingRecomputeEvery    = 50
+)
+
+// HedgingOptions enables hedged reads on a Cluster. See ClusterOptions.Hedging.
+//
+// A FetchValue, FetchCounter, FetchSet, FetchMap or non-streaming SecondaryIndexQuery command that
+// has not completed after the hedge delay is executed a second time, on a different Node when the
+// NodeManager allows it. The first successful response is used and the other execution is
+// cancelled. Each execution, including the hedge, is retried as usual and reported to the
+// CommandObserver as a separate command.
+//
+// The hedge delay is the Percentile of recent latencies of the same kind of command, measured from
+// when the command was executed until its first successful response, and kept between MinDelay and
+// MaxDelay. Until MinSamples latencies have been measured, the delay is MaxDelay. Hedging is skipped
+// while the Cluster has fewer than two Nodes
+type HedgingOptions struct {
+	Percentile float64       // NB: between 0 and 1, defaults to 0.95
+	MinDelay   time.Duration // NB: defaults to 5ms
+	MaxDelay   time.Duration // NB: defaults to 1s
+	MinSamples int           // NB: defaults to 100
+}
+
+// hedger holds the options and measured latencies of hedged reads
+type hedger struct {
+	percentile float64
+	minDelay   time.Duration
+	maxDelay   time.Duration
+	minSamples int
+	latencies  map[reflect.Type]*latencyWindow
+	sync.Mutex
+}
+
+func newHedger(options *HedgingOptions) *hedger {
+	h := &hedger{
+		percentile: options.Percentile,
+		minDelay:   options.MinDelay,
+		maxDelay:   options.MaxDelay,
+		minSamples: options.MinSamples,
+		latencies:  make(map[reflect.Type]*latencyWindow),
+	}
+	if h.percentile <= 0 || h.percentile > 1 {
+		h.percentile = defaultHedgingPercentile
+	}
+	if h.minDelay <= 0 {
+		h.minDelay = defaultHedgingMinDelay
+	}
+	if h.maxDelay <= 0 {
+		h.maxDelay = defaultHedgingMaxDelay
+	}
+	if h.maxDelay < h.minDelay {
+		h.maxDelay = h.minDelay
+	}
+	if h.minSamples <= 0 {
+		h.minSamples = defaultHedgingMinSamples
+	}
+	return h
+}
+
+func (h *hedger) window(cmd Command) *latencyWindow {
+	t := reflect.TypeOf(cmd)
+	h.Lock()
+	defer h.Unlock()
+	w, ok := h.latencies[t]
+	if !ok {
+		w = &latencyWindow{samples: make([]time.Duration, 0, hedgingLatencySamples)}
+		h.latencies[t] = w
+	}
+	return w
+}
+
+// delay returns how long to wait before hedging cmd
+func (h *hedger) delay(cmd Command) time.Duration {
+	d, ok := h.window(cmd).percentile(h.percentile, h.minSamples)
+	if !ok || d > h.maxDelay {
+		return h.maxDelay
+	}
+	if d < h.minDelay {
+		return h.minDelay
+	}
+	return d
+}
+
+func (h *hedger) observe(cmd Command, d time.Duration) {
+	h.window(cmd).observe(d)
+}
+
+// latencyWindow holds the most recent latencies of a kind of command
+type latencyWindow struct {
+	samples  []time.Duration
+	next     int
+	observed int // NB: since the percentile was computed
+	computed float64
+	value    time.Duration
+	sync.Mutex
+}
+
+func (w *latencyWindow) observe(d time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+	if len(w.samples) < cap(w.samples) {
+		w.samples = append(w.samples, d)
+	} else {
+		w.samples[w.next] = d
+		w.next = (w.next + 1) % len(w.samples)
+	}
+	w.observed++
+}
+
+// percentile returns the p percentile of the samples, or false if there are fewer than
+// minSamples. NB: it is recomputed only after enough new samples, since that sorts them
+func (w *latencyWindow) percentile(p float64, minSamples int) (time.Duration, bool) {
+	w.Lock()
+	defer w.Unlock()
+	if len(w.samples) < minSamples {
+		return 0, false
+	}
+	if w.computed != p || w.observed >= hedgingRecomputeEvery || w.value == 0 {
+		sorted := make([]time.Duration, len(w.samples))
+		copy(sorted, w.samples)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		w.value = sorted[i]
+		w.computed = p
+		w.observed = 0
+	}
+	return w.value, true
+}
+
+// canHedge returns true if there are enough Nodes to hedge on
+func (c *Cluster) canHedge() bool {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.nodes) > 1
+}
+
+// executeHedged executes a clone of cmd, and a second clone if the first has not completed after
+// the hedge delay, then gives cmd the result of the first to succeed. NB: the clones are executed
+// rather than cmd itself, so that the one abandoned does not write to cmd
+func (c *Cluster) executeHedged(async *Async, cmd hedgeableCommand, primary hedgeableCommand) {
+	ctx, cancel := context.WithCancel(async.context())
+	defer cancel()
+
+	started := time.Now()
+	done := make(chan Command, 2)
+	executions := make(map[Command]*Async, 2)
+	execute := func(clone hedgeableCommand) {
+		sub := &Async{
+			Command: clone,
+			Context: ctx,
+			Done:    done,
+			hedge:   true,
+		}
+		executions[clone] = sub
+		go c.execute(sub)
+	}
+
+	execute(primary)
+	timer := time.NewTimer(c.hedger.delay(cmd))
+	defer timer.Stop()
+
+	var result *Async
+	for pending := 1; pending > 0; {
+		select {
+		case <-timer.C:
+			hedge := cmd.cloneCommand()
+			if rc, ok := hedge.(retryableCommand); ok {
+				// NB: the NodeManager avoids the Node the first execution is on
+				if n := primary.(retryableCommand).getLastNode(); n != nil {
+					rc.setLastNode(n)
+				}
+			}
+			c.log.debug("hedging command", "command", cmd.Name(), "after", time.Since(started))
+			execute(hedge)
+			pending++
+		case d := <-done:
+			pending--
+			result = executions[d]
+			if result.Error == nil && d.Error() == nil {
+				pending = 0
+				c.hedger.observe(cmd, time.Since(started))
+				if d != primary {
+					c.log.debug("hedge completed first", "command", cmd.Name())
+				}
+			}
+		}
+	}
+
+	cmd.adopt(result.Command.(hedgeableCommand))
+	async.done(result.Error)
+}
@@ -0,0 +1,216 @@
+package riak
+
+import (
+	"testing"
+	"time"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+func TestLatencyWindowPercentile(t *testing.T) {
+	w := &latencyWindow{samples: make([]time.Duration, 0, 10)}
+	for i := 1; i <= 9; i++ {
+		w.observe(time.Duration(i) * time.Millisecond)
+	}
+	if _, ok := w.percentile(0.5, 10); ok {
+		t.Error("expected no percentile below the minimum number of samples")
+	}
+	w.observe(10 * time.Millisecond)
+	if got, _ := w.percentile(0.5, 10); got != 5*time.Millisecond {
+		t.Errorf("expected median of 5ms, got %v", got)
+	}
+	if got, _ := w.percentile(0.95, 10); got != 10*time.Millisecond {
+		t.Errorf("expected 95th percentile of 10ms, got %v", got)
+	}
+
+	// NB: the oldest samples are replaced once the window is full
+	for i := 0; i < hedgingRecomputeEvery; i++ {
+		w.observe(time.Second)
+	}
+	if got, _ := w.percentile(0.5, 10); got != time.Second {
+		t.Errorf("expected median of 1s, got %v", got)
+	}
+}
+
+func TestHedgerDelay(t *testing.T) {
+	h := newHedger(&HedgingOptions{
+		MinDelay:   10 * time.Millisecond,
+		MaxDelay:   100 * time.Millisecond,
+		MinSamples: 5,
+	})
+	cmd := &FetchValueCommand{}
+	if got := h.delay(cmd); got != 100*time.Millisecond {
+		t.Errorf("expected MaxDelay without samples, got %v", got)
+	}
+	for i := 0; i < 5; i++ {
+		h.observe(cmd, time.Millisecond)
+	}
+	if got := h.delay(cmd); got != 10*time.Millisecond {
+		t.Errorf("expected MinDelay, got %v", got)
+	}
+	if got := h.delay(&FetchMapCommand{}); got != 100*time.Millisecond {
+		t.Errorf("expected latencies to be kept by kind of command, got %v", got)
+	}
+}
+
+func TestHedgeableCommandClone(t *testing.T) {
+	fetch, err := NewFetchValueCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		WithR(2).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := NewSecondaryIndexQueryCommandBuilder().
+		WithBucket("b").
+		WithIndexName("idx_bin").
+		WithIndexKey("v").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter, err := NewFetchCounterCommandBuilder().WithBucketType("counters").WithBucket("b").WithKey("k").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := NewFetchSetCommandBuilder().WithBucketType("sets").WithBucket("b").WithKey("k").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewFetchMapCommandBuilder().WithBucketType("maps").WithBucket("b").WithKey("k").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cmd := range []Command{fetch, query, counter, set, m} {
+		hc, ok := cmd.(hedgeableCommand)
+		if !ok {
+			t.Errorf("expected %T to be hedgeable", cmd)
+			continue
+		}
+		clone := hc.cloneCommand()
+		if clone == nil {
+			t.Errorf("expected %T to clone", cmd)
+			continue
+		}
+		original, _ := cmd.constructPbRequest()
+		cloned, _ := clone.constructPbRequest()
+		if original == cloned || !proto.Equal(original, cloned) {
+			t.Errorf("expected %T clone to have an equal copy of the request", cmd)
+		}
+	}
+
+	streaming, err := NewSecondaryIndexQueryCommandBuilder().
+		WithBucket("b").
+		WithIndexName("idx_bin").
+		WithIndexKey("v").
+		WithStreaming(true).
+		WithCallback(func([]*SecondaryIndexQueryResult) error { return nil }).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone := streaming.(hedgeableCommand).cloneCommand(); clone != nil {
+		t.Error("expected a streaming query not to be hedged")
+	}
+	if _, ok := interface{}(&StoreValueCommand{}).(hedgeableCommand); ok {
+		t.Error("expected StoreValue not to be hedgeable")
+	}
+}
+
+func storeOnNode(t *testing.T, node *Node, value string) {
+	cmd, err := NewStoreValueCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		WithContent(&Object{Value: []byte(value)}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = node.execute(cmd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterHedgesSlowRead(t *testing.T) {
+	servers := newTestServers(t, 2)
+	slow, fast := servers[0], servers[1]
+	observer := &recordingObserver{}
+	cluster, nodes := newTestCluster(t, nil, &ClusterOptions{
+		Observer: observer,
+		Hedging: &HedgingOptions{
+			MinDelay: 10 * time.Millisecond,
+			MaxDelay: 20 * time.Millisecond,
+		},
+	}, slow.Addr(), fast.Addr())
+	storeOnNode(t, nodes[0], "slow")
+	storeOnNode(t, nodes[1], "fast")
+	slow.SetLatency(500 * time.Millisecond)
+
+	cmd, err := NewFetchValueCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	if err = cluster.Execute(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed >= 500*time.Millisecond {
+		t.Errorf("expected hedge to complete before the slow node, took %v", elapsed)
+	}
+	fetch := cmd.(*FetchValueCommand)
+	if !fetch.Success() || fetch.Response == nil || len(fetch.Response.Values) != 1 {
+		t.Fatalf("expected one value, got %+v", fetch.Response)
+	}
+	if got := string(fetch.Response.Values[0].Value); got != "fast" {
+		t.Errorf("expected value from the fast node, got %q", got)
+	}
+	if got := fetch.getLastNode(); got != nodes[1] {
+		t.Errorf("expected command to report the fast node, got %v", got)
+	}
+
+	observer.Lock()
+	defer observer.Unlock()
+	if len(observer.started) != 2 {
+		t.Errorf("expected two executions, got %d", len(observer.started))
+	}
+}
+
+func TestClusterDoesNotHedgeFastRead(t *testing.T) {
+	servers := newTestServers(t, 2)
+	observer := &recordingObserver{}
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{
+		Observer: observer,
+		Hedging: &HedgingOptions{
+			MinDelay: 10 * time.Millisecond,
+			MaxDelay: 20 * time.Millisecond,
+		},
+	}, servers[0].Addr(), servers[1].Addr())
+	cluster.hedger.maxDelay = time.Second
+
+	for i := 0; i < 4; i++ {
+		cmd, err := NewFetchValueCommandBuilder().
+			WithBucket("b").
+			WithKey("k").
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = cluster.Execute(cmd); err != nil {
+			t.Fatal(err)
+		}
+		if !cmd.(*FetchValueCommand).Response.IsNotFound {
+			t.Error("expected not found")
+		}
+	}
+
+	observer.Lock()
+	defer observer.Unlock()
+	if len(observer.started) != 4 {
+		t.Errorf("expected one execution per command, got %d", len(observer.started))
+	}
+}
@@ -0,0 +1,674 @@
+package riak
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	rpbRiakDT "github.com/basho/riak-go-client/rpb/riak_dt"
+	rpbRiakKV "github.com/basho/riak-go-client/rpb/riak_kv"
+	proto "github.com/golang/protobuf/proto"
+)
+
+const (
+	defaultJournalMaxSegmentBytes = 16 << 20
+	defaultJournalReplayInterval  = time.Second
+	journalSegmentPattern         = "journal-*.log"
+	journalSegmentFormat          = "journal-%020d.log"
+	journalAckFile                = "journal.ack"
+	journalHeaderSize             = 8 // NB: record length and CRC-32 of the record
+	journalMaxRecordBytes         = 1 << 30
+)
+
+// JournalOptions enables a durable journal of write commands on a Cluster. See
+// ClusterOptions.Journal.
+//
+// A StoreValue, DeleteValue, UpdateCounter, UpdateSet or UpdateMap command that can not be executed
+// because no Node is available, and that was not written to Riak, is appended to the journal and
+// fails with ErrClusterCommandJournaled, meaning it was accepted and will be executed later. The
+// journal is synced to disk before that error is returned. While the journal holds commands, new
+// write commands are appended to it rather than executed, so that writes are executed in order.
+// These commands are not put in the Cluster's command queue.
+//
+// Every ReplayInterval, journaled commands are executed in order until one fails with an error
+// other than a RiakError. A command Riak rejects is logged and dropped, as is a command that is not
+// idempotent, such as a counter update, and fails with an OutcomeUnknownError. The journal is kept
+// in Dir across restarts of the process, and the segment files of commands that have been executed
+// are deleted. NB: a command is executed at least once, so a counter update may be applied twice if
+// the process exits after executing it but before recording that it was
+type JournalOptions struct {
+	Dir             string        // NB: required, created if it does not exist
+	MaxSegmentBytes int64         // NB: size at which a new segment file is started, defaults to 16MB
+	ReplayInterval  time.Duration // NB: defaults to 1s
+}
+
+// JournalStats describes the backlog of a Cluster's journal. See Cluster.JournalStats
+type JournalStats struct {
+	Pending  uint64 // NB: commands journaled and not yet executed
+	Segments int    // NB: segment files in the journal directory
+	Bytes    int64  // NB: size of the segment files, including executed commands not yet deleted
+}
+
+var errJournalTorn = errors.New("[Journal] incomplete or corrupt record")
+
+// journal is an append-only log of write commands, kept in segment files named after the sequence
+// number of their first record. Each record is its length, its CRC-32 and the command's request
+// code followed by its marshalled request. The sequence number of the first record not yet
+// acknowledged is kept in the ack file
+type journal struct {
+	dir             string
+	maxSegmentBytes int64
+	replayInterval  time.Duration
+	segments        []*journalSegment // NB: in order, records are appended to the last
+	active          *os.File
+	next            uint64 // NB: sequence number of the next record appended
+	acked           uint64 // NB: sequence number of the first record not acknowledged
+	reader          *journalReader
+	closed          bool
+	sync.Mutex
+}
+
+type journalSegment struct {
+	path  string
+	first uint64 // NB: sequence number of its first record
+	count uint64
+	size  int64
+}
+
+func (s *journalSegment) end() uint64 {
+	return s.first + s.count
+}
+
+// journalReader reads the records of a segment in order
+type journalReader struct {
+	segment *journalSegment
+	file    *os.File
+	r       *bufio.Reader
+	seq     uint64        // NB: sequence number of the next record read
+	entry   *journalEntry // NB: read and not yet acknowledged
+}
+
+func (r *journalReader) close() {
+	r.file.Close()
+}
+
+// journalEntry is a journaled command
+type journalEntry struct {
+	seq  uint64
+	code byte
+	data []byte
+}
+
+// openJournal opens the journal in options.Dir, truncating a record left incomplete by a crash and
+// deleting segments that have been acknowledged
+func openJournal(options *JournalOptions) (*journal, error) {
+	j := &journal{
+		dir:             options.Dir,
+		maxSegmentBytes: options.MaxSegmentBytes,
+		replayInterval:  options.ReplayInterval,
+	}
+	if j.maxSegmentBytes <= 0 {
+		j.maxSegmentBytes = defaultJournalMaxSegmentBytes
+	}
+	if j.replayInterval <= 0 {
+		j.replayInterval = defaultJournalReplayInterval
+	}
+	if err := os.MkdirAll(j.dir, 0755); err != nil {
+		return nil, err
+	}
+	acked, err := j.readAck()
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(j.dir, journalSegmentPattern))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		var first uint64
+		if _, err := fmt.Sscanf(filepath.Base(path), journalSegmentFormat, &first); err != nil {
+			continue
+		}
+		j.segments = append(j.segments, &journalSegment{path: path, first: first})
+	}
+	sort.Slice(j.segments, func(a, b int) bool { return j.segments[a].first < j.segments[b].first })
+	for i, s := range j.segments {
+		if err := s.scan(i == len(j.segments)-1); err != nil {
+			return nil, err
+		}
+	}
+
+	j.acked, j.next = acked, acked
+	if n := len(j.segments); n > 0 {
+		if first := j.segments[0].first; j.acked < first {
+			j.acked = first
+		}
+		if end := j.segments[n-1].end(); end > j.next {
+			j.next = end
+		}
+	}
+	j.compact()
+
+	if n := len(j.segments); n > 0 && j.segments[n-1].size < j.maxSegmentBytes {
+		j.active, err = os.OpenFile(j.segments[n-1].path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return j, nil
+	}
+	if err = j.roll(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// scan counts the records of the segment. An incomplete record at the end of the last segment is
+// truncated, since it was being appended when the process exited
+func (s *journalSegment) scan(last bool) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		payload, err := readJournalRecord(r)
+		switch {
+		case err == io.EOF:
+			return nil
+		case err == errJournalTorn && last:
+			return os.Truncate(s.path, s.size)
+		case err != nil:
+			return newClientError(fmt.Sprintf("[Journal] could not read segment %s", s.path), err)
+		}
+		s.count++
+		s.size += int64(journalHeaderSize + len(payload))
+	}
+}
+
+// readJournalRecord returns the payload of the next record of r, io.EOF at the end of the segment
+// or errJournalTorn if the record is incomplete or corrupt
+func readJournalRecord(r io.Reader) ([]byte, error) {
+	var header [journalHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errJournalTorn
+		}
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[0:4])
+	if n == 0 || n > journalMaxRecordBytes {
+		return nil, errJournalTorn
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errJournalTorn
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errJournalTorn
+	}
+	return payload, nil
+}
+
+// append durably appends a record of the command with request code and marshalled request data
+func (j *journal) append(code byte, data []byte) error {
+	j.Lock()
+	defer j.Unlock()
+	if j.closed {
+		return ErrClusterJournalClosed
+	}
+	s := j.segments[len(j.segments)-1]
+	if s.size >= j.maxSegmentBytes {
+		if err := j.roll(); err != nil {
+			return err
+		}
+		s = j.segments[len(j.segments)-1]
+	}
+
+	record := make([]byte, journalHeaderSize+1+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(1+len(data)))
+	record[journalHeaderSize] = code
+	copy(record[journalHeaderSize+1:], data)
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[journalHeaderSize:]))
+
+	_, err := j.active.Write(record)
+	if err == nil {
+		err = j.active.Sync()
+	}
+	if err != nil {
+		// NB: so that the next record follows the last complete one
+		j.active.Truncate(s.size)
+		return err
+	}
+	s.count++
+	s.size += int64(len(record))
+	j.next++
+	return nil
+}
+
+// roll starts a new segment, which records are appended to
+func (j *journal) roll() error {
+	path := filepath.Join(j.dir, fmt.Sprintf(journalSegmentFormat, j.next))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if j.active != nil {
+		j.active.Close()
+	}
+	j.active = f
+	j.segments = append(j.segments, &journalSegment{path: path, first: j.next})
+	j.compact()
+	return nil
+}
+
+// compact deletes the segments, other than the one being appended to, whose records have all been
+// acknowledged. NB: a segment that can not be deleted is tried again by the next compaction
+func (j *journal) compact() {
+	for len(j.segments) > 1 && j.segments[0].end() <= j.acked {
+		s := j.segments[0]
+		if j.reader != nil && j.reader.segment == s {
+			j.reader.close()
+			j.reader = nil
+		}
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		j.segments = j.segments[1:]
+	}
+}
+
+// peek returns the first record not acknowledged, or nil if there is none
+func (j *journal) peek() (*journalEntry, error) {
+	j.Lock()
+	defer j.Unlock()
+	if j.closed {
+		return nil, ErrClusterJournalClosed
+	}
+	if j.acked >= j.next {
+		return nil, nil
+	}
+	if j.reader != nil {
+		if j.reader.entry != nil {
+			return j.reader.entry, nil
+		}
+		if j.reader.seq >= j.reader.segment.end() {
+			j.reader.close()
+			j.reader = nil
+		}
+	}
+	if j.reader == nil {
+		if err := j.openReader(); err != nil {
+			return nil, err
+		}
+	}
+	payload, err := readJournalRecord(j.reader.r)
+	if err != nil {
+		// NB: read the record again from a new reader next time
+		j.reader.close()
+		j.reader = nil
+		return nil, err
+	}
+	j.reader.entry = &journalEntry{
+		seq:  j.reader.seq,
+		code: payload[0],
+		data: payload[1:],
+	}
+	return j.reader.entry, nil
+}
+
+// openReader opens the segment holding the first record not acknowledged, positioned at that record
+func (j *journal) openReader() error {
+	var segment *journalSegment
+	for _, s := range j.segments {
+		if j.acked >= s.first && j.acked < s.end() {
+			segment = s
+			break
+		}
+	}
+	if segment == nil {
+		return newClientError(fmt.Sprintf("[Journal] no segment holds record %d", j.acked), nil)
+	}
+	f, err := os.Open(segment.path)
+	if err != nil {
+		return err
+	}
+	reader := &journalReader{
+		segment: segment,
+		file:    f,
+		r:       bufio.NewReader(f),
+		seq:     segment.first,
+	}
+	for ; reader.seq < j.acked; reader.seq++ {
+		if _, err = readJournalRecord(reader.r); err != nil {
+			reader.close()
+			return err
+		}
+	}
+	j.reader = reader
+	return nil
+}
+
+// ack acknowledges the first record not acknowledged, which has been executed
+func (j *journal) ack() error {
+	j.Lock()
+	defer j.Unlock()
+	if j.closed {
+		return ErrClusterJournalClosed
+	}
+	if j.acked >= j.next {
+		return nil
+	}
+	j.acked++
+	if j.reader != nil {
+		if j.reader.entry != nil {
+			j.reader.entry = nil
+			j.reader.seq++
+		} else {
+			j.reader.close()
+			j.reader = nil
+		}
+	}
+	if err := j.writeAck(); err != nil {
+		return err
+	}
+	j.compact()
+	return nil
+}
+
+func (j *journal) readAck() (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(j.dir, journalAckFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// writeAck replaces the ack file, so that it is never seen partly written
+func (j *journal) writeAck() error {
+	path := filepath.Join(j.dir, journalAckFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strconv.FormatUint(j.acked, 10))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (j *journal) pending() uint64 {
+	j.Lock()
+	defer j.Unlock()
+	return j.next - j.acked
+}
+
+func (j *journal) stats() JournalStats {
+	j.Lock()
+	defer j.Unlock()
+	stats := JournalStats{
+		Pending:  j.next - j.acked,
+		Segments: len(j.segments),
+	}
+	for _, s := range j.segments {
+		stats.Bytes += s.size
+	}
+	return stats
+}
+
+func (j *journal) close() error {
+	j.Lock()
+	defer j.Unlock()
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+	if j.reader != nil {
+		j.reader.close()
+		j.reader = nil
+	}
+	return j.active.Close()
+}
+
+// isJournalable returns true if cmd is a write command that may be journaled, see JournalOptions
+func isJournalable(cmd Command) bool {
+	switch cmd.(type) {
+	case *StoreValueCommand, *DeleteValueCommand, *UpdateCounterCommand, *UpdateSetCommand, *UpdateMapCommand:
+		return true
+	default:
+		return false
+	}
+}
+
+// journaledCommand is a command read back from the journal to be executed
+type journaledCommand struct {
+	commandImpl
+	retryableCommandImpl
+	code     byte
+	protobuf proto.Message
+}
+
+// newJournaledCommand returns the command of entry, with its request unmarshalled
+func newJournaledCommand(entry *journalEntry) (*journaledCommand, error) {
+	var msg proto.Message
+	switch entry.code {
+	case rpbCode_RpbPutReq:
+		msg = &rpbRiakKV.RpbPutReq{}
+	case rpbCode_RpbDelReq:
+		msg = &rpbRiakKV.RpbDelReq{}
+	case rpbCode_RpbCounterUpdateReq:
+		msg = &rpbRiakKV.RpbCounterUpdateReq{}
+	case rpbCode_DtUpdateReq:
+		msg = &rpbRiakDT.DtUpdateReq{}
+	default:
+		return nil, newClientError(fmt.Sprintf("[Journal] unexpected request code %d", entry.code), nil)
+	}
+	if err := proto.Unmarshal(entry.data, msg); err != nil {
+		return nil, err
+	}
+	return &journaledCommand{
+		code:     entry.code,
+		protobuf: msg,
+	}, nil
+}
+
+// Name identifies this command
+func (cmd *journaledCommand) Name() string {
+	return cmd.getName("Journaled")
+}
+
+// isIdempotent returns false for updates that increment counters, or stores without a vclock, as
+// the commands they were journaled from
+func (cmd *journaledCommand) isIdempotent() bool {
+	switch msg := cmd.protobuf.(type) {
+	case *rpbRiakKV.RpbPutReq:
+		return msg.Vclock != nil
+	case *rpbRiakKV.RpbCounterUpdateReq:
+		return false
+	case *rpbRiakDT.DtUpdateReq:
+		op := msg.GetOp()
+		return op.GetCounterOp() == nil && !mapOpIncrementsCounters(op.GetMapOp())
+	default:
+		return true
+	}
+}
+
+func mapOpIncrementsCounters(op *rpbRiakDT.MapOp) bool {
+	for _, update := range op.GetUpdates() {
+		if update.GetCounterOp() != nil || mapOpIncrementsCounters(update.GetMapOp()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cmd *journaledCommand) getRequestCode() byte {
+	return cmd.code
+}
+
+func (cmd *journaledCommand) constructPbRequest() (proto.Message, error) {
+	return cmd.protobuf, nil
+}
+
+func (cmd *journaledCommand) onSuccess(msg proto.Message) error {
+	cmd.success = true
+	return nil
+}
+
+func (cmd *journaledCommand) getResponseCode() byte {
+	switch cmd.code {
+	case rpbCode_RpbPutReq:
+		return rpbCode_RpbPutResp
+	case rpbCode_RpbDelReq:
+		return rpbCode_RpbDelResp
+	case rpbCode_RpbCounterUpdateReq:
+		return rpbCode_RpbCounterUpdateResp
+	default:
+		return rpbCode_DtUpdateResp
+	}
+}
+
+func (cmd *journaledCommand) getResponseProtobufMessage() proto.Message {
+	switch cmd.code {
+	case rpbCode_RpbPutReq:
+		return &rpbRiakKV.RpbPutResp{}
+	case rpbCode_RpbDelReq:
+		return nil
+	case rpbCode_RpbCounterUpdateReq:
+		return &rpbRiakKV.RpbCounterUpdateResp{}
+	default:
+		return &rpbRiakDT.DtUpdateResp{}
+	}
+}
+
+// journalCommand appends cmd to the journal, returning ErrClusterCommandJournaled if it was
+func (c *Cluster) journalCommand(cmd Command) error {
+	msg, err := cmd.constructPbRequest()
+	if err != nil {
+		return err
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err = c.journal.append(cmd.getRequestCode(), data); err != nil {
+		c.log.err("could not journal command", err, "command", cmd.Name())
+		return newClientError(ErrClusterJournalFailed, err)
+	}
+	c.log.debug("journaled command", "command", cmd.Name())
+	return ErrClusterCommandJournaled
+}
+
+// journals returns true if the command of async is to be journaled when no Node can execute it
+func (c *Cluster) journals(async *Async) bool {
+	return c.journal != nil && !async.replay && isJournalable(async.Command)
+}
+
+// shouldJournal returns true if the command of async, which failed with err, is to be journaled:
+// it is a write command that was not written to Riak because no Node could execute it
+func (c *Cluster) shouldJournal(async *Async, err error) bool {
+	if err == nil || !c.journals(async) {
+		return false
+	}
+	var clientErr ClientError
+	if !errors.As(err, &clientErr) || clientErr.Errmsg != ErrClusterNoNodesAvailable {
+		return false
+	}
+	var riakErr RiakError
+	return !async.Command.getRequestWritten() && !errors.As(err, &riakErr) && !isContextError(err)
+}
+
+// replayJournal executes journaled commands every replay interval, until the Cluster is stopped
+func (c *Cluster) replayJournal() {
+	defer close(c.journalDone)
+	ticker := time.NewTicker(c.journal.replayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.journalStop:
+			return
+		case <-ticker.C:
+			c.replayJournalEntries()
+		}
+	}
+}
+
+// replayJournalEntries executes journaled commands in order until there are none left or one fails
+// with an error other than a RiakError
+func (c *Cluster) replayJournalEntries() {
+	for {
+		select {
+		case <-c.journalStop:
+			return
+		default:
+		}
+		entry, err := c.journal.peek()
+		if err != nil {
+			c.log.err("could not read journal", err)
+			return
+		}
+		if entry == nil {
+			return
+		}
+		cmd, err := newJournaledCommand(entry)
+		if err == nil {
+			async := &Async{
+				Command: cmd,
+				replay:  true,
+			}
+			c.execute(async)
+			if err = async.Error; err == nil {
+				err = cmd.Error()
+			}
+			var riakErr RiakError
+			if err != nil && !errors.As(err, &riakErr) && !IsOutcomeUnknown(err) {
+				c.log.debug("journal replay stopped, command failed", "seq", entry.seq, "err", err)
+				return
+			}
+		}
+		// NB: a command Riak may have applied is not executed again, it could be applied twice
+		if IsOutcomeUnknown(err) {
+			c.log.err("dropping journaled command, outcome unknown", err, "seq", entry.seq)
+		} else if err != nil {
+			c.log.err("dropping journaled command", err, "seq", entry.seq)
+		}
+		if err = c.journal.ack(); err != nil {
+			c.log.err("could not acknowledge journaled command", err, "seq", entry.seq)
+			return
+		}
+	}
+}
+
+// JournalStats returns the backlog of the Cluster's journal, see JournalOptions. It is zero if
+// ClusterOptions.Journal was not set
+func (c *Cluster) JournalStats() JournalStats {
+	if c.journal == nil {
+		return JournalStats{}
+	}
+	return c.journal.stats()
+}
@@ -0,0 +1,330 @@
+package riak
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/basho/riak-go-client/riaktest"
+	proto "github.com/golang/protobuf/proto"
+)
+
+func journalSegmentFiles(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, journalSegmentPattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestJournalAppendAckReopen(t *testing.T) {
+	dir := t.TempDir()
+	options := &JournalOptions{Dir: dir, MaxSegmentBytes: 16}
+	j, err := openJournal(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(0); i < 5; i++ {
+		if err = j.append(rpbCode_RpbPutReq, []byte{'a' + i, 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l'}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// NB: each record fills a segment
+	if s := j.stats(); s.Pending != 5 || s.Segments != 5 || s.Bytes != 5*21 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	for i := byte(0); i < 3; i++ {
+		entry, err := j.peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.seq != uint64(i) || entry.code != rpbCode_RpbPutReq || entry.data[0] != 'a'+i {
+			t.Fatalf("unexpected entry %+v", entry)
+		}
+		if err = j.ack(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(journalSegmentFiles(t, dir)); got != 2 {
+		t.Errorf("expected acknowledged segments to be deleted, %d remain", got)
+	}
+	if err = j.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if j, err = openJournal(options); err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	if s := j.stats(); s.Pending != 2 || s.Segments != 3 {
+		t.Errorf("unexpected stats after reopening %+v", s)
+	}
+	entry, err := j.peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.seq != 3 || entry.data[0] != 'd' {
+		t.Errorf("expected the first record not acknowledged, got %+v", entry)
+	}
+}
+
+func TestJournalTruncatesIncompleteRecord(t *testing.T) {
+	dir := t.TempDir()
+	j, err := openJournal(&JournalOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"one", "two"} {
+		if err = j.append(rpbCode_RpbDelReq, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.close()
+
+	// NB: a record being appended when the process exited
+	paths := journalSegmentFiles(t, dir)
+	f, err := os.OpenFile(paths[len(paths)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 9, 1, 2})
+	f.Close()
+
+	if j, err = openJournal(&JournalOptions{Dir: dir}); err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	if err = j.append(rpbCode_RpbDelReq, []byte("three")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"one", "two", "three"} {
+		entry, err := j.peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil || string(entry.data) != want {
+			t.Fatalf("expected %q, got %+v", want, entry)
+		}
+		j.ack()
+	}
+	if entry, err := j.peek(); entry != nil || err != nil {
+		t.Errorf("expected no more records, got %+v %v", entry, err)
+	}
+}
+
+func TestClusterJournalDirRequired(t *testing.T) {
+	if _, err := NewCluster(&ClusterOptions{Journal: &JournalOptions{}}); err != ErrClusterJournalDirRequired {
+		t.Errorf("expected ErrClusterJournalDirRequired, got %v", err)
+	}
+}
+
+func TestClusterJournalsWritesDuringOutage(t *testing.T) {
+	srv, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := srv.Addr()
+	dir := t.TempDir()
+	cluster, nodes := newTestCluster(t, &NodeOptions{HealthCheckInterval: 10 * time.Millisecond}, &ClusterOptions{
+		ExecutionAttempts: 1,
+		Journal: &JournalOptions{
+			Dir:            dir,
+			ReplayInterval: 10 * time.Millisecond,
+		},
+	}, addr)
+	node := nodes[0]
+	srv.Stop()
+	// NB: a failed ping has the node health checked, so that no write is sent on a stale connection
+	cluster.Execute(&PingCommand{})
+	for node.isCurrentState(nodeRunning) {
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, value := range []string{"first", "second"} {
+		cmd, err := NewStoreValueCommandBuilder().
+			WithBucket("b").
+			WithKey("k").
+			WithContent(&Object{Value: []byte(value)}).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = cluster.Execute(cmd); err != ErrClusterCommandJournaled {
+			t.Fatalf("expected %q to be journaled, got %v", value, err)
+		}
+	}
+	if got := cluster.JournalStats().Pending; got != 2 {
+		t.Errorf("expected 2 journaled commands, got %d", got)
+	}
+	cluster.Stop()
+
+	// NB: the journal is kept when the process restarts
+	if srv, err = riaktest.NewServer(&riaktest.ServerOptions{Address: addr}); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	cluster, _ = newTestCluster(t, &NodeOptions{HealthCheckInterval: 10 * time.Millisecond}, &ClusterOptions{
+		ExecutionAttempts: 1,
+		Journal: &JournalOptions{
+			Dir:            dir,
+			ReplayInterval: 10 * time.Millisecond,
+		},
+	}, addr)
+	deadline := time.Now().Add(5 * time.Second)
+	for cluster.JournalStats().Pending != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected journaled commands to be replayed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cmd, err := NewFetchValueCommandBuilder().WithBucket("b").WithKey("k").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(cmd); err != nil {
+		t.Fatal(err)
+	}
+	values := cmd.(*FetchValueCommand).Response.Values
+	if len(values) != 1 || string(values[0].Value) != "second" {
+		t.Errorf("expected the last journaled value, got %v", values)
+	}
+}
+
+// journalOutage starts a Cluster with a journal and options, and stops srv so that write commands
+// are journaled
+func journalOutage(t *testing.T, srv *riaktest.Server, options *ClusterOptions) (*Cluster, *Node) {
+	options.ExecutionAttempts = 1
+	options.Journal = &JournalOptions{
+		Dir:            t.TempDir(),
+		ReplayInterval: 200 * time.Millisecond,
+	}
+	cluster, nodes := newTestCluster(t, &NodeOptions{HealthCheckInterval: 10 * time.Millisecond}, options, srv.Addr())
+	srv.Stop()
+	// NB: a failed ping has the node health checked, so that no write is sent on a stale connection
+	cluster.Execute(&PingCommand{})
+	for nodes[0].isCurrentState(nodeRunning) {
+		time.Sleep(time.Millisecond)
+	}
+	return cluster, nodes[0]
+}
+
+func newJournalTestStore(t *testing.T) Command {
+	cmd, err := NewStoreValueCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		WithContent(&Object{Value: []byte("v")}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestClusterJournalChecksAdmissionAndState(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	cluster, _ := journalOutage(t, srv, &ClusterOptions{
+		Admission: &AdmissionOptions{
+			RateLimits: map[string]RateLimit{"StoreValue": {Rate: 0.001}},
+			Reject:     true,
+		},
+	})
+	if err := cluster.Execute(newJournalTestStore(t)); err != ErrClusterCommandJournaled {
+		t.Fatalf("expected the write to be journaled, got %v", err)
+	}
+
+	// NB: behind the journaled write, but over the rate limit
+	if err := cluster.Execute(newJournalTestStore(t)); !IsAdmissionRejected(err) {
+		t.Errorf("expected the write to be rejected, got %v", err)
+	}
+	cluster.admission = nil
+
+	if err := cluster.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	want := cluster.Execute(&PingCommand{})
+	if err := cluster.Execute(newJournalTestStore(t)); err == nil || err == ErrClusterCommandJournaled || err.Error() != want.Error() {
+		t.Errorf("expected the write to fail as the Cluster is stopped with %v, got %v", want, err)
+	}
+}
+
+func TestClusterJournalDropsCommandWithUnknownOutcome(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	addr := srv.Addr()
+	cluster, node := journalOutage(t, srv, &ClusterOptions{})
+	cmd, err := NewUpdateCounterCommandBuilder().
+		WithBucketType("counters").
+		WithBucket("b").
+		WithKey("k").
+		WithIncrement(1).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(cmd); err != ErrClusterCommandJournaled {
+		t.Fatalf("expected the update to be journaled, got %v", err)
+	}
+
+	if srv, err = riaktest.NewServer(&riaktest.ServerOptions{Address: addr}); err != nil {
+		t.Fatal(err)
+	}
+	for !node.isCurrentState(nodeRunning) {
+		time.Sleep(time.Millisecond)
+	}
+	// NB: the replayed update is written, and the server stops before responding
+	srv.SetLatency(time.Second)
+	time.Sleep(300 * time.Millisecond)
+	srv.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for cluster.JournalStats().Pending != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the update with an unknown outcome to be dropped rather than replayed again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJournaledCommandIsIdempotent(t *testing.T) {
+	counter, err := NewUpdateCounterCommandBuilder().WithBucket("b").WithKey("k").WithIncrement(1).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := NewUpdateSetCommandBuilder().WithBucket("b").WithKey("k").WithAdditions([]byte("a")).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapOp := &MapOperation{}
+	mapOp.Map("inner").IncrementCounter("c", 1)
+	updateMap, err := NewUpdateMapCommandBuilder().WithBucket("b").WithKey("k").WithMapOperation(mapOp).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		cmd        Command
+		idempotent bool
+	}{
+		{newJournalTestStore(t), false},
+		{counter, false},
+		{set, true},
+		{updateMap, false},
+	} {
+		msg, err := tc.cmd.constructPbRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		journaled, err := newJournaledCommand(&journalEntry{code: tc.cmd.getRequestCode(), data: data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := journaled.isIdempotent(); got != tc.idempotent {
+			t.Errorf("%s: expected isIdempotent %v, got %v", tc.cmd.Name(), tc.idempotent, got)
+		}
+	}
+}
@@ -24,9 +24,10 @@ type FetchValueCommand struct {
 	commandImpl
 	timeoutImpl
 	retryableCommandImpl
-	Response *FetchValueResponse
-	protobuf *rpbRiakKV.RpbGetReq
-	resolver ConflictResolver
+	Response    *FetchValueResponse
+	protobuf    *rpbRiakKV.RpbGetReq
+	resolver    ConflictResolver
+	compression *compression
 }
 
 // Name identifies this command
@@ -34,6 +35,33 @@ func (cmd *FetchValueCommand) Name() string {
 	return cmd.getName("FetchValue")
 }
 
+func (cmd *FetchValueCommand) getLocation() (location, bool) {
+	return locationOf(cmd.protobuf)
+}
+
+func (cmd *FetchValueCommand) cloneCommand() hedgeableCommand {
+	return &FetchValueCommand{
+		commandImpl: commandImpl{name: cmd.name},
+		timeoutImpl: cmd.timeoutImpl,
+		protobuf:    proto.Clone(cmd.protobuf).(*rpbRiakKV.RpbGetReq),
+		resolver:    cmd.resolver,
+		compression: cmd.compression,
+	}
+}
+
+func (cmd *FetchValueCommand) setCompression(c *compression) {
+	cmd.compression = c
+}
+
+func (cmd *FetchValueCommand) adopt(c hedgeableCommand) {
+	clone := c.(*FetchValueCommand)
+	cmd.adoptResult(&clone.commandImpl)
+	cmd.Response = clone.Response
+	if n := clone.getLastNode(); n != nil {
+		cmd.setLastNode(n)
+	}
+}
+
 func (cmd *FetchValueCommand) constructPbRequest() (proto.Message, error) {
 	return cmd.protobuf, nil
 }
@@ -65,7 +93,7 @@ func (cmd *FetchValueCommand) onSuccess(msg proto.Message) error {
 			} else {
 				response.Values = make([]*Object, len(pbContent))
 				for i, content := range pbContent {
-					ro, err := fromRpbContent(content)
+					ro, err := fromRpbContent(content, cmd.compression)
 					if err != nil {
 						return err
 					}
@@ -259,10 +287,11 @@ type StoreValueCommand struct {
 	commandImpl
 	timeoutImpl
 	retryableCommandImpl
-	Response *StoreValueResponse
-	value    *Object
-	protobuf *rpbRiakKV.RpbPutReq
-	resolver ConflictResolver
+	Response    *StoreValueResponse
+	value       *Object
+	protobuf    *rpbRiakKV.RpbPutReq
+	resolver    ConflictResolver
+	compression *compression
 }
 
 // Name identifies this command
@@ -270,6 +299,35 @@ func (cmd *StoreValueCommand) Name() string {
 	return cmd.getName("StoreValue")
 }
 
+// NB: storing a value without a vclock creates a sibling, or a new object if Riak generates the key
+func (cmd *StoreValueCommand) isIdempotent() bool {
+	if cmd.value != nil && cmd.value.VClock != nil {
+		return true
+	}
+	return cmd.protobuf.Vclock != nil
+}
+
+// NB: as in setProtobufFromValue, properties of the value override options
+func (cmd *StoreValueCommand) getLocation() (location, bool) {
+	loc, _ := locationOf(cmd.protobuf)
+	if v := cmd.value; v != nil {
+		if v.BucketType != "" {
+			loc.bucketType = v.BucketType
+		}
+		if v.Bucket != "" {
+			loc.bucket = v.Bucket
+		}
+		if v.Key != "" {
+			loc.key = v.Key
+		}
+	}
+	return loc, loc.bucket != "" && loc.key != ""
+}
+
+func (cmd *StoreValueCommand) setCompression(c *compression) {
+	cmd.compression = c
+}
+
 func (cmd *StoreValueCommand) constructPbRequest() (msg proto.Message, err error) {
 	value := cmd.value
 
@@ -280,6 +338,9 @@ func (cmd *StoreValueCommand) constructPbRequest() (msg proto.Message, err error
 	if err != nil {
 		return
 	}
+	if err = cmd.compression.compress(string(cmd.protobuf.Type), string(cmd.protobuf.Bucket), cmd.protobuf.Content); err != nil {
+		return
+	}
 
 	msg = cmd.protobuf
 	return
@@ -305,7 +366,7 @@ func (cmd *StoreValueCommand) onSuccess(msg proto.Message) error {
 			if pbContent := rpbPutResp.GetContent(); pbContent != nil && len(pbContent) > 0 {
 				response.Values = make([]*Object, len(pbContent))
 				for i, content := range pbContent {
-					ro, err := fromRpbContent(content)
+					ro, err := fromRpbContent(content, cmd.compression)
 					if err != nil {
 						return err
 					}
@@ -374,10 +435,12 @@ type StoreValueResponse struct {
 //		WithBucket("myBucket").
 //		Build()
 type StoreValueCommandBuilder struct {
-	value    *Object
-	timeout  time.Duration
-	protobuf *rpbRiakKV.RpbPutReq
-	resolver ConflictResolver
+	value       *Object
+	timeout     time.Duration
+	protobuf    *rpbRiakKV.RpbPutReq
+	resolver    ConflictResolver
+	encode      bool
+	encodeValue interface{} // NB: set by WithValue, encoded by Build
 }
 
 // NewStoreValueCommandBuilder is a factory function for generating the command builder struct
@@ -424,6 +487,21 @@ func (builder *StoreValueCommandBuilder) WithContent(object *Object) *StoreValue
 	return builder
 }
 
+// WithValue sets v, encoded with the Serializer registered for the ContentType of the content set
+// with WithContent, as the value to be stored. ContentType defaults to application/json, and Build
+// fails if no Serializer is registered for it. See RegisterSerializer
+//
+//	command, err := NewStoreValueCommandBuilder().
+//		WithBucket("myBucket").
+//		WithKey("myKey").
+//		WithValue(&Person{Name: "Alice"}).
+//		Build()
+func (builder *StoreValueCommandBuilder) WithValue(v interface{}) *StoreValueCommandBuilder {
+	builder.encode = true
+	builder.encodeValue = v
+	return builder
+}
+
 // WithW sets the number of nodes that must report back a successful write in order for then
 // command operation to be considered a success by Riak
 //
@@ -521,8 +599,19 @@ func (builder *StoreValueCommandBuilder) Build() (Command, error) {
 	if err := validateLocatable(builder.protobuf); err != nil {
 		return nil, err
 	}
+	value := builder.value
+	if builder.encode {
+		// NB: the content set with WithContent is not modified
+		value = &Object{}
+		if builder.value != nil {
+			*value = *builder.value
+		}
+		if err := value.SetValue(builder.encodeValue); err != nil {
+			return nil, err
+		}
+	}
 	return &StoreValueCommand{
-		value: builder.value,
+		value: value,
 		timeoutImpl: timeoutImpl{
 			timeout: builder.timeout,
 		},
@@ -548,6 +637,10 @@ func (cmd *DeleteValueCommand) Name() string {
 	return cmd.getName("DeleteValue")
 }
 
+func (cmd *DeleteValueCommand) getLocation() (location, bool) {
+	return locationOf(cmd.protobuf)
+}
+
 func (cmd *DeleteValueCommand) constructPbRequest() (msg proto.Message, err error) {
 	msg = cmd.protobuf
 	return
@@ -1163,6 +1256,25 @@ func (cmd *SecondaryIndexQueryCommand) Name() string {
 	return cmd.getName("SecondaryIndexQuery")
 }
 
+// NB: a streaming query delivers results to its callback as they arrive, so it is not hedged
+func (cmd *SecondaryIndexQueryCommand) cloneCommand() hedgeableCommand {
+	if cmd.protobuf.GetStream() {
+		return nil
+	}
+	return &SecondaryIndexQueryCommand{
+		commandImpl: commandImpl{name: cmd.name},
+		timeoutImpl: cmd.timeoutImpl,
+		protobuf:    proto.Clone(cmd.protobuf).(*rpbRiakKV.RpbIndexReq),
+	}
+}
+
+func (cmd *SecondaryIndexQueryCommand) adopt(c hedgeableCommand) {
+	clone := c.(*SecondaryIndexQueryCommand)
+	cmd.adoptResult(&clone.commandImpl)
+	cmd.Response = clone.Response
+	cmd.done = clone.done
+}
+
 func (cmd *SecondaryIndexQueryCommand) constructPbRequest() (proto.Message, error) {
 	if cmd.protobuf.GetKey() != nil {
 		cmd.protobuf.Qtype = rpbRiakKV.RpbIndexReq_eq.Enum()
@@ -30,3 +30,34 @@ func validateLocatable(msg proto.Message) error {
 	}
 	return nil
 }
+
+// location identifies the bucket type, bucket and key a command operates on
+type location struct {
+	bucketType string
+	bucket     string
+	key        string
+}
+
+// Interface implemented by Command types that operate on a single key, allowing a NodeManager to
+// route them to a node that owns the key
+type keyedCommand interface {
+	getLocation() (location, bool)
+}
+
+// locationOf returns the location of a request message. It returns false if the key has not been
+// set, for example when Riak is to generate one
+func locationOf(msg proto.Message) (location, bool) {
+	l, ok := msg.(rpbLocatable)
+	if !ok {
+		return location{}, false
+	}
+	loc := location{
+		bucketType: string(l.GetType()),
+		bucket:     string(l.GetBucket()),
+		key:        string(l.GetKey()),
+	}
+	if loc.bucketType == "" {
+		loc.bucketType = defaultBucketType
+	}
+	return loc, loc.bucket != "" && loc.key != ""
+}
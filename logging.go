@@ -1,15 +1,17 @@
 package riak
 
-// Bare-bones logging to enable/disable debug logging
+// Bare-bones logging to enable/disable debug logging, and the Logger interface used to plug in
+// other logging libraries
 
 import (
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
 )
 
-// If true, debug messages will be written to the log
+// If true, debug messages will be written to the default log
 var EnableDebugLogging = false
 
 var errLogger = log.New(os.Stderr, "", log.LstdFlags)
@@ -21,6 +23,144 @@ func init() {
 	}
 }
 
+// Logger is implemented by types that receive the log output of a Cluster and its Nodes. Each entry
+// consists of a message and alternating key / value pairs with details such as the node address,
+// command name, attempt and state. Implementations must be safe for concurrent use.
+//
+// NewStdLogger and NewSlogLogger adapt the standard library loggers. When no Logger is set, entries
+// are written to Stderr and debug entries are only written if EnableDebugLogging is true
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// NewStdLogger returns a Logger that writes entries to l in the form
+//
+//	[LEVEL] msg key1=value1 key2=value2
+//
+// Debug entries are only written if debug is true
+func NewStdLogger(l *log.Logger, debug bool) Logger {
+	if l == nil {
+		panic("[Logger] nil log.Logger argument")
+	}
+	return &stdLogger{
+		out:    l,
+		errOut: l,
+		debug:  func() bool { return debug },
+	}
+}
+
+type stdLogger struct {
+	out    *log.Logger
+	errOut *log.Logger
+	debug  func() bool
+}
+
+func (l *stdLogger) Debug(msg string, keyvals ...interface{}) {
+	if l.debug() {
+		l.out.Println(formatEntry("DEBUG", msg, keyvals))
+	}
+}
+
+func (l *stdLogger) Info(msg string, keyvals ...interface{}) {
+	l.out.Println(formatEntry("INFO", msg, keyvals))
+}
+
+func (l *stdLogger) Warn(msg string, keyvals ...interface{}) {
+	l.out.Println(formatEntry("WARNING", msg, keyvals))
+}
+
+func (l *stdLogger) Error(msg string, keyvals ...interface{}) {
+	l.errOut.Println(formatEntry("ERROR", msg, keyvals))
+}
+
+func formatEntry(level, msg string, keyvals []interface{}) string {
+	var b strings.Builder
+	b.WriteString("[")
+	b.WriteString(level)
+	b.WriteString("] ")
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		b.WriteString(" ")
+		fmt.Fprint(&b, keyvals[i])
+		b.WriteString("=")
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(&b, "%v", keyvals[i+1])
+		} else {
+			b.WriteString("MISSING")
+		}
+	}
+	return b.String()
+}
+
+// packageLogger is the Logger used when none is set. It writes to the package level log.Loggers so
+// that setLogWriter and EnableDebugLogging apply
+type packageLogger struct{}
+
+func (packageLogger) Debug(msg string, keyvals ...interface{}) {
+	if EnableDebugLogging {
+		logger.Println(formatEntry("DEBUG", msg, keyvals))
+	}
+}
+
+func (packageLogger) Info(msg string, keyvals ...interface{}) {
+	logger.Println(formatEntry("INFO", msg, keyvals))
+}
+
+func (packageLogger) Warn(msg string, keyvals ...interface{}) {
+	logger.Println(formatEntry("WARNING", msg, keyvals))
+}
+
+func (packageLogger) Error(msg string, keyvals ...interface{}) {
+	errLogger.Println(formatEntry("ERROR", msg, keyvals))
+}
+
+// componentLogger writes the entries of a single component, such as a Node, adding the fields that
+// identify it to each one
+type componentLogger struct {
+	logger Logger
+	fields []interface{}
+}
+
+func newComponentLogger(l Logger, keyvals ...interface{}) *componentLogger {
+	if l == nil {
+		l = packageLogger{}
+	}
+	return &componentLogger{
+		logger: l,
+		fields: keyvals,
+	}
+}
+
+func (l *componentLogger) withFields(keyvals []interface{}) []interface{} {
+	all := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	all = append(all, l.fields...)
+	return append(all, keyvals...)
+}
+
+func (l *componentLogger) debug(msg string, keyvals ...interface{}) {
+	l.logger.Debug(msg, l.withFields(keyvals)...)
+}
+
+func (l *componentLogger) info(msg string, keyvals ...interface{}) {
+	l.logger.Info(msg, l.withFields(keyvals)...)
+}
+
+func (l *componentLogger) warn(msg string, keyvals ...interface{}) {
+	l.logger.Warn(msg, l.withFields(keyvals)...)
+}
+
+func (l *componentLogger) error(msg string, keyvals ...interface{}) {
+	l.logger.Error(msg, l.withFields(keyvals)...)
+}
+
+// err writes err as an error entry
+func (l *componentLogger) err(msg string, err error, keyvals ...interface{}) {
+	l.logger.Error(msg, l.withFields(append([]interface{}{"err", err}, keyvals...))...)
+}
+
 // setLogWriter replaces the default log writer, which uses Stderr
 func setLogWriter(out io.Writer) {
 	logger = log.New(out, "", log.LstdFlags)
@@ -0,0 +1,37 @@
+//go:build go1.21
+// +build go1.21
+
+package riak
+
+import (
+	"log/slog"
+)
+
+// NewSlogLogger returns a Logger that writes entries to l, mapping the key / value pairs of each
+// entry to slog attributes. Whether debug entries are written is decided by l's handler
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		panic("[Logger] nil slog.Logger argument")
+	}
+	return &slogLogger{l: l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s *slogLogger) Debug(msg string, keyvals ...interface{}) {
+	s.l.Debug(msg, keyvals...)
+}
+
+func (s *slogLogger) Info(msg string, keyvals ...interface{}) {
+	s.l.Info(msg, keyvals...)
+}
+
+func (s *slogLogger) Warn(msg string, keyvals ...interface{}) {
+	s.l.Warn(msg, keyvals...)
+}
+
+func (s *slogLogger) Error(msg string, keyvals ...interface{}) {
+	s.l.Error(msg, keyvals...)
+}
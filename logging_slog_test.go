@@ -0,0 +1,28 @@
+//go:build go1.21
+// +build go1.21
+
+package riak
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	l.Debug("not written", "node", "127.0.0.1:8087")
+	l.Error("failed", "node", "127.0.0.1:8087", "attempt", 2)
+
+	out := buf.String()
+	if strings.Contains(out, "not written") {
+		t.Errorf("expected debug entry to be filtered, got %q", out)
+	}
+	for _, want := range []string{"level=ERROR", "msg=failed", "node=127.0.0.1:8087", "attempt=2"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in %q", want, out)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package riak
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"testing"
+
+	"github.com/basho/riak-go-client/riaktest"
+)
+
+type logEntry struct {
+	level   string
+	msg     string
+	keyvals []interface{}
+}
+
+func (e logEntry) field(key string) (interface{}, bool) {
+	for i := 0; i+1 < len(e.keyvals); i += 2 {
+		if e.keyvals[i] == key {
+			return e.keyvals[i+1], true
+		}
+	}
+	return nil, false
+}
+
+type recordingLogger struct {
+	entries []logEntry
+	sync.Mutex
+}
+
+func (l *recordingLogger) record(level, msg string, keyvals []interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.entries = append(l.entries, logEntry{level, msg, keyvals})
+}
+
+func (l *recordingLogger) Debug(msg string, keyvals ...interface{}) { l.record("debug", msg, keyvals) }
+func (l *recordingLogger) Info(msg string, keyvals ...interface{})  { l.record("info", msg, keyvals) }
+func (l *recordingLogger) Warn(msg string, keyvals ...interface{})  { l.record("warn", msg, keyvals) }
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) { l.record("error", msg, keyvals) }
+
+func (l *recordingLogger) find(msg string) (logEntry, bool) {
+	l.Lock()
+	defer l.Unlock()
+	for _, e := range l.entries {
+		if e.msg == msg {
+			return e, true
+		}
+	}
+	return logEntry{}, false
+}
+
+func TestStdLoggerFormat(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0), false)
+	l.Debug("not written")
+	l.Warn("something happened", "node", "127.0.0.1:8087", "attempt", 2, "dangling")
+	if got, want := buf.String(), "[WARNING] something happened node=127.0.0.1:8087 attempt=2 dangling=MISSING\n"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	buf.Reset()
+	l = NewStdLogger(log.New(&buf, "", 0), true)
+	l.Debug("written")
+	if got, want := buf.String(), "[DEBUG] written\n"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestComponentLoggerAddsFields(t *testing.T) {
+	rl := &recordingLogger{}
+	l := newComponentLogger(rl, "component", "Node", "node", "127.0.0.1:8087")
+	l.err("failed", ErrClusterShuttingDown, "command", "Ping")
+
+	e, ok := rl.find("failed")
+	if !ok {
+		t.Fatal("expected entry to be logged")
+	}
+	if e.level != "error" {
+		t.Errorf("expected error level, got %s", e.level)
+	}
+	for key, want := range map[string]interface{}{
+		"component": "Node",
+		"node":      "127.0.0.1:8087",
+		"err":       ErrClusterShuttingDown,
+		"command":   "Ping",
+	} {
+		if got, _ := e.field(key); got != want {
+			t.Errorf("expected %s=%v, got %v", key, want, got)
+		}
+	}
+}
+
+func TestClusterLoggerIsUsedByNodes(t *testing.T) {
+	srv, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	node, err := NewNode(&NodeOptions{
+		RemoteAddress: srv.Addr(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := &recordingLogger{}
+	cluster, err := NewCluster(&ClusterOptions{
+		Nodes:  []*Node{node},
+		Logger: rl,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Stop()
+
+	cmd := &PingCommand{}
+	if err = cluster.Execute(cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	e, ok := rl.find("executing command")
+	if !ok {
+		t.Fatal("expected node to log command execution")
+	}
+	if got, _ := e.field("command"); got != cmd.Name() {
+		t.Errorf("expected command=%s, got %v", cmd.Name(), got)
+	}
+	if got, _ := e.field("node"); fmt.Sprint(got) != srv.Addr() {
+		t.Errorf("expected node=%s, got %v", srv.Addr(), got)
+	}
+	if e, ok = rl.find("successfully executed command"); !ok {
+		t.Fatal("expected cluster to log command completion")
+	}
+	if got, _ := e.field("attempt"); got != 1 {
+		t.Errorf("expected attempt=1, got %v", got)
+	}
+	if _, ok = rl.find("connected"); !ok {
+		t.Error("expected connection to log with the cluster logger")
+	}
+}
+
+func TestClusterLoggerIsUsedByAsync(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	rl := &recordingLogger{}
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{Logger: rl}, srv.Addr())
+
+	cmd := &PingCommand{}
+	done := make(chan Command, 1)
+	if err := cluster.ExecuteAsync(&Async{Command: cmd, Done: done}); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	e, ok := rl.find("signaling Done channel")
+	if !ok {
+		t.Fatal("expected async to log with the cluster logger")
+	}
+	if got, _ := e.field("component"); got != "Async" {
+		t.Errorf("expected component=Async, got %v", got)
+	}
+	if got, _ := e.field("command"); got != cmd.Name() {
+		t.Errorf("expected command=%s, got %v", cmd.Name(), got)
+	}
+}
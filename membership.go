@@ -0,0 +1,276 @@
+package riak
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// MembershipProvider supplies the addresses, as host:port, of the Riak nodes a Cluster uses. See
+// ClusterOptions.MembershipProvider.
+//
+// The Cluster calls Members when it starts and each time Changes signals, and compares the result
+// with the addresses of its Nodes. A Node is created and started for each new address, and the
+// Node of each address no longer supplied is drained and stopped, as by Cluster.RemoveNode. If
+// Members returns an error or no addresses, the Nodes are left as they are.
+//
+// If the provider implements io.Closer, the Cluster closes it when it stops
+type MembershipProvider interface {
+	// Members returns the current addresses
+	Members() ([]string, error)
+	// Changes returns a channel that signals when the addresses may have changed, or nil if they
+	// never change
+	Changes() <-chan struct{}
+}
+
+// Membership errors
+var (
+	ErrFileMembershipPathRequired = newClientError("[FileMembershipProvider] Path is required", nil)
+)
+
+// StaticMembershipProvider supplies a fixed set of addresses
+type StaticMembershipProvider struct {
+	members []string
+}
+
+// NewStaticMembershipProvider returns a StaticMembershipProvider supplying members
+func NewStaticMembershipProvider(members ...string) *StaticMembershipProvider {
+	return &StaticMembershipProvider{members: members}
+}
+
+// Members implements MembershipProvider
+func (p *StaticMembershipProvider) Members() ([]string, error) {
+	return p.members, nil
+}
+
+// Changes implements MembershipProvider
+func (p *StaticMembershipProvider) Changes() <-chan struct{} {
+	return nil
+}
+
+// CallbackMembershipProvider supplies the addresses returned by a function. Call Notify when they
+// change
+type CallbackMembershipProvider struct {
+	members func() ([]string, error)
+	changes chan struct{}
+}
+
+// NewCallbackMembershipProvider returns a CallbackMembershipProvider supplying the addresses
+// returned by members
+func NewCallbackMembershipProvider(members func() ([]string, error)) *CallbackMembershipProvider {
+	return &CallbackMembershipProvider{
+		members: members,
+		changes: make(chan struct{}, 1),
+	}
+}
+
+// Members implements MembershipProvider
+func (p *CallbackMembershipProvider) Members() ([]string, error) {
+	return p.members()
+}
+
+// Changes implements MembershipProvider
+func (p *CallbackMembershipProvider) Changes() <-chan struct{} {
+	return p.changes
+}
+
+// Notify tells the Cluster that the addresses have changed. It does not block
+func (p *CallbackMembershipProvider) Notify() {
+	signalMembersChanged(p.changes)
+}
+
+// FileMembershipProviderOptions configures a FileMembershipProvider
+type FileMembershipProviderOptions struct {
+	Path         string        // NB: required
+	PollInterval time.Duration // NB: how often to check the file for changes, defaults to 5s
+	// Unmarshal parses the file, defaults to json.Unmarshal. NB: pass yaml.Unmarshal, or that of
+	// another format, to read a file in that format
+	Unmarshal func(data []byte, v interface{}) error
+}
+
+// FileMembershipProvider supplies the addresses listed in a file, JSON unless another Unmarshal is
+// given, and reloads them when the file changes. The file holds either a list of addresses or an
+// object with a "nodes" list:
+//
+//	{"nodes": ["riak-1.example.com:8087", "riak-2.example.com:8087"]}
+type FileMembershipProvider struct {
+	path         string
+	unmarshal    func(data []byte, v interface{}) error
+	pollInterval time.Duration
+	size         int64     // NB: only used by the watch goroutine
+	modTime      time.Time // NB: only used by the watch goroutine
+	changes      chan struct{}
+	stop         chan struct{}
+	start        sync.Once
+	close        sync.Once
+}
+
+// NewFileMembershipProvider is a factory function that takes a FileMembershipProviderOptions
+// struct and returns a FileMembershipProvider
+func NewFileMembershipProvider(options *FileMembershipProviderOptions) (*FileMembershipProvider, error) {
+	if options == nil || options.Path == "" {
+		return nil, ErrFileMembershipPathRequired
+	}
+	unmarshal := options.Unmarshal
+	if unmarshal == nil {
+		unmarshal = json.Unmarshal
+	}
+	pollInterval := options.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaultMembershipPollInterval
+	}
+	p := &FileMembershipProvider{
+		path:         options.Path,
+		unmarshal:    unmarshal,
+		pollInterval: pollInterval,
+		changes:      make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+	}
+	p.size, p.modTime = p.stat()
+	return p, nil
+}
+
+// Members implements MembershipProvider, reading the file
+func (p *FileMembershipProvider) Members() ([]string, error) {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	if err = p.unmarshal(data, &members); err == nil {
+		return members, nil
+	}
+	var file struct {
+		Nodes []string `json:"nodes"`
+	}
+	if err = p.unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("[FileMembershipProvider] could not parse %s: %v", p.path, err)
+	}
+	return file.Nodes, nil
+}
+
+// Changes implements MembershipProvider. NB: the file is checked every PollInterval, and a change
+// in its size or modification time is signalled
+func (p *FileMembershipProvider) Changes() <-chan struct{} {
+	p.start.Do(func() {
+		go p.watch()
+	})
+	return p.changes
+}
+
+// Close stops watching the file
+func (p *FileMembershipProvider) Close() error {
+	p.close.Do(func() {
+		close(p.stop)
+	})
+	return nil
+}
+
+func (p *FileMembershipProvider) watch() {
+	ticker := time.NewTicker(p.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			s, m := p.stat()
+			if s != p.size || !m.Equal(p.modTime) {
+				p.size, p.modTime = s, m
+				signalMembersChanged(p.changes)
+			}
+		}
+	}
+}
+
+func (p *FileMembershipProvider) stat() (int64, time.Time) {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return -1, time.Time{}
+	}
+	return info.Size(), info.ModTime()
+}
+
+// watchMembers refreshes the Cluster's Nodes each time the MembershipProvider signals a change
+func (c *Cluster) watchMembers() {
+	defer close(c.membershipDone)
+	changes := c.membership.Changes()
+	for {
+		select {
+		case <-c.membershipStop:
+			return
+		case <-changes:
+			c.refreshMembers()
+		}
+	}
+}
+
+// refreshMembers adds a Node for each new member, and drains and removes the Nodes of members that
+// are gone. NB: only called from Start and the watchMembers goroutine
+func (c *Cluster) refreshMembers() {
+	members, err := c.membership.Members()
+	if err != nil {
+		c.log.err("could not get members, keeping current nodes", err)
+		return
+	}
+	if len(members) == 0 {
+		c.log.warn("no members, keeping current nodes")
+		return
+	}
+
+	current := make(map[string]bool, len(members))
+	for _, addr := range members {
+		current[addr] = true
+		if _, ok := c.members[addr]; ok {
+			continue
+		}
+		var options NodeOptions
+		if c.memberNodeOptions != nil {
+			options = *c.memberNodeOptions
+		}
+		options.RemoteAddress = addr
+		node, err := NewNode(&options)
+		if err != nil {
+			c.log.err("could not create node for member", err, "addr", addr)
+			continue
+		}
+		if err = c.AddNode(node); err != nil {
+			c.log.err("could not add node for member", err, "addr", addr)
+			continue
+		}
+		c.members[addr] = node
+		c.log.info("added node for member", "addr", addr)
+	}
+
+	// NB: drain removed Nodes concurrently, so that one busy Node does not hold up the others
+	var wg sync.WaitGroup
+	for addr, node := range c.members {
+		if current[addr] {
+			continue
+		}
+		delete(c.members, addr)
+		wg.Add(1)
+		go func(addr string, node *Node) {
+			defer wg.Done()
+			if err := c.RemoveNode(node); err != nil {
+				c.log.err("error when removing node", err, "addr", addr)
+				return
+			}
+			c.log.info("removed node no longer a member", "addr", addr)
+		}(addr, node)
+	}
+	wg.Wait()
+}
+
+// closeMembership closes the MembershipProvider if it implements io.Closer
+func (c *Cluster) closeMembership() {
+	if closer, ok := c.membership.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			c.log.err("error when closing membership provider", err)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package riak
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/basho/riak-go-client/riaktest"
+)
+
+func TestNewFileMembershipProvider(t *testing.T) {
+	if _, err := NewFileMembershipProvider(&FileMembershipProviderOptions{}); err != ErrFileMembershipPathRequired {
+		t.Errorf("expected ErrFileMembershipPathRequired, got %v", err)
+	}
+
+	// NB: one address per line
+	lines := func(data []byte, v interface{}) error {
+		members, ok := v.(*[]string)
+		if !ok {
+			return errors.New("expected a list")
+		}
+		*members = strings.Fields(string(data))
+		return nil
+	}
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name      string
+		unmarshal func([]byte, interface{}) error
+		content   string
+	}{
+		{"list.json", nil, `["a:8087", "b:8087"]`},
+		{"object.json", nil, `{"nodes": ["a:8087", "b:8087"]}`},
+		{"object.conf", json.Unmarshal, `{"nodes": ["a:8087", "b:8087"]}`},
+		{"nodes.txt", lines, "a:8087\nb:8087\n"},
+	} {
+		path := filepath.Join(dir, tc.name)
+		if err := ioutil.WriteFile(path, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		p, err := NewFileMembershipProvider(&FileMembershipProviderOptions{Path: path, Unmarshal: tc.unmarshal})
+		if err != nil {
+			t.Fatal(err)
+		}
+		members, err := p.Members()
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if len(members) != 2 || members[0] != "a:8087" || members[1] != "b:8087" {
+			t.Errorf("%s: unexpected members %v", tc.name, members)
+		}
+	}
+
+	path := filepath.Join(dir, "bad.json")
+	if err := ioutil.WriteFile(path, []byte(`{"nodes": 1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := NewFileMembershipProvider(&FileMembershipProviderOptions{Path: path})
+	if _, err := p.Members(); err == nil {
+		t.Error("expected parse error")
+	}
+}
+
+func TestClusterSRVDiscoveryWithMembershipProvider(t *testing.T) {
+	_, err := NewCluster(&ClusterOptions{
+		SRVDiscovery:       &SRVDiscoveryOptions{Name: "riak.test"},
+		MembershipProvider: NewStaticMembershipProvider("127.0.0.1:8087"),
+	})
+	if err != ErrClusterSRVDiscoveryWithMembership {
+		t.Errorf("expected ErrClusterSRVDiscoveryWithMembership, got %v", err)
+	}
+}
+
+func TestClusterStaticMembershipProvider(t *testing.T) {
+	servers := newTestServers(t, 2)
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{
+		MembershipProvider: NewStaticMembershipProvider(servers[0].Addr(), servers[1].Addr()),
+		MemberNodeOptions:  &NodeOptions{MinConnections: 1},
+	})
+
+	waitForClusterAddrs(t, cluster, servers...)
+	if err := cluster.Execute(&PingCommand{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterCallbackMembershipProvider(t *testing.T) {
+	servers := newTestServers(t, 2)
+	var mu sync.Mutex
+	members := []string{servers[0].Addr()}
+	provider := NewCallbackMembershipProvider(func() ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return members, nil
+	})
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{
+		MembershipProvider: provider,
+		MemberNodeOptions:  &NodeOptions{MinConnections: 1},
+	})
+	waitForClusterAddrs(t, cluster, servers[0])
+
+	mu.Lock()
+	members = []string{servers[1].Addr()}
+	mu.Unlock()
+	provider.Notify()
+	waitForClusterAddrs(t, cluster, servers[1])
+
+	if err := cluster.Execute(&PingCommand{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterFileMembershipProviderReloads(t *testing.T) {
+	servers := newTestServers(t, 2)
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	write := func(servers ...*riaktest.Server) {
+		var file struct {
+			Nodes []string `json:"nodes"`
+		}
+		for _, srv := range servers {
+			file.Nodes = append(file.Nodes, srv.Addr())
+		}
+		content, err := json.Marshal(&file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(servers[0])
+	provider, err := NewFileMembershipProvider(&FileMembershipProviderOptions{
+		Path:         path,
+		PollInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{
+		MembershipProvider: provider,
+		MemberNodeOptions:  &NodeOptions{MinConnections: 1},
+	})
+	waitForClusterAddrs(t, cluster, servers[0])
+
+	write(servers[0], servers[1])
+	waitForClusterAddrs(t, cluster, servers[0], servers[1])
+
+	write(servers[1])
+	waitForClusterAddrs(t, cluster, servers[1])
+
+	// NB: a file that can not be parsed keeps the current nodes
+	if err = ioutil.WriteFile(path, []byte("nodes: {"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	waitForClusterAddrs(t, cluster, servers[1])
+}
+
+func TestClusterRemoveNodeDrains(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	cluster, nodes := newTestCluster(t, nil, nil, srv.Addr())
+	node := nodes[0]
+	var err error
+
+	// NB: a command in flight on the node
+	atomic.AddInt32(&node.inFlight, 1)
+	removed := make(chan error)
+	go func() {
+		removed <- cluster.RemoveNode(node)
+	}()
+
+	select {
+	case err = <-removed:
+		t.Fatalf("expected RemoveNode to wait for the command in flight, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !node.isCurrentState(nodeRunning) {
+		t.Errorf("expected node to be running while draining, got %v", node.getState())
+	}
+	if len(clusterAddrs(cluster)) != 0 {
+		t.Error("expected node to be removed from the cluster while draining")
+	}
+
+	atomic.AddInt32(&node.inFlight, -1)
+	if err = <-removed; err != nil {
+		t.Fatal(err)
+	}
+	if !node.isCurrentState(nodeShutdown) {
+		t.Errorf("expected node to be shut down, got %v", node.getState())
+	}
+}
+
+func TestClusterRemoveNodeDrainTimeout(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	cluster, nodes := newTestCluster(t, nil, &ClusterOptions{NodeDrainTimeout: 20 * time.Millisecond}, srv.Addr())
+	node := nodes[0]
+
+	atomic.AddInt32(&node.inFlight, 1)
+	if err := cluster.RemoveNode(node); err != nil {
+		t.Fatal(err)
+	}
+	if !node.isCurrentState(nodeShutdown) {
+		t.Errorf("expected node to be shut down after the drain timeout, got %v", node.getState())
+	}
+}
+
+func TestClusterExecuteWhileMembersChange(t *testing.T) {
+	servers := newTestServers(t, 3)
+	var mu sync.Mutex
+	all := []string{servers[0].Addr(), servers[1].Addr(), servers[2].Addr()}
+	members := all
+	provider := NewCallbackMembershipProvider(func() ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return members, nil
+	})
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{
+		MembershipProvider: provider,
+		MemberNodeOptions:  &NodeOptions{MinConnections: 1},
+	})
+	waitForClusterAddrs(t, cluster, servers...)
+
+	// NB: nodes are added and removed while commands are executed on them, run with -race
+	stop := make(chan struct{})
+	var failed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := cluster.Execute(&PingCommand{}); err != nil {
+					atomic.AddInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		mu.Lock()
+		if i%2 == 0 {
+			members = all[:1]
+		} else {
+			members = all
+		}
+		mu.Unlock()
+		provider.Notify()
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	if n := atomic.LoadInt32(&failed); n > 0 {
+		t.Errorf("expected commands to be executed on the remaining nodes, %d failed", n)
+	}
+}
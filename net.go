@@ -4,6 +4,12 @@ import (
 	"net"
 )
 
+// NB: variables so that tests can replace them
+var (
+	resolveTCPAddr = net.ResolveTCPAddr
+	lookupSRV      = net.LookupSRV
+)
+
 func isTemporaryNetError(err error) bool {
 	if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
 		return true
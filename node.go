@@ -3,6 +3,8 @@ package riak
 import (
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,31 +19,74 @@ const (
 )
 
 // NodeOptions defines the RemoteAddress and operational configuration for connections to a Riak KV
-// instance
+// instance.
+//
+// When ConnectionAcquireTimeout is set and MaxConnections connections are in use, commands wait in
+// line for up to ConnectionAcquireTimeout for a connection to become available instead of failing
+// immediately.
+//
+// By default, any network error causes the Node to stop executing commands and begin health
+// checking, and it resumes after a single successful health check. When CircuitBreaker is set, the
+// Node instead tolerates failures up to a failure rate and probes with trial commands before
+// resuming normal operation; see CircuitBreakerOptions.
+//
+// RemoteAddress is resolved when the Node is created. To follow a host name that moves to a new IP
+// address, set ResolveInterval to resolve it again periodically, or ResolveAfterConnectFailures to
+// resolve it again after that many consecutive failures to connect. Connections to the previous
+// address are closed once they are idle.
+//
+// Set MaxConnectionAge to close connections once they have been open that long, for instance so
+// that connections authenticated with credentials that have since rotated are replaced, see
+// AuthOptions.CredentialProvider. Each connection's age is shortened by up to a quarter at random,
+// so that connections opened together are not all replaced at once.
+//
+// Set MaxResponseSize to fail commands whose response is larger, such as a fetch of an object with
+// very many siblings, rather than allocate a buffer of the size Riak announces. StoreValue commands
+// larger than MaxResponseSize fail without being sent, as the value could not be fetched. See
+// ErrResponseTooLarge and ErrRequestTooLarge
 type NodeOptions struct {
-	RemoteAddress       string
-	MinConnections      uint16
-	MaxConnections      uint16
-	TempNetErrorRetries uint16
-	IdleTimeout         time.Duration
-	ConnectTimeout      time.Duration
-	RequestTimeout      time.Duration
-	HealthCheckInterval time.Duration
-	HealthCheckBuilder  CommandBuilder
-	AuthOptions         *AuthOptions
+	RemoteAddress               string
+	MinConnections              uint16
+	MaxConnections              uint16
+	TempNetErrorRetries         uint16
+	IdleTimeout                 time.Duration
+	ConnectTimeout              time.Duration
+	RequestTimeout              time.Duration
+	ConnectionAcquireTimeout    time.Duration
+	MaxConnectionAge            time.Duration
+	MaxResponseSize             int // NB: in bytes, 0 for no limit
+	HealthCheckInterval         time.Duration
+	ResolveInterval             time.Duration
+	ResolveAfterConnectFailures uint16
+	HealthCheckBuilder          CommandBuilder
+	CircuitBreaker              *CircuitBreakerOptions
+	AuthOptions                 *AuthOptions
 }
 
 // Node is a struct that contains all of the information needed to connect and maintain connections
 // with a Riak KV instance
 type Node struct {
-	addr                *net.TCPAddr
+	remoteAddress       string
+	resolveInterval     time.Duration
+	resolveAfter        uint16
 	healthCheckInterval time.Duration
 	healthCheckBuilder  CommandBuilder
 	stopChan            chan struct{}
 	cm                  *connectionManager
+	log                 *componentLogger
+	observer            CommandObserver
+	inFlight            int32 // NB: accessed atomically
+	latency             ewma
+	breaker             *circuitBreaker
+	health              nodeHealth
+	events              *eventHub // NB: the Cluster's, nil for a Node that is not in a Cluster
 	stateData
 }
 
+// ErrNodeHealthCheckFailed is reported by NodeStatus when a health check command did not succeed
+// without returning an error
+var ErrNodeHealthCheckFailed = newClientError("[Node] health check command did not succeed", nil)
+
 var defaultNodeOptions = &NodeOptions{
 	RemoteAddress:       defaultRemoteAddress,
 	MinConnections:      defaultMinConnections,
@@ -84,13 +129,19 @@ func NewNode(options *NodeOptions) (*Node, error) {
 
 	var err error
 	var resolvedAddress *net.TCPAddr
-	resolvedAddress, err = net.ResolveTCPAddr("tcp", options.RemoteAddress)
+	resolvedAddress, err = resolveTCPAddr("tcp", options.RemoteAddress)
 	if err == nil {
 		n := &Node{
+			remoteAddress:       options.RemoteAddress,
+			resolveInterval:     options.ResolveInterval,
+			resolveAfter:        options.ResolveAfterConnectFailures,
 			stopChan:            make(chan struct{}),
-			addr:                resolvedAddress,
 			healthCheckInterval: options.HealthCheckInterval,
 			healthCheckBuilder:  options.HealthCheckBuilder,
+			log:                 newComponentLogger(nil, "component", "Node", "node", resolvedAddress),
+		}
+		if options.CircuitBreaker != nil {
+			n.breaker = newCircuitBreaker(n, options.CircuitBreaker)
 		}
 
 		connMgrOpts := &connectionManagerOptions{
@@ -101,13 +152,22 @@ func NewNode(options *NodeOptions) (*Node, error) {
 			idleTimeout:         options.IdleTimeout,
 			connectTimeout:      options.ConnectTimeout,
 			requestTimeout:      options.RequestTimeout,
+			acquireTimeout:      options.ConnectionAcquireTimeout,
+			maxConnectionAge:    options.MaxConnectionAge,
+			maxResponseSize:     options.MaxResponseSize,
 			authOptions:         options.AuthOptions,
+			onEvent: func(t EventType) {
+				n.events.emit(&Event{Type: t, Node: n})
+			},
 		}
 
 		var cm *connectionManager
 		if cm, err = newConnectionManager(connMgrOpts); err == nil {
 			n.cm = cm
 			n.initStateData("nodeCreated", "nodeRunning", "nodeHealthChecking", "nodeShuttingDown", "nodeShutdown", "nodeError")
+			n.onStateChange = func(from, to state) {
+				n.events.emit(&Event{Type: EventNodeStateChanged, Node: n, From: n.stateName(from), To: n.stateName(to)})
+			}
 			n.setState(nodeCreated)
 			return n, nil
 		}
@@ -119,7 +179,80 @@ func NewNode(options *NodeOptions) (*Node, error) {
 // String returns a formatted string including the remoteAddress for the Node and its current
 // connection count
 func (n *Node) String() string {
-	return fmt.Sprintf("%v|%d|%d", n.addr, n.cm.count(), n.cm.q.count())
+	return fmt.Sprintf("%v|%d|%d", n.cm.getAddr(), n.cm.count(), n.cm.q.count())
+}
+
+// setLogger replaces the Logger used by this Node and its connections. It must be called before the
+// Node is started
+func (n *Node) setLogger(l Logger) {
+	n.log = newComponentLogger(l, "component", "Node", "node", n.cm.getAddr())
+	n.cm.setLogger(l)
+}
+
+// setEvents sets the eventHub that Events of this Node and its connections are emitted to. It must
+// be called before the Node is started
+func (n *Node) setEvents(h *eventHub) {
+	n.events = h
+}
+
+// onHealthCheckFailed records a failed health check and emits its Event
+func (n *Node) onHealthCheckFailed(err error) {
+	n.health.onHealthCheck(err)
+	n.events.emit(&Event{Type: EventHealthCheckFailed, Node: n, Err: err})
+}
+
+// setObserver sets the CommandObserver notified of each attempt to execute a command on this Node.
+// It must be called before the Node is started
+func (n *Node) setObserver(o CommandObserver) {
+	n.observer = o
+}
+
+// PoolStats returns statistics about this Node's connection pool, useful when sizing
+// MaxConnections and ConnectionAcquireTimeout
+func (n *Node) PoolStats() PoolStats {
+	return n.cm.stats()
+}
+
+// Addr returns the IP:PORT address of the Riak node this Node connects to. It changes if
+// RemoteAddress is resolved again to a different address
+func (n *Node) Addr() string {
+	return n.cm.getAddr().String()
+}
+
+// resolve resolves RemoteAddress again, returning true if it changed
+func (n *Node) resolve() bool {
+	addr, err := resolveTCPAddr("tcp", n.remoteAddress)
+	if err != nil {
+		n.log.err("error when resolving address", err, "remoteAddress", n.remoteAddress)
+		return false
+	}
+	previous := n.cm.getAddr()
+	if !n.cm.setAddr(addr) {
+		return false
+	}
+	n.log.info("address changed", "remoteAddress", n.remoteAddress, "previous", previous, "current", addr)
+	return true
+}
+
+// InFlight returns the number of commands this Node is executing, including those waiting for a
+// connection
+func (n *Node) InFlight() int {
+	return int(atomic.LoadInt32(&n.inFlight))
+}
+
+// Latency returns an exponentially weighted moving average of the time taken by Riak to respond to
+// commands executed on this Node, or zero if none have completed
+func (n *Node) Latency() time.Duration {
+	return n.latency.value()
+}
+
+// CircuitBreakerState returns the state of this Node's circuit breaker. It is always CircuitClosed
+// if NodeOptions.CircuitBreaker was not set
+func (n *Node) CircuitBreakerState() CircuitBreakerState {
+	if n.breaker == nil {
+		return CircuitClosed
+	}
+	return n.breaker.getState()
 }
 
 // Start opens a connection with Riak at the configured remoteAddress and adds the connections to the
@@ -129,12 +262,16 @@ func (n *Node) start() error {
 		return err
 	}
 
-	logDebug("[Node]", "(%v) starting", n)
+	n.log.debug("starting")
 	if err := n.cm.start(); err != nil {
-		logErr("[Node]", err)
+		n.log.err("error when starting connection manager", err)
 	}
 	n.setState(nodeRunning)
-	logDebug("[Node]", "(%v) started", n)
+	n.log.debug("started", "state", n.stateData.String(), "connections", n.cm.count())
+
+	if n.resolveInterval > 0 {
+		go n.resolvePeriodically()
+	}
 
 	return nil
 }
@@ -146,7 +283,7 @@ func (n *Node) stop() error {
 		return err
 	}
 
-	logDebug("[Node]", "(%v) shutting down.", n)
+	n.log.debug("shutting down")
 
 	n.setState(nodeShuttingDown)
 	close(n.stopChan)
@@ -155,10 +292,10 @@ func (n *Node) stop() error {
 
 	if err == nil {
 		n.setState(nodeShutdown)
-		logDebug("[Node]", "(%v) shut down.", n)
+		n.log.debug("shut down", "state", n.stateData.String())
 	} else {
 		n.setState(nodeError)
-		logErr("[Node]", err)
+		n.log.err("error when stopping connection manager", err, "state", n.stateData.String())
 	}
 
 	return err
@@ -166,16 +303,41 @@ func (n *Node) stop() error {
 
 // Execute retrieves an available connection from the pool and executes the Command operation against
 // Riak
-func (n *Node) execute(cmd Command) (bool, error) {
+func (n *Node) execute(cmd Command) (executed bool, err error) {
 	if err := n.stateCheck(nodeRunning, nodeHealthChecking); err != nil {
 		return false, err
 	}
 
 	if n.isCurrentState(nodeRunning) {
-		conn, err := n.cm.get()
+		if n.breaker != nil {
+			generation, allowed := n.breaker.allow()
+			if !allowed {
+				// NB: a half-open breaker has let through all of its trial commands
+				return false, nil
+			}
+			defer func() {
+				if n.breaker.record(generation, breakerOutcomeOf(err)) {
+					n.doHealthCheck()
+				}
+			}()
+		}
+
+		atomic.AddInt32(&n.inFlight, 1)
+		defer atomic.AddInt32(&n.inFlight, -1)
+
+		acquireStart := time.Now()
+		conn, err := n.cm.get(cmd.getContext())
+		connectionWait := time.Since(acquireStart)
 		if err != nil {
-			logErr("[Node]", err)
-			n.doHealthCheck()
+			n.observeAttempt(cmd, connectionWait, nil, 0, err)
+			n.log.err("could not get a connection", err, "command", cmd.Name())
+			if !isContextError(err) {
+				n.health.onError(err)
+			}
+			if n.breaker == nil && !isContextError(err) && err != ErrConnMgrAcquireTimeout && err != ErrConnMgrShuttingDown {
+				// NB: a node that is merely busy is not unhealthy
+				n.doHealthCheck()
+			}
 			return false, err
 		}
 
@@ -187,30 +349,54 @@ func (n *Node) execute(cmd Command) (bool, error) {
 			rc.setLastNode(n)
 		}
 
-		logDebug("[Node]", "(%v) - executing command '%v'", n, cmd.Name())
+		n.log.debug("executing command", "command", cmd.Name(), "attempt", cmd.getAttempt())
+		executeStart := time.Now()
 		err = conn.execute(cmd)
+		latency := time.Since(executeStart)
+		n.observeAttempt(cmd, connectionWait, conn, latency, err)
+		if _, isRiakErr := err.(RiakError); err == nil || isRiakErr {
+			// NB: only count commands Riak responded to
+			n.latency.observe(latency)
+		}
 		if err == nil {
 			// NB: basically the success path of _responseReceived in Node.js client
 			if cmErr := n.cm.put(conn); cmErr != nil {
-				logErr("[Node]", cmErr)
+				n.log.err("error when returning connection", cmErr, "command", cmd.Name())
 			}
 			return true, nil
+		} else if isContextError(err) {
+			// NB: the caller gave up on this command. This says nothing about the health of
+			// this node, but an aborted request leaves the connection unusable
+			if conn.available() {
+				if cmErr := n.cm.put(conn); cmErr != nil {
+					n.log.err("error when returning connection", cmErr, "command", cmd.Name())
+				}
+			} else if cmErr := n.cm.remove(conn); cmErr != nil {
+				n.log.err("error when removing connection", cmErr, "command", cmd.Name())
+			}
+			return true, err
 		} else {
+			n.health.onError(err)
 			// NB: basically, this is _connectionClosed / _responseReceived in Node.js client
 			// must differentiate between Riak and non-Riak errors here and within execute() in connection
 			switch err.(type) {
 			case RiakError, ClientError:
 				// Riak and Client errors will not close connection
-				if cmErr := n.cm.put(conn); cmErr != nil {
-					logErr("[Node]", cmErr)
+				if !conn.available() {
+					// NB: unless the connection could not be used again, see ErrResponseTooLarge
+					if cmErr := n.cm.remove(conn); cmErr != nil {
+						n.log.err("error when removing connection", cmErr, "command", cmd.Name())
+					}
+				} else if cmErr := n.cm.put(conn); cmErr != nil {
+					n.log.err("error when returning connection", cmErr, "command", cmd.Name())
 				}
 				return true, err
 			default:
 				// NB: must be a non-Riak, non-Client error, close the connection
 				if cmErr := n.cm.remove(conn); cmErr != nil {
-					logErr("[Node]", cmErr)
+					n.log.err("error when removing connection", cmErr, "command", cmd.Name())
 				}
-				if !isTemporaryNetError(err) {
+				if n.breaker == nil && !isTemporaryNetError(err) {
 					n.doHealthCheck()
 				}
 				return true, err
@@ -221,13 +407,34 @@ func (n *Node) execute(cmd Command) (bool, error) {
 	}
 }
 
+// observeAttempt reports an attempt to execute cmd to the observer, if any. conn is nil if no
+// connection could be acquired
+func (n *Node) observeAttempt(cmd Command, connectionWait time.Duration, conn *connection, latency time.Duration, err error) {
+	if n.observer == nil {
+		return
+	}
+	e := &AttemptEvent{
+		Command:        cmd,
+		Node:           n,
+		Attempt:        cmd.getAttempt(),
+		ConnectionWait: connectionWait,
+		Latency:        latency,
+		Err:            err,
+	}
+	if conn != nil {
+		e.BytesWritten = conn.bytesWritten
+		e.BytesRead = conn.bytesRead
+	}
+	n.observer.AttemptCompleted(e)
+}
+
 func (n *Node) doHealthCheck() {
 	// NB: ensure we're not already healthchecking or shutting down
 	if n.isStateLessThan(nodeHealthChecking) {
 		n.setState(nodeHealthChecking)
 		go n.healthCheck()
 	} else {
-		logDebug("[Node]", "(%v) is already healthchecking or shutting down.", n)
+		n.log.debug("already healthchecking or shutting down", "state", n.stateData.String())
 	}
 }
 
@@ -243,7 +450,7 @@ func (n *Node) getHealthCheckCommand() (hc Command) {
 	}
 
 	if err != nil {
-		logErr("[Node]", err)
+		n.log.err("error when building healthcheck command, using ping", err)
 		hc = &PingCommand{}
 	}
 
@@ -253,7 +460,7 @@ func (n *Node) getHealthCheckCommand() (hc Command) {
 func (n *Node) ensureHealthCheckCanContinue() bool {
 	// ensure we ARE healthchecking
 	if !n.isCurrentState(nodeHealthChecking) {
-		logDebug("[Node]", "(%v) expected healthchecking state, got %s", n, n.stateData.String())
+		n.log.debug("expected healthchecking state", "state", n.stateData.String())
 		return false
 	}
 	return true
@@ -262,7 +469,7 @@ func (n *Node) ensureHealthCheckCanContinue() bool {
 // private goroutine funcs
 
 func (n *Node) healthCheck() {
-	logDebug("[Node]", "(%v) starting healthcheck routine", n)
+	n.log.debug("starting healthcheck routine")
 
 	healthCheckTicker := time.NewTicker(n.healthCheckInterval)
 	defer healthCheckTicker.Stop()
@@ -273,31 +480,48 @@ func (n *Node) healthCheck() {
 		}
 		select {
 		case <-n.stopChan:
-			logDebug("[Node]", "(%v) healthcheck quitting", n)
+			n.log.debug("healthcheck quitting", "state", n.stateData.String())
 			return
 		case t := <-healthCheckTicker.C:
 			if !n.ensureHealthCheckCanContinue() {
 				return
 			}
-			logDebug("[Node]", "(%v) running healthcheck at %v", n, t)
+			if n.breaker != nil && !n.breaker.coolDownElapsed() {
+				continue
+			}
+			n.log.debug("running healthcheck", "at", t)
 			conn, cerr := n.cm.createConnection()
 			if cerr != nil {
 				conn.close()
-				logError("[Node]", "(%v) failed healthcheck in createConnection, err: %v", n, cerr)
+				n.log.err("failed healthcheck in createConnection", cerr)
+				n.onHealthCheckFailed(cerr)
+				if n.resolveAfter > 0 && n.cm.consecutiveConnectFailures() >= uint32(n.resolveAfter) {
+					n.resolve()
+				}
 			} else {
 				if !n.ensureHealthCheckCanContinue() {
 					conn.close()
 					return
 				}
 				hcmd := n.getHealthCheckCommand()
-				logDebug("[Node]", "(%v) healthcheck executing %v", n, hcmd.Name())
+				n.log.debug("healthcheck executing", "command", hcmd.Name())
 				if hcerr := conn.execute(hcmd); hcerr != nil || !hcmd.Success() {
 					conn.close()
-					logError("[Node]", "(%v) failed healthcheck, err: %v", n, hcerr)
+					n.log.err("failed healthcheck", hcerr, "command", hcmd.Name())
+					if hcerr == nil {
+						if hcerr = hcmd.Error(); hcerr == nil {
+							hcerr = ErrNodeHealthCheckFailed
+						}
+					}
+					n.onHealthCheckFailed(hcerr)
 				} else {
 					conn.close()
-					logDebug("[Node]", "(%v) healthcheck success, err: %v, success: %v", n, hcerr, hcmd.Success())
+					n.log.debug("healthcheck success", "command", hcmd.Name())
+					n.health.onHealthCheck(nil)
 					if n.ensureHealthCheckCanContinue() {
+						if n.breaker != nil {
+							n.breaker.halfOpen()
+						}
 						n.setState(nodeRunning)
 					}
 					return
@@ -306,3 +530,57 @@ func (n *Node) healthCheck() {
 		}
 	}
 }
+
+// drain waits up to timeout for the commands in flight on the Node to complete, returning false if
+// some are still in flight
+func (n *Node) drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for n.InFlight() > 0 {
+		if time.Now().After(deadline) {
+			n.log.warn("commands still in flight after drain timeout", "inFlight", n.InFlight(), "timeout", timeout)
+			return false
+		}
+		time.Sleep(nodeDrainPollInterval)
+	}
+	return true
+}
+
+func (n *Node) resolvePeriodically() {
+	ticker := time.NewTicker(n.resolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopChan:
+			return
+		case <-ticker.C:
+			n.resolve()
+		}
+	}
+}
+
+// ewmaWeight is the weight given to each new sample by ewma
+const ewmaWeight = 0.2
+
+// ewma is an exponentially weighted moving average of durations
+type ewma struct {
+	avg     float64
+	sampled bool
+	sync.Mutex
+}
+
+func (e *ewma) observe(d time.Duration) {
+	e.Lock()
+	defer e.Unlock()
+	if e.sampled {
+		e.avg += ewmaWeight * (float64(d) - e.avg)
+	} else {
+		e.avg = float64(d)
+		e.sampled = true
+	}
+}
+
+func (e *ewma) value() time.Duration {
+	e.Lock()
+	defer e.Unlock()
+	return time.Duration(e.avg)
+}
@@ -37,11 +37,11 @@ func TestCreateNodeWithOptionsAndStart(t *testing.T) {
 	if node == nil {
 		t.Fatal("expected non-nil node")
 	}
-	if node.addr.Port != int(tl.port) {
-		t.Errorf("expected port %d, got: %d", tl.port, node.addr.Port)
+	if node.cm.getAddr().Port != int(tl.port) {
+		t.Errorf("expected port %d, got: %d", tl.port, node.cm.getAddr().Port)
 	}
-	if node.addr.Zone != "" {
-		t.Errorf("expected empty zone, got: %s", string(node.addr.Zone))
+	if node.cm.getAddr().Zone != "" {
+		t.Errorf("expected empty zone, got: %s", string(node.cm.getAddr().Zone))
 	}
 	if expected, actual := opts.MinConnections, node.cm.minConnections; expected != actual {
 		t.Errorf("expected %v, got: %v", expected, actual)
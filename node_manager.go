@@ -9,6 +9,12 @@ type NodeManager interface {
 	ExecuteOnNode(nodes []*Node, command Command, previousNode *Node) (bool, error)
 }
 
+// loggingNodeManager is implemented by NodeManagers that log, so that they use the Logger of the
+// Cluster they are given to
+type loggingNodeManager interface {
+	setLogger(l Logger)
+}
+
 var ErrDefaultNodeManagerRequiresNode = newClientError("Must pass at least one node to default node manager", nil)
 
 type defaultNodeManager struct {
@@ -49,7 +55,7 @@ func (nm *defaultNodeManager) ExecuteOnNode(nodes []*Node, command Command, prev
 
 		executed, err = node.execute(command)
 		if executed == true {
-			logDebug("[DefaultNodeManager]", "executed '%s' on node '%s', err '%v'", command.Name(), node, err)
+			node.log.debug("executed command", "nodeManager", "DefaultNodeManager", "command", command.Name(), "err", err)
 			break
 		}
 
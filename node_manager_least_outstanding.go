@@ -0,0 +1,109 @@
+package riak
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// NodeScore describes how loaded a Node is, as seen by LeastOutstandingNodeManager. Lower scores
+// are preferred
+type NodeScore struct {
+	Node     *Node
+	InFlight int
+	Latency  time.Duration
+	Score    float64
+}
+
+// LeastOutstandingNodeManager is a NodeManager that favours Nodes with fewer commands in flight and
+// lower response latency. For each command it picks two Nodes at random and executes the command
+// on the one with the lower score, where the score is the Node's in-flight count plus one,
+// multiplied by its average latency. Unlike round robin, this moves load away from a Node that is
+// slow but not failing, without sending all load to the single fastest Node.
+//
+// Nodes that have not yet completed a command have a latency, and so a score, of zero, so that new
+// Nodes are tried promptly
+type LeastOutstandingNodeManager struct {
+	rand *rand.Rand
+	sync.Mutex
+}
+
+// NewLeastOutstandingNodeManager is a factory function that returns a LeastOutstandingNodeManager
+func NewLeastOutstandingNodeManager() *LeastOutstandingNodeManager {
+	return &LeastOutstandingNodeManager{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Score returns the current score of node
+func (nm *LeastOutstandingNodeManager) Score(node *Node) NodeScore {
+	s := NodeScore{
+		Node:     node,
+		InFlight: node.InFlight(),
+		Latency:  node.Latency(),
+	}
+	s.Score = float64(s.InFlight+1) * float64(s.Latency)
+	return s
+}
+
+// Scores returns the current scores of nodes, useful for debugging how commands are distributed
+func (nm *LeastOutstandingNodeManager) Scores(nodes []*Node) []NodeScore {
+	scores := make([]NodeScore, len(nodes))
+	for i, node := range nodes {
+		scores[i] = nm.Score(node)
+	}
+	return scores
+}
+
+// ExecuteOnNode executes command on the less loaded of two randomly chosen Nodes, trying other
+// Nodes if that Node cannot execute it
+func (nm *LeastOutstandingNodeManager) ExecuteOnNode(nodes []*Node, command Command, previous *Node) (bool, error) {
+	if nodes == nil {
+		panic("[LeastOutstandingNodeManager] nil nodes argument")
+	}
+	if len(nodes) == 0 || nodes[0] == nil {
+		return false, ErrDefaultNodeManagerRequiresNode
+	}
+
+	candidates := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		// don't try the same node twice in a row if we have multiple nodes
+		if len(nodes) > 1 && previous != nil && previous == node {
+			continue
+		}
+		candidates = append(candidates, node)
+	}
+
+	var err error
+	executed := false
+	for len(candidates) > 0 {
+		i := nm.choose(candidates)
+		node := candidates[i]
+		executed, err = node.execute(command)
+		if executed {
+			node.log.debug("executed command", "nodeManager", "LeastOutstandingNodeManager", "command", command.Name(), "err", err)
+			break
+		}
+		candidates = append(candidates[:i], candidates[i+1:]...)
+	}
+
+	return executed, err
+}
+
+// choose returns the index of the lower scoring of two distinct random candidates
+func (nm *LeastOutstandingNodeManager) choose(candidates []*Node) int {
+	if len(candidates) == 1 {
+		return 0
+	}
+	nm.Lock()
+	i := nm.rand.Intn(len(candidates))
+	j := nm.rand.Intn(len(candidates) - 1)
+	nm.Unlock()
+	if j >= i {
+		j++
+	}
+	if nm.Score(candidates[j]).Score < nm.Score(candidates[i]).Score {
+		return j
+	}
+	return i
+}
@@ -0,0 +1,128 @@
+package riak
+
+import (
+	"testing"
+	"time"
+
+	"github.com/basho/riak-go-client/riaktest"
+)
+
+func newStartedTestNode(t *testing.T) *Node {
+	srv, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Stop() })
+	node, err := NewNode(&NodeOptions{
+		RemoteAddress: srv.Addr(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = node.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.stop() })
+	return node
+}
+
+func TestEwma(t *testing.T) {
+	e := &ewma{}
+	if got := e.value(); got != 0 {
+		t.Errorf("expected 0 before any sample, got %v", got)
+	}
+	e.observe(100 * time.Millisecond)
+	if got := e.value(); got != 100*time.Millisecond {
+		t.Errorf("expected first sample to set the average, got %v", got)
+	}
+	e.observe(200 * time.Millisecond)
+	if got, want := e.value(), 120*time.Millisecond; got != want {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestNodeTracksLatencyAndInFlight(t *testing.T) {
+	node := newStartedTestNode(t)
+
+	if executed, err := node.execute(&PingCommand{}); !executed || err != nil {
+		t.Fatalf("expected ping to execute, got executed %v err %v", executed, err)
+	}
+	if got := node.Latency(); got <= 0 {
+		t.Errorf("expected a positive latency, got %v", got)
+	}
+	if got := node.InFlight(); got != 0 {
+		t.Errorf("expected no commands in flight, got %d", got)
+	}
+}
+
+func TestLeastOutstandingNodeManagerAvoidsSlowNode(t *testing.T) {
+	slow := newStartedTestNode(t)
+	fast := newStartedTestNode(t)
+	slow.latency.observe(time.Second)
+	nodes := []*Node{slow, fast}
+
+	nm := NewLeastOutstandingNodeManager()
+	for i := 0; i < 10; i++ {
+		cmd := &PingCommand{}
+		if executed, err := nm.ExecuteOnNode(nodes, cmd, nil); !executed || err != nil {
+			t.Fatalf("expected ping to execute, got executed %v err %v", executed, err)
+		}
+		if got := cmd.getLastNode(); got != fast {
+			t.Errorf("expected command to execute on %v, got %v", fast, got)
+		}
+	}
+
+	scores := nm.Scores(nodes)
+	if scores[0].Node != slow || scores[0].Latency != time.Second || scores[0].Score != float64(time.Second) {
+		t.Errorf("unexpected score for slow node %+v", scores[0])
+	}
+	if scores[1].Score >= scores[0].Score {
+		t.Errorf("expected fast node to score lower, got %v and %v", scores[1].Score, scores[0].Score)
+	}
+}
+
+func TestLeastOutstandingNodeManagerPrefersFewerInFlight(t *testing.T) {
+	busy, err := NewNode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle, err := NewNode(&NodeOptions{RemoteAddress: "127.0.0.1:8088"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy.latency.observe(time.Millisecond)
+	idle.latency.observe(time.Millisecond)
+	busy.inFlight = 5
+
+	nm := NewLeastOutstandingNodeManager()
+	candidates := []*Node{busy, idle}
+	for i := 0; i < 10; i++ {
+		if got := nm.choose(candidates); got != 1 {
+			t.Fatalf("expected idle node to be chosen, got index %d", got)
+		}
+	}
+}
+
+func TestLeastOutstandingNodeManagerSkipsNodesThatCannotExecute(t *testing.T) {
+	stopped, err := NewNode(&NodeOptions{RemoteAddress: "127.0.0.1:8088"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := newStartedTestNode(t)
+	// NB: make the stopped node the preferred one
+	running.latency.observe(time.Second)
+
+	nm := NewLeastOutstandingNodeManager()
+	cmd := &PingCommand{}
+	if executed, err := nm.ExecuteOnNode([]*Node{stopped, running}, cmd, nil); !executed || err != nil {
+		t.Fatalf("expected ping to execute, got executed %v err %v", executed, err)
+	}
+	if got := cmd.getLastNode(); got != running {
+		t.Errorf("expected command to execute on %v, got %v", running, got)
+	}
+
+	cmd = &PingCommand{}
+	if executed, _ := nm.ExecuteOnNode([]*Node{stopped}, cmd, nil); executed {
+		t.Error("expected command not to execute on a stopped node")
+	}
+}
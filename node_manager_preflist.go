@@ -0,0 +1,287 @@
+package riak
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultPreflistCacheTTL        = time.Minute
+	defaultPreflistMaxCacheEntries = 10000
+	preflistMaxLookups             = 8
+)
+
+// PreflistNodeManagerOptions are used to configure a PreflistNodeManager
+type PreflistNodeManagerOptions struct {
+	// NodeNames maps the Riak node names reported in preflists, such as riak@10.0.0.1, to the
+	// Cluster's Nodes. If nil, the name of each Node is discovered by fetching its server info
+	NodeNames map[string]*Node
+	// CacheTTL is how long a fetched preflist is used before it is fetched again
+	CacheTTL time.Duration
+	// MaxCacheEntries limits the number of keys whose preflists are cached, defaults to 10000
+	MaxCacheEntries int
+	// RouteBucket decides whether the commands on keys of a bucket are sent to a primary owner. If
+	// it returns false, the preflists of the bucket's keys are not fetched and its commands are
+	// distributed round robin. NB: defaults to all buckets
+	RouteBucket func(bucketType, bucket string) bool
+}
+
+// PreflistNodeManager is a NodeManager that sends commands operating on a single key, such as
+// FetchValue, StoreValue, DeleteValue and the data type commands, to a primary owner of the key.
+// This saves Riak forwarding the request from the coordinating node.
+//
+// Preflists are fetched in the background with FetchPreflistCommand and cached per key. Until a
+// key's preflist is known, or when none of its primaries is available, commands are distributed
+// round robin as by the default NodeManager. A cached preflist is discarded when a command
+// executed on its primary fails, and after CacheTTL.
+//
+// NB: the first command on each key, and the first after its preflist expires, costs an extra
+// FetchPreflistCommand, with at most 8 fetched at once. When keys are rarely used more than once
+// within CacheTTL, such as for write-once or randomly read buckets, that cost outweighs the saving.
+// Use RouteBucket to leave those buckets round robin
+type PreflistNodeManager struct {
+	nodeNames   map[string]*Node
+	ttl         time.Duration
+	maxEntries  int
+	routeBucket func(bucketType, bucket string) bool
+	fallback    defaultNodeManager
+	lookupNm    defaultNodeManager
+	lookups     chan struct{}
+	cache       map[location]*preflistEntry
+	fetching    map[location]bool
+	discovered  map[string]*Node
+	log         *componentLogger
+	sync.Mutex
+}
+
+type preflistEntry struct {
+	primaries []string // NB: node names, in preflist order
+	expires   time.Time
+}
+
+// NewPreflistNodeManager is a factory function that takes a PreflistNodeManagerOptions struct and
+// returns a PreflistNodeManager
+func NewPreflistNodeManager(options *PreflistNodeManagerOptions) *PreflistNodeManager {
+	if options == nil {
+		options = &PreflistNodeManagerOptions{}
+	}
+	nm := &PreflistNodeManager{
+		nodeNames:   options.NodeNames,
+		ttl:         options.CacheTTL,
+		maxEntries:  options.MaxCacheEntries,
+		routeBucket: options.RouteBucket,
+		lookups:     make(chan struct{}, preflistMaxLookups),
+		cache:       make(map[location]*preflistEntry),
+		fetching:    make(map[location]bool),
+		discovered:  make(map[string]*Node),
+		log:         newComponentLogger(nil, "component", "PreflistNodeManager"),
+	}
+	if nm.ttl <= 0 {
+		nm.ttl = defaultPreflistCacheTTL
+	}
+	if nm.maxEntries <= 0 {
+		nm.maxEntries = defaultPreflistMaxCacheEntries
+	}
+	return nm
+}
+
+// setLogger replaces the Logger of this PreflistNodeManager, see loggingNodeManager
+func (nm *PreflistNodeManager) setLogger(l Logger) {
+	nm.log = newComponentLogger(l, "component", "PreflistNodeManager")
+}
+
+// ExecuteOnNode executes command on a primary owner of its key if the key's preflist is known,
+// otherwise on a Node chosen round robin
+func (nm *PreflistNodeManager) ExecuteOnNode(nodes []*Node, command Command, previous *Node) (bool, error) {
+	if nodes == nil {
+		panic("[PreflistNodeManager] nil nodes argument")
+	}
+	if len(nodes) == 0 || nodes[0] == nil {
+		return false, ErrDefaultNodeManagerRequiresNode
+	}
+
+	kc, ok := command.(keyedCommand)
+	if !ok {
+		return nm.fallback.ExecuteOnNode(nodes, command, previous)
+	}
+	loc, ok := kc.getLocation()
+	if !ok || (nm.routeBucket != nil && !nm.routeBucket(loc.bucketType, loc.bucket)) {
+		return nm.fallback.ExecuteOnNode(nodes, command, previous)
+	}
+
+	primaries, cached := nm.primaries(nodes, loc)
+	if !cached {
+		nm.lookup(nodes, loc)
+		return nm.fallback.ExecuteOnNode(nodes, command, previous)
+	}
+
+	for _, node := range primaries {
+		// don't try the same node twice in a row if we have multiple nodes
+		if len(nodes) > 1 && previous != nil && previous == node {
+			continue
+		}
+		executed, err := node.execute(command)
+		if executed {
+			node.log.debug("executed command", "nodeManager", "PreflistNodeManager", "command", command.Name(), "err", err)
+			if err != nil {
+				nm.invalidate(loc)
+			}
+			return executed, err
+		}
+	}
+
+	// NB: if no primary is one of nodes, the preflist is kept so that it is not fetched again
+	// for every command
+	if len(primaries) > 0 {
+		nm.invalidate(loc)
+	}
+	return nm.fallback.ExecuteOnNode(nodes, command, previous)
+}
+
+// primaries returns the Nodes among nodes that are primary owners of loc, in preflist order. It
+// returns false if the preflist of loc is not cached
+func (nm *PreflistNodeManager) primaries(nodes []*Node, loc location) ([]*Node, bool) {
+	nm.Lock()
+	defer nm.Unlock()
+	entry, ok := nm.cache[loc]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(nm.cache, loc)
+		return nil, false
+	}
+	var owners []*Node
+	for _, name := range entry.primaries {
+		if node := nm.nodeNamed(name); node != nil && containsNode(nodes, node) {
+			owners = append(owners, node)
+		}
+	}
+	return owners, true
+}
+
+// nodeNamed returns the Node with the Riak node name, or nil if it is not known. nm must be locked
+func (nm *PreflistNodeManager) nodeNamed(name string) *Node {
+	if nm.nodeNames != nil {
+		return nm.nodeNames[name]
+	}
+	return nm.discovered[name]
+}
+
+func (nm *PreflistNodeManager) invalidate(loc location) {
+	nm.Lock()
+	defer nm.Unlock()
+	delete(nm.cache, loc)
+}
+
+// lookup fetches the preflist of loc in the background unless it is already being fetched or too
+// many lookups are in progress
+func (nm *PreflistNodeManager) lookup(nodes []*Node, loc location) {
+	nm.Lock()
+	defer nm.Unlock()
+	if nm.fetching[loc] {
+		return
+	}
+	select {
+	case nm.lookups <- struct{}{}:
+	default:
+		return
+	}
+	nm.fetching[loc] = true
+	go func() {
+		defer func() {
+			nm.Lock()
+			delete(nm.fetching, loc)
+			nm.Unlock()
+			<-nm.lookups
+		}()
+		if nm.nodeNames == nil {
+			nm.discoverNodeNames(nodes)
+		}
+		nm.fetchPreflist(nodes, loc)
+	}()
+}
+
+func (nm *PreflistNodeManager) fetchPreflist(nodes []*Node, loc location) {
+	cmd, err := NewFetchPreflistCommandBuilder().
+		WithBucketType(loc.bucketType).
+		WithBucket(loc.bucket).
+		WithKey(loc.key).
+		Build()
+	if err != nil {
+		nm.log.err("could not build preflist command", err, "bucketType", loc.bucketType, "bucket", loc.bucket, "key", loc.key)
+		return
+	}
+	executed, err := nm.lookupNm.ExecuteOnNode(nodes, cmd, nil)
+	if !executed || err != nil {
+		nm.log.debug("could not fetch preflist", "bucketType", loc.bucketType, "bucket", loc.bucket, "key", loc.key, "err", err)
+		return
+	}
+
+	entry := &preflistEntry{
+		expires: time.Now().Add(nm.ttl),
+	}
+	for _, item := range cmd.(*FetchPreflistCommand).Response.Preflist {
+		if item.Primary {
+			entry.primaries = append(entry.primaries, item.Node)
+		}
+	}
+
+	nm.Lock()
+	defer nm.Unlock()
+	if len(nm.cache) >= nm.maxEntries {
+		nm.evict()
+	}
+	nm.cache[loc] = entry
+}
+
+// evict removes expired entries from the cache, or an arbitrary entry if none have expired. nm
+// must be locked
+func (nm *PreflistNodeManager) evict() {
+	now := time.Now()
+	for loc, entry := range nm.cache {
+		if now.After(entry.expires) {
+			delete(nm.cache, loc)
+		}
+	}
+	if len(nm.cache) < nm.maxEntries {
+		return
+	}
+	for loc := range nm.cache {
+		delete(nm.cache, loc)
+		return
+	}
+}
+
+// discoverNodeNames fetches the server info of each Node whose Riak node name is not yet known
+func (nm *PreflistNodeManager) discoverNodeNames(nodes []*Node) {
+	nm.Lock()
+	known := make(map[*Node]bool, len(nm.discovered))
+	for _, node := range nm.discovered {
+		known[node] = true
+	}
+	nm.Unlock()
+
+	for _, node := range nodes {
+		if known[node] {
+			continue
+		}
+		cmd := &GetServerInfoCommand{}
+		if executed, err := node.execute(cmd); !executed || err != nil {
+			nm.log.debug("could not fetch server info", "node", node.Addr(), "err", err)
+			continue
+		}
+		nm.Lock()
+		nm.discovered[cmd.Response.Node] = node
+		nm.Unlock()
+	}
+}
+
+func containsNode(nodes []*Node, node *Node) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,295 @@
+package riak
+
+import (
+	"testing"
+	"time"
+
+	"github.com/basho/riak-go-client/riaktest"
+)
+
+var preflistRing = []string{"riak@a", "riak@b"}
+
+// newPreflistCluster returns a Cluster with nm, of a Node on a server for each Riak node of
+// preflistRing, by name
+func newPreflistCluster(t *testing.T, nm NodeManager) (*Cluster, map[string]*Node) {
+	var addrs []string
+	for _, name := range preflistRing {
+		srv, err := riaktest.NewServer(&riaktest.ServerOptions{
+			NodeName:  name,
+			RingNodes: preflistRing,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { srv.Stop() })
+		addrs = append(addrs, srv.Addr())
+	}
+	cluster, nodes := newTestCluster(t, nil, &ClusterOptions{NodeManager: nm}, addrs...)
+	nodesByName := make(map[string]*Node)
+	for i, name := range preflistRing {
+		nodesByName[name] = nodes[i]
+	}
+	return cluster, nodesByName
+}
+
+func newPreflistFetch(t *testing.T, key string) *FetchValueCommand {
+	cmd, err := NewFetchValueCommandBuilder().
+		WithBucket("b").
+		WithKey(key).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd.(*FetchValueCommand)
+}
+
+func waitForPreflist(t *testing.T, nm *PreflistNodeManager, nodes []*Node, loc location) []*Node {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if primaries, ok := nm.primaries(nodes, loc); ok && len(primaries) > 0 {
+			return primaries
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("preflist of %v was not cached", loc)
+	return nil
+}
+
+func TestPreflistNodeManagerRoutesToPrimary(t *testing.T) {
+	nm := NewPreflistNodeManager(nil)
+	cluster, nodesByName := newPreflistCluster(t, nm)
+
+	preflist, err := NewFetchPreflistCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(preflist); err != nil {
+		t.Fatal(err)
+	}
+	owner := nodesByName[preflist.(*FetchPreflistCommand).Response.Preflist[0].Node]
+
+	// NB: the first command triggers the preflist lookup
+	if err = cluster.Execute(newPreflistFetch(t, "k")); err != nil {
+		t.Fatal(err)
+	}
+	loc := location{bucketType: defaultBucketType, bucket: "b", key: "k"}
+	if primaries := waitForPreflist(t, nm, cluster.nodes, loc); primaries[0] != owner {
+		t.Errorf("expected first primary %v, got %v", owner, primaries[0])
+	}
+
+	for i := 0; i < 4; i++ {
+		cmd := newPreflistFetch(t, "k")
+		if err = cluster.Execute(cmd); err != nil {
+			t.Fatal(err)
+		}
+		if got := cmd.getLastNode(); got != owner {
+			t.Errorf("expected command to execute on %v, got %v", owner, got)
+		}
+	}
+}
+
+func TestPreflistNodeManagerFallsBackWithoutNodeNames(t *testing.T) {
+	nm := NewPreflistNodeManager(&PreflistNodeManagerOptions{
+		NodeNames: map[string]*Node{},
+	})
+	cluster, _ := newPreflistCluster(t, nm)
+
+	if err := cluster.Execute(newPreflistFetch(t, "k")); err != nil {
+		t.Fatal(err)
+	}
+	loc := location{bucketType: defaultBucketType, bucket: "b", key: "k"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := nm.primaries(cluster.nodes, loc); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("preflist was not cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	used := make(map[*Node]bool)
+	for i := 0; i < 4; i++ {
+		cmd := newPreflistFetch(t, "k")
+		if err := cluster.Execute(cmd); err != nil {
+			t.Fatal(err)
+		}
+		used[cmd.getLastNode()] = true
+	}
+	if len(used) != 2 {
+		t.Errorf("expected commands to be distributed round robin, used %d nodes", len(used))
+	}
+}
+
+func TestPreflistNodeManagerRouteBucket(t *testing.T) {
+	nm := NewPreflistNodeManager(&PreflistNodeManagerOptions{
+		RouteBucket: func(bucketType, bucket string) bool {
+			return bucket != "b"
+		},
+	})
+	cluster, _ := newPreflistCluster(t, nm)
+
+	used := make(map[*Node]bool)
+	for i := 0; i < 4; i++ {
+		cmd := newPreflistFetch(t, "k")
+		if err := cluster.Execute(cmd); err != nil {
+			t.Fatal(err)
+		}
+		used[cmd.getLastNode()] = true
+	}
+	if len(used) != 2 {
+		t.Errorf("expected commands to be distributed round robin, used %d nodes", len(used))
+	}
+	// NB: lookups are marked as fetching before they start, and none were cached
+	nm.Lock()
+	fetching, cached := len(nm.fetching), len(nm.cache)
+	nm.Unlock()
+	if fetching != 0 || cached != 0 {
+		t.Errorf("expected no preflist to be fetched, %d fetching and %d cached", fetching, cached)
+	}
+}
+
+func TestPreflistNodeManagerInvalidatesOnError(t *testing.T) {
+	nm := NewPreflistNodeManager(nil)
+	cluster, nodesByName := newPreflistCluster(t, nm)
+
+	// NB: the default bucket type is not a data type bucket type, so this fails
+	cmd, err := NewFetchCounterCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := location{bucketType: defaultBucketType, bucket: "b", key: "k"}
+	nm.Lock()
+	nm.nodeNames = nodesByName
+	nm.cache[loc] = &preflistEntry{
+		primaries: preflistRing,
+		expires:   time.Now().Add(time.Minute),
+	}
+	nm.Unlock()
+
+	executed, err := nm.ExecuteOnNode(cluster.nodes, cmd, nil)
+	if !executed || err == nil {
+		t.Fatalf("expected command to execute and fail, got executed %v err %v", executed, err)
+	}
+	if got := cmd.(*FetchCounterCommand).getLastNode(); got != nodesByName["riak@a"] {
+		t.Errorf("expected command to execute on the first primary, got %v", got)
+	}
+	if _, ok := nm.primaries(cluster.nodes, loc); ok {
+		t.Error("expected preflist to be invalidated")
+	}
+}
+
+func TestPreflistNodeManagerExpiresEntries(t *testing.T) {
+	nm := NewPreflistNodeManager(&PreflistNodeManagerOptions{
+		MaxCacheEntries: 2,
+	})
+	nodes := []*Node{{}}
+	a := location{bucketType: defaultBucketType, bucket: "b", key: "a"}
+	b := location{bucketType: defaultBucketType, bucket: "b", key: "b"}
+	nm.cache[a] = &preflistEntry{expires: time.Now().Add(-time.Second)}
+	nm.cache[b] = &preflistEntry{expires: time.Now().Add(time.Minute)}
+
+	if _, ok := nm.primaries(nodes, a); ok {
+		t.Error("expected expired preflist not to be used")
+	}
+	if _, ok := nm.primaries(nodes, b); !ok {
+		t.Error("expected preflist to be cached")
+	}
+
+	nm.cache[a] = &preflistEntry{expires: time.Now().Add(-time.Second)}
+	nm.evict()
+	if _, ok := nm.cache[a]; ok {
+		t.Error("expected expired preflist to be evicted")
+	}
+	if _, ok := nm.cache[b]; !ok {
+		t.Error("expected unexpired preflist to be kept while there is room")
+	}
+}
+
+func TestKeyedCommandLocations(t *testing.T) {
+	store, err := NewStoreValueCommandBuilder().
+		WithBucket("b").
+		WithContent(&Object{
+			BucketType: "t",
+			Key:        "k",
+			Value:      []byte("v"),
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, ok := store.(keyedCommand).getLocation()
+	if !ok || loc != (location{bucketType: "t", bucket: "b", key: "k"}) {
+		t.Errorf("unexpected location %v %v", loc, ok)
+	}
+
+	generated, err := NewStoreValueCommandBuilder().
+		WithBucket("b").
+		WithContent(&Object{Value: []byte("v")}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = generated.(keyedCommand).getLocation(); ok {
+		t.Error("expected a command without a key not to have a location")
+	}
+
+	counter, err := NewUpdateCounterCommandBuilder().
+		WithBucketType("counters").
+		WithBucket("b").
+		WithKey("k").
+		WithIncrement(1).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, ok = counter.(keyedCommand).getLocation()
+	if !ok || loc != (location{bucketType: "counters", bucket: "b", key: "k"}) {
+		t.Errorf("unexpected location %v %v", loc, ok)
+	}
+
+	if _, ok = Command(&PingCommand{}).(keyedCommand); ok {
+		t.Error("expected Ping not to be a keyedCommand")
+	}
+}
+
+func TestPreflistNodeManagerUsesClusterLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	nm := NewPreflistNodeManager(nil)
+	node, err := NewNode(&NodeOptions{RemoteAddress: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewCluster(&ClusterOptions{
+		Nodes:       []*Node{node},
+		NodeManager: nm,
+		Logger:      logger,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// NB: the Node is not started so its server info can not be fetched, nor the preflist without Nodes
+	nm.discoverNodeNames([]*Node{node})
+	nm.fetchPreflist([]*Node{}, location{bucketType: "default", bucket: "b", key: "k"})
+
+	for _, msg := range []string{"could not fetch server info", "could not fetch preflist"} {
+		e, ok := logger.find(msg)
+		if !ok {
+			t.Fatalf("expected %q to be logged", msg)
+		}
+		if component, _ := e.field("component"); component != "PreflistNodeManager" {
+			t.Errorf("%s: expected component PreflistNodeManager, got %v", msg, component)
+		}
+	}
+	e, _ := logger.find("could not fetch preflist")
+	if key, _ := e.field("key"); key != "k" {
+		t.Errorf("expected key k, got %v", key)
+	}
+}
@@ -1,9 +1,14 @@
 package riak
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/basho/riak-go-client/riaktest"
 )
 
 func TestCreateNodeWithOptions(t *testing.T) {
@@ -29,15 +34,15 @@ func TestCreateNodeWithOptions(t *testing.T) {
 	if expected, actual := nodeCreated, node.getState(); expected != actual {
 		t.Errorf("expected %v, got %v", expected, actual)
 	}
-	if node.addr.Port != 1234 {
-		t.Errorf("expected port 1234, got: %s", string(node.addr.Port))
+	if node.cm.getAddr().Port != 1234 {
+		t.Errorf("expected port 1234, got: %s", string(node.cm.getAddr().Port))
 	}
-	if node.addr.Zone != "" {
-		t.Errorf("expected empty zone, got: %s", string(node.addr.Zone))
+	if node.cm.getAddr().Zone != "" {
+		t.Errorf("expected empty zone, got: %s", string(node.cm.getAddr().Zone))
 	}
 	var testIP = net.ParseIP("8.8.8.8")
-	if !node.addr.IP.Equal(testIP) {
-		t.Errorf("expected %v, got: %v", testIP, node.addr.IP)
+	if !node.cm.getAddr().IP.Equal(testIP) {
+		t.Errorf("expected %v, got: %v", testIP, node.cm.getAddr().IP)
 	}
 	if expected, actual := node.cm.minConnections, opts.MinConnections; expected != actual {
 		t.Errorf("expected %v, got: %v", expected, actual)
@@ -80,8 +85,8 @@ func TestEnsureNodeValuesWithZeroValOptions(t *testing.T) {
 	if expected, actual := nodeCreated, node.getState(); expected != actual {
 		t.Errorf("expected %v, got %v", expected, actual)
 	}
-	if node.addr.Port != int(defaultRemotePort) {
-		t.Errorf("expected port %v, got: %v", defaultRemotePort, node.addr.Port)
+	if node.cm.getAddr().Port != int(defaultRemotePort) {
+		t.Errorf("expected port %v, got: %v", defaultRemotePort, node.cm.getAddr().Port)
 	}
 	if expected, actual := node.cm.minConnections, defaultMinConnections; expected != actual {
 		t.Errorf("expected %v, got: %v", expected, actual)
@@ -111,14 +116,14 @@ func TestEnsureDefaultNodeValues(t *testing.T) {
 	if err != nil {
 		t.Error(err.Error())
 	}
-	if node.addr.Port != 8087 {
-		t.Errorf("expected port 8087, got: %v", string(node.addr.Port))
+	if node.cm.getAddr().Port != 8087 {
+		t.Errorf("expected port 8087, got: %v", string(node.cm.getAddr().Port))
 	}
-	if node.addr.Zone != "" {
-		t.Errorf("expected empty zone, got: %v", string(node.addr.Zone))
+	if node.cm.getAddr().Zone != "" {
+		t.Errorf("expected empty zone, got: %v", string(node.cm.getAddr().Zone))
 	}
-	if !node.addr.IP.Equal(localhost) {
-		t.Errorf("expected %v, got: %v", localhost, node.addr.IP)
+	if !node.cm.getAddr().IP.Equal(localhost) {
+		t.Errorf("expected %v, got: %v", localhost, node.cm.getAddr().IP)
 	}
 	if expected, actual := defaultMinConnections, node.cm.minConnections; expected != actual {
 		t.Errorf("expected %v, got: %v", expected, actual)
@@ -151,3 +156,211 @@ func TestEnsureDefaultNodeValues(t *testing.T) {
 		t.Errorf("expected %v, got: %v", expected, actual)
 	}
 }
+
+// fakeResolver replaces resolveTCPAddr, resolving each host to an address set by the test
+type fakeResolver struct {
+	addrs map[string]string
+	sync.Mutex
+}
+
+func newFakeResolver(t *testing.T) *fakeResolver {
+	r := &fakeResolver{addrs: make(map[string]string)}
+	previous := resolveTCPAddr
+	resolveTCPAddr = r.resolve
+	t.Cleanup(func() { resolveTCPAddr = previous })
+	return r
+}
+
+func (r *fakeResolver) set(host, addr string) {
+	r.Lock()
+	defer r.Unlock()
+	r.addrs[host] = addr
+}
+
+func (r *fakeResolver) resolve(network, address string) (*net.TCPAddr, error) {
+	r.Lock()
+	addr, ok := r.addrs[address]
+	r.Unlock()
+	if !ok {
+		addr = address
+	}
+	return net.ResolveTCPAddr(network, addr)
+}
+
+func waitForNodeAddr(t *testing.T, node *Node, addr string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for node.Addr() != addr {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected node address to change to %s, got %s", addr, node.Addr())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNodeResolvesPeriodically(t *testing.T) {
+	srv1, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv1.Stop()
+	srv2, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv2.Stop()
+
+	resolver := newFakeResolver(t)
+	resolver.set("riak.test:8087", srv1.Addr())
+	node, err := NewNode(&NodeOptions{
+		RemoteAddress:   "riak.test:8087",
+		MinConnections:  2,
+		ResolveInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = node.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer node.stop()
+	if got := node.Addr(); got != srv1.Addr() {
+		t.Fatalf("expected %s, got %s", srv1.Addr(), got)
+	}
+
+	resolver.set("riak.test:8087", srv2.Addr())
+	waitForNodeAddr(t, node, srv2.Addr())
+
+	// NB: idle connections to the previous address are closed, so commands go to the new one
+	srv1.Stop()
+	for i := 0; i < 4; i++ {
+		if executed, err := node.execute(&PingCommand{}); !executed || err != nil {
+			t.Fatalf("expected ping to execute, got executed %v err %v", executed, err)
+		}
+	}
+}
+
+func TestNodeResolvesAfterConnectFailures(t *testing.T) {
+	srv1, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv2, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv2.Stop()
+
+	resolver := newFakeResolver(t)
+	resolver.set("riak.test:8087", srv1.Addr())
+	node, err := NewNode(&NodeOptions{
+		RemoteAddress:               "riak.test:8087",
+		MinConnections:              1,
+		HealthCheckInterval:         10 * time.Millisecond,
+		ResolveAfterConnectFailures: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = node.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer node.stop()
+
+	srv1.Stop()
+	resolver.set("riak.test:8087", srv2.Addr())
+	if _, err := node.execute(&PingCommand{}); err == nil {
+		t.Fatal("expected ping to fail")
+	}
+	waitForNodeAddr(t, node, srv2.Addr())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !node.isCurrentState(nodeRunning) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected health check to succeed against the new address")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if executed, err := node.execute(&PingCommand{}); !executed || err != nil {
+		t.Fatalf("expected ping to execute, got executed %v err %v", executed, err)
+	}
+}
+
+func TestNodeMaxResponseSize(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	unlimited, _ := newTestCluster(t, nil, nil, srv.Addr())
+	limited, _ := newTestCluster(t, &NodeOptions{MaxResponseSize: 1024}, nil, srv.Addr())
+	for key, size := range map[string]int{"small": 10, "large": 4096} {
+		store, err := NewStoreValueCommandBuilder().
+			WithBucket("b").
+			WithKey(key).
+			WithContent(&Object{Value: make([]byte, size)}).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = unlimited.Execute(store); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fetch, err := NewFetchValueCommandBuilder().WithBucket("b").WithKey("large").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = limited.Execute(fetch)
+	var tooLarge ResponseTooLargeError
+	if !errors.Is(err, ErrResponseTooLarge) || !errors.As(err, &tooLarge) || tooLarge.Size <= 4096 || tooLarge.MaxSize != 1024 {
+		t.Fatalf("expected ResponseTooLargeError, got %v", err)
+	}
+	if ClassifyError(err) != ErrorClassClient {
+		t.Errorf("expected a client error, got %v", ClassifyError(err))
+	}
+
+	// NB: the unread response is discarded with its connection, and the node stays healthy
+	node := limited.nodes[0]
+	if !node.isCurrentState(nodeRunning) {
+		t.Errorf("expected node to keep running, is %v", node.stateData.String())
+	}
+	fetch, err = NewFetchValueCommandBuilder().WithBucket("b").WithKey("small").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = limited.Execute(fetch); err != nil {
+		t.Fatal(err)
+	}
+	if values := fetch.(*FetchValueCommand).Response.Values; len(values) != 1 || len(values[0].Value) != 10 {
+		t.Errorf("expected the small value, got %v", values)
+	}
+}
+
+func TestNodeMaxResponseSizeRejectsLargeStoreValue(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	cluster, _ := newTestCluster(t, &NodeOptions{MaxResponseSize: 1024}, nil, srv.Addr())
+	store, err := NewStoreValueCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		WithContent(&Object{Value: make([]byte, 2048)}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Execute(store)
+	var tooLarge RequestTooLargeError
+	if !errors.Is(err, ErrRequestTooLarge) || !errors.As(err, &tooLarge) || tooLarge.Size <= 2048 {
+		t.Fatalf("expected RequestTooLargeError, got %v", err)
+	}
+	if store.getRequestWritten() {
+		t.Error("expected the request not to be sent")
+	}
+
+	fetch, err := NewFetchValueCommandBuilder().WithBucket("b").WithKey("k").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(fetch); err != nil {
+		t.Fatal(err)
+	}
+	if !fetch.(*FetchValueCommand).Response.IsNotFound {
+		t.Error("expected the value not to be stored")
+	}
+}
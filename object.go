@@ -75,7 +75,8 @@ func (o *Object) AddToIndex(indexName string, indexValue string) {
 	}
 }
 
-func fromRpbContent(rpbContent *rpbRiakKV.RpbContent) (ro *Object, err error) {
+// NB: values are decompressed by c, which may be nil, see CompressionOptions
+func fromRpbContent(rpbContent *rpbRiakKV.RpbContent, c *compression) (ro *Object, err error) {
 	// NB: ro = "Riak Object"
 	ro = &Object{
 		IsTombstone: rpbContent.GetDeleted(),
@@ -131,6 +132,9 @@ func fromRpbContent(rpbContent *rpbRiakKV.RpbContent) (ro *Object, err error) {
 		}
 	}
 
+	if err = c.decompress(ro); err != nil {
+		return nil, err
+	}
 	return
 }
 
@@ -0,0 +1,114 @@
+package riak
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// CommandObserver is implemented by types that want to measure what a Cluster is doing, such as
+// collecting metrics. Set it with ClusterOptions.Observer; it is also used by the Cluster's Nodes.
+//
+// Methods are called synchronously from the goroutine executing the command, so implementations
+// must be safe for concurrent use and should return quickly
+type CommandObserver interface {
+	// CommandStarted is called once, when the Cluster begins executing a command
+	CommandStarted(cmd Command)
+	// AttemptCompleted is called each time a Node tries to execute a command
+	AttemptCompleted(e *AttemptEvent)
+	// CommandRetrying is called before the Cluster re-tries a command that failed
+	CommandRetrying(e *RetryEvent)
+	// CommandEnqueued is called when no Node could execute a command and it is placed in the
+	// Cluster's command queue
+	CommandEnqueued(cmd Command, queueDepth uint16)
+	// CommandCompleted is called once, when the Cluster is done with a command
+	CommandCompleted(e *CompletedEvent)
+}
+
+// AttemptEvent describes a single try to execute a Command on a Node
+type AttemptEvent struct {
+	Command        Command
+	Node           *Node
+	Attempt        int           // NB: starts at 1
+	ConnectionWait time.Duration // time spent acquiring a connection from the Node's pool
+	BytesWritten   int
+	BytesRead      int
+	Latency        time.Duration // time from writing the request to reading the last response
+	Err            error
+}
+
+// RetryEvent describes a Command about to be re-tried after Err
+type RetryEvent struct {
+	Command Command
+	Attempt int // NB: the attempt that failed
+	Err     error
+}
+
+// CompletedEvent describes the outcome of a Command
+type CompletedEvent struct {
+	Command    Command
+	Attempts   int
+	Duration   time.Duration // time since CommandStarted, including time spent queued
+	Err        error
+	ErrorClass ErrorClass
+}
+
+// ErrorClass is a coarse classification of the error a command failed with, suitable for use as a
+// metric label
+type ErrorClass string
+
+// Error classes
+const (
+	ErrorClassNone           ErrorClass = "none"            // no error
+	ErrorClassRiak           ErrorClass = "riak"            // an error response from Riak
+	ErrorClassTimeout        ErrorClass = "timeout"         // a network or connection pool timeout
+	ErrorClassNetwork        ErrorClass = "network"         // any other network error
+	ErrorClassContext        ErrorClass = "context"         // the command's context was cancelled or its deadline passed
+	ErrorClassOutcomeUnknown ErrorClass = "outcome_unknown" // see OutcomeUnknownError
+	ErrorClassRejected       ErrorClass = "rejected"        // see AdmissionRejectedError
+	ErrorClassSecurity       ErrorClass = "security"        // see TLSError and AuthError
+	ErrorClassClient         ErrorClass = "client"          // an error raised by this package
+	ErrorClassOther          ErrorClass = "other"
+)
+
+// ClassifyError returns the ErrorClass of err
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassNone
+	}
+	if IsOutcomeUnknown(err) {
+		return ErrorClassOutcomeUnknown
+	}
+	if IsAdmissionRejected(err) {
+		return ErrorClassRejected
+	}
+	if isContextError(err) {
+		return ErrorClassContext
+	}
+	if IsTLSError(err) || IsAuthError(err) {
+		return ErrorClassSecurity
+	}
+	var riakErr RiakError
+	if errors.As(err, &riakErr) {
+		return ErrorClassRiak
+	}
+	if errors.Is(err, ErrConnMgrAcquireTimeout) {
+		return ErrorClassTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ErrorClassTimeout
+		}
+		return ErrorClassNetwork
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorClassNetwork
+	}
+	var clientErr ClientError
+	if errors.As(err, &clientErr) {
+		return ErrorClassClient
+	}
+	return ErrorClassOther
+}
@@ -0,0 +1,199 @@
+package riak
+
+import (
+	"expvar"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExpvarObserver is a CommandObserver that aggregates counters and latency histograms per command
+// name and per node, and publishes them with the expvar package so that they are served at
+// /debug/vars. The published variable looks like
+//
+//	{
+//	  "commands": {
+//	    "FetchValue": {"started": 10, "attempts": 11, "retries": 1, "enqueued": 0, "completed": 10,
+//	                   "errors": {"riak": 1}, "latency": {...}}
+//	  },
+//	  "nodes": {
+//	    "127.0.0.1:8087": {"attempts": 11, "errors": 1, "bytesWritten": 512, "bytesRead": 2048,
+//	                       "latency": {...}, "connectionWait": {...}}
+//	  }
+//	}
+//
+// where each histogram holds the count, the sum in milliseconds and cumulative bucket counts
+type ExpvarObserver struct {
+	commands *expvar.Map
+	nodes    *expvar.Map
+	sync.Mutex
+}
+
+// NewExpvarObserver creates an ExpvarObserver and publishes its statistics under name. As with
+// expvar.Publish, it panics if name is already in use, including by an earlier ExpvarObserver, so
+// create one ExpvarObserver per name and share it between Clusters
+func NewExpvarObserver(name string) *ExpvarObserver {
+	o := &ExpvarObserver{
+		commands: new(expvar.Map).Init(),
+		nodes:    new(expvar.Map).Init(),
+	}
+	root := expvar.NewMap(name)
+	root.Set("commands", o.commands)
+	root.Set("nodes", o.nodes)
+	return o
+}
+
+// CommandStarted implements CommandObserver
+func (o *ExpvarObserver) CommandStarted(cmd Command) {
+	o.commandStats(cmd).Add("started", 1)
+}
+
+// AttemptCompleted implements CommandObserver
+func (o *ExpvarObserver) AttemptCompleted(e *AttemptEvent) {
+	o.commandStats(e.Command).Add("attempts", 1)
+	n := o.nodeStats(e.Node)
+	n.Add("attempts", 1)
+	n.Add("bytesWritten", int64(e.BytesWritten))
+	n.Add("bytesRead", int64(e.BytesRead))
+	if e.Err != nil {
+		n.Add("errors", 1)
+	}
+	n.Get("connectionWait").(*histogram).observe(e.ConnectionWait)
+	if e.Latency > 0 {
+		n.Get("latency").(*histogram).observe(e.Latency)
+	}
+}
+
+// CommandRetrying implements CommandObserver
+func (o *ExpvarObserver) CommandRetrying(e *RetryEvent) {
+	o.commandStats(e.Command).Add("retries", 1)
+}
+
+// CommandEnqueued implements CommandObserver
+func (o *ExpvarObserver) CommandEnqueued(cmd Command, queueDepth uint16) {
+	o.commandStats(cmd).Add("enqueued", 1)
+}
+
+// CommandCompleted implements CommandObserver
+func (o *ExpvarObserver) CommandCompleted(e *CompletedEvent) {
+	c := o.commandStats(e.Command)
+	c.Add("completed", 1)
+	if e.ErrorClass != ErrorClassNone {
+		c.Get("errors").(*expvar.Map).Add(string(e.ErrorClass), 1)
+	}
+	c.Get("latency").(*histogram).observe(e.Duration)
+}
+
+func (o *ExpvarObserver) commandStats(cmd Command) *expvar.Map {
+	name := commandTypeName(cmd)
+	if m, ok := o.commands.Get(name).(*expvar.Map); ok {
+		return m
+	}
+	o.Lock()
+	defer o.Unlock()
+	if m, ok := o.commands.Get(name).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map).Init()
+	for _, k := range []string{"started", "attempts", "retries", "enqueued", "completed"} {
+		m.Set(k, new(expvar.Int))
+	}
+	m.Set("errors", new(expvar.Map).Init())
+	m.Set("latency", newHistogram())
+	o.commands.Set(name, m)
+	return m
+}
+
+func (o *ExpvarObserver) nodeStats(n *Node) *expvar.Map {
+	addr := n.Addr()
+	if m, ok := o.nodes.Get(addr).(*expvar.Map); ok {
+		return m
+	}
+	o.Lock()
+	defer o.Unlock()
+	if m, ok := o.nodes.Get(addr).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map).Init()
+	for _, k := range []string{"attempts", "errors", "bytesWritten", "bytesRead"} {
+		m.Set(k, new(expvar.Int))
+	}
+	m.Set("latency", newHistogram())
+	m.Set("connectionWait", newHistogram())
+	o.nodes.Set(addr, m)
+	return m
+}
+
+// commandTypeName returns the name of the Command type without the "Command" suffix. Unlike
+// Command.Name(), it does not vary when debug logging is enabled
+func commandTypeName(cmd Command) string {
+	t := reflect.TypeOf(cmd)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return strings.TrimSuffix(t.Name(), "Command")
+}
+
+// histogramBounds are the upper bounds of the histogram buckets
+var histogramBounds = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// histogram is an expvar.Var counting durations in cumulative buckets
+type histogram struct {
+	counts []uint64 // NB: one per bound plus one for +Inf, not cumulative
+	count  uint64
+	sum    time.Duration
+	sync.Mutex
+}
+
+func newHistogram() *histogram {
+	return &histogram{
+		counts: make([]uint64, len(histogramBounds)+1),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(histogramBounds) && d > histogramBounds[i] {
+		i++
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+// String implements expvar.Var
+func (h *histogram) String() string {
+	h.Lock()
+	defer h.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, `{"count": %d, "sumMs": %g, "buckets": {`, h.count, float64(h.sum)/float64(time.Millisecond))
+	cumulative := uint64(0)
+	for i, c := range h.counts {
+		cumulative += c
+		if i < len(histogramBounds) {
+			fmt.Fprintf(&b, `"%s": %d, `, histogramBounds[i], cumulative)
+		} else {
+			fmt.Fprintf(&b, `"+Inf": %d`, cumulative)
+		}
+	}
+	b.WriteString("}}")
+	return b.String()
+}
@@ -0,0 +1,205 @@
+package riak
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	started   []Command
+	attempts  []*AttemptEvent
+	retries   []*RetryEvent
+	completed []*CompletedEvent
+	sync.Mutex
+}
+
+func (o *recordingObserver) CommandStarted(cmd Command) {
+	o.Lock()
+	defer o.Unlock()
+	o.started = append(o.started, cmd)
+}
+
+func (o *recordingObserver) AttemptCompleted(e *AttemptEvent) {
+	o.Lock()
+	defer o.Unlock()
+	o.attempts = append(o.attempts, e)
+}
+
+func (o *recordingObserver) CommandRetrying(e *RetryEvent) {
+	o.Lock()
+	defer o.Unlock()
+	o.retries = append(o.retries, e)
+}
+
+func (o *recordingObserver) CommandEnqueued(cmd Command, queueDepth uint16) {}
+
+func (o *recordingObserver) CommandCompleted(e *CompletedEvent) {
+	o.Lock()
+	defer o.Unlock()
+	o.completed = append(o.completed, e)
+}
+
+func TestObserverSeesSuccessfulCommand(t *testing.T) {
+	o := &recordingObserver{}
+	srv := newTestServers(t, 1)[0]
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{Observer: o, ExecutionAttempts: 2}, srv.Addr())
+
+	cmd, err := NewStoreValueCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		WithContent(&Object{Value: []byte("value")}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(o.started) != 1 || o.started[0] != cmd {
+		t.Errorf("expected command to be started once, got %v", o.started)
+	}
+	if len(o.attempts) != 1 {
+		t.Fatalf("expected 1 attempt, got %d", len(o.attempts))
+	}
+	a := o.attempts[0]
+	if a.Attempt != 1 || a.Node != cluster.nodes[0] || a.Err != nil {
+		t.Errorf("unexpected attempt: %+v", a)
+	}
+	if a.BytesWritten <= 5 || a.BytesRead < 5 || a.Latency <= 0 {
+		t.Errorf("expected bytes and latency to be measured: %+v", a)
+	}
+	if len(o.retries) != 0 {
+		t.Errorf("expected no retries, got %d", len(o.retries))
+	}
+	if len(o.completed) != 1 {
+		t.Fatalf("expected command to be completed once, got %d", len(o.completed))
+	}
+	if c := o.completed[0]; c.Attempts != 1 || c.Err != nil || c.ErrorClass != ErrorClassNone {
+		t.Errorf("unexpected completion: %+v", c)
+	}
+}
+
+func TestObserverSeesRetriesAndErrorClass(t *testing.T) {
+	o := &recordingObserver{}
+	srv := newTestServers(t, 1)[0]
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{Observer: o, ExecutionAttempts: 2}, srv.Addr())
+
+	// NB: the fake server rejects fetching a data type from a bucket type without one
+	cmd, err := NewFetchCounterCommandBuilder().
+		WithBucketType("no_datatype").
+		WithBucket("b").
+		WithKey("k").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(cmd); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if len(o.attempts) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(o.attempts))
+	}
+	if len(o.retries) != 1 || o.retries[0].Attempt != 1 {
+		t.Errorf("expected 1 retry after attempt 1, got %+v", o.retries)
+	}
+	c := o.completed[0]
+	if c.Attempts != 2 || c.ErrorClass != ErrorClassRiak {
+		t.Errorf("unexpected completion: %+v", c)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want ErrorClass
+	}{
+		{nil, ErrorClassNone},
+		{newClientError(ErrClusterNoNodesAvailable, RiakError{Errmsg: "overload"}), ErrorClassRiak},
+		{newClientError(ErrClusterContextDone, context.DeadlineExceeded), ErrorClassContext},
+		{newClientError(ErrClusterNoNodesAvailable, ErrConnMgrAcquireTimeout), ErrorClassTimeout},
+		{io.EOF, ErrorClassNetwork},
+		{ErrClusterShuttingDown, ErrorClassClient},
+		{errors.New("boom"), ErrorClassOther},
+	}
+	for _, c := range cases {
+		if got := ClassifyError(c.err); got != c.want {
+			t.Errorf("%v: expected %s, got %s", c.err, c.want, got)
+		}
+	}
+}
+
+// expvarObserverRuns makes the expvar names of TestExpvarObserver unique, as expvar panics when a
+// name is reused, e.g. with go test -count=2
+var expvarObserverRuns int32
+
+func TestExpvarObserver(t *testing.T) {
+	name := fmt.Sprintf("riak_test_expvar_observer_%d", atomic.AddInt32(&expvarObserverRuns, 1))
+	o := NewExpvarObserver(name)
+	srv := newTestServers(t, 1)[0]
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{Observer: o, ExecutionAttempts: 2}, srv.Addr())
+
+	for i := 0; i < 3; i++ {
+		if err := cluster.Execute(&PingCommand{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stats struct {
+		Commands map[string]struct {
+			Started   int64
+			Completed int64
+			Latency   struct {
+				Count   uint64
+				Buckets map[string]uint64
+			}
+		}
+		Nodes map[string]struct {
+			Attempts       int64
+			BytesRead      int64
+			ConnectionWait struct {
+				Count uint64
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	ping := stats.Commands["Ping"]
+	if ping.Started != 3 || ping.Completed != 3 || ping.Latency.Count != 3 || ping.Latency.Buckets["+Inf"] != 3 {
+		t.Errorf("unexpected command stats: %+v", ping)
+	}
+	node := stats.Nodes[cluster.nodes[0].Addr()]
+	if node.Attempts != 3 || node.BytesRead != 15 || node.ConnectionWait.Count != 3 {
+		t.Errorf("unexpected node stats: %+v", node)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h := newHistogram()
+	h.observe(500 * time.Microsecond)
+	h.observe(3 * time.Millisecond)
+	h.observe(time.Minute)
+
+	var v struct {
+		Count   uint64
+		Buckets map[string]uint64
+	}
+	if err := json.Unmarshal([]byte(h.String()), &v); err != nil {
+		t.Fatal(err)
+	}
+	for le, want := range map[string]uint64{"1ms": 1, "2ms": 1, "5ms": 2, "10s": 2, "+Inf": 3} {
+		if got := v.Buckets[le]; got != want {
+			t.Errorf("bucket %s: expected %d, got %d", le, want, got)
+		}
+	}
+}
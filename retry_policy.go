@@ -0,0 +1,181 @@
+package riak
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy decides whether the Cluster re-tries a command that failed, and how long it waits
+// before doing so. Set it for all commands with ClusterOptions.RetryPolicy, or for a single command
+// with WithRetryPolicy. Implementations must be safe for concurrent use.
+//
+// Only re-tryable commands are re-tried; streaming commands such as ListKeys are never re-tried
+type RetryPolicy interface {
+	// Retry is called after attempt failed with err. attempt is the number of attempts made so far
+	// in this execution of cmd, starting at 1
+	Retry(cmd Command, attempt int, err error) (retry bool, delay time.Duration)
+}
+
+// RetryPolicyFunc adapts a function to the RetryPolicy interface
+type RetryPolicyFunc func(cmd Command, attempt int, err error) (bool, time.Duration)
+
+// Retry implements RetryPolicy
+func (f RetryPolicyFunc) Retry(cmd Command, attempt int, err error) (bool, time.Duration) {
+	return f(cmd, attempt, err)
+}
+
+// NeverRetryPolicy does not re-try any command
+var NeverRetryPolicy RetryPolicy = RetryPolicyFunc(func(Command, int, error) (bool, time.Duration) {
+	return false, 0
+})
+
+// WithRetryPolicy sets the RetryPolicy used for cmd in place of the Cluster's, and returns cmd
+//
+//	cmd, err := NewStoreValueCommandBuilder().
+//		WithBucket("myBucket").
+//		WithContent(obj).
+//		Build()
+//	cluster.Execute(WithRetryPolicy(cmd, NeverRetryPolicy))
+func WithRetryPolicy(cmd Command, policy RetryPolicy) Command {
+	cmd.setRetryPolicy(policy)
+	return cmd
+}
+
+const (
+	defaultRetryInitialDelay = 100 * time.Millisecond
+	defaultRetryMaxDelay     = 10 * time.Second
+	defaultRetryMultiplier   = 2
+)
+
+// ExponentialRetryPolicyOptions configures an ExponentialRetryPolicy
+type ExponentialRetryPolicyOptions struct {
+	MaxAttempts  int           // NB: including the first, defaults to 3
+	InitialDelay time.Duration // NB: defaults to 100ms
+	MaxDelay     time.Duration // NB: caps the delay, defaults to 10s
+	Multiplier   float64       // NB: defaults to 2
+	NoJitter     bool          // NB: by default each delay is chosen at random between InitialDelay and the exponential delay
+}
+
+// ExponentialRetryPolicy re-tries a command after any error, up to a maximum number of attempts,
+// waiting exponentially longer before each attempt up to a maximum delay
+type ExponentialRetryPolicy struct {
+	maxAttempts  int
+	initialDelay time.Duration
+	maxDelay     time.Duration
+	multiplier   float64
+	jitter       bool
+	rand         *rand.Rand
+	sync.Mutex
+}
+
+// NewExponentialRetryPolicy is a factory function that takes an ExponentialRetryPolicyOptions
+// struct and returns an ExponentialRetryPolicy
+func NewExponentialRetryPolicy(options *ExponentialRetryPolicyOptions) *ExponentialRetryPolicy {
+	if options == nil {
+		options = &ExponentialRetryPolicyOptions{}
+	}
+	p := &ExponentialRetryPolicy{
+		maxAttempts:  options.MaxAttempts,
+		initialDelay: options.InitialDelay,
+		maxDelay:     options.MaxDelay,
+		multiplier:   options.Multiplier,
+		jitter:       !options.NoJitter,
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if p.maxAttempts <= 0 {
+		p.maxAttempts = int(defaultExecutionAttempts)
+	}
+	if p.initialDelay <= 0 {
+		p.initialDelay = defaultRetryInitialDelay
+	}
+	if p.maxDelay <= 0 {
+		p.maxDelay = defaultRetryMaxDelay
+	}
+	if p.multiplier < 1 {
+		p.multiplier = defaultRetryMultiplier
+	}
+	return p
+}
+
+// Retry implements RetryPolicy
+func (p *ExponentialRetryPolicy) Retry(cmd Command, attempt int, err error) (bool, time.Duration) {
+	if attempt >= p.maxAttempts {
+		return false, 0
+	}
+	return true, p.delay(attempt)
+}
+
+func (p *ExponentialRetryPolicy) delay(attempt int) time.Duration {
+	initial := float64(p.initialDelay)
+	d := initial * math.Pow(p.multiplier, float64(attempt-1))
+	if d > float64(p.maxDelay) {
+		d = float64(p.maxDelay)
+	}
+	if p.jitter {
+		p.Lock()
+		d = initial + p.rand.Float64()*(d-initial)
+		p.Unlock()
+	}
+	return time.Duration(d)
+}
+
+// NoWriteAfterTimeoutRetryPolicy returns a RetryPolicy that does not re-try a write, such as a
+// StoreValue or UpdateCounter command, that failed with a timeout, since Riak may have applied it.
+// Other commands and errors are re-tried as decided by next
+func NoWriteAfterTimeoutRetryPolicy(next RetryPolicy) RetryPolicy {
+	return RetryPolicyFunc(func(cmd Command, attempt int, err error) (bool, time.Duration) {
+		if isWriteCommand(cmd) && isTimeoutError(err) {
+			return false, 0
+		}
+		return next.Retry(cmd, attempt, err)
+	})
+}
+
+// OverloadRetryPolicy returns a RetryPolicy that only re-tries commands that failed because Riak
+// or the connection pool was overloaded, as decided by next. Other errors are not re-tried
+func OverloadRetryPolicy(next RetryPolicy) RetryPolicy {
+	return RetryPolicyFunc(func(cmd Command, attempt int, err error) (bool, time.Duration) {
+		if !isOverloadError(err) {
+			return false, 0
+		}
+		return next.Retry(cmd, attempt, err)
+	})
+}
+
+// isWriteCommand returns true if cmd changes data or configuration in Riak
+func isWriteCommand(cmd Command) bool {
+	switch cmd.(type) {
+	case *StoreValueCommand, *DeleteValueCommand,
+		*UpdateCounterCommand, *UpdateSetCommand, *UpdateMapCommand,
+		*StoreBucketPropsCommand, *StoreBucketTypePropsCommand,
+		*StoreIndexCommand, *DeleteIndexCommand, *StoreSchemaCommand:
+		return true
+	default:
+		return false
+	}
+}
+
+// isTimeoutError returns true if err is a network timeout, or Riak timing out waiting for vnodes
+func isTimeoutError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var riakErr RiakError
+	return errors.As(err, &riakErr) && strings.Contains(riakErr.Errmsg, "timeout")
+}
+
+// isOverloadError returns true if err is Riak reporting overload, or no connection being available
+// in the Node's pool
+func isOverloadError(err error) bool {
+	if errors.Is(err, ErrConnMgrAllConnectionsInUse) || errors.Is(err, ErrConnMgrAcquireTimeout) {
+		return true
+	}
+	var riakErr RiakError
+	return errors.As(err, &riakErr) && strings.Contains(riakErr.Errmsg, "overload")
+}
@@ -0,0 +1,150 @@
+package riak
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testNetError struct {
+	timeout bool
+}
+
+func (e testNetError) Error() string   { return "test net error" }
+func (e testNetError) Timeout() bool   { return e.timeout }
+func (e testNetError) Temporary() bool { return false }
+
+type recordingRetryPolicy struct {
+	attempts []int
+	retries  int
+	sync.Mutex
+}
+
+func (p *recordingRetryPolicy) Retry(cmd Command, attempt int, err error) (bool, time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.attempts = append(p.attempts, attempt)
+	return attempt <= p.retries, time.Millisecond
+}
+
+func TestExponentialRetryPolicy(t *testing.T) {
+	p := NewExponentialRetryPolicy(&ExponentialRetryPolicyOptions{
+		MaxAttempts:  5,
+		InitialDelay: 100 * time.Millisecond,
+		MaxDelay:     300 * time.Millisecond,
+		NoJitter:     true,
+	})
+	for i, want := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		300 * time.Millisecond,
+		300 * time.Millisecond,
+	} {
+		attempt := i + 1
+		retry, delay := p.Retry(&PingCommand{}, attempt, io.EOF)
+		if !retry || delay != want {
+			t.Errorf("attempt %d: expected retry after %v, got %v %v", attempt, want, retry, delay)
+		}
+	}
+	if retry, _ := p.Retry(&PingCommand{}, 5, io.EOF); retry {
+		t.Error("expected no retry after MaxAttempts")
+	}
+
+	jittered := NewExponentialRetryPolicy(nil)
+	for i := 0; i < 100; i++ {
+		_, delay := jittered.Retry(&PingCommand{}, 2, io.EOF)
+		if delay < defaultRetryInitialDelay || delay > 2*defaultRetryInitialDelay {
+			t.Fatalf("expected jittered delay between %v and %v, got %v", defaultRetryInitialDelay, 2*defaultRetryInitialDelay, delay)
+		}
+	}
+	if retry, _ := jittered.Retry(&PingCommand{}, int(defaultExecutionAttempts), io.EOF); retry {
+		t.Errorf("expected default of %d attempts", defaultExecutionAttempts)
+	}
+}
+
+func TestNoWriteAfterTimeoutRetryPolicy(t *testing.T) {
+	p := NoWriteAfterTimeoutRetryPolicy(NewExponentialRetryPolicy(nil))
+	store := &StoreValueCommand{}
+	fetch := &FetchValueCommand{}
+	for _, tc := range []struct {
+		cmd  Command
+		err  error
+		want bool
+	}{
+		{store, testNetError{timeout: true}, false},
+		{store, newClientError("wrapped", testNetError{timeout: true}), false},
+		{store, RiakError{Errmsg: "timeout"}, false},
+		{store, testNetError{timeout: false}, true},
+		{store, io.EOF, true},
+		{&UpdateCounterCommand{}, testNetError{timeout: true}, false},
+		{fetch, testNetError{timeout: true}, true},
+	} {
+		if retry, _ := p.Retry(tc.cmd, 1, tc.err); retry != tc.want {
+			t.Errorf("%T %v: expected retry %v, got %v", tc.cmd, tc.err, tc.want, retry)
+		}
+	}
+}
+
+func TestOverloadRetryPolicy(t *testing.T) {
+	p := OverloadRetryPolicy(NewExponentialRetryPolicy(nil))
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{RiakError{Errmsg: "overload"}, true},
+		{ErrConnMgrAcquireTimeout, true},
+		{newClientError(ErrClusterNoNodesAvailable, ErrConnMgrAllConnectionsInUse), true},
+		{RiakError{Errmsg: "notfound"}, false},
+		{io.EOF, false},
+	} {
+		if retry, _ := p.Retry(&FetchValueCommand{}, 1, tc.err); retry != tc.want {
+			t.Errorf("%v: expected retry %v, got %v", tc.err, tc.want, retry)
+		}
+	}
+	if retry, _ := p.Retry(&FetchValueCommand{}, int(defaultExecutionAttempts), RiakError{Errmsg: "overload"}); retry {
+		t.Error("expected next policy to limit attempts")
+	}
+}
+
+// NB: the default bucket type is not a data type bucket type, so FetchCounter fails
+func newFailingFetchCounter(t *testing.T) Command {
+	cmd, err := NewFetchCounterCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestClusterUsesRetryPolicy(t *testing.T) {
+	p := &recordingRetryPolicy{retries: 2}
+	srv := newTestServers(t, 1)[0]
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{RetryPolicy: p}, srv.Addr())
+
+	if err := cluster.Execute(newFailingFetchCounter(t)); err == nil {
+		t.Fatal("expected error")
+	}
+	if got := p.attempts; len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Errorf("expected policy to be asked after attempts 1, 2 and 3, got %v", got)
+	}
+}
+
+func TestWithRetryPolicyOverridesCluster(t *testing.T) {
+	clusterPolicy := &recordingRetryPolicy{retries: 2}
+	srv := newTestServers(t, 1)[0]
+	cluster, _ := newTestCluster(t, nil, &ClusterOptions{RetryPolicy: clusterPolicy}, srv.Addr())
+
+	cmdPolicy := &recordingRetryPolicy{}
+	if err := cluster.Execute(WithRetryPolicy(newFailingFetchCounter(t), cmdPolicy)); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(clusterPolicy.attempts) != 0 {
+		t.Errorf("expected cluster policy not to be used, got %v", clusterPolicy.attempts)
+	}
+	if got := cmdPolicy.attempts; len(got) != 1 || got[0] != 1 {
+		t.Errorf("expected command policy to be asked once, got %v", got)
+	}
+}
@@ -0,0 +1,334 @@
+package riaktest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	rpbRiak "github.com/basho/riak-go-client/rpb/riak"
+	rpbRiakDT "github.com/basho/riak-go-client/rpb/riak_dt"
+	proto "github.com/golang/protobuf/proto"
+)
+
+// datatype is a stored Riak data type. Every update bumps version, which is
+// returned to clients as the opaque context
+type datatype struct {
+	kind    rpbRiakDT.DtFetchResp_DataType
+	version uint64
+	counter int64
+	set     map[string]bool
+	m       *dtMap
+}
+
+type mapFieldKey struct {
+	name string
+	kind rpbRiakDT.MapField_MapFieldType
+}
+
+type dtMap struct {
+	entries map[mapFieldKey]*mapEntry
+}
+
+type mapEntry struct {
+	counter  int64
+	set      map[string]bool
+	register []byte
+	flag     bool
+	m        *dtMap
+}
+
+func newDtMap() *dtMap {
+	return &dtMap{entries: make(map[mapFieldKey]*mapEntry)}
+}
+
+func (s *store) dtFetch(req *rpbRiakDT.DtFetchReq) (*rpbRiakDT.DtFetchResp, error) {
+	if len(req.Bucket) == 0 || len(req.Key) == 0 {
+		return nil, errors.New("bucket and key are required")
+	}
+	s.Lock()
+	defer s.Unlock()
+	id := newBucketID(req.Type, req.Bucket)
+	kind, ok := kindFromProps(s.props(id).Datatype)
+	if !ok {
+		return nil, fmt.Errorf("bucket type %s is not a data type bucket type", id.bucketType)
+	}
+	resp := &rpbRiakDT.DtFetchResp{Type: kind.Enum()}
+	b := s.getBucket(id, false)
+	if b == nil {
+		return resp, nil
+	}
+	dt, ok := b.datatypes[string(req.Key)]
+	if !ok {
+		// NB: a nil Value means not found
+		return resp, nil
+	}
+	resp.Value = dt.value()
+	if req.IncludeContext == nil || req.GetIncludeContext() {
+		resp.Context = encodeVersion(dt.version)
+	}
+	return resp, nil
+}
+
+func (s *store) dtUpdate(req *rpbRiakDT.DtUpdateReq) (*rpbRiakDT.DtUpdateResp, error) {
+	if len(req.Bucket) == 0 {
+		return nil, errors.New("bucket is required")
+	}
+	if req.Op == nil {
+		return nil, errors.New("op is required")
+	}
+	kind, err := opKind(req.Op)
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	id := newBucketID(req.Type, req.Bucket)
+	if expected, ok := kindFromProps(s.props(id).Datatype); !ok {
+		// NB: real Riak requires the bucket type to be created with a datatype property,
+		// here the first update defines it
+		if p, ok := s.types[id.bucketType]; ok {
+			p.Datatype = []byte(kindNames[kind])
+		} else {
+			s.types[id.bucketType] = &rpbRiak.RpbBucketProps{Datatype: []byte(kindNames[kind])}
+		}
+	} else if expected != kind {
+		return nil, fmt.Errorf("bucket type %s holds %s data types, got %s operation", id.bucketType, expected, kind)
+	}
+	b := s.getBucket(id, true)
+
+	key := string(req.Key)
+	generatedKey := false
+	if key == "" {
+		key = randomString(22)
+		generatedKey = true
+	}
+
+	dt, exists := b.datatypes[key]
+	if !exists {
+		dt = &datatype{kind: kind}
+	} else if dt.kind != kind {
+		return nil, fmt.Errorf("%s is a %s, got %s operation", key, dt.kind, kind)
+	}
+
+	// NB: apply to a copy so that a failed operation leaves no trace
+	updated := dt.clone()
+	switch kind {
+	case rpbRiakDT.DtFetchResp_COUNTER:
+		updated.counter += counterIncrement(req.Op.CounterOp)
+	case rpbRiakDT.DtFetchResp_SET:
+		err = applySetOp(updated.set, req.Op.SetOp)
+	case rpbRiakDT.DtFetchResp_MAP:
+		err = applyMapOp(updated.m, req.Op.MapOp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	updated.version++
+	b.datatypes[key] = updated
+
+	resp := &rpbRiakDT.DtUpdateResp{}
+	if generatedKey {
+		resp.Key = []byte(key)
+	}
+	if req.IncludeContext == nil || req.GetIncludeContext() {
+		resp.Context = encodeVersion(updated.version)
+	}
+	if req.GetReturnBody() {
+		v := updated.value()
+		resp.CounterValue = v.CounterValue
+		resp.SetValue = v.SetValue
+		resp.MapValue = v.MapValue
+	}
+	return resp, nil
+}
+
+var kindNames = map[rpbRiakDT.DtFetchResp_DataType]string{
+	rpbRiakDT.DtFetchResp_COUNTER: "counter",
+	rpbRiakDT.DtFetchResp_SET:     "set",
+	rpbRiakDT.DtFetchResp_MAP:     "map",
+}
+
+func kindFromProps(datatype []byte) (rpbRiakDT.DtFetchResp_DataType, bool) {
+	for kind, name := range kindNames {
+		if name == string(datatype) {
+			return kind, true
+		}
+	}
+	return 0, false
+}
+
+func opKind(op *rpbRiakDT.DtOp) (rpbRiakDT.DtFetchResp_DataType, error) {
+	switch {
+	case op.CounterOp != nil:
+		return rpbRiakDT.DtFetchResp_COUNTER, nil
+	case op.SetOp != nil:
+		return rpbRiakDT.DtFetchResp_SET, nil
+	case op.MapOp != nil:
+		return rpbRiakDT.DtFetchResp_MAP, nil
+	}
+	return 0, errors.New("op must contain a counter, set or map operation")
+}
+
+func counterIncrement(op *rpbRiakDT.CounterOp) int64 {
+	if op == nil || op.Increment == nil {
+		return 1
+	}
+	return op.GetIncrement()
+}
+
+func applySetOp(set map[string]bool, op *rpbRiakDT.SetOp) error {
+	if op == nil {
+		return nil
+	}
+	for _, r := range op.Removes {
+		if !set[string(r)] {
+			return fmt.Errorf("precondition, not_present: %s", r)
+		}
+		delete(set, string(r))
+	}
+	for _, a := range op.Adds {
+		set[string(a)] = true
+	}
+	return nil
+}
+
+func applyMapOp(m *dtMap, op *rpbRiakDT.MapOp) error {
+	if op == nil {
+		return nil
+	}
+	for _, f := range op.Removes {
+		k := mapFieldKey{name: string(f.Name), kind: f.GetType()}
+		if _, ok := m.entries[k]; !ok {
+			return fmt.Errorf("precondition, not_present: %s", f.Name)
+		}
+		delete(m.entries, k)
+	}
+	for _, u := range op.Updates {
+		if u.Field == nil {
+			return errors.New("map update requires a field")
+		}
+		k := mapFieldKey{name: string(u.Field.Name), kind: u.Field.GetType()}
+		e, ok := m.entries[k]
+		if !ok {
+			e = &mapEntry{
+				set: make(map[string]bool),
+				m:   newDtMap(),
+			}
+		}
+		switch k.kind {
+		case rpbRiakDT.MapField_COUNTER:
+			e.counter += counterIncrement(u.CounterOp)
+		case rpbRiakDT.MapField_SET:
+			if err := applySetOp(e.set, u.SetOp); err != nil {
+				return err
+			}
+		case rpbRiakDT.MapField_REGISTER:
+			e.register = u.RegisterOp
+		case rpbRiakDT.MapField_FLAG:
+			e.flag = u.GetFlagOp() == rpbRiakDT.MapUpdate_ENABLE
+		case rpbRiakDT.MapField_MAP:
+			if err := applyMapOp(e.m, u.MapOp); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown map field type: %v", k.kind)
+		}
+		m.entries[k] = e
+	}
+	return nil
+}
+
+func (dt *datatype) clone() *datatype {
+	c := &datatype{
+		kind:    dt.kind,
+		version: dt.version,
+		counter: dt.counter,
+		set:     cloneSet(dt.set),
+		m:       dt.m.clone(),
+	}
+	return c
+}
+
+func cloneSet(set map[string]bool) map[string]bool {
+	c := make(map[string]bool, len(set))
+	for k, v := range set {
+		c[k] = v
+	}
+	return c
+}
+
+func (m *dtMap) clone() *dtMap {
+	c := newDtMap()
+	if m == nil {
+		return c
+	}
+	for k, e := range m.entries {
+		c.entries[k] = &mapEntry{
+			counter:  e.counter,
+			set:      cloneSet(e.set),
+			register: e.register,
+			flag:     e.flag,
+			m:        e.m.clone(),
+		}
+	}
+	return c
+}
+
+func (dt *datatype) value() *rpbRiakDT.DtValue {
+	v := &rpbRiakDT.DtValue{}
+	switch dt.kind {
+	case rpbRiakDT.DtFetchResp_COUNTER:
+		v.CounterValue = proto.Int64(dt.counter)
+	case rpbRiakDT.DtFetchResp_SET:
+		v.SetValue = setValue(dt.set)
+	case rpbRiakDT.DtFetchResp_MAP:
+		v.MapValue = dt.m.value()
+	}
+	return v
+}
+
+func setValue(set map[string]bool) [][]byte {
+	elems := make([]string, 0, len(set))
+	for e := range set {
+		elems = append(elems, e)
+	}
+	return sortedBytes(elems)
+}
+
+func (m *dtMap) value() []*rpbRiakDT.MapEntry {
+	keys := make([]mapFieldKey, 0, len(m.entries))
+	for k := range m.entries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].kind < keys[j].kind
+	})
+	entries := make([]*rpbRiakDT.MapEntry, len(keys))
+	for i, k := range keys {
+		e := m.entries[k]
+		me := &rpbRiakDT.MapEntry{
+			Field: &rpbRiakDT.MapField{
+				Name: []byte(k.name),
+				Type: k.kind.Enum(),
+			},
+		}
+		switch k.kind {
+		case rpbRiakDT.MapField_COUNTER:
+			me.CounterValue = proto.Int64(e.counter)
+		case rpbRiakDT.MapField_SET:
+			me.SetValue = setValue(e.set)
+		case rpbRiakDT.MapField_REGISTER:
+			me.RegisterValue = e.register
+		case rpbRiakDT.MapField_FLAG:
+			me.FlagValue = proto.Bool(e.flag)
+		case rpbRiakDT.MapField_MAP:
+			me.MapValue = e.m.value()
+		}
+		entries[i] = me
+	}
+	return entries
+}
@@ -0,0 +1,14 @@
+/*
+Package riaktest provides an in-process fake Riak KV node for tests.
+
+The fake server speaks the Riak Protocol Buffers API over TCP, so code built
+on package riak can be exercised against it without a real cluster. Data is
+kept in memory and supports the KV operations (fetch, store, delete with
+vclocks, siblings when allow_mult is set, conditional requests), listing
+buckets and keys, secondary index queries with pagination, preflists, bucket
+and bucket type properties, and the counter, set and map data types.
+
+It is not a complete Riak implementation: there is a single node, no quorum
+semantics, no MapReduce and no Riak Search.
+*/
+package riaktest
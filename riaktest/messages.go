@@ -0,0 +1,217 @@
+package riaktest
+
+import (
+	rpbRiak "github.com/basho/riak-go-client/rpb/riak"
+	rpbRiakDT "github.com/basho/riak-go-client/rpb/riak_dt"
+	rpbRiakKV "github.com/basho/riak-go-client/rpb/riak_kv"
+	proto "github.com/golang/protobuf/proto"
+)
+
+// NB: these mirror the rpbCode_* constants of the riak package
+const (
+	codeErrorResp                byte = 0
+	codePingReq                  byte = 1
+	codePingResp                 byte = 2
+	codeGetServerInfoReq         byte = 7
+	codeGetServerInfoResp        byte = 8
+	codeGetReq                   byte = 9
+	codeGetResp                  byte = 10
+	codePutReq                   byte = 11
+	codePutResp                  byte = 12
+	codeDelReq                   byte = 13
+	codeDelResp                  byte = 14
+	codeListBucketsReq           byte = 15
+	codeListBucketsResp          byte = 16
+	codeListKeysReq              byte = 17
+	codeListKeysResp             byte = 18
+	codeGetBucketReq             byte = 19
+	codeGetBucketResp            byte = 20
+	codeSetBucketReq             byte = 21
+	codeSetBucketResp            byte = 22
+	codeIndexReq                 byte = 25
+	codeIndexResp                byte = 26
+	codeResetBucketReq           byte = 29
+	codeResetBucketResp          byte = 30
+	codeGetBucketTypeReq         byte = 31
+	codeSetBucketTypeReq         byte = 32
+	codeGetBucketKeyPreflistReq  byte = 33
+	codeGetBucketKeyPreflistResp byte = 34
+	codeDtFetchReq               byte = 80
+	codeDtFetchResp              byte = 81
+	codeDtUpdateReq              byte = 82
+	codeDtUpdateResp             byte = 83
+	codeAuthReq                  byte = 253
+	codeAuthResp                 byte = 254
+	codeStartTls                 byte = 255
+)
+
+var handlers = map[byte]handler{
+	codePingReq: {
+		newRequest: func() proto.Message { return nil },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			return single(codePingResp, nil), nil
+		},
+	},
+	codeGetServerInfoReq: {
+		newRequest: func() proto.Message { return nil },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			return single(codeGetServerInfoResp, &rpbRiak.RpbGetServerInfoResp{
+				Node:          []byte(s.nodeName),
+				ServerVersion: []byte(defaultVersion),
+			}), nil
+		},
+	},
+	codeGetReq: {
+		newRequest: func() proto.Message { return &rpbRiakKV.RpbGetReq{} },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			resp, err := s.store.get(req.(*rpbRiakKV.RpbGetReq))
+			if err != nil {
+				return nil, err
+			}
+			if resp == nil {
+				// NB: not found is an empty RpbGetResp
+				return single(codeGetResp, nil), nil
+			}
+			return single(codeGetResp, resp), nil
+		},
+	},
+	codePutReq: {
+		newRequest: func() proto.Message { return &rpbRiakKV.RpbPutReq{} },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			resp, err := s.store.put(req.(*rpbRiakKV.RpbPutReq))
+			if err != nil {
+				return nil, err
+			}
+			return single(codePutResp, resp), nil
+		},
+	},
+	codeDelReq: {
+		newRequest: func() proto.Message { return &rpbRiakKV.RpbDelReq{} },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			s.store.del(req.(*rpbRiakKV.RpbDelReq))
+			return single(codeDelResp, nil), nil
+		},
+	},
+	codeListBucketsReq: {
+		newRequest: func() proto.Message { return &rpbRiakKV.RpbListBucketsReq{} },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			r := req.(*rpbRiakKV.RpbListBucketsReq)
+			buckets := s.store.listBuckets(bucketTypeOf(r.Type))
+			if !r.GetStream() {
+				return single(codeListBucketsResp, &rpbRiakKV.RpbListBucketsResp{
+					Buckets: buckets,
+				}), nil
+			}
+			return []response{
+				{codeListBucketsResp, &rpbRiakKV.RpbListBucketsResp{Buckets: buckets}},
+				{codeListBucketsResp, &rpbRiakKV.RpbListBucketsResp{Done: proto.Bool(true)}},
+			}, nil
+		},
+	},
+	codeListKeysReq: {
+		newRequest: func() proto.Message { return &rpbRiakKV.RpbListKeysReq{} },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			r := req.(*rpbRiakKV.RpbListKeysReq)
+			keys := s.store.listKeys(newBucketID(r.Type, r.Bucket))
+			// NB: RpbListKeysReq is always streamed
+			return []response{
+				{codeListKeysResp, &rpbRiakKV.RpbListKeysResp{Keys: keys}},
+				{codeListKeysResp, &rpbRiakKV.RpbListKeysResp{Done: proto.Bool(true)}},
+			}, nil
+		},
+	},
+	codeGetBucketReq: {
+		newRequest: func() proto.Message { return &rpbRiak.RpbGetBucketReq{} },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			r := req.(*rpbRiak.RpbGetBucketReq)
+			props := s.store.bucketProps(newBucketID(r.Type, r.Bucket))
+			return single(codeGetBucketResp, &rpbRiak.RpbGetBucketResp{Props: props}), nil
+		},
+	},
+	codeSetBucketReq: {
+		newRequest: func() proto.Message { return &rpbRiak.RpbSetBucketReq{} },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			r := req.(*rpbRiak.RpbSetBucketReq)
+			s.store.setBucketProps(newBucketID(r.Type, r.Bucket), r.Props)
+			return single(codeSetBucketResp, nil), nil
+		},
+	},
+	codeResetBucketReq: {
+		newRequest: func() proto.Message { return &rpbRiak.RpbResetBucketReq{} },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			r := req.(*rpbRiak.RpbResetBucketReq)
+			s.store.resetBucketProps(newBucketID(r.Type, r.Bucket))
+			return single(codeResetBucketResp, nil), nil
+		},
+	},
+	codeGetBucketTypeReq: {
+		newRequest: func() proto.Message { return &rpbRiak.RpbGetBucketTypeReq{} },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			r := req.(*rpbRiak.RpbGetBucketTypeReq)
+			props := s.store.bucketTypeProps(bucketTypeOf(r.Type))
+			return single(codeGetBucketResp, &rpbRiak.RpbGetBucketResp{Props: props}), nil
+		},
+	},
+	codeSetBucketTypeReq: {
+		newRequest: func() proto.Message { return &rpbRiak.RpbSetBucketTypeReq{} },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			r := req.(*rpbRiak.RpbSetBucketTypeReq)
+			s.store.setBucketTypeProps(bucketTypeOf(r.Type), r.Props)
+			return single(codeSetBucketResp, nil), nil
+		},
+	},
+	codeIndexReq: {
+		newRequest: func() proto.Message { return &rpbRiakKV.RpbIndexReq{} },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			r := req.(*rpbRiakKV.RpbIndexReq)
+			resp, err := s.store.index(r)
+			if err != nil {
+				return nil, err
+			}
+			if !r.GetStream() {
+				return single(codeIndexResp, resp), nil
+			}
+			// NB: when streaming, the continuation is sent along with done
+			done := &rpbRiakKV.RpbIndexResp{
+				Continuation: resp.Continuation,
+				Done:         proto.Bool(true),
+			}
+			resp.Continuation = nil
+			return []response{
+				{codeIndexResp, resp},
+				{codeIndexResp, done},
+			}, nil
+		},
+	},
+	codeGetBucketKeyPreflistReq: {
+		newRequest: func() proto.Message { return &rpbRiakKV.RpbGetBucketKeyPreflistReq{} },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			r := req.(*rpbRiakKV.RpbGetBucketKeyPreflistReq)
+			return single(codeGetBucketKeyPreflistResp, s.preflist(r)), nil
+		},
+	},
+	codeDtFetchReq: {
+		newRequest: func() proto.Message { return &rpbRiakDT.DtFetchReq{} },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			resp, err := s.store.dtFetch(req.(*rpbRiakDT.DtFetchReq))
+			if err != nil {
+				return nil, err
+			}
+			return single(codeDtFetchResp, resp), nil
+		},
+	},
+	codeDtUpdateReq: {
+		newRequest: func() proto.Message { return &rpbRiakDT.DtUpdateReq{} },
+		handle: func(s *Server, req proto.Message) ([]response, error) {
+			resp, err := s.store.dtUpdate(req.(*rpbRiakDT.DtUpdateReq))
+			if err != nil {
+				return nil, err
+			}
+			return single(codeDtUpdateResp, resp), nil
+		},
+	},
+}
+
+func single(code byte, msg proto.Message) []response {
+	return []response{{code, msg}}
+}
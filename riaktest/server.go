@@ -0,0 +1,327 @@
+package riaktest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rpbRiak "github.com/basho/riak-go-client/rpb/riak"
+	proto "github.com/golang/protobuf/proto"
+)
+
+const (
+	defaultAddress  = "127.0.0.1:0"
+	defaultNodeName = "riaktest@127.0.0.1"
+	defaultVersion  = "2.1.4-riaktest"
+	defaultNVal     = uint32(3)
+	defaultRingSize = int64(64)
+	maxMessageSize  = 64 * 1024 * 1024
+)
+
+// Server errors
+var (
+	ErrServerStopped = errors.New("[riaktest] server is stopped")
+)
+
+// ServerOptions configures a fake Riak server. All fields are optional
+type ServerOptions struct {
+	Address  string // NB: in the form HOST:PORT, defaults to 127.0.0.1 and a random free port
+	NodeName string // NB: returned by RpbGetServerInfoReq and used in preflists
+	// RingNodes are the names of the nodes that partitions are assigned to, in turn, when reporting
+	// preflists. Defaults to NodeName alone. Give several servers the same RingNodes to have them
+	// agree on preflists
+	RingNodes []string
+	// Latency is added before responding to each request, to simulate a slow node. See also
+	// Server.SetLatency
+	Latency time.Duration
+	// TLSConfig enables security, as it is enabled on a Riak node: clients must upgrade their
+	// connections to TLS with RpbStartTls and authenticate with RpbAuthReq before making any other
+	// request. Set ClientAuth and ClientCAs to request client certificates
+	TLSConfig *tls.Config
+	// Authenticate checks the credentials of an RpbAuthReq, cert being the verified client
+	// certificate, if any. A non-nil error is returned to the client. Defaults to accepting anyone
+	Authenticate func(user, password string, cert *x509.Certificate) error
+}
+
+// Server is an in-process fake Riak node that speaks the Protocol Buffers
+// API. It keeps all data in memory and is intended for hermetic tests of code
+// built on the riak package, for instance:
+//
+//	srv, err := riaktest.NewServer(nil)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer srv.Stop()
+//
+//	node, err := riak.NewNode(&riak.NodeOptions{
+//		RemoteAddress: srv.Addr(),
+//	})
+type Server struct {
+	nodeName  string
+	ringNodes []string
+	ln        net.Listener
+	conns     map[net.Conn]struct{}
+	stopped   bool
+	wg        sync.WaitGroup
+	connsMu   sync.Mutex
+	store     *store
+	latency   int64 // NB: time.Duration, accessed atomically
+	tlsConfig *tls.Config
+	authFunc  func(user, password string, cert *x509.Certificate) error
+}
+
+// NewServer starts a fake Riak server listening on the address in options
+func NewServer(options *ServerOptions) (*Server, error) {
+	if options == nil {
+		options = &ServerOptions{}
+	}
+	if options.Address == "" {
+		options.Address = defaultAddress
+	}
+	if options.NodeName == "" {
+		options.NodeName = defaultNodeName
+	}
+	if len(options.RingNodes) == 0 {
+		options.RingNodes = []string{options.NodeName}
+	}
+	ln, err := net.Listen("tcp", options.Address)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		nodeName:  options.NodeName,
+		ringNodes: options.RingNodes,
+		ln:        ln,
+		conns:     make(map[net.Conn]struct{}),
+		store:     newStore(),
+		latency:   int64(options.Latency),
+		tlsConfig: options.TLSConfig,
+		authFunc:  options.Authenticate,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the HOST:PORT address the server is listening on, suitable for
+// use as riak.NodeOptions.RemoteAddress
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// NodeName returns the Riak node name reported by this server
+func (s *Server) NodeName() string {
+	return s.nodeName
+}
+
+// SetLatency changes the latency added before responding to each request
+func (s *Server) SetLatency(d time.Duration) {
+	atomic.StoreInt64(&s.latency, int64(d))
+}
+
+// Reset discards all stored objects, data types and bucket properties
+func (s *Server) Reset() {
+	s.store.reset()
+}
+
+// Stop closes the listener and all client connections, then waits for
+// connection handlers to exit
+func (s *Server) Stop() error {
+	s.connsMu.Lock()
+	if s.stopped {
+		s.connsMu.Unlock()
+		return ErrServerStopped
+	}
+	s.stopped = true
+	err := s.ln.Close()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.connsMu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.connsMu.Lock()
+		if s.stopped {
+			s.connsMu.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.connsMu.Unlock()
+		go s.handleConn(c)
+	}
+}
+
+func (s *Server) handleConn(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.connsMu.Lock()
+		delete(s.conns, c)
+		s.connsMu.Unlock()
+		c.Close()
+	}()
+	sizeBuf := make([]byte, 4)
+	conn := c // NB: replaced by the TLS connection after RpbStartTls
+	var tlsConn *tls.Conn
+	authenticated := s.tlsConfig == nil
+	for {
+		code, data, err := readMessage(conn, sizeBuf)
+		if err != nil {
+			return
+		}
+		if d := atomic.LoadInt64(&s.latency); d > 0 {
+			time.Sleep(time.Duration(d))
+		}
+		switch {
+		case code == codeStartTls:
+			if tlsConn, err = s.startTls(conn, tlsConn); tlsConn != nil {
+				conn = tlsConn
+			}
+		case code == codeAuthReq:
+			authenticated, err = s.authenticate(conn, tlsConn, data)
+		case !authenticated:
+			err = writeError(conn, "Security is enabled, please STARTTLS first")
+		default:
+			err = s.dispatch(conn, code, data)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// startTls answers an RpbStartTls and performs the server side of the TLS handshake, returning the
+// TLS connection. A non-nil error means the connection is no longer usable
+func (s *Server) startTls(c net.Conn, tlsConn *tls.Conn) (*tls.Conn, error) {
+	if s.tlsConfig == nil {
+		return nil, writeError(c, "Security not enabled; STARTTLS not allowed.")
+	}
+	if tlsConn != nil {
+		return nil, writeError(c, "Connection is already secured")
+	}
+	if err := writeMessage(c, codeStartTls, nil); err != nil {
+		return nil, err
+	}
+	tlsConn = tls.Server(c, s.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// authenticate answers an RpbAuthReq, returning true if the client is now authenticated
+func (s *Server) authenticate(w io.Writer, tlsConn *tls.Conn, data []byte) (bool, error) {
+	if s.tlsConfig == nil {
+		return false, writeError(w, "Security not enabled")
+	}
+	if tlsConn == nil {
+		return false, writeError(w, "Security is enabled, please STARTTLS first")
+	}
+	req := &rpbRiak.RpbAuthReq{}
+	if err := proto.Unmarshal(data, req); err != nil {
+		return false, writeError(w, err.Error())
+	}
+	if s.authFunc != nil {
+		var cert *x509.Certificate
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			cert = certs[0]
+		}
+		if err := s.authFunc(string(req.User), string(req.Password), cert); err != nil {
+			return false, writeError(w, err.Error())
+		}
+	}
+	return true, writeMessage(w, codeAuthResp, nil)
+}
+
+// dispatch decodes a single request and writes its response(s). A non-nil
+// error means the connection is no longer usable
+func (s *Server) dispatch(w io.Writer, code byte, data []byte) error {
+	h, ok := handlers[code]
+	if !ok {
+		return writeError(w, fmt.Sprintf("unknown message code: %d", code))
+	}
+	req := h.newRequest()
+	if req != nil {
+		if err := proto.Unmarshal(data, req); err != nil {
+			return writeError(w, err.Error())
+		}
+	}
+	resps, err := h.handle(s, req)
+	if err != nil {
+		return writeError(w, err.Error())
+	}
+	for _, r := range resps {
+		if err := writeMessage(w, r.code, r.msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// response is a single framed message sent back to the client. Streaming
+// operations produce more than one
+type response struct {
+	code byte
+	msg  proto.Message
+}
+
+type handler struct {
+	newRequest func() proto.Message
+	handle     func(s *Server, req proto.Message) ([]response, error)
+}
+
+func readMessage(r io.Reader, sizeBuf []byte) (byte, []byte, error) {
+	if _, err := io.ReadFull(r, sizeBuf); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(sizeBuf)
+	if length == 0 || length > maxMessageSize {
+		return 0, nil, fmt.Errorf("[riaktest] invalid message length: %d", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return data[0], data[1:], nil
+}
+
+func writeMessage(w io.Writer, code byte, msg proto.Message) error {
+	var body []byte
+	if msg != nil {
+		var err error
+		if body, err = proto.Marshal(msg); err != nil {
+			return err
+		}
+	}
+	frame := make([]byte, 5+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)+1))
+	frame[4] = code
+	copy(frame[5:], body)
+	_, err := w.Write(frame)
+	return err
+}
+
+func writeError(w io.Writer, errmsg string) error {
+	errcode := uint32(0)
+	return writeMessage(w, codeErrorResp, &rpbRiak.RpbErrorResp{
+		Errmsg:  []byte(errmsg),
+		Errcode: &errcode,
+	})
+}
@@ -0,0 +1,348 @@
+package riaktest_test
+
+import (
+	"bytes"
+	"testing"
+
+	riak "github.com/basho/riak-go-client"
+	"github.com/basho/riak-go-client/riaktest"
+)
+
+func newTestCluster(t *testing.T) (*riaktest.Server, *riak.Cluster) {
+	srv, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := riak.NewNode(&riak.NodeOptions{
+		RemoteAddress: srv.Addr(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := riak.NewCluster(&riak.ClusterOptions{
+		Nodes: []*riak.Node{node},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := cluster.Stop(); err != nil {
+			t.Error(err)
+		}
+		if err := srv.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+	return srv, cluster
+}
+
+func execute(t *testing.T, cluster *riak.Cluster, builder riak.CommandBuilder) riak.Command {
+	cmd, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(cmd); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestPing(t *testing.T) {
+	_, cluster := newTestCluster(t)
+	cmd := execute(t, cluster, &riak.PingCommandBuilder{})
+	if !cmd.Success() {
+		t.Error("expected ping success")
+	}
+}
+
+func TestStoreAndFetchValue(t *testing.T) {
+	_, cluster := newTestCluster(t)
+
+	obj := &riak.Object{
+		ContentType: "text/plain",
+		Value:       []byte("this is a value"),
+	}
+	cmd := execute(t, cluster, riak.NewStoreValueCommandBuilder().
+		WithBucket("b").
+		WithContent(obj).
+		WithReturnBody(true))
+	svc := cmd.(*riak.StoreValueCommand)
+	key := svc.Response.GeneratedKey
+	if key == "" {
+		t.Fatal("expected generated key")
+	}
+	if len(svc.Response.Values) != 1 || len(svc.Response.VClock) == 0 {
+		t.Fatalf("unexpected store response: %v", svc.Response)
+	}
+
+	cmd = execute(t, cluster, riak.NewFetchValueCommandBuilder().
+		WithBucket("b").
+		WithKey(key))
+	rsp := cmd.(*riak.FetchValueCommand).Response
+	if rsp.IsNotFound {
+		t.Fatal("expected object to be found")
+	}
+	if got, want := string(rsp.Values[0].Value), "this is a value"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if got, want := rsp.Values[0].ContentType, "text/plain"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	execute(t, cluster, riak.NewDeleteValueCommandBuilder().
+		WithBucket("b").
+		WithKey(key))
+	cmd = execute(t, cluster, riak.NewFetchValueCommandBuilder().
+		WithBucket("b").
+		WithKey(key))
+	if !cmd.(*riak.FetchValueCommand).Response.IsNotFound {
+		t.Error("expected object to be deleted")
+	}
+}
+
+func TestSiblingsWithAllowMult(t *testing.T) {
+	_, cluster := newTestCluster(t)
+
+	execute(t, cluster, riak.NewStoreBucketPropsCommandBuilder().
+		WithBucket("siblings").
+		WithAllowMult(true))
+
+	for _, v := range []string{"one", "two"} {
+		// NB: no vclock, so each write creates a sibling
+		execute(t, cluster, riak.NewStoreValueCommandBuilder().
+			WithBucket("siblings").
+			WithKey("k").
+			WithContent(&riak.Object{Value: []byte(v)}))
+	}
+
+	cmd := execute(t, cluster, riak.NewFetchValueCommandBuilder().
+		WithBucket("siblings").
+		WithKey("k"))
+	rsp := cmd.(*riak.FetchValueCommand).Response
+	if got, want := len(rsp.Values), 2; got != want {
+		t.Fatalf("expected %d siblings, got %d", want, got)
+	}
+
+	// NB: storing with the fetched vclock resolves the siblings
+	obj := &riak.Object{
+		VClock: rsp.VClock,
+		Value:  []byte("resolved"),
+	}
+	execute(t, cluster, riak.NewStoreValueCommandBuilder().
+		WithBucket("siblings").
+		WithKey("k").
+		WithContent(obj))
+	cmd = execute(t, cluster, riak.NewFetchValueCommandBuilder().
+		WithBucket("siblings").
+		WithKey("k"))
+	rsp = cmd.(*riak.FetchValueCommand).Response
+	if len(rsp.Values) != 1 || string(rsp.Values[0].Value) != "resolved" {
+		t.Errorf("expected siblings to be resolved, got %v", rsp.Values)
+	}
+}
+
+func TestListBucketsAndKeys(t *testing.T) {
+	srv, cluster := newTestCluster(t)
+
+	for _, k := range []string{"c", "a", "b"} {
+		execute(t, cluster, riak.NewStoreValueCommandBuilder().
+			WithBucket("listing").
+			WithKey(k).
+			WithContent(&riak.Object{Value: []byte(k)}))
+	}
+
+	cmd := execute(t, cluster, riak.NewListKeysCommandBuilder().
+		WithBucket("listing"))
+	keys := cmd.(*riak.ListKeysCommand).Response.Keys
+	if got, want := len(keys), 3; got != want {
+		t.Fatalf("expected %d keys, got %d", want, got)
+	}
+
+	cmd = execute(t, cluster, riak.NewListBucketsCommandBuilder())
+	buckets := cmd.(*riak.ListBucketsCommand).Response.Buckets
+	if len(buckets) != 1 || buckets[0] != "listing" {
+		t.Errorf("unexpected buckets: %v", buckets)
+	}
+
+	srv.Reset()
+	cmd = execute(t, cluster, riak.NewListBucketsCommandBuilder())
+	if buckets = cmd.(*riak.ListBucketsCommand).Response.Buckets; len(buckets) != 0 {
+		t.Errorf("expected no buckets after reset, got %v", buckets)
+	}
+}
+
+func TestSecondaryIndexPagination(t *testing.T) {
+	_, cluster := newTestCluster(t)
+
+	for i, k := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		obj := &riak.Object{Value: []byte(k)}
+		obj.AddToIntIndex("age_int", (i+1)*10)
+		execute(t, cluster, riak.NewStoreValueCommandBuilder().
+			WithBucket("indexed").
+			WithKey(k).
+			WithContent(obj))
+	}
+
+	var seen []string
+	var continuation []byte
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		cmd := execute(t, cluster, riak.NewSecondaryIndexQueryCommandBuilder().
+			WithBucket("indexed").
+			WithIndexName("age_int").
+			WithIntRange(20, 50).
+			WithMaxResults(2).
+			WithContinuation(continuation))
+		rsp := cmd.(*riak.SecondaryIndexQueryCommand).Response
+		for _, r := range rsp.Results {
+			seen = append(seen, string(r.ObjectKey))
+		}
+		if continuation = rsp.Continuation; continuation == nil {
+			break
+		}
+	}
+	want := []string{"k2", "k3", "k4", "k5"}
+	if len(seen) != len(want) {
+		t.Fatalf("expected %v, got %v", want, seen)
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Errorf("expected %v, got %v", want, seen)
+			break
+		}
+	}
+}
+
+func TestCounters(t *testing.T) {
+	_, cluster := newTestCluster(t)
+
+	for _, inc := range []int64{5, -2} {
+		execute(t, cluster, riak.NewUpdateCounterCommandBuilder().
+			WithBucketType("counters").
+			WithBucket("b").
+			WithKey("k").
+			WithIncrement(inc))
+	}
+	cmd := execute(t, cluster, riak.NewFetchCounterCommandBuilder().
+		WithBucketType("counters").
+		WithBucket("b").
+		WithKey("k"))
+	if got, want := cmd.(*riak.FetchCounterCommand).Response.CounterValue, int64(3); got != want {
+		t.Errorf("expected %d, got %d", want, got)
+	}
+
+	cmd = execute(t, cluster, riak.NewFetchCounterCommandBuilder().
+		WithBucketType("counters").
+		WithBucket("b").
+		WithKey("missing"))
+	if !cmd.(*riak.FetchCounterCommand).Response.IsNotFound {
+		t.Error("expected not found")
+	}
+}
+
+func TestSets(t *testing.T) {
+	_, cluster := newTestCluster(t)
+
+	cmd := execute(t, cluster, riak.NewUpdateSetCommandBuilder().
+		WithBucketType("sets").
+		WithBucket("b").
+		WithKey("k").
+		WithAdditions([]byte("a"), []byte("b")).
+		WithReturnBody(true))
+	rsp := cmd.(*riak.UpdateSetCommand).Response
+	if len(rsp.SetValue) != 2 || len(rsp.Context) == 0 {
+		t.Fatalf("unexpected update response: %v", rsp)
+	}
+
+	execute(t, cluster, riak.NewUpdateSetCommandBuilder().
+		WithBucketType("sets").
+		WithBucket("b").
+		WithKey("k").
+		WithContext(rsp.Context).
+		WithRemovals([]byte("a")))
+
+	cmd = execute(t, cluster, riak.NewFetchSetCommandBuilder().
+		WithBucketType("sets").
+		WithBucket("b").
+		WithKey("k"))
+	set := cmd.(*riak.FetchSetCommand).Response.SetValue
+	if len(set) != 1 || !bytes.Equal(set[0], []byte("b")) {
+		t.Errorf("unexpected set value: %q", set)
+	}
+}
+
+func TestMaps(t *testing.T) {
+	_, cluster := newTestCluster(t)
+
+	mapOp := &riak.MapOperation{}
+	mapOp.IncrementCounter("visits", 2).
+		AddToSet("tags", []byte("go")).
+		SetRegister("name", []byte("riak")).
+		SetFlag("enabled", true)
+	mapOp.Map("nested").SetRegister("inner", []byte("value"))
+	execute(t, cluster, riak.NewUpdateMapCommandBuilder().
+		WithBucketType("maps").
+		WithBucket("b").
+		WithKey("k").
+		WithMapOperation(mapOp))
+
+	cmd := execute(t, cluster, riak.NewFetchMapCommandBuilder().
+		WithBucketType("maps").
+		WithBucket("b").
+		WithKey("k"))
+	m := cmd.(*riak.FetchMapCommand).Response.Map
+	if m.Counters["visits"] != 2 {
+		t.Errorf("unexpected counter: %v", m.Counters)
+	}
+	if len(m.Sets["tags"]) != 1 {
+		t.Errorf("unexpected set: %v", m.Sets)
+	}
+	if string(m.Registers["name"]) != "riak" {
+		t.Errorf("unexpected register: %v", m.Registers)
+	}
+	if !m.Flags["enabled"] {
+		t.Errorf("unexpected flag: %v", m.Flags)
+	}
+	if string(m.Maps["nested"].Registers["inner"]) != "value" {
+		t.Errorf("unexpected nested map: %v", m.Maps)
+	}
+}
+
+func TestBucketProps(t *testing.T) {
+	_, cluster := newTestCluster(t)
+
+	execute(t, cluster, riak.NewStoreBucketPropsCommandBuilder().
+		WithBucket("props").
+		WithNVal(5))
+	cmd := execute(t, cluster, riak.NewFetchBucketPropsCommandBuilder().
+		WithBucket("props"))
+	if got, want := cmd.(*riak.FetchBucketPropsCommand).Response.NVal, uint32(5); got != want {
+		t.Errorf("expected n_val %d, got %d", want, got)
+	}
+
+	execute(t, cluster, riak.NewResetBucketCommandBuilder().
+		WithBucket("props"))
+	cmd = execute(t, cluster, riak.NewFetchBucketPropsCommandBuilder().
+		WithBucket("props"))
+	if got, want := cmd.(*riak.FetchBucketPropsCommand).Response.NVal, uint32(3); got != want {
+		t.Errorf("expected n_val %d, got %d", want, got)
+	}
+}
+
+func TestStopTwice(t *testing.T) {
+	srv, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Stop(); err != riaktest.ErrServerStopped {
+		t.Errorf("expected ErrServerStopped, got %v", err)
+	}
+}
@@ -0,0 +1,495 @@
+package riaktest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	rpbRiak "github.com/basho/riak-go-client/rpb/riak"
+	rpbRiakKV "github.com/basho/riak-go-client/rpb/riak_kv"
+	proto "github.com/golang/protobuf/proto"
+)
+
+const defaultBucketType = "default"
+
+type bucketID struct {
+	bucketType string
+	bucket     string
+}
+
+func newBucketID(bucketType, bucket []byte) bucketID {
+	return bucketID{
+		bucketType: bucketTypeOf(bucketType),
+		bucket:     string(bucket),
+	}
+}
+
+func bucketTypeOf(bucketType []byte) string {
+	if len(bucketType) == 0 {
+		return defaultBucketType
+	}
+	return string(bucketType)
+}
+
+// object is a stored KV object. Every write bumps version, which doubles as
+// the object's vclock
+type object struct {
+	version  uint64
+	siblings []*rpbRiakKV.RpbContent
+}
+
+type bucket struct {
+	props     *rpbRiak.RpbBucketProps
+	objects   map[string]*object
+	datatypes map[string]*datatype
+}
+
+type store struct {
+	buckets map[bucketID]*bucket
+	types   map[string]*rpbRiak.RpbBucketProps
+	sync.Mutex
+}
+
+func newStore() *store {
+	s := &store{}
+	s.reset()
+	return s
+}
+
+func (s *store) reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.buckets = make(map[bucketID]*bucket)
+	s.types = make(map[string]*rpbRiak.RpbBucketProps)
+}
+
+// getBucket must be called with the store locked
+func (s *store) getBucket(id bucketID, create bool) *bucket {
+	b, ok := s.buckets[id]
+	if !ok && create {
+		b = &bucket{
+			objects:   make(map[string]*object),
+			datatypes: make(map[string]*datatype),
+		}
+		s.buckets[id] = b
+	}
+	return b
+}
+
+// Vclocks and data type contexts are opaque to clients, so the object
+// version is all that is encoded
+func encodeVersion(v uint64) []byte {
+	b := make([]byte, 10)
+	copy(b, "vc")
+	binary.BigEndian.PutUint64(b[2:], v)
+	return b
+}
+
+func decodeVersion(b []byte) (uint64, bool) {
+	if len(b) != 10 || string(b[:2]) != "vc" {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(b[2:]), true
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)[:n]
+}
+
+// Bucket properties
+
+// typeProps must be called with the store locked
+func (s *store) typeProps(bucketType string) *rpbRiak.RpbBucketProps {
+	props := &rpbRiak.RpbBucketProps{
+		NVal:          proto.Uint32(defaultNVal),
+		AllowMult:     proto.Bool(bucketType != defaultBucketType), // NB: as in Riak 2.0+
+		LastWriteWins: proto.Bool(false),
+		Backend:       []byte("memory"),
+	}
+	if p, ok := s.types[bucketType]; ok {
+		proto.Merge(props, p)
+	}
+	return props
+}
+
+func (s *store) bucketTypeProps(bucketType string) *rpbRiak.RpbBucketProps {
+	s.Lock()
+	defer s.Unlock()
+	return s.typeProps(bucketType)
+}
+
+func (s *store) setBucketTypeProps(bucketType string, props *rpbRiak.RpbBucketProps) {
+	s.Lock()
+	defer s.Unlock()
+	if p, ok := s.types[bucketType]; ok {
+		proto.Merge(p, props)
+	} else if props != nil {
+		s.types[bucketType] = proto.Clone(props).(*rpbRiak.RpbBucketProps)
+	}
+}
+
+// props must be called with the store locked
+func (s *store) props(id bucketID) *rpbRiak.RpbBucketProps {
+	props := s.typeProps(id.bucketType)
+	if b := s.getBucket(id, false); b != nil && b.props != nil {
+		proto.Merge(props, b.props)
+	}
+	return props
+}
+
+func (s *store) bucketProps(id bucketID) *rpbRiak.RpbBucketProps {
+	s.Lock()
+	defer s.Unlock()
+	return s.props(id)
+}
+
+func (s *store) setBucketProps(id bucketID, props *rpbRiak.RpbBucketProps) {
+	s.Lock()
+	defer s.Unlock()
+	b := s.getBucket(id, true)
+	if b.props == nil {
+		b.props = &rpbRiak.RpbBucketProps{}
+	}
+	if props != nil {
+		proto.Merge(b.props, props)
+	}
+}
+
+func (s *store) resetBucketProps(id bucketID) {
+	s.Lock()
+	defer s.Unlock()
+	if b := s.getBucket(id, false); b != nil {
+		b.props = nil
+	}
+}
+
+// KV
+
+func (s *store) get(req *rpbRiakKV.RpbGetReq) (*rpbRiakKV.RpbGetResp, error) {
+	if len(req.Bucket) == 0 || len(req.Key) == 0 {
+		return nil, errors.New("bucket and key are required")
+	}
+	s.Lock()
+	defer s.Unlock()
+	b := s.getBucket(newBucketID(req.Type, req.Bucket), false)
+	if b == nil {
+		return nil, nil
+	}
+	o, ok := b.objects[string(req.Key)]
+	if !ok {
+		return nil, nil
+	}
+	vclock := encodeVersion(o.version)
+	if req.IfModified != nil && bytes.Equal(req.IfModified, vclock) {
+		return &rpbRiakKV.RpbGetResp{
+			Vclock:    vclock,
+			Unchanged: proto.Bool(true),
+		}, nil
+	}
+	return &rpbRiakKV.RpbGetResp{
+		Vclock:  vclock,
+		Content: copyContents(o.siblings, req.GetHead()),
+	}, nil
+}
+
+func (s *store) put(req *rpbRiakKV.RpbPutReq) (*rpbRiakKV.RpbPutResp, error) {
+	if len(req.Bucket) == 0 {
+		return nil, errors.New("bucket is required")
+	}
+	if req.Content == nil {
+		return nil, errors.New("content is required")
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	id := newBucketID(req.Type, req.Bucket)
+	props := s.props(id)
+	b := s.getBucket(id, true)
+
+	key := string(req.Key)
+	generatedKey := false
+	if key == "" {
+		key = randomString(22)
+		generatedKey = true
+	}
+
+	o, exists := b.objects[key]
+	if req.GetIfNoneMatch() && exists {
+		return nil, errors.New("match_found")
+	}
+	if req.GetIfNotModified() {
+		if !exists {
+			return nil, errors.New("notfound")
+		}
+		if !bytes.Equal(req.Vclock, encodeVersion(o.version)) {
+			return nil, errors.New("modified")
+		}
+	}
+
+	content := proto.Clone(req.Content).(*rpbRiakKV.RpbContent)
+	now := time.Now()
+	content.Vtag = []byte(randomString(22))
+	content.LastMod = proto.Uint32(uint32(now.Unix()))
+	content.LastModUsecs = proto.Uint32(uint32(now.Nanosecond() / 1000))
+
+	if !exists {
+		o = &object{}
+		b.objects[key] = o
+	}
+	// NB: a write that does not descend from the current version is
+	// concurrent with it and becomes a sibling, but only if allow_mult is set
+	version, hasVersion := decodeVersion(req.Vclock)
+	descends := !exists || (hasVersion && version == o.version)
+	if props.GetAllowMult() && !props.GetLastWriteWins() && !descends {
+		o.siblings = append(o.siblings, content)
+	} else {
+		o.siblings = []*rpbRiakKV.RpbContent{content}
+	}
+	o.version++
+
+	resp := &rpbRiakKV.RpbPutResp{}
+	if generatedKey {
+		resp.Key = []byte(key)
+	}
+	if req.GetReturnBody() || req.GetReturnHead() {
+		resp.Vclock = encodeVersion(o.version)
+		resp.Content = copyContents(o.siblings, req.GetReturnHead())
+	}
+	return resp, nil
+}
+
+func (s *store) del(req *rpbRiakKV.RpbDelReq) {
+	s.Lock()
+	defer s.Unlock()
+	if b := s.getBucket(newBucketID(req.Type, req.Bucket), false); b != nil {
+		delete(b.objects, string(req.Key))
+		delete(b.datatypes, string(req.Key))
+	}
+}
+
+func copyContents(contents []*rpbRiakKV.RpbContent, head bool) []*rpbRiakKV.RpbContent {
+	rv := make([]*rpbRiakKV.RpbContent, len(contents))
+	for i, c := range contents {
+		rv[i] = proto.Clone(c).(*rpbRiakKV.RpbContent)
+		if head {
+			rv[i].Value = nil
+		}
+	}
+	return rv
+}
+
+// Listing
+
+func (s *store) listBuckets(bucketType string) [][]byte {
+	s.Lock()
+	defer s.Unlock()
+	names := make([]string, 0)
+	for id, b := range s.buckets {
+		if id.bucketType == bucketType && (len(b.objects) > 0 || len(b.datatypes) > 0) {
+			names = append(names, id.bucket)
+		}
+	}
+	return sortedBytes(names)
+}
+
+func (s *store) listKeys(id bucketID) [][]byte {
+	s.Lock()
+	defer s.Unlock()
+	b := s.getBucket(id, false)
+	if b == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(b.objects)+len(b.datatypes))
+	for k := range b.objects {
+		keys = append(keys, k)
+	}
+	for k := range b.datatypes {
+		keys = append(keys, k)
+	}
+	return sortedBytes(keys)
+}
+
+func sortedBytes(s []string) [][]byte {
+	sort.Strings(s)
+	rv := make([][]byte, len(s))
+	for i, v := range s {
+		rv[i] = []byte(v)
+	}
+	return rv
+}
+
+// Secondary indexes
+
+type indexEntry struct {
+	term string
+	key  string
+}
+
+func (s *store) index(req *rpbRiakKV.RpbIndexReq) (*rpbRiakKV.RpbIndexResp, error) {
+	index := string(req.Index)
+	isRange := req.GetQtype() == rpbRiakKV.RpbIndexReq_range
+	isInt := strings.HasSuffix(index, "_int")
+	if !isInt && !strings.HasSuffix(index, "_bin") && index != "$key" && index != "$bucket" {
+		return nil, fmt.Errorf("unknown index type: %s", index)
+	}
+
+	var termRegex *regexp.Regexp
+	if req.TermRegex != nil {
+		var err error
+		if termRegex, err = regexp.Compile(string(req.TermRegex)); err != nil {
+			return nil, err
+		}
+	}
+
+	less := func(a, b string) bool { return a < b }
+	if isInt {
+		less = func(a, b string) bool {
+			ai, _ := strconv.ParseInt(a, 10, 64)
+			bi, _ := strconv.ParseInt(b, 10, 64)
+			return ai < bi
+		}
+	}
+	matches := func(term string) bool {
+		if termRegex != nil && !termRegex.MatchString(term) {
+			return false
+		}
+		if isRange {
+			return !less(term, string(req.RangeMin)) && !less(string(req.RangeMax), term)
+		}
+		return index == "$bucket" || term == string(req.Key)
+	}
+
+	entries := s.indexEntries(newBucketID(req.Type, req.Bucket), index, matches)
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].term != entries[j].term {
+			return less(entries[i].term, entries[j].term)
+		}
+		return entries[i].key < entries[j].key
+	})
+
+	if req.Continuation != nil {
+		after, err := decodeContinuation(req.Continuation)
+		if err != nil {
+			return nil, err
+		}
+		i := sort.Search(len(entries), func(i int) bool {
+			e := entries[i]
+			if e.term != after.term {
+				return less(after.term, e.term)
+			}
+			return e.key > after.key
+		})
+		entries = entries[i:]
+	}
+
+	resp := &rpbRiakKV.RpbIndexResp{}
+	if maxResults := int(req.GetMaxResults()); maxResults > 0 && len(entries) > maxResults {
+		entries = entries[:maxResults]
+		resp.Continuation = encodeContinuation(entries[maxResults-1])
+	}
+
+	if req.GetReturnTerms() && isRange {
+		resp.Results = make([]*rpbRiak.RpbPair, len(entries))
+		for i, e := range entries {
+			resp.Results[i] = &rpbRiak.RpbPair{
+				Key:   []byte(e.term),
+				Value: []byte(e.key),
+			}
+		}
+	} else {
+		resp.Keys = make([][]byte, len(entries))
+		for i, e := range entries {
+			resp.Keys[i] = []byte(e.key)
+		}
+	}
+	return resp, nil
+}
+
+// indexEntries returns de-duplicated term / key pairs of an index, across
+// all siblings of all objects in the bucket
+func (s *store) indexEntries(id bucketID, index string, matches func(string) bool) []indexEntry {
+	s.Lock()
+	defer s.Unlock()
+	entries := make([]indexEntry, 0)
+	b := s.getBucket(id, false)
+	if b == nil {
+		return entries
+	}
+	seen := make(map[indexEntry]bool)
+	add := func(e indexEntry) {
+		if !seen[e] && matches(e.term) {
+			seen[e] = true
+			entries = append(entries, e)
+		}
+	}
+	for key, o := range b.objects {
+		switch index {
+		case "$key", "$bucket":
+			add(indexEntry{term: key, key: key})
+			continue
+		}
+		for _, c := range o.siblings {
+			for _, idx := range c.Indexes {
+				if string(idx.Key) == index {
+					add(indexEntry{term: string(idx.Value), key: key})
+				}
+			}
+		}
+	}
+	return entries
+}
+
+func encodeContinuation(e indexEntry) []byte {
+	data := []byte(e.term + "\x00" + e.key)
+	sum := crc32.ChecksumIEEE(data)
+	buf := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(buf, sum)
+	return []byte(base64.StdEncoding.EncodeToString(append(buf, data...)))
+}
+
+func decodeContinuation(c []byte) (indexEntry, error) {
+	data, err := base64.StdEncoding.DecodeString(string(c))
+	if err != nil || len(data) < 4 || crc32.ChecksumIEEE(data[4:]) != binary.BigEndian.Uint32(data) {
+		return indexEntry{}, errors.New("invalid continuation")
+	}
+	parts := strings.SplitN(string(data[4:]), "\x00", 2)
+	if len(parts) != 2 {
+		return indexEntry{}, errors.New("invalid continuation")
+	}
+	return indexEntry{term: parts[0], key: parts[1]}, nil
+}
+
+// Preflists
+
+// preflist reports the primary partitions of the key, each owned by one of the
+// ring nodes in turn. The partition index is derived from a hash of the bucket
+// and key
+func (s *Server) preflist(req *rpbRiakKV.RpbGetBucketKeyPreflistReq) *rpbRiakKV.RpbGetBucketKeyPreflistResp {
+	props := s.store.bucketProps(newBucketID(req.Type, req.Bucket))
+	nval := int64(props.GetNVal())
+	h := int64(crc32.ChecksumIEEE(append(append([]byte{}, req.Bucket...), req.Key...)))
+	items := make([]*rpbRiakKV.RpbBucketKeyPreflistItem, nval)
+	for i := int64(0); i < nval; i++ {
+		partition := (h + i) % defaultRingSize
+		items[i] = &rpbRiakKV.RpbBucketKeyPreflistItem{
+			Partition: proto.Int64(partition),
+			Node:      []byte(s.ringNodes[partition%int64(len(s.ringNodes))]),
+			Primary:   proto.Bool(true),
+		}
+	}
+	return &rpbRiakKV.RpbGetBucketKeyPreflistResp{Preflist: items}
+}
@@ -0,0 +1,53 @@
+package riak
+
+import (
+	"testing"
+
+	"github.com/basho/riak-go-client/riaktest"
+)
+
+// newTestServers returns n started riaktest Servers, stopped when the test ends
+func newTestServers(t *testing.T, n int) []*riaktest.Server {
+	var servers []*riaktest.Server
+	for i := 0; i < n; i++ {
+		srv, err := riaktest.NewServer(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { srv.Stop() })
+		servers = append(servers, srv)
+	}
+	return servers
+}
+
+// newTestCluster returns a started Cluster, stopped when the test ends, with a Node on each of addrs.
+// NB: nodeOptions and options may be nil, their RemoteAddress and Nodes are set by newTestCluster
+func newTestCluster(t *testing.T, nodeOptions *NodeOptions, options *ClusterOptions, addrs ...string) (*Cluster, []*Node) {
+	var nodes []*Node
+	for _, addr := range addrs {
+		o := NodeOptions{}
+		if nodeOptions != nil {
+			o = *nodeOptions
+		}
+		o.RemoteAddress = addr
+		node, err := NewNode(&o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	o := ClusterOptions{}
+	if options != nil {
+		o = *options
+	}
+	o.Nodes = nodes
+	cluster, err := NewCluster(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cluster.Stop() })
+	return cluster, nodes
+}
@@ -0,0 +1,238 @@
+package riak
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// Serializer encodes Go values as the values of Objects of a content type, see RegisterSerializer.
+// A Serializer is used by many goroutines at once.
+//
+// Serializers for JSON, protobuf, gob and plain text are built in. Import
+// github.com/basho/riak-go-client/serializers/msgpack to register one for MessagePack
+type Serializer interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Content types of the built-in Serializers
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeGob      = "application/x-gob"
+	ContentTypeText     = "text/plain"
+)
+
+// Built-in Serializers
+var (
+	JSONSerializer     Serializer = jsonSerializer{}
+	ProtobufSerializer Serializer = protobufSerializer{} // NB: values must be proto.Messages
+	GobSerializer      Serializer = gobSerializer{}
+	TextSerializer     Serializer = textSerializer{} // NB: values must be strings, []byte, or implement encoding.TextMarshaler / TextUnmarshaler
+)
+
+const errUnknownContentType = "[Serializer] no Serializer is registered for the content type"
+
+// Serializer errors
+var (
+	ErrUnknownContentType = newClientError(errUnknownContentType, nil) // NB: matched by UnknownContentTypeError
+	ErrValueNotFound      = newClientError("[Serializer] value was not found or is a tombstone", nil)
+	ErrValueHasSiblings   = newClientError("[Serializer] value has siblings, resolve them with a ConflictResolver or use DecodeSiblings", nil)
+	ErrDecodeSiblingsType = newClientError("[Serializer] DecodeSiblings requires a pointer to a slice", nil)
+)
+
+var serializers = struct {
+	sync.RWMutex
+	byType map[string]Serializer
+}{
+	byType: map[string]Serializer{
+		ContentTypeJSON:        JSONSerializer,
+		ContentTypeProtobuf:    ProtobufSerializer,
+		"application/protobuf": ProtobufSerializer,
+		ContentTypeGob:         GobSerializer,
+		ContentTypeText:        TextSerializer,
+	},
+}
+
+// RegisterSerializer registers s for contentType, replacing the Serializer registered for it if
+// any. Parameters of contentType, such as charset, are ignored
+func RegisterSerializer(contentType string, s Serializer) {
+	serializers.Lock()
+	defer serializers.Unlock()
+	serializers.byType[mediaType(contentType)] = s
+}
+
+// SerializerFor returns the Serializer registered for contentType, ignoring its parameters, e.g.
+// "application/json; charset=utf-8" is serialized as "application/json". If there is none the
+// error wraps an UnknownContentTypeError
+func SerializerFor(contentType string) (Serializer, error) {
+	serializers.RLock()
+	defer serializers.RUnlock()
+	if s, ok := serializers.byType[mediaType(contentType)]; ok && s != nil {
+		return s, nil
+	}
+	return nil, newClientError(errUnknownContentType, UnknownContentTypeError{ContentType: contentType})
+}
+
+// mediaType returns contentType without parameters, in lower case
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// SetValue sets the Value of o to v encoded with the Serializer registered for the ContentType of
+// o. ContentType defaults to application/json
+func (o *Object) SetValue(v interface{}) error {
+	if o.ContentType == "" {
+		o.ContentType = ContentTypeJSON
+	}
+	s, err := SerializerFor(o.ContentType)
+	if err != nil {
+		return err
+	}
+	value, err := s.Marshal(v)
+	if err != nil {
+		return newClientError(fmt.Sprintf("[Serializer] could not encode value as %s", o.ContentType), err)
+	}
+	o.Value = value
+	return nil
+}
+
+// DecodeInto decodes the Value of o into v, which must be a pointer, with the Serializer registered
+// for the ContentType of o
+func (o *Object) DecodeInto(v interface{}) error {
+	if o.IsTombstone {
+		return ErrValueNotFound
+	}
+	s, err := SerializerFor(o.ContentType)
+	if err != nil {
+		return err
+	}
+	if err = s.Unmarshal(o.Value, v); err != nil {
+		return newClientError(fmt.Sprintf("[Serializer] could not decode value as %s", o.ContentType), err)
+	}
+	return nil
+}
+
+// DecodeInto decodes the fetched value into v, see Object.DecodeInto. It fails with
+// ErrValueNotFound if there is no value, and with ErrValueHasSiblings if there is more than one.
+// Tombstones are ignored
+func (resp *FetchValueResponse) DecodeInto(v interface{}) error {
+	var value *Object
+	for _, o := range resp.Values {
+		if o.IsTombstone {
+			continue
+		}
+		if value != nil {
+			return ErrValueHasSiblings
+		}
+		value = o
+	}
+	if resp.IsNotFound || value == nil {
+		return ErrValueNotFound
+	}
+	return value.DecodeInto(v)
+}
+
+// DecodeSiblings decodes each fetched value into a new element appended to the slice v points to,
+// e.g. a *[]Person. Tombstones are ignored
+func (resp *FetchValueResponse) DecodeSiblings(v interface{}) error {
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() || ptr.Elem().Kind() != reflect.Slice {
+		return ErrDecodeSiblingsType
+	}
+	slice := ptr.Elem()
+	for _, o := range resp.Values {
+		if o.IsTombstone {
+			continue
+		}
+		elem := reflect.New(slice.Type().Elem())
+		if err := o.DecodeInto(elem.Interface()); err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, elem.Elem())
+	}
+	ptr.Elem().Set(slice)
+	return nil
+}
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonSerializer) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type protobufSerializer struct{}
+
+func (protobufSerializer) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Marshal(msg)
+}
+
+func (protobufSerializer) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+type gobSerializer struct{}
+
+func (gobSerializer) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobSerializer) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type textSerializer struct{}
+
+func (textSerializer) Marshal(v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case string:
+		return []byte(t), nil
+	case []byte:
+		return t, nil
+	case encoding.TextMarshaler:
+		return t.MarshalText()
+	default:
+		return nil, fmt.Errorf("%T can not be encoded as text", v)
+	}
+}
+
+func (textSerializer) Unmarshal(data []byte, v interface{}) error {
+	switch t := v.(type) {
+	case *string:
+		*t = string(data)
+	case *[]byte:
+		*t = append((*t)[:0], data...)
+	case encoding.TextUnmarshaler:
+		return t.UnmarshalText(data)
+	default:
+		return fmt.Errorf("%T can not be decoded from text", v)
+	}
+	return nil
+}
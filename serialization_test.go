@@ -0,0 +1,227 @@
+package riak
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	rpbRiak "github.com/basho/riak-go-client/rpb/riak"
+)
+
+type serializationTestPerson struct {
+	Name string
+	Age  int
+	Tags []string
+}
+
+func TestSerializersRoundTrip(t *testing.T) {
+	person := serializationTestPerson{Name: "Alex", Age: 42, Tags: []string{"a", "b"}}
+	for _, contentType := range []string{
+		ContentTypeJSON,
+		"application/json; charset=utf-8",
+		ContentTypeGob,
+	} {
+		object := &Object{ContentType: contentType}
+		if err := object.SetValue(&person); err != nil {
+			t.Fatalf("%s: %v", contentType, err)
+		}
+		var decoded serializationTestPerson
+		if err := object.DecodeInto(&decoded); err != nil {
+			t.Fatalf("%s: %v", contentType, err)
+		}
+		if !reflect.DeepEqual(decoded, person) {
+			t.Errorf("%s: expected %v, got %v", contentType, person, decoded)
+		}
+	}
+}
+
+func TestProtobufSerializer(t *testing.T) {
+	object := &Object{ContentType: ContentTypeProtobuf}
+	if err := object.SetValue(&rpbRiak.RpbPair{Key: []byte("k"), Value: []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+	decoded := &rpbRiak.RpbPair{}
+	if err := object.DecodeInto(decoded); err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded.Key) != "k" || string(decoded.Value) != "v" {
+		t.Errorf("unexpected pair %v", decoded)
+	}
+	if err := object.SetValue(serializationTestPerson{}); err == nil || !strings.Contains(err.Error(), "proto.Message") {
+		t.Errorf("expected an error encoding a value that is not a proto.Message, got %v", err)
+	}
+}
+
+func TestTextSerializer(t *testing.T) {
+	object := &Object{ContentType: ContentTypeText}
+	if err := object.SetValue("hello"); err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err := object.DecodeInto(&s); err != nil || s != "hello" {
+		t.Errorf("expected hello, got %q, %v", s, err)
+	}
+	// NB: encoding.TextMarshaler and TextUnmarshaler
+	if err := object.SetValue(net.IPv4(10, 0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	var ip net.IP
+	if err := object.DecodeInto(&ip); err != nil || ip.String() != "10.0.0.1" {
+		t.Errorf("expected 10.0.0.1, got %v, %v", ip, err)
+	}
+	if err := object.SetValue(42); err == nil {
+		t.Error("expected an error encoding an int as text")
+	}
+}
+
+func TestSerializerUnknownContentType(t *testing.T) {
+	object := &Object{ContentType: "application/x-unknown", Value: []byte("?")}
+	var v interface{}
+	err := object.DecodeInto(&v)
+	var unknownErr UnknownContentTypeError
+	if !errors.Is(err, ErrUnknownContentType) || !errors.As(err, &unknownErr) || unknownErr.ContentType != "application/x-unknown" {
+		t.Fatalf("expected UnknownContentTypeError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "application/x-unknown") {
+		t.Errorf("expected the content type in the error, got %q", err.Error())
+	}
+
+	_, err = NewStoreValueCommandBuilder().
+		WithBucket("b").
+		WithKey("k").
+		WithContent(&Object{ContentType: "application/x-unknown"}).
+		WithValue("v").
+		Build()
+	if !errors.Is(err, ErrUnknownContentType) {
+		t.Errorf("expected Build to fail with UnknownContentTypeError, got %v", err)
+	}
+}
+
+type upperSerializer struct{}
+
+func (upperSerializer) Marshal(v interface{}) ([]byte, error) {
+	return []byte(strings.ToUpper(v.(string))), nil
+}
+
+func (upperSerializer) Unmarshal(data []byte, v interface{}) error {
+	*v.(*string) = strings.ToLower(string(data))
+	return nil
+}
+
+func TestRegisterSerializer(t *testing.T) {
+	RegisterSerializer("Application/X-Upper", upperSerializer{})
+	object := &Object{ContentType: "application/x-upper; charset=utf-8"}
+	if err := object.SetValue("riak"); err != nil {
+		t.Fatal(err)
+	}
+	if string(object.Value) != "RIAK" {
+		t.Errorf("expected RIAK, got %q", object.Value)
+	}
+	var s string
+	if err := object.DecodeInto(&s); err != nil || s != "riak" {
+		t.Errorf("expected riak, got %q, %v", s, err)
+	}
+}
+
+func TestStoreAndFetchTypedValue(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	cluster, _ := newTestCluster(t, nil, nil, srv.Addr())
+	person := serializationTestPerson{Name: "Alex", Age: 42}
+
+	content := &Object{ContentType: ContentTypeGob}
+	store, err := NewStoreValueCommandBuilder().
+		WithBucket("people").
+		WithKey("alex").
+		WithContent(content).
+		WithValue(&person).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(store); err != nil {
+		t.Fatal(err)
+	}
+	if content.Value != nil {
+		t.Error("expected the content not to be modified")
+	}
+
+	fetch, err := NewFetchValueCommandBuilder().WithBucket("people").WithKey("alex").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(fetch); err != nil {
+		t.Fatal(err)
+	}
+	resp := fetch.(*FetchValueCommand).Response
+	if resp.Values[0].ContentType != ContentTypeGob {
+		t.Errorf("expected ContentType %s, got %s", ContentTypeGob, resp.Values[0].ContentType)
+	}
+	var decoded serializationTestPerson
+	if err = resp.DecodeInto(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, person) {
+		t.Errorf("expected %v, got %v", person, decoded)
+	}
+
+	fetch, err = NewFetchValueCommandBuilder().WithBucket("people").WithKey("nobody").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(fetch); err != nil {
+		t.Fatal(err)
+	}
+	if err = fetch.(*FetchValueCommand).Response.DecodeInto(&decoded); err != ErrValueNotFound {
+		t.Errorf("expected ErrValueNotFound, got %v", err)
+	}
+}
+
+func TestDecodeSiblings(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	cluster, _ := newTestCluster(t, nil, nil, srv.Addr())
+	// NB: siblings of different content types are decoded by their own Serializer
+	for _, contentType := range []string{ContentTypeJSON, ContentTypeGob} {
+		store, err := NewStoreValueCommandBuilder().
+			WithBucketType("siblings").
+			WithBucket("people").
+			WithKey("alex").
+			WithContent(&Object{ContentType: contentType}).
+			WithValue(&serializationTestPerson{Name: contentType}).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = cluster.Execute(store); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fetch, err := NewFetchValueCommandBuilder().
+		WithBucketType("siblings").
+		WithBucket("people").
+		WithKey("alex").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(fetch); err != nil {
+		t.Fatal(err)
+	}
+	resp := fetch.(*FetchValueCommand).Response
+	var person serializationTestPerson
+	if err = resp.DecodeInto(&person); err != ErrValueHasSiblings {
+		t.Errorf("expected ErrValueHasSiblings, got %v", err)
+	}
+	var people []serializationTestPerson
+	if err = resp.DecodeSiblings(&people); err != nil {
+		t.Fatal(err)
+	}
+	if len(people) != 2 || people[0].Name != ContentTypeJSON || people[1].Name != ContentTypeGob {
+		t.Errorf("unexpected siblings %v", people)
+	}
+	if err = resp.DecodeSiblings(people); err != ErrDecodeSiblingsType {
+		t.Errorf("expected ErrDecodeSiblingsType, got %v", err)
+	}
+}
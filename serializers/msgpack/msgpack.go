@@ -0,0 +1,36 @@
+/*
+Package msgpack registers a MessagePack riak.Serializer for the content type application/msgpack,
+and its aliases application/x-msgpack and application/vnd.msgpack. Import it for its side effect:
+
+	import _ "github.com/basho/riak-go-client/serializers/msgpack"
+
+It is kept out of package riak so that the client does not depend on a MessagePack library
+*/
+package msgpack
+
+import (
+	riak "github.com/basho/riak-go-client"
+	vmsgpack "github.com/vmihailenco/msgpack"
+)
+
+// ContentType is the content type of MessagePack values
+const ContentType = "application/msgpack"
+
+// Serializer encodes values as MessagePack
+var Serializer riak.Serializer = serializer{}
+
+func init() {
+	for _, contentType := range []string{ContentType, "application/x-msgpack", "application/vnd.msgpack"} {
+		riak.RegisterSerializer(contentType, Serializer)
+	}
+}
+
+type serializer struct{}
+
+func (serializer) Marshal(v interface{}) ([]byte, error) {
+	return vmsgpack.Marshal(v)
+}
+
+func (serializer) Unmarshal(data []byte, v interface{}) error {
+	return vmsgpack.Unmarshal(data, v)
+}
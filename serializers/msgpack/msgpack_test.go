@@ -0,0 +1,76 @@
+package msgpack
+
+import (
+	"reflect"
+	"testing"
+
+	riak "github.com/basho/riak-go-client"
+	"github.com/basho/riak-go-client/riaktest"
+)
+
+type person struct {
+	Name string
+	Age  int
+	Tags []string
+}
+
+func TestSerializerRegistered(t *testing.T) {
+	for _, contentType := range []string{ContentType, "application/x-msgpack", "application/vnd.msgpack; charset=utf-8"} {
+		if s, err := riak.SerializerFor(contentType); err != nil || s != Serializer {
+			t.Errorf("%s: expected the MessagePack Serializer, got %v, %v", contentType, s, err)
+		}
+	}
+}
+
+func TestStoreAndFetch(t *testing.T) {
+	srv, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	node, err := riak.NewNode(&riak.NodeOptions{RemoteAddress: srv.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := riak.NewCluster(&riak.ClusterOptions{Nodes: []*riak.Node{node}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Stop()
+
+	alex := person{Name: "Alex", Age: 42, Tags: []string{"a", "b"}}
+	store, err := riak.NewStoreValueCommandBuilder().
+		WithBucket("people").
+		WithKey("alex").
+		WithContent(&riak.Object{ContentType: ContentType}).
+		WithValue(&alex).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(store); err != nil {
+		t.Fatal(err)
+	}
+
+	fetch, err := riak.NewFetchValueCommandBuilder().WithBucket("people").WithKey("alex").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Execute(fetch); err != nil {
+		t.Fatal(err)
+	}
+	resp := fetch.(*riak.FetchValueCommand).Response
+	if resp.Values[0].ContentType != ContentType {
+		t.Errorf("expected ContentType %s, got %s", ContentType, resp.Values[0].ContentType)
+	}
+	var decoded person
+	if err = resp.DecodeInto(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, alex) {
+		t.Errorf("expected %v, got %v", alex, decoded)
+	}
+}
@@ -0,0 +1,92 @@
+package riak
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SRVDiscoveryOptions configures discovery of a Cluster's Nodes from DNS SRV records. See
+// ClusterOptions.SRVDiscovery.
+//
+// The records are looked up when the Cluster starts and every RefreshInterval after that. A Node is
+// added for each new target and drained and removed when its target is no longer returned. If the
+// lookup fails or returns no records, the current Nodes are kept
+type SRVDiscoveryOptions struct {
+	Service         string        // NB: e.g. "riak-pb", as in net.LookupSRV. If Service and Proto are empty, Name is looked up directly
+	Proto           string        // NB: e.g. "tcp"
+	Name            string        // NB: required
+	RefreshInterval time.Duration // NB: defaults to 30s
+	NodeOptions     *NodeOptions  // NB: template for discovered Nodes, RemoteAddress is set from each record
+}
+
+// srvMembershipProvider is the MembershipProvider used for ClusterOptions.SRVDiscovery
+type srvMembershipProvider struct {
+	options *SRVDiscoveryOptions
+	changes chan struct{}
+	stop    chan struct{}
+	start   sync.Once
+	close   sync.Once
+}
+
+func newSRVMembershipProvider(options *SRVDiscoveryOptions) *srvMembershipProvider {
+	return &srvMembershipProvider{
+		options: options,
+		changes: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Members implements MembershipProvider
+func (p *srvMembershipProvider) Members() ([]string, error) {
+	_, records, err := lookupSRV(p.options.Service, p.options.Proto, p.options.Name)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]string, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		members = append(members, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+	}
+	return members, nil
+}
+
+// Changes implements MembershipProvider. NB: the records are looked up again every RefreshInterval
+func (p *srvMembershipProvider) Changes() <-chan struct{} {
+	p.start.Do(func() {
+		go pollMembers(p.options.RefreshInterval, p.stop, p.changes)
+	})
+	return p.changes
+}
+
+// Close stops polling
+func (p *srvMembershipProvider) Close() error {
+	p.close.Do(func() {
+		close(p.stop)
+	})
+	return nil
+}
+
+// pollMembers signals changes every interval until stop is closed
+func pollMembers(interval time.Duration, stop <-chan struct{}, changes chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			signalMembersChanged(changes)
+		}
+	}
+}
+
+// signalMembersChanged sends on changes without blocking; a pending signal already covers this one
+func signalMembersChanged(changes chan<- struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
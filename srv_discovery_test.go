@@ -0,0 +1,139 @@
+package riak
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/basho/riak-go-client/riaktest"
+)
+
+// fakeSRV replaces lookupSRV, returning records set by the test
+type fakeSRV struct {
+	records []*net.SRV
+	err     error
+	sync.Mutex
+}
+
+func newFakeSRV(t *testing.T) *fakeSRV {
+	f := &fakeSRV{}
+	previous := lookupSRV
+	lookupSRV = f.lookup
+	t.Cleanup(func() { lookupSRV = previous })
+	return f
+}
+
+func (f *fakeSRV) set(err error, servers ...*riaktest.Server) {
+	f.Lock()
+	defer f.Unlock()
+	f.err = err
+	f.records = nil
+	for _, srv := range servers {
+		host, port, _ := net.SplitHostPort(srv.Addr())
+		p, _ := strconv.Atoi(port)
+		f.records = append(f.records, &net.SRV{Target: host + ".", Port: uint16(p)})
+	}
+}
+
+func (f *fakeSRV) lookup(service, proto, name string) (string, []*net.SRV, error) {
+	f.Lock()
+	defer f.Unlock()
+	return name, f.records, f.err
+}
+
+func clusterAddrs(c *Cluster) map[string]bool {
+	c.Lock()
+	defer c.Unlock()
+	addrs := make(map[string]bool)
+	for _, node := range c.nodes {
+		addrs[node.Addr()] = true
+	}
+	return addrs
+}
+
+func waitForClusterAddrs(t *testing.T, c *Cluster, servers ...*riaktest.Server) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		addrs := clusterAddrs(c)
+		matches := len(addrs) == len(servers)
+		for _, srv := range servers {
+			matches = matches && addrs[srv.Addr()]
+		}
+		if matches {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d discovered nodes, got %v", len(servers), addrs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClusterSRVDiscoveryRequiresName(t *testing.T) {
+	if _, err := NewCluster(&ClusterOptions{SRVDiscovery: &SRVDiscoveryOptions{}}); err != ErrClusterSRVNameRequired {
+		t.Errorf("expected ErrClusterSRVNameRequired, got %v", err)
+	}
+}
+
+func TestClusterSRVDiscovery(t *testing.T) {
+	var servers []*riaktest.Server
+	for i := 0; i < 2; i++ {
+		srv, err := riaktest.NewServer(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Stop()
+		servers = append(servers, srv)
+	}
+
+	srv := newFakeSRV(t)
+	srv.set(nil, servers[0])
+	cluster, err := NewCluster(&ClusterOptions{
+		SRVDiscovery: &SRVDiscoveryOptions{
+			Service:         "riak-pb",
+			Proto:           "tcp",
+			Name:            "riak.test",
+			RefreshInterval: 10 * time.Millisecond,
+			NodeOptions:     &NodeOptions{MinConnections: 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(cluster.nodes); got != 0 {
+		t.Fatalf("expected no default node, got %d nodes", got)
+	}
+	if err = cluster.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Stop()
+
+	// NB: the first lookup happens before Start returns
+	if addrs := clusterAddrs(cluster); len(addrs) != 1 || !addrs[servers[0].Addr()] {
+		t.Fatalf("expected node for %s, got %v", servers[0].Addr(), addrs)
+	}
+	if err = cluster.Execute(&PingCommand{}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.set(nil, servers[0], servers[1])
+	waitForClusterAddrs(t, cluster, servers[0], servers[1])
+
+	srv.set(nil, servers[1])
+	waitForClusterAddrs(t, cluster, servers[1])
+
+	// NB: failed and empty lookups keep the current nodes
+	srv.set(errors.New("no such host"))
+	time.Sleep(50 * time.Millisecond)
+	waitForClusterAddrs(t, cluster, servers[1])
+	srv.set(nil)
+	time.Sleep(50 * time.Millisecond)
+	waitForClusterAddrs(t, cluster, servers[1])
+
+	if err = cluster.Execute(&PingCommand{}); err != nil {
+		t.Fatal(err)
+	}
+}
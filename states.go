@@ -19,9 +19,10 @@ type stateful interface {
 
 type stateData struct {
 	sync.RWMutex
-	stateVal     state
-	stateDesc    []string
-	setStateFunc func(sd *stateData, st state)
+	stateVal      state
+	stateDesc     []string
+	setStateFunc  func(sd *stateData, st state)
+	onStateChange func(from, to state) // NB: optional, called after the state changes
 }
 
 var defaultSetStateFunc = func(sd *stateData, st state) {
@@ -34,7 +35,12 @@ func (s *stateData) initStateData(desc ...string) {
 }
 
 func (s *stateData) String() string {
-	stateIdx := int(s.stateVal)
+	return s.stateName(s.getState())
+}
+
+// stateName returns the description of st
+func (s *stateData) stateName(st state) string {
+	stateIdx := int(st)
 	if len(s.stateDesc) > stateIdx {
 		return s.stateDesc[stateIdx]
 	} else {
@@ -62,8 +68,13 @@ func (s *stateData) getState() state {
 
 func (s *stateData) setState(st state) {
 	s.Lock()
-	defer s.Unlock()
+	from := s.stateVal
 	s.setStateFunc(s, st)
+	to, onStateChange := s.stateVal, s.onStateChange
+	s.Unlock()
+	if onStateChange != nil && from != to {
+		onStateChange(from, to)
+	}
 }
 
 func (s *stateData) stateCheck(allowed ...state) error {
@@ -0,0 +1,136 @@
+package riak
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClusterStatus is a snapshot of the state of a Cluster and its Nodes, for display on an admin page
+// or a debug endpoint. It can be marshalled to JSON, in which durations are in nanoseconds. See
+// Cluster.Status
+type ClusterStatus struct {
+	State    string       `json:"state"`    // NB: e.g. "clusterRunning"
+	InFlight int          `json:"inFlight"` // NB: commands executing or queued
+	Nodes    []NodeStatus `json:"nodes"`
+	// QueueDepth is the number of commands in the queue, see ClusterOptions.QueueMaxDepth
+	QueueDepth    int `json:"queueDepth"`
+	QueueMaxDepth int `json:"queueMaxDepth"` // NB: 0 if commands are not queued
+	// OldestEnqueuedAge is how long the command that has been in the queue longest has been there
+	OldestEnqueuedAge time.Duration `json:"oldestEnqueuedAge"`
+}
+
+// NodeStatus is a snapshot of the state of a Node. See Node.Status
+type NodeStatus struct {
+	Address        string `json:"address"`        // NB: the IP:PORT connected to
+	RemoteAddress  string `json:"remoteAddress"`  // NB: as given in NodeOptions
+	State          string `json:"state"`          // NB: e.g. "nodeRunning"
+	HealthChecking bool   `json:"healthChecking"` // NB: commands are not executed while health checking
+	// LastHealthCheck is when the last health check completed, and HealthCheckError why it failed
+	LastHealthCheck  time.Time `json:"lastHealthCheck"`
+	HealthCheckError string    `json:"healthCheckError,omitempty"`
+	CircuitBreaker   string    `json:"circuitBreaker"` // NB: "closed" if there is no circuit breaker
+	// LastError is the last error executing a command or health checking, and LastErrorAt when it
+	// occurred
+	LastError        string        `json:"lastError,omitempty"`
+	LastErrorAt      time.Time     `json:"lastErrorAt"`
+	Connections      uint16        `json:"connections"` // NB: idle and in use
+	IdleConnections  uint16        `json:"idleConnections"`
+	InUseConnections uint16        `json:"inUseConnections"`
+	InFlight         int           `json:"inFlight"` // NB: including commands waiting for a connection
+	Latency          time.Duration `json:"latency"`  // NB: see Node.Latency
+}
+
+// nodeHealth records the errors of a Node and the outcome of its health checks, see NodeStatus
+type nodeHealth struct {
+	lastErr         error
+	lastErrAt       time.Time
+	lastHealthCheck time.Time
+	healthCheckErr  error
+	sync.Mutex
+}
+
+func (h *nodeHealth) onError(err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.lastErr = err
+	h.lastErrAt = time.Now()
+}
+
+// onHealthCheck records the outcome of a health check, err being nil if it succeeded
+func (h *nodeHealth) onHealthCheck(err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.lastHealthCheck = time.Now()
+	h.healthCheckErr = err
+	if err != nil {
+		h.lastErr = err
+		h.lastErrAt = h.lastHealthCheck
+	}
+}
+
+// Status returns a snapshot of the state of the Node
+func (n *Node) Status() NodeStatus {
+	pool := n.cm.stats()
+	s := NodeStatus{
+		Address:         n.Addr(),
+		RemoteAddress:   n.remoteAddress,
+		State:           n.stateData.String(),
+		HealthChecking:  n.isCurrentState(nodeHealthChecking),
+		CircuitBreaker:  n.CircuitBreakerState().String(),
+		Connections:     pool.Connections,
+		IdleConnections: pool.Idle,
+		InFlight:        n.InFlight(),
+		Latency:         n.Latency(),
+	}
+	if pool.Connections > pool.Idle {
+		s.InUseConnections = pool.Connections - pool.Idle
+	}
+
+	n.health.Lock()
+	defer n.health.Unlock()
+	s.LastHealthCheck = n.health.lastHealthCheck
+	if n.health.healthCheckErr != nil {
+		s.HealthCheckError = n.health.healthCheckErr.Error()
+	}
+	if n.health.lastErr != nil {
+		s.LastError = n.health.lastErr.Error()
+		s.LastErrorAt = n.health.lastErrAt
+	}
+	return s
+}
+
+// Status returns a snapshot of the state of the Cluster and its Nodes
+func (c *Cluster) Status() ClusterStatus {
+	s := ClusterStatus{
+		State:    c.stateData.String(),
+		InFlight: int(atomic.LoadInt32(&c.inFlight)),
+	}
+	nodes := c.getNodes()
+	s.Nodes = make([]NodeStatus, 0, len(nodes))
+	for _, n := range nodes {
+		s.Nodes = append(s.Nodes, n.Status())
+	}
+
+	if c.queueCommands && c.isStateLessThan(clusterShuttingDown) {
+		s.QueueMaxDepth = int(c.cq.queueSize)
+		var oldest time.Time
+		f := func(v interface{}) (bool, bool) {
+			if v == nil {
+				return true, false
+			}
+			s.QueueDepth++
+			if async, ok := v.(*Async); ok && (oldest.IsZero() || async.enqueuedAt.Before(oldest)) {
+				oldest = async.enqueuedAt
+			}
+			return false, true
+		}
+		if err := c.cq.iterate(f); err != nil {
+			c.log.err("error when reading command queue", err)
+		}
+		if !oldest.IsZero() {
+			s.OldestEnqueuedAge = time.Since(oldest)
+		}
+	}
+	return s
+}
@@ -0,0 +1,79 @@
+package riak
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestClusterStatus(t *testing.T) {
+	srv := newTestServers(t, 1)[0]
+	node, err := NewNode(&NodeOptions{
+		RemoteAddress:       srv.Addr(),
+		HealthCheckInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := NewCluster(&ClusterOptions{
+		Nodes:                  []*Node{node},
+		QueueMaxDepth:          4,
+		QueueExecutionInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Stop()
+
+	s := cluster.Status()
+	if s.State != "clusterRunning" || len(s.Nodes) != 1 || s.QueueMaxDepth != 4 || s.QueueDepth != 0 {
+		t.Errorf("unexpected status %+v", s)
+	}
+	ns := s.Nodes[0]
+	if ns.Address != srv.Addr() || ns.State != "nodeRunning" || ns.HealthChecking || ns.Connections == 0 ||
+		ns.IdleConnections != ns.Connections || ns.InUseConnections != 0 || ns.LastError != "" {
+		t.Errorf("unexpected node status %+v", ns)
+	}
+
+	srv.Stop()
+	cluster.Execute(&PingCommand{})
+	deadline := time.Now().Add(5 * time.Second)
+	for cluster.Status().Nodes[0].LastHealthCheck.IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a failed health check")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	async := &Async{
+		Command: &PingCommand{},
+		Done:    make(chan Command, 1),
+	}
+	// NB: returns once the command is queued
+	cluster.execute(async)
+	time.Sleep(20 * time.Millisecond)
+
+	s = cluster.Status()
+	ns = s.Nodes[0]
+	if ns.State != "nodeHealthChecking" || !ns.HealthChecking || ns.HealthCheckError == "" ||
+		ns.LastError == "" || ns.LastErrorAt.IsZero() {
+		t.Errorf("unexpected node status %+v", ns)
+	}
+	if s.QueueDepth == 0 || s.OldestEnqueuedAge < 20*time.Millisecond {
+		t.Errorf("expected a queued command, got depth %d age %v", s.QueueDepth, s.OldestEnqueuedAge)
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ClusterStatus
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.QueueDepth != s.QueueDepth || len(decoded.Nodes) != 1 || decoded.Nodes[0].LastError != ns.LastError {
+		t.Errorf("expected status to round trip through JSON, got %s", data)
+	}
+}
@@ -0,0 +1,288 @@
+package riak
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/basho/riak-go-client/riaktest"
+)
+
+// testCA issues certificates for the TLS tests, in place of the certificates in tools/test-ca used
+// by the security tests against a real Riak node
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pool   *x509.CertPool
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{}
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "riak-go-client test CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	cert := ca.issue(t, template)
+	ca.cert, ca.key = cert.Leaf, cert.PrivateKey.(*ecdsa.PrivateKey)
+	ca.pool = x509.NewCertPool()
+	ca.pool.AddCert(ca.cert)
+	return ca
+}
+
+// issue returns a certificate for template signed by ca, or self-signed if ca has no certificate yet
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template.SerialNumber = big.NewInt(ca.serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func (ca *testCA) serverCert(t *testing.T) tls.Certificate {
+	return ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "riak-test"},
+		DNSNames:    []string{"riak-test"},
+		IPAddresses: []net.IP{localhost},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+func (ca *testCA) clientCert(t *testing.T, user string) tls.Certificate {
+	cert := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: user},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	cert.Leaf = nil // NB: as loaded by tls.LoadX509KeyPair before Go 1.23
+	return cert
+}
+
+// newSecureTestServer starts a riaktest.Server with security enabled. Users authenticate with the
+// password "Test1234", or with a client certificate issued by ca whose common name is their name
+func newSecureTestServer(t *testing.T, ca *testCA) *riaktest.Server {
+	srv, err := riaktest.NewServer(&riaktest.ServerOptions{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.serverCert(t)},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    ca.pool,
+		},
+		Authenticate: func(user, password string, cert *x509.Certificate) error {
+			if cert != nil {
+				if cert.Subject.CommonName != user {
+					return fmt.Errorf("certificate is not for user %q", user)
+				}
+				return nil
+			}
+			if password != "Test1234" {
+				return errors.New("Authentication failed")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Stop() })
+	return srv
+}
+
+// connectSecure connects to srv with authOptions, returning the error connecting failed with
+func connectSecure(t *testing.T, srv *riaktest.Server, authOptions *AuthOptions) error {
+	addr, err := net.ResolveTCPAddr("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := newConnection(&connectionOptions{
+		remoteAddress: addr,
+		authOptions:   authOptions,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.close()
+	if err = conn.connect(); err != nil {
+		return err
+	}
+	return conn.execute(&PingCommand{})
+}
+
+// pingSecureCluster pings srv through a Cluster whose Node authenticates with authOptions, as
+// buildClusterAndRunTest does against a real Riak node
+func pingSecureCluster(t *testing.T, srv *riaktest.Server, authOptions *AuthOptions) {
+	node, err := NewNode(&NodeOptions{
+		RemoteAddress: srv.Addr(),
+		AuthOptions:   authOptions,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := NewCluster(&ClusterOptions{Nodes: []*Node{node}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cluster.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Stop()
+
+	command := &PingCommand{}
+	if err = cluster.Execute(command); err != nil {
+		t.Fatal(err)
+	}
+	if !command.Success() {
+		t.Error("expected ping to succeed")
+	}
+}
+
+func TestExecuteCommandOnClusterWithTLSAndPassword(t *testing.T) {
+	ca := newTestCA(t)
+	pingSecureCluster(t, newSecureTestServer(t, ca), &AuthOptions{
+		User:     "riakpass",
+		Password: "Test1234",
+		TlsConfig: &tls.Config{
+			ServerName: "riak-test",
+			RootCAs:    ca.pool,
+		},
+	})
+}
+
+func TestExecuteCommandOnClusterWithTLSClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	// NB: no User or Password, the user is the common name of the certificate
+	pingSecureCluster(t, newSecureTestServer(t, ca), &AuthOptions{
+		TlsConfig: &tls.Config{
+			ServerName:   "riak-test",
+			RootCAs:      ca.pool,
+			Certificates: []tls.Certificate{ca.clientCert(t, "riakuser")},
+		},
+	})
+}
+
+func TestTLSUntrustedServerCertificate(t *testing.T) {
+	srv := newSecureTestServer(t, newTestCA(t))
+	err := connectSecure(t, srv, &AuthOptions{
+		User:     "riakpass",
+		Password: "Test1234",
+		TlsConfig: &tls.Config{
+			ServerName: "riak-test",
+			RootCAs:    newTestCA(t).pool,
+		},
+	})
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	if !IsTLSError(err) || IsAuthError(err) || !errors.As(err, &unknownAuthorityErr) {
+		t.Errorf("expected TLSError for an unknown authority, got %v", err)
+	}
+	if got := ClassifyError(err); got != ErrorClassSecurity {
+		t.Errorf("expected %v, got %v", ErrorClassSecurity, got)
+	}
+}
+
+func TestTLSUntrustedClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	srv := newSecureTestServer(t, ca)
+	// NB: with TLS 1.3 the client completes its side of the handshake before the server rejects the
+	// certificate, so the rejection is read in response to the auth request
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		err := connectSecure(t, srv, &AuthOptions{
+			TlsConfig: &tls.Config{
+				ServerName:   "riak-test",
+				RootCAs:      ca.pool,
+				Certificates: []tls.Certificate{newTestCA(t).clientCert(t, "riakuser")},
+				MaxVersion:   version,
+			},
+		})
+		if !IsTLSError(err) || IsAuthError(err) {
+			t.Errorf("expected TLSError with %s, got %v", tls.VersionName(version), err)
+		}
+	}
+}
+
+func TestTLSAuthFailure(t *testing.T) {
+	ca := newTestCA(t)
+	srv := newSecureTestServer(t, ca)
+	err := connectSecure(t, srv, &AuthOptions{
+		User:     "riakpass",
+		Password: "wrong",
+		TlsConfig: &tls.Config{
+			ServerName: "riak-test",
+			RootCAs:    ca.pool,
+		},
+	})
+	var authErr AuthError
+	var riakErr RiakError
+	if !errors.As(err, &authErr) || authErr.User != "riakpass" || IsTLSError(err) {
+		t.Fatalf("expected AuthError for riakpass, got %v", err)
+	}
+	if !errors.As(err, &riakErr) || riakErr.Errmsg != "Authentication failed" {
+		t.Errorf("expected the RiakError to be wrapped, got %v", err)
+	}
+
+	// NB: the user is the common name of the certificate, unless given
+	err = connectSecure(t, srv, &AuthOptions{
+		User: "riakpass",
+		TlsConfig: &tls.Config{
+			ServerName:   "riak-test",
+			RootCAs:      ca.pool,
+			Certificates: []tls.Certificate{ca.clientCert(t, "riakuser")},
+		},
+	})
+	if !IsAuthError(err) {
+		t.Errorf("expected AuthError for a certificate of another user, got %v", err)
+	}
+}
+
+func TestTLSSecurityNotEnabled(t *testing.T) {
+	srv, err := riaktest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	err = connectSecure(t, srv, &AuthOptions{
+		User:      "riakpass",
+		Password:  "Test1234",
+		TlsConfig: &tls.Config{ServerName: "riak-test"},
+	})
+	var riakErr RiakError
+	if !IsTLSError(err) || !errors.As(err, &riakErr) {
+		t.Errorf("expected TLSError wrapping a RiakError, got %v", err)
+	}
+}
+
+func TestTLSUserRequired(t *testing.T) {
+	ca := newTestCA(t)
+	srv := newSecureTestServer(t, ca)
+	err := connectSecure(t, srv, &AuthOptions{
+		Password:  "Test1234",
+		TlsConfig: &tls.Config{ServerName: "riak-test", RootCAs: ca.pool},
+	})
+	if err != ErrAuthMissingUser {
+		t.Errorf("expected ErrAuthMissingUser, got %v", err)
+	}
+}